@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type User struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	Username     string             `bson:"username"`
+	PasswordHash string             `bson:"password_hash"`
+	Tier         string             `bson:"tier,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	Defaults     UploadDefaults     `bson:"defaults,omitempty"`
+	Identities   []UserIdentity     `bson:"identities,omitempty"`
+}
+
+type session struct {
+	Token     string             `bson:"token"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+const (
+	sessionCookie = "xyli_session"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+var (
+	usersColl    *mongo.Collection
+	sessionsColl *mongo.Collection
+
+	usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,32}$`)
+)
+
+func initAccounts(ctx context.Context) {
+	usersColl = db.Collection("users")
+	sessionsColl = db.Collection("sessions")
+
+	_, err := usersColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Error creating users index: %v", err)
+	}
+
+	_, err = sessionsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("Error creating sessions indexes: %v", err)
+	}
+
+	_, err = gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "metadata.owner_id", Value: 1}, {Key: "uploadDate", Value: -1}},
+	})
+	if err != nil {
+		log.Printf("Error creating owner index: %v", err)
+	}
+}
+
+func generateToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// currentUser resolves the session cookie, or an access token sent as
+// Bearer, to a user. Any lookup failure is treated as an anonymous request.
+func currentUser(r *http.Request) *User {
+	if token := bearerToken(r); isAccessToken(token) {
+		return tokenUser(r.Context(), token)
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" || dbBreaker.Open() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var sess session
+	err = sessionsColl.FindOne(ctx, bson.M{
+		"token":      cookie.Value,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&sess)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil
+	}
+
+	var user User
+	err = usersColl.FindOne(ctx, bson.M{"_id": sess.UserID}).Decode(&user)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil
+	}
+	return &user
+}
+
+func startSession(ctx context.Context, w http.ResponseWriter, userID primitive.ObjectID) error {
+	sess := session{
+		Token:     generateToken(),
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(sessionTTL),
+	}
+	_, err := sessionsColl.InsertOne(ctx, sess)
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.Token,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config().Upload.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func renderAuth(w http.ResponseWriter, mode, username, errMsg string) {
+	tmpl := template.Must(template.ParseFiles("templates/auth.html"))
+	tmpl.Execute(w, struct {
+		Mode      string
+		Username  string
+		Error     string
+		Providers []*OAuthProvider
+	}{mode, username, errMsg, config().OAuth.Providers})
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		renderAuth(w, "register", "", "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+
+	if !usernamePattern.MatchString(username) {
+		renderAuth(w, "register", username, "Имя пользователя: 3–32 символа, латиница, цифры, _ и -")
+		return
+	}
+	if len(password) < 8 {
+		renderAuth(w, "register", username, "Пароль должен быть не короче 8 символов")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "hash error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	user := User{
+		ID:           primitive.NewObjectID(),
+		Username:     username,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now(),
+	}
+	_, err = usersColl.InsertOne(ctx, user)
+	dbBreaker.Record(err)
+	if mongo.IsDuplicateKeyError(err) {
+		renderAuth(w, "register", username, "Имя пользователя уже занято")
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := startSession(ctx, w, user.ID); err != nil {
+		http.Error(w, "session error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		renderAuth(w, "login", "", "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var user User
+	err := usersColl.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	dbBreaker.Record(err)
+	if err != nil && err != mongo.ErrNoDocuments {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err == mongo.ErrNoDocuments || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		renderAuth(w, "login", username, "Неверное имя пользователя или пароль")
+		return
+	}
+
+	if err := startSession(ctx, w, user.ID); err != nil {
+		http.Error(w, "session error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		_, err = sessionsColl.DeleteOne(ctx, bson.M{"token": cookie.Value})
+		dbBreaker.Record(err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/dashboard.html"))
+	tmpl.Execute(w, struct {
+		User  *User
+		Admin bool
+	}{user, isAdmin(user)})
+}
+
+func handleDashboardFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	// q finds files by name, by the text recognised in images or by a
+	// document's title and author.
+	filter := bson.M{"metadata.owner_id": user.ID}
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}
+		filter["$or"] = bson.A{
+			bson.M{"filename": pattern},
+			bson.M{"metadata.ocr_text": pattern},
+			bson.M{"metadata.doc.title": pattern},
+			bson.M{"metadata.doc.author": pattern},
+		}
+	}
+
+	opts := options.GridFSFind().SetSort(bson.D{{Key: "uploadDate", Value: -1}}).SetLimit(500)
+	cursor, err := gfsBucket.FindContext(ctx, filter, opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var docs []fileRecord
+	err = cursor.All(ctx, &docs)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+
+	files := make([]fileEntry, 0, len(docs))
+	for i := range docs {
+		files = append(files, newFileEntry(&docs[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": files})
+}
+
+// fileEntry is a file as the dashboard lists it.
+type fileEntry struct {
+	ID           string     `json:"id"`
+	Filename     string     `json:"filename"`
+	Folder       string     `json:"folder,omitempty"`
+	Size         int64      `json:"size"`
+	SizeText     string     `json:"size_text"`
+	ContentType  string     `json:"content_type"`
+	UploadedAt   time.Time  `json:"uploaded_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Link         string     `json:"link"`
+	DeletionLink string     `json:"deletion_link"`
+	Document     *docInfo   `json:"document,omitempty"`
+	Protected    bool       `json:"protected,omitempty"`
+	BandwidthCap int64      `json:"bandwidth_cap,omitempty"`
+	BandwidthUse int64      `json:"bandwidth_used,omitempty"`
+	Disabled     bool       `json:"disabled,omitempty"`
+	Visibility   string     `json:"visibility"`
+}
+
+func newFileEntry(doc *fileRecord) fileEntry {
+	return fileEntry{
+		ID:           doc.Metadata.ShortID,
+		Filename:     doc.Filename,
+		Folder:       doc.Metadata.Folder,
+		Size:         doc.Length,
+		SizeText:     formatSize(doc.Length),
+		ContentType:  doc.Metadata.ContentType,
+		UploadedAt:   doc.UploadDate,
+		ExpiresAt:    doc.Metadata.ExpiresAt,
+		Link:         doc.Link(),
+		DeletionLink: doc.DeletionLink(),
+		Document:     doc.Metadata.Doc,
+		Protected:    doc.Metadata.PasswordHash != "",
+		BandwidthCap: doc.Metadata.BandwidthCap,
+		BandwidthUse: bandwidthUsed(doc),
+		Disabled:     doc.Metadata.Disabled,
+		Visibility:   visibilityOrPublic(doc.Metadata.Visibility),
+	}
+}
+
+// findManagedFile looks up a file the user may manage: their own, or any
+// file for an admin. Other files are reported as not found.
+func findManagedFile(ctx context.Context, user *User, shortID string) (*fileRecord, error) {
+	var doc fileRecord
+	if err := findFileByShortID(ctx, shortID, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Metadata.OwnerID != user.ID && !isAdmin(user) {
+		return nil, errFileNotFound
+	}
+	return &doc, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const adminPageSize = 50
+
+func isAdmin(user *User) bool {
+	if user == nil {
+		return false
+	}
+	for _, name := range config().Admin.Users {
+		if name == user.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin returns the signed-in administrator, or writes the rejection
+// and returns nil.
+func requireAdmin(w http.ResponseWriter, r *http.Request, api bool) *User {
+	user := requestUser(r)
+	if isAdmin(user) {
+		return user
+	}
+	if api {
+		jsonError(w, "Forbidden", http.StatusForbidden)
+	} else if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	} else {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}
+	return nil
+}
+
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	user := requireAdmin(w, r, false)
+	if user == nil {
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/admin.html"))
+	tmpl.Execute(w, struct{ User *User }{user})
+}
+
+func handleAdminFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	filter := bson.M{
+		"metadata.derived_from": bson.M{"$exists": false},
+		"metadata.blob_holder":  bson.M{"$ne": true},
+	}
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}
+		filter["$or"] = bson.A{
+			bson.M{"filename": pattern},
+			bson.M{"metadata.short_id": q},
+			bson.M{"metadata.content_type": pattern},
+			bson.M{"metadata.ocr_text": pattern},
+			bson.M{"metadata.doc.title": pattern},
+			bson.M{"metadata.doc.author": pattern},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	filesColl := gfsBucket.GetFilesCollection()
+	total, err := filesColl.CountDocuments(ctx, filter)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	opts := options.GridFSFind().
+		SetSort(bson.D{{Key: "uploadDate", Value: -1}}).
+		SetSkip(int32((page - 1) * adminPageSize)).
+		SetLimit(adminPageSize)
+	cursor, err := gfsBucket.FindContext(ctx, filter, opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var docs []fileRecord
+	err = cursor.All(ctx, &docs)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+
+	owners := map[primitive.ObjectID]string{}
+	var ownerIDs []primitive.ObjectID
+	for _, doc := range docs {
+		if !doc.Metadata.OwnerID.IsZero() {
+			ownerIDs = append(ownerIDs, doc.Metadata.OwnerID)
+		}
+	}
+	if len(ownerIDs) > 0 {
+		userCursor, err := usersColl.Find(ctx, bson.M{"_id": bson.M{"$in": ownerIDs}})
+		dbBreaker.Record(err)
+		if err == nil {
+			var users []User
+			userCursor.All(ctx, &users)
+			for _, u := range users {
+				owners[u.ID] = u.Username
+			}
+		}
+	}
+
+	type fileEntry struct {
+		ShortID     string    `json:"short_id"`
+		Filename    string    `json:"filename"`
+		Size        int64     `json:"size"`
+		SizeText    string    `json:"size_text"`
+		ContentType string    `json:"content_type"`
+		FileType    string    `json:"file_type"`
+		UploadedAt  time.Time `json:"uploaded_at"`
+		Owner       string    `json:"owner,omitempty"`
+		Link        string    `json:"link"`
+		Document    *docInfo  `json:"document,omitempty"`
+		Bandwidth   int64     `json:"bandwidth_cap,omitempty"`
+		UsedBytes   int64     `json:"bandwidth_used,omitempty"`
+		Disabled    bool      `json:"disabled,omitempty"`
+	}
+
+	files := make([]fileEntry, 0, len(docs))
+	for _, doc := range docs {
+		files = append(files, fileEntry{
+			ShortID:     doc.Metadata.ShortID,
+			Filename:    doc.Filename,
+			Size:        doc.Length,
+			SizeText:    formatSize(doc.Length),
+			ContentType: doc.Metadata.ContentType,
+			FileType:    getFileType(doc.Metadata.ContentType),
+			UploadedAt:  doc.UploadDate,
+			Owner:       owners[doc.Metadata.OwnerID],
+			Link:        doc.Link(),
+			Document:    doc.Metadata.Doc,
+			Bandwidth:   doc.Metadata.BandwidthCap,
+			UsedBytes:   bandwidthUsed(&doc),
+			Disabled:    doc.Metadata.Disabled,
+		})
+	}
+
+	pages := (total + adminPageSize - 1) / adminPageSize
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files": files,
+		"page":  page,
+		"pages": pages,
+		"total": total,
+	})
+}
+
+// handleAdminDelete force-deletes any files by short ID, one or many at a time.
+func handleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := requireAdmin(w, r, true)
+	if admin == nil {
+		return
+	}
+
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	deleted := 0
+	for _, shortID := range req.IDs {
+		var doc fileRecord
+		if err := findFile(ctx, bson.M{"metadata.short_id": shortID}, &doc); err != nil {
+			continue
+		}
+		if err := deleteStoredFile(ctx, &doc); err != nil {
+			continue
+		}
+		deleted++
+		log.Printf("Admin %s deleted file %s (%s)", admin.Username, shortID, doc.Filename)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+}
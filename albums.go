@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// An album groups some of an account's uploads under a short link of its
+// own, /a/{id}, which shows them as a gallery: images and videos as lazily
+// loaded thumbnails, everything else as a file card. The album only holds
+// short IDs; files that expire or are deleted drop out of the gallery, and
+// disabled, password-protected and end-to-end encrypted files show as a
+// card without a preview that links to the file's own page.
+
+const maxAlbumFiles = 500
+
+type album struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	ShortID   string             `bson:"short_id"`
+	Title     string             `bson:"title"`
+	OwnerID   primitive.ObjectID `bson:"owner_id"`
+	Files     []string           `bson:"files"`
+	CreatedAt time.Time          `bson:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+
+	TransferToken   string    `bson:"transfer_token,omitempty"`
+	TransferExpires time.Time `bson:"transfer_expires,omitempty"`
+}
+
+func (a *album) Link() string {
+	return fmt.Sprintf("%s/a/%s", config().Upload.BaseURL, a.ShortID)
+}
+
+var albumsColl *mongo.Collection
+
+func initAlbums(ctx context.Context) {
+	albumsColl = db.Collection("albums")
+	_, err := albumsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "short_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "updated_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Printf("Error creating albums indexes: %v", err)
+	}
+}
+
+func albumJSON(a *album) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         a.ShortID,
+		"title":      a.Title,
+		"link":       a.Link(),
+		"files":      a.Files,
+		"created_at": a.CreatedAt,
+		"updated_at": a.UpdatedAt,
+	}
+}
+
+// albumFileIDs checks that user may add each of ids to an album and returns
+// them without duplicates.
+func albumFileIDs(ctx context.Context, user *User, ids []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, err := findManagedFile(ctx, user, id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+// handleAlbums lists the caller's albums (GET) or creates one (POST
+// {title, files}).
+func handleAlbums(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		cursor, err := albumsColl.Find(ctx, bson.M{"owner_id": user.ID}, options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}}).SetLimit(1000))
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var albums []album
+		err = cursor.All(ctx, &albums)
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		out := make([]map[string]interface{}, 0, len(albums))
+		for i := range albums {
+			out = append(out, albumJSON(&albums[i]))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"albums": out})
+
+	case http.MethodPost:
+		var req struct {
+			Title string   `json:"title"`
+			Files []string `json:"files"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Title = strings.TrimSpace(req.Title); len(req.Title) > 200 {
+			jsonError(w, "Title too long", http.StatusBadRequest)
+			return
+		}
+		if len(req.Files) > maxAlbumFiles {
+			jsonError(w, fmt.Sprintf("An album holds at most %d files", maxAlbumFiles), http.StatusBadRequest)
+			return
+		}
+		files, err := albumFileIDs(ctx, user, req.Files)
+		if err == errFileNotFound {
+			jsonError(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		a := album{ShortID: generateID(), Title: req.Title, OwnerID: user.ID, Files: files, CreatedAt: now, UpdatedAt: now}
+		_, err = albumsColl.InsertOne(ctx, a)
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(albumJSON(&a))
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlbum serves /api/albums/{id}: GET returns it, PATCH {title}
+// renames it, DELETE removes it (not its files), POST or DELETE on
+// /api/albums/{id}/files with {files} adds or removes files, and POST on
+// /api/albums/{id}/transfer hands it to another account.
+func handleAlbum(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/albums/")
+	id, sub, _ := strings.Cut(id, "/")
+	if sub != "" && sub != "files" && sub != "transfer" {
+		jsonError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"short_id": id}
+	if !isAdmin(user) {
+		filter["owner_id"] = user.ID
+	}
+	var a album
+	err := albumsColl.FindOne(ctx, filter).Decode(&a)
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var update bson.M
+	switch {
+	case sub == "transfer" && r.Method == http.MethodPost:
+		serveAlbumTransfer(ctx, w, r, user, &a)
+		return
+
+	case sub == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(albumJSON(&a))
+		return
+
+	case sub == "" && r.Method == http.MethodDelete:
+		_, err := albumsColl.DeleteOne(ctx, bson.M{"_id": a.ID})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+		return
+
+	case sub == "" && r.Method == http.MethodPatch:
+		var req struct {
+			Title string `json:"title"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Title = strings.TrimSpace(req.Title); len(req.Title) > 200 {
+			jsonError(w, "Title too long", http.StatusBadRequest)
+			return
+		}
+		a.Title = req.Title
+		update = bson.M{"title": a.Title}
+
+	case sub == "files" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		var req struct {
+			Files []string `json:"files"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || len(req.Files) == 0 {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			remove := map[string]bool{}
+			for _, id := range req.Files {
+				remove[id] = true
+			}
+			kept := make([]string, 0, len(a.Files))
+			for _, id := range a.Files {
+				if !remove[id] {
+					kept = append(kept, id)
+				}
+			}
+			a.Files = kept
+		} else {
+			files, err := albumFileIDs(ctx, user, req.Files)
+			if err == errFileNotFound {
+				jsonError(w, "File not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				jsonError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			present := map[string]bool{}
+			for _, id := range a.Files {
+				present[id] = true
+			}
+			for _, id := range files {
+				if !present[id] {
+					a.Files = append(a.Files, id)
+				}
+			}
+			if len(a.Files) > maxAlbumFiles {
+				jsonError(w, fmt.Sprintf("An album holds at most %d files", maxAlbumFiles), http.StatusBadRequest)
+				return
+			}
+		}
+		update = bson.M{"files": a.Files}
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	update["updated_at"] = a.UpdatedAt
+	_, err = albumsColl.UpdateOne(ctx, bson.M{"_id": a.ID}, bson.M{"$set": update})
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(albumJSON(&a))
+}
+
+// albumItem is one tile of the gallery.
+type albumItem struct {
+	ID       string
+	Filename string
+	Size     string
+	Kind     string // "image", "video" or "file"
+	Poster   bool
+}
+
+// handleAlbumPage shows the gallery of /a/{id}.
+func handleAlbumPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/a/")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var a album
+	err := albumsColl.FindOne(ctx, bson.M{"short_id": id}).Decode(&a)
+	dbBreaker.Record(err)
+	if isMongoOutage(err) {
+		serveUnavailable(w, false)
+		return
+	}
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "album not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	var docs []fileRecord
+	if len(a.Files) > 0 {
+		cursor, err := gfsBucket.GetFilesCollection().Find(ctx, bson.M{
+			"metadata.short_id":   bson.M{"$in": a.Files},
+			"metadata.owner_id":   a.OwnerID,
+			"metadata.expires_at": notExpired(),
+			"metadata.visibility": bson.M{"$ne": visibilityPrivate},
+		})
+		dbBreaker.Record(err)
+		if err == nil {
+			err = cursor.All(ctx, &docs)
+			dbBreaker.Record(err)
+		}
+		if err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	byID := make(map[string]*fileRecord, len(docs))
+	for i := range docs {
+		byID[docs[i].Metadata.ShortID] = &docs[i]
+	}
+
+	loc := requestLocale(r)
+	items := make([]albumItem, 0, len(a.Files))
+	for _, id := range a.Files {
+		f, ok := byID[id]
+		if !ok {
+			continue
+		}
+		item := albumItem{ID: id, Filename: f.Filename, Size: loc.size(f.Length), Kind: "file"}
+		hidden := f.Metadata.Disabled || f.Metadata.PasswordHash != "" || f.Metadata.E2E || burnsAfterDownload(f)
+		if !hidden {
+			switch getFileType(f.Metadata.ContentType) {
+			case "image":
+				item.Kind = "image"
+			case "video":
+				item.Kind, item.Poster = "video", config().Posters.Enabled
+			}
+		}
+		items = append(items, item)
+	}
+
+	title := a.Title
+	if title == "" {
+		title = loc.album.Untitled
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl := template.Must(template.ParseFiles("templates/album.html"))
+	err = tmpl.Execute(w, struct {
+		Lang  string
+		Title string
+		Count string
+		Items []albumItem
+		Text  *albumText
+	}{loc.tag, title, loc.albumCount(len(items)), items, &loc.album})
+	if err != nil {
+		log.Printf("Album template error: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Anonymous uploads are limited per person rather than per IP: each browser
+// gets an HMAC-signed identity cookie, so many users behind one CGNAT
+// address do not share a single quota. The cookie only picks the bucket;
+// a looser per-IP cap still applies so clearing cookies does not reset it.
+
+const anonCookie = "xyli_anon"
+
+type anonUsage struct {
+	windowStart time.Time
+	uploads     int
+	bytes       int64
+}
+
+type anonQuotaTracker struct {
+	mu     sync.Mutex
+	usage  map[string]*anonUsage
+	window time.Duration
+	secret []byte
+}
+
+var anonQuota *anonQuotaTracker
+
+func initAnonQuota() {
+	secret := []byte(config().AnonQuota.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		if config().AnonQuota.Enabled {
+			log.Println("anonQuota.secret is not set; anonymous identity cookies will not survive a restart")
+		}
+	}
+
+	anonQuota = &anonQuotaTracker{usage: make(map[string]*anonUsage), secret: secret}
+	configureAnonQuota(config())
+	go anonQuota.janitor()
+}
+
+// configureAnonQuota applies the limits in c.AnonQuota. It runs again on
+// every config reload; the secret is only read at startup.
+func configureAnonQuota(c *Config) {
+	cfg := &c.AnonQuota
+	if cfg.MaxUploads <= 0 {
+		cfg.MaxUploads = 50
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 1 << 30
+	}
+	if cfg.WindowSeconds <= 0 {
+		cfg.WindowSeconds = 24 * 3600
+	}
+	if cfg.IPMultiplier <= 0 {
+		cfg.IPMultiplier = 10
+	}
+
+	anonQuota.mu.Lock()
+	anonQuota.window = time.Duration(cfg.WindowSeconds) * time.Second
+	anonQuota.mu.Unlock()
+}
+
+func (t *anonQuotaTracker) sign(id string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// identity returns the anonymous ID from a valid cookie, issuing a fresh
+// one when the cookie is missing or forged.
+func (t *anonQuotaTracker) identity(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(anonCookie); err == nil {
+		id, sig, ok := strings.Cut(cookie.Value, ".")
+		if ok && hmac.Equal([]byte(sig), []byte(t.sign(id))) {
+			return id
+		}
+	}
+
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	id := base64.RawURLEncoding.EncodeToString(raw)
+	http.SetCookie(w, &http.Cookie{
+		Name:     anonCookie,
+		Value:    id + "." + t.sign(id),
+		Path:     "/",
+		MaxAge:   365 * 24 * 3600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config().Upload.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+func (t *anonQuotaTracker) current(key string, now time.Time) *anonUsage {
+	u, ok := t.usage[key]
+	if !ok || now.Sub(u.windowStart) >= t.window {
+		u = &anonUsage{windowStart: now}
+		t.usage[key] = u
+	}
+	return u
+}
+
+// take charges one upload of size bytes to both the person and the IP. It
+// returns how many uploads the person has left and when the window resets,
+// or how long to wait if either is over its limit.
+func (t *anonQuotaTracker) take(id, ip string, size int64) (int, time.Duration, bool) {
+	cfg := config().AnonQuota
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	person := t.current("id:"+id, now)
+	network := t.current("ip:"+ip, now)
+
+	if person.uploads+1 > cfg.MaxUploads || person.bytes+size > cfg.MaxBytes {
+		return 0, t.window - now.Sub(person.windowStart), false
+	}
+	m := cfg.IPMultiplier
+	if network.uploads+1 > cfg.MaxUploads*m || network.bytes+size > cfg.MaxBytes*int64(m) {
+		return 0, t.window - now.Sub(network.windowStart), false
+	}
+
+	person.uploads++
+	person.bytes += size
+	network.uploads++
+	network.bytes += size
+	return cfg.MaxUploads - person.uploads, t.window - now.Sub(person.windowStart), true
+}
+
+func (t *anonQuotaTracker) janitor() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mu.Lock()
+		now := time.Now()
+		for key, u := range t.usage {
+			if now.Sub(u.windowStart) >= t.window {
+				delete(t.usage, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// allowAnonUpload checks the captcha and enforces the anonymous quota,
+// writing the error response and returning false when either fails. Every
+// anonymous upload path goes through it.
+func allowAnonUpload(w http.ResponseWriter, r *http.Request, size int64) bool {
+	if !requireCaptcha(w, r) {
+		return false
+	}
+	if !config().AnonQuota.Enabled {
+		return true
+	}
+	id := anonQuota.identity(w, r)
+	remaining, wait, ok := anonQuota.take(id, clientIP(r), size)
+	setAnonRateHeaders(w.Header(), remaining, wait)
+	if !ok {
+		setRateLimited(w.Header(), config().AnonQuota.MaxUploads, wait)
+		jsonError(w, "Anonymous upload quota exceeded, sign in or try later", http.StatusTooManyRequests)
+	}
+	return ok
+}
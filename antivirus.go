@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// With antivirus enabled every upload is streamed to clamd through the
+// INSTREAM command while it is being stored, and the verdict is awaited
+// before the upload is acknowledged. Infected uploads are either deleted
+// right away ("reject") or kept with metadata.quarantine set, which hides
+// them from every public route until an admin deletes them ("quarantine").
+//
+// clamd refuses streams longer than its StreamMaxLength, so that should be
+// at least upload.maxSize.
+
+const clamChunkSize = 64 * 1024
+
+type infectedError struct {
+	Signature string
+}
+
+func (e *infectedError) Error() string {
+	return "malware detected: " + e.Signature
+}
+
+var errScannerUnavailable = errors.New("virus scanner unavailable")
+
+type scanEvent struct {
+	FileID    primitive.ObjectID `bson:"file_id" json:"-"`
+	ShortID   string             `bson:"short_id" json:"short_id"`
+	Filename  string             `bson:"filename" json:"filename"`
+	Size      int64              `bson:"size" json:"size"`
+	Signature string             `bson:"signature" json:"signature"`
+	Action    string             `bson:"action" json:"action"`
+	OwnerID   primitive.ObjectID `bson:"owner_id,omitempty" json:"-"`
+	At        time.Time          `bson:"at" json:"at"`
+}
+
+var scanEvents *mongo.Collection
+
+func initAntivirus(ctx context.Context) {
+	cfg := &config().Antivirus
+	if cfg.Address == "" {
+		cfg.Address = "tcp://127.0.0.1:3310"
+	}
+	if cfg.Action != "quarantine" {
+		cfg.Action = "reject"
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 60
+	}
+
+	scanEvents = db.Collection("scan_events")
+	_, err := scanEvents.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(90 * 24 * 3600),
+	})
+	if err != nil {
+		log.Printf("Error creating scan_events index: %v", err)
+	}
+}
+
+// clamScan is a single INSTREAM session. It is written to like any other
+// io.Writer; failures are kept for Verdict so that a scanner hiccup never
+// aborts the upload itself.
+type clamScan struct {
+	conn    net.Conn
+	timeout time.Duration
+	err     error
+}
+
+func startScan() (*clamScan, error) {
+	network, address := "tcp", config().Antivirus.Address
+	if rest, ok := strings.CutPrefix(address, "unix://"); ok {
+		network, address = "unix", rest
+	} else {
+		address = strings.TrimPrefix(address, "tcp://")
+	}
+
+	timeout := time.Duration(config().Antivirus.TimeoutSeconds) * time.Second
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &clamScan{conn: conn, timeout: timeout}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *clamScan) Write(p []byte) (int, error) {
+	for data := p; len(data) > 0 && s.err == nil; {
+		chunk := data
+		if len(chunk) > clamChunkSize {
+			chunk = chunk[:clamChunkSize]
+		}
+		data = data[len(chunk):]
+		s.err = s.send(chunk)
+	}
+	return len(p), nil
+}
+
+func (s *clamScan) send(chunk []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(chunk)
+	return err
+}
+
+// Verdict ends the stream and returns the name of the detected signature,
+// or "" for a clean file.
+func (s *clamScan) Verdict() (string, error) {
+	if s.err == nil {
+		s.err = s.send(nil)
+	}
+	// clamd may have answered (and hung up) mid-stream, e.g. on its size
+	// limit, so the reply is worth reading even after a write error.
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	reply, err := bufio.NewReader(s.conn).ReadString(0)
+	if err != nil {
+		if s.err != nil {
+			return "", s.err
+		}
+		return "", err
+	}
+	reply = strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), "\x00")
+
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+func (s *clamScan) Close() error {
+	return s.conn.Close()
+}
+
+// handleInfected applies the configured action to a freshly stored upload
+// that failed the scan and returns the error reported to the uploader.
+func handleInfected(ctx context.Context, id primitive.ObjectID, filename string, size int64, signature string, metadata bson.M) error {
+	ev := scanEvent{
+		FileID:    id,
+		Filename:  filename,
+		Size:      size,
+		Signature: signature,
+		Action:    config().Antivirus.Action,
+		At:        time.Now(),
+	}
+	ev.ShortID, _ = metadata["short_id"].(string)
+	ev.OwnerID, _ = metadata["owner_id"].(primitive.ObjectID)
+
+	if ev.Action == "quarantine" {
+		_, err := gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+			"metadata.quarantine": bson.M{"signature": signature, "at": ev.At},
+		}})
+		dbBreaker.Record(err)
+		if err != nil {
+			ev.Action = "reject"
+		}
+	}
+	if ev.Action == "reject" {
+		backend, _ := metadata["storage"].(string)
+		s, err := storageFor(backend)
+		if err == nil {
+			err = s.Delete(ctx, id)
+		}
+		if err != nil {
+			log.Printf("Error deleting infected upload %s: %v", ev.ShortID, err)
+		}
+	}
+
+	recordInfection(ctx, ev)
+	return &infectedError{Signature: signature}
+}
+
+// recordInfection logs a detection for the admin page and notifies admins.
+func recordInfection(ctx context.Context, ev scanEvent) {
+	_, err := scanEvents.InsertOne(ctx, ev)
+	dbBreaker.Record(err)
+	notify(notifyEvent{
+		Type:    "malware_detected",
+		Message: fmt.Sprintf("Upload %s (%s) contains %s (%s)", ev.ShortID, ev.Filename, ev.Signature, ev.Action),
+		Details: map[string]interface{}{
+			"short_id":  ev.ShortID,
+			"filename":  ev.Filename,
+			"signature": ev.Signature,
+			"action":    ev.Action,
+		},
+	})
+}
+
+func isInfected(err error) bool {
+	var infected *infectedError
+	return errors.As(err, &infected)
+}
+
+func handleAdminAntivirus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(100)
+	cursor, err := scanEvents.Find(ctx, bson.M{}, opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	events := []scanEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": config().Antivirus.Enabled,
+		"action":  config().Antivirus.Action,
+		"events":  events,
+	})
+}
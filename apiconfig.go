@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// expiryPresets are the lifetimes offered by the upload page. Clients may
+// send any other value parseExpiry accepts.
+var expiryPresets = []string{"1h", "1d", "7d", "30d"}
+
+// handleAPIConfig describes what this instance accepts, so the web UI, the
+// CLI and third-party clients need not hardcode limits.
+func handleAPIConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxTTL, _ := parseExpiry(config().Upload.MaxExpiry)
+	options := []string{}
+	for _, preset := range expiryPresets {
+		if ttl, _ := parseExpiry(preset); maxTTL == 0 || ttl <= maxTTL {
+			options = append(options, preset)
+		}
+	}
+
+	expiry := map[string]interface{}{
+		"default":     config().Upload.DefaultExpiry,
+		"max":         config().Upload.MaxExpiry,
+		"options":     options,
+		"allow_never": maxTTL == 0,
+		"paste": map[string]interface{}{
+			"default": orDefault(config().Upload.PasteDefaultExpiry, config().Upload.DefaultExpiry),
+			"max":     orDefault(config().Upload.PasteMaxExpiry, config().Upload.MaxExpiry),
+		},
+	}
+
+	anonymous := map[string]interface{}{"allowed": true}
+	if config().AnonQuota.Enabled {
+		anonymous["quota"] = map[string]interface{}{
+			"max_uploads":    config().AnonQuota.MaxUploads,
+			"max_bytes":      config().AnonQuota.MaxBytes,
+			"window_seconds": config().AnonQuota.WindowSeconds,
+		}
+	}
+
+	if config().Captcha.Provider != "" {
+		anonymous["captcha"] = map[string]string{
+			"provider": config().Captcha.Provider,
+			"site_key": config().Captcha.SiteKey,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"base_url":      config().Upload.BaseURL,
+		"max_size":      config().Upload.MaxSize,
+		"size_units":    config().Display.SizeUnits,
+		"allowed_types": []string{"*/*"},
+		"anonymous":     anonymous,
+		"expiry":        expiry,
+		"paste": map[string]interface{}{
+			"max_size":  config().Paste.MaxSize,
+			"languages": pasteLanguages,
+		},
+		"features": apiFeatures(),
+	})
+}
+
+// apiFeatures lists what this instance supports, for /api/config and
+// /api/v1/meta.
+func apiFeatures() map[string]bool {
+	return map[string]bool{
+		"accounts":            true,
+		"api_keys":            true,
+		"s3_api":              config().S3API.Enabled,
+		"thumbnails":          true,
+		"image_transform":     true,
+		"video_posters":       config().Posters.Enabled,
+		"dedup":               config().Dedup.Enabled,
+		"antivirus":           config().Antivirus.Enabled,
+		"spool":               config().Spool.Enabled,
+		"proof_of_work":       config().Challenge.Enabled && config().Challenge.Mode == "pow",
+		"pastes":              true,
+		"short_links":         true,
+		"ocr":                 config().OCR.Enabled,
+		"doc_info":            config().DocInfo.Enabled,
+		"file_passwords":      true,
+		"doc_previews":        config().Previews.Enabled,
+		"e2e":                 true,
+		"bandwidth_caps":      true,
+		"file_counters":       true,
+		"max_downloads":       true,
+		"disable_links":       true,
+		"transfers":           true,
+		"discord_bot":         config().Discord.Enabled,
+		"upload_defaults":     true,
+		"strip_exif":          true,
+		"integration_configs": true,
+		"quick_upload":        true,
+		"helper_upload":       true,
+		"albums":              true,
+		"folders":             true,
+		"artifacts":           true,
+		"search":              true,
+		"file_list":           true,
+		"localized_errors":    true,
+		"compression":         config().Compression.Enabled,
+		"http_caching":        true,
+		"filename_slugs":      config().Upload.Slugs,
+		"signed_urls":         true,
+		"raw_image_quality":   true,
+		"visibility":          true,
+		"ip_blocklist":        true,
+		"upload_receipts":     config().Receipts.Enabled,
+		"abuse_reports":       true,
+		"hash_lookup":         true,
+		"instance_import":     config().Import.Enabled,
+		"quota_headers":       true,
+		"captcha":             config().Captcha.Provider != "",
+		"derivative_control":  true,
+		"reprocess_jobs":      true,
+		"oauth_login":         len(config().OAuth.Providers) > 0,
+		"access_tokens":       config().Tokens.Enabled,
+		"git_lfs":             config().LFS.Enabled,
+		"registry":            config().Registry.Enabled,
+	}
+}
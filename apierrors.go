@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// JSON errors carry a stable code next to the message, so scripts can key
+// off the code while people read the text in their own language:
+//
+//	{"error": "File not found", "code": "file_not_found", "message": "Файл не найден"}
+//
+// error stays the English text it always was. message follows the
+// request's Accept-Language when the locale translates the code and is the
+// English text otherwise. Codes come from apiErrorCodes, then from the
+// message prefixes of apiErrorPrefixes, then from the status alone.
+
+var apiErrorCodes = map[string]string{
+	"Database error":                  "database_error",
+	"Method not allowed":              "method_not_allowed",
+	"Unauthorized":                    "unauthorized",
+	"Forbidden":                       "forbidden",
+	"Bad request":                     "bad_request",
+	"Not found":                       "not_found",
+	"File not found":                  "file_not_found",
+	"User not found":                  "user_not_found",
+	"Album not found":                 "album_not_found",
+	"Decode error":                    "server_error",
+	"Server error":                    "server_error",
+	"Upload error":                    "server_error",
+	"Delete error":                    "server_error",
+	"Invalid JSON":                    "invalid_json",
+	"Invalid expires value":           "invalid_expires",
+	"Invalid max_downloads value":     "invalid_max_downloads",
+	"Invalid strip_exif value":        "invalid_strip_exif",
+	"Invalid sort":                    "invalid_sort",
+	"Invalid cursor":                  "invalid_cursor",
+	"Password too long":               "password_too_long",
+	"File is empty":                   "empty",
+	"Paste is empty":                  "empty",
+	"Title too long":                  "title_too_long",
+	"API key required":                "api_key_required",
+	"Too many API keys":               "too_many_api_keys",
+	"Virus scanner unavailable":       "scanner_unavailable",
+	"Storage unavailable":             "unavailable",
+	"Storage temporarily unavailable": "unavailable",
+	"Folder is not empty":             "folder_not_empty",
+	"Access blocked":                  "ip_blocked",
+	"File is under review":            "under_review",
+	"Checksum mismatch":               "checksum_mismatch",
+	"Captcha required":                "captcha_required",
+	"Captcha failed":                  "captcha_failed",
+	"Captcha check unavailable":       "unavailable",
+	"Cannot unlink the last login":    "last_sign_in_method",
+	"Reprocessing already running":    "reprocess_running",
+	"Job not found":                   "job_not_found",
+	"Invalid username or password":    "invalid_credentials",
+	"Invalid refresh token":           "invalid_refresh_token",
+}
+
+var apiErrorPrefixes = []struct{ prefix, code string }{
+	{"File too large", "too_large"},
+	{"File rejected: ", "rejected"},
+	{"Anonymous upload quota exceeded", "quota_exceeded"},
+	{"Invalid ", "invalid_parameter"},
+	{"Remote ", "remote_error"},
+}
+
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "server_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// apiErrorCode names the error a message and status stand for.
+func apiErrorCode(message string, status int) string {
+	if code, ok := apiErrorCodes[message]; ok {
+		return code
+	}
+	for _, p := range apiErrorPrefixes {
+		if strings.HasPrefix(message, p.prefix) {
+			return p.code
+		}
+	}
+	if code, ok := statusErrorCodes[status]; ok {
+		return code
+	}
+	return "error"
+}
+
+// responseLocale finds the locale withMetrics stored for the request by
+// unwrapping w; it is nil for writers that did not pass through it.
+func responseLocale(w http.ResponseWriter) *locale {
+	for w != nil {
+		if rec, ok := w.(*statusRecorder); ok {
+			return rec.locale()
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+	return nil
+}
+
+// jsonErrorCode answers with an error under an explicit code.
+func jsonErrorCode(w http.ResponseWriter, code, message string, status int) {
+	human := message
+	if loc := responseLocale(w); loc != nil {
+		if text, ok := loc.apiErrors[code]; ok {
+			human = text
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message, "code": code, "message": human})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKey lets scripts and tools act on behalf of a user. The secret doubles
+// as a Bearer token and, paired with the key ID, as S3 credentials; SigV4
+// needs the plain secret on the server side, so it is stored as is.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"-"`
+	Name       string             `bson:"name" json:"name"`
+	KeyID      string             `bson:"key_id" json:"key_id"`
+	Secret     string             `bson:"secret" json:"-"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	// SSHKey is a public key in authorized_keys form that signs in to the
+	// SFTP server as this key.
+	SSHKey         string `bson:"ssh_key,omitempty" json:"ssh_key,omitempty"`
+	SSHFingerprint string `bson:"ssh_fingerprint,omitempty" json:"ssh_fingerprint,omitempty"`
+}
+
+const maxAPIKeysPerUser = 20
+
+var errTooManyKeys = errors.New("too many API keys")
+
+var apiKeysColl *mongo.Collection
+
+func initAPIKeys(ctx context.Context) {
+	apiKeysColl = db.Collection("api_keys")
+	_, err := apiKeysColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "secret", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "ssh_fingerprint", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	})
+	if err != nil {
+		log.Printf("Error creating api_keys indexes: %v", err)
+	}
+}
+
+func randomString(alphabet string, n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
+
+func newAPIKey(userID primitive.ObjectID, name string) *APIKey {
+	return &APIKey{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Name:      name,
+		KeyID:     "XYLI" + randomString("ABCDEFGHIJKLMNOPQRSTUVWXYZ234567", 16),
+		Secret:    randomString("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", 40),
+		CreatedAt: time.Now(),
+	}
+}
+
+// lookupAPIKey finds a key by field ("key_id" or "secret") and its owner.
+func lookupAPIKey(field, value string) (*APIKey, *User) {
+	if value == "" || dbBreaker.Open() {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var key APIKey
+	err := apiKeysColl.FindOne(ctx, bson.M{field: value}).Decode(&key)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, nil
+	}
+
+	var user User
+	err = usersColl.FindOne(ctx, bson.M{"_id": key.UserID}).Decode(&user)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, nil
+	}
+
+	go touchAPIKey(key.ID)
+	return &key, &user
+}
+
+func touchAPIKey(id primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := apiKeysColl.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_used_at": time.Now()}})
+	dbBreaker.Record(err)
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// requestUser identifies the caller by session cookie, access token or by an
+// API key sent as "Authorization: Bearer <secret>".
+func requestUser(r *http.Request) *User {
+	user, _ := requestAuth(r)
+	return user
+}
+
+// requestAuth is requestUser that also returns the API key used, if any.
+func requestAuth(r *http.Request) (*User, *APIKey) {
+	if token := bearerToken(r); token != "" && !isAccessToken(token) {
+		key, user := lookupAPIKey("secret", token)
+		return user, key
+	}
+	return currentUser(r), nil
+}
+
+// handleAPIKeys lists and creates keys for the signed-in user. Managing keys
+// requires a browser session, so a leaked key cannot mint more keys.
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		cursor, err := apiKeysColl.Find(ctx, bson.M{"user_id": user.ID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		keys := []APIKey{}
+		if err := cursor.All(ctx, &keys); err != nil {
+			jsonError(w, "Decode error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			req.Name = "API key"
+		}
+		if len(req.Name) > 64 {
+			req.Name = req.Name[:64]
+		}
+
+		count, err := apiKeysColl.CountDocuments(ctx, bson.M{"user_id": user.ID})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxAPIKeysPerUser {
+			jsonError(w, "Too many API keys", http.StatusBadRequest)
+			return
+		}
+
+		key := newAPIKey(user.ID, req.Name)
+		_, err = apiKeysColl.InsertOne(ctx, key)
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"name":   key.Name,
+			"key_id": key.KeyID,
+			"secret": key.Secret,
+		})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAPIKeyDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && !strings.HasSuffix(r.URL.Path, "/ssh") {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := currentUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keyID := strings.TrimPrefix(r.URL.Path, "/api/keys/")
+	if strings.HasSuffix(keyID, "/ssh") {
+		handleAPIKeySSH(w, r, user, strings.TrimSuffix(keyID, "/ssh"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	res, err := apiKeysColl.DeleteOne(ctx, bson.M{"key_id": keyID, "user_id": user.ID})
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if res.DeletedCount == 0 {
+		jsonError(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// handleAPIKeySSH attaches (PUT {public_key}) or removes (DELETE) the SSH
+// public key that signs in to the SFTP server as the key.
+func handleAPIKeySSH(w http.ResponseWriter, r *http.Request, user *User, keyID string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var update bson.M
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			PublicKey string `json:"public_key"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		line, fingerprint, err := sshKeyFingerprint(req.PublicKey)
+		if err != nil {
+			jsonError(w, "Invalid public key", http.StatusBadRequest)
+			return
+		}
+		update = bson.M{"$set": bson.M{"ssh_key": line, "ssh_fingerprint": fingerprint}}
+	case http.MethodDelete:
+		update = bson.M{"$unset": bson.M{"ssh_key": "", "ssh_fingerprint": ""}}
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := apiKeysColl.UpdateOne(ctx, bson.M{"key_id": keyID, "user_id": user.ID}, update)
+	dbBreaker.Record(err)
+	if mongo.IsDuplicateKeyError(err) {
+		jsonError(w, "This public key is already attached to another API key", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		jsonError(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Append mode: an upload sent with append=true stays open, and whoever holds
+// its append token keeps adding to it with POST /append/{id} until they send
+// ?close=1. Meanwhile /raw/ serves what has arrived so far and answers
+// Range: bytes=N- requests, which is what the viewer polls to follow a
+// growing log. Checksums and the antivirus scan happen once the file is
+// closed, since before that there is nothing final to check.
+
+const appendTokenHeader = "X-Append-Token"
+
+// appendUpload starts a growing file with r as its first content and returns
+// the token needed to append to it.
+func appendUpload(ctx context.Context, filename string, r io.Reader, metadata bson.M) (string, error) {
+	token := generateID() + generateID() + generateID()
+	metadata["append_token"] = token
+	n, err := appendStore.Put(ctx, primitive.NewObjectID(), filename, r, metadata)
+	if err != nil {
+		return "", err
+	}
+	recordUploadStat(metadata, n)
+	uploadWebhook(filename, n, metadata)
+	return token, nil
+}
+
+func handleAppend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shortID := r.URL.Path[len("/append/"):]
+	token := r.Header.Get(appendTokenHeader)
+	if shortID == "" || token == "" {
+		jsonError(w, "File ID and "+appendTokenHeader+" header are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	var fileDoc fileRecord
+	err := findFile(ctx, bson.M{"metadata.short_id": shortID, "metadata.growing": true}, &fileDoc)
+	if isMongoOutage(err) {
+		serveUnavailable(w, true)
+		return
+	}
+	if err == errFileNotFound {
+		jsonError(w, "File not found or already closed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(fileDoc.Metadata.AppendToken)) != 1 {
+		jsonError(w, "Invalid append token", http.StatusForbidden)
+		return
+	}
+
+	length, err := appendStore.Append(ctx, fileDoc.ID, -1, http.MaxBytesReader(w, r.Body, config().Upload.MaxSize))
+	if !writeAppendError(w, err) {
+		return
+	}
+
+	growing := true
+	if closing, _ := strconv.ParseBool(r.URL.Query().Get("close")); closing {
+		fileDoc.Length = length
+		err := finishAppend(ctx, &fileDoc)
+		if isInfected(err) {
+			jsonError(w, "File rejected: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err == errScannerUnavailable {
+			setUnavailable(w.Header(), scannerRetryAfter)
+			jsonError(w, "Virus scanner unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !writeAppendError(w, err) {
+			return
+		}
+		growing = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"length":  length,
+		"growing": growing,
+	})
+}
+
+// writeAppendError answers a failed append and reports whether err was nil.
+func writeAppendError(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case err == errAppendClosed:
+		jsonError(w, "File is already closed", http.StatusConflict)
+	case err == errAppendConflict:
+		jsonError(w, "Another append is in progress, retry", http.StatusConflict)
+	case err == errAppendTooLarge, errors.As(err, &tooLarge):
+		jsonError(w, "File too large (max "+formatSize(config().Upload.MaxSize)+")", http.StatusRequestEntityTooLarge)
+	case isMongoOutage(err):
+		serveUnavailable(w, true)
+	default:
+		jsonError(w, "Append error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// finishAppend closes a growing file, recording its checksums and scanning
+// it the way putContent does for regular uploads.
+func finishAppend(ctx context.Context, f *fileRecord) error {
+	hashes := map[string]hash.Hash{"sha256": sha256.New()}
+	if config().Checksums.MD5 {
+		hashes["md5"] = md5.New()
+	}
+	if config().Checksums.SHA1 {
+		hashes["sha1"] = sha1.New()
+	}
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+
+	var scan *clamScan
+	if config().Antivirus.Enabled {
+		var err error
+		scan, err = startScan()
+		if err != nil {
+			log.Printf("Error connecting to clamd: %v", err)
+			if !config().Antivirus.FailOpen {
+				return errScannerUnavailable
+			}
+		} else {
+			defer scan.Close()
+			writers = append(writers, scan)
+		}
+	}
+
+	content, err := appendStore.OpenRange(ctx, f.ID, 0, f.Length)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{}
+	for name, h := range hashes {
+		set["metadata."+name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if err := appendStore.Close(ctx, f.ID, set); err != nil {
+		return err
+	}
+
+	if scan != nil {
+		signature, err := scan.Verdict()
+		if err != nil {
+			log.Printf("Error scanning upload %s: %v", f.Metadata.ShortID, err)
+			if !config().Antivirus.FailOpen {
+				appendStore.Delete(ctx, f.ID)
+				return errScannerUnavailable
+			}
+		}
+		if signature != "" {
+			metadata := bson.M{"short_id": f.Metadata.ShortID, "storage": appendStore.Name()}
+			if !f.Metadata.OwnerID.IsZero() {
+				metadata["owner_id"] = f.Metadata.OwnerID
+			}
+			return handleInfected(ctx, f.ID, f.Filename, f.Length, signature, metadata)
+		}
+	}
+	return nil
+}
+
+// parseOpenRange reads a single "bytes=N-" or "bytes=N-M" range header.
+func parseOpenRange(header string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end = -1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+// serveAppendFile sends an append-mode file from /raw/. Growing files are
+// never cached, and a range that starts at the current end gets a 416 with
+// the length so far, which tells a follower there is nothing new yet.
+func serveAppendFile(w http.ResponseWriter, r *http.Request, f *fileRecord) int64 {
+	h := w.Header()
+	setContentHeaders(h, f.Metadata.ContentType)
+	h.Set("Accept-Ranges", "bytes")
+	total := strconv.FormatInt(f.Length, 10)
+	if f.Metadata.Growing {
+		h.Set("X-Xyli-Growing", "true")
+		h.Set("Cache-Control", "no-store")
+		total = "*"
+	} else {
+		setChecksumHeaders(h, f)
+	}
+
+	start, end, ranged := parseOpenRange(r.Header.Get("Range"))
+	if !ranged {
+		start, end = 0, f.Length-1
+	}
+	if ranged && start >= f.Length {
+		h.Set("Content-Range", "bytes */"+strconv.FormatInt(f.Length, 10))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return 0
+	}
+	if end < 0 || end >= f.Length {
+		end = f.Length - 1
+	}
+
+	content, err := appendStore.OpenRange(r.Context(), f.ID, start, end+1)
+	if err != nil {
+		http.Error(w, "download error", http.StatusInternalServerError)
+		return 0
+	}
+	defer content.Close()
+
+	h.Set("Content-Length", strconv.FormatInt(end+1-start, 10))
+	if ranged {
+		h.Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+total)
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	n, _ := io.Copy(w, content)
+	return n
+}
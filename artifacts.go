@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Artifact mode lets CI jobs keep build outputs here. A job uploads with an
+// API key and names the pipeline, branch and build:
+//
+//	curl -H "Authorization: Bearer KEY" --data-binary @app.tar.gz \
+//	  "https://host/api/artifacts?pipeline=app&branch=main&build=42&name=app.tar.gz&keep=10"
+//
+// Artifacts belong to the key that uploaded them. After each upload only
+// the newest keep builds of that pipeline and branch are kept (by the time
+// of their last upload); older builds are deleted with all their files.
+// Artifacts do not get the account's default expiry, but ?expires= works
+// as usual and plans with a maximum lifetime still apply.
+//
+//	POST /api/artifacts                 upload, raw body or one multipart file
+//	GET  /api/artifacts                 list builds, newest first, filtered by
+//	                                    ?pipeline=, ?branch= and ?build=
+//	GET  /api/artifacts/latest          redirect to the newest file ?name= of
+//	                                    ?pipeline= and ?branch=
+
+const maxArtifactField = 200
+
+// artifactInfo is metadata.artifact of a CI upload.
+type artifactInfo struct {
+	Pipeline string `bson:"pipeline" json:"pipeline"`
+	Branch   string `bson:"branch" json:"branch"`
+	Build    string `bson:"build" json:"build"`
+}
+
+// artifactField checks one of pipeline, branch or build.
+func artifactField(v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	return v, v != "" && len(v) <= maxArtifactField && !strings.ContainsAny(v, "\x00\r\n")
+}
+
+func initArtifacts(ctx context.Context) {
+	cfg := &config().Artifacts
+	if cfg.KeepBuilds <= 0 {
+		cfg.KeepBuilds = 10
+	}
+	if cfg.MaxKeepBuilds <= 0 {
+		cfg.MaxKeepBuilds = 1000
+	}
+	_, err := gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "metadata.api_key_id", Value: 1},
+			{Key: "metadata.artifact.pipeline", Value: 1},
+			{Key: "metadata.artifact.branch", Value: 1},
+			{Key: "uploadDate", Value: -1},
+		},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"metadata.artifact": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Error creating artifacts index: %v", err)
+	}
+}
+
+func handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		handleArtifactUpload(w, r)
+	case http.MethodGet:
+		handleArtifactList(w, r)
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleArtifactUpload(w http.ResponseWriter, r *http.Request) {
+	user, key := requestAuth(r)
+	if user == nil || key == nil {
+		jsonError(w, "API key required", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	pipeline, ok1 := artifactField(q.Get("pipeline"))
+	branch, ok2 := artifactField(q.Get("branch"))
+	build, ok3 := artifactField(q.Get("build"))
+	if !ok1 || !ok2 || !ok3 {
+		jsonError(w, "pipeline, branch and build are required", http.StatusBadRequest)
+		return
+	}
+	keep := config().Artifacts.KeepBuilds
+	if v := q.Get("keep"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > config().Artifacts.MaxKeepBuilds {
+			jsonError(w, fmt.Sprintf("keep must be between 1 and %d", config().Artifacts.MaxKeepBuilds), http.StatusBadRequest)
+			return
+		}
+		keep = n
+	}
+	if r.ContentLength > config().Upload.MaxSize {
+		jsonError(w, fmt.Sprintf("File too large (max %s)", formatSize(config().Upload.MaxSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body, name, claimed := io.Reader(r.Body), q.Get("name"), r.Header.Get("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(claimed); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		part, err := mr.NextPart()
+		if err != nil {
+			jsonError(w, "File not found", http.StatusBadRequest)
+			return
+		}
+		defer part.Close()
+		body, claimed = part, part.Header.Get("Content-Type")
+		if name == "" {
+			name = part.FileName()
+		}
+	}
+	expires := q.Get("expires")
+	if expires == "" {
+		expires = "never"
+	}
+
+	// Artifacts are kept byte for byte, whatever the account's defaults.
+	metadata, ok := storeSimpleUpload(w, r, jsonUploadError(w), simpleUpload{
+		Body:      body,
+		Name:      name,
+		Claimed:   claimed,
+		MaxSize:   config().Upload.MaxSize,
+		Expires:   expires,
+		StripEXIF: "false",
+		Metadata:  bson.M{"artifact": artifactInfo{pipeline, branch, build}},
+	})
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	removed, err := pruneArtifacts(ctx, key, pipeline, branch, keep)
+	if err != nil {
+		log.Printf("Error pruning artifacts of %s/%s: %v", pipeline, branch, err)
+	}
+	if removed == nil {
+		removed = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"link":           fmt.Sprintf("%s/%s", config().Upload.BaseURL, metadata["short_id"]),
+		"deletion_link":  fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"]),
+		"pipeline":       pipeline,
+		"branch":         branch,
+		"build":          build,
+		"builds_removed": removed,
+	})
+}
+
+// pruneArtifacts deletes the builds of a pipeline and branch beyond the
+// newest keep and returns the builds it deleted.
+func pruneArtifacts(ctx context.Context, key *APIKey, pipeline, branch string, keep int) ([]string, error) {
+	match := bson.M{
+		"metadata.api_key_id":        key.KeyID,
+		"metadata.artifact.pipeline": pipeline,
+		"metadata.artifact.branch":   branch,
+	}
+	cursor, err := gfsBucket.GetFilesCollection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": "$metadata.artifact.build", "last": bson.M{"$max": "$uploadDate"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "last", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$skip", Value: keep}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	var old []struct {
+		Build string `bson:"_id"`
+	}
+	err = cursor.All(ctx, &old)
+	dbBreaker.Record(err)
+	if err != nil || len(old) == 0 {
+		return nil, err
+	}
+
+	builds := make([]string, 0, len(old))
+	for _, b := range old {
+		builds = append(builds, b.Build)
+	}
+	match["metadata.artifact.build"] = bson.M{"$in": builds}
+	cursor, err = gfsBucket.FindContext(ctx, match)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	var files []fileRecord
+	err = cursor.All(ctx, &files)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if err := deleteStoredFile(ctx, &files[i]); err != nil {
+			return nil, err
+		}
+	}
+	return builds, nil
+}
+
+// artifactFilter matches the caller's artifacts: those of the key for an
+// API key, all of the account's for a session.
+func artifactFilter(r *http.Request, user *User, key *APIKey) bson.M {
+	filter := bson.M{
+		"metadata.owner_id":   user.ID,
+		"metadata.artifact":   bson.M{"$exists": true},
+		"metadata.expires_at": notExpired(),
+	}
+	if key != nil {
+		filter["metadata.api_key_id"] = key.KeyID
+	}
+	for _, field := range []string{"pipeline", "branch", "build"} {
+		if v := r.URL.Query().Get(field); v != "" {
+			filter["metadata.artifact."+field] = v
+		}
+	}
+	return filter
+}
+
+func handleArtifactList(w http.ResponseWriter, r *http.Request) {
+	user, key := requestAuth(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	opts := options.GridFSFind().SetSort(bson.D{{Key: "uploadDate", Value: -1}}).SetLimit(1000)
+	cursor, err := gfsBucket.FindContext(ctx, artifactFilter(r, user, key), opts)
+	dbBreaker.Record(err)
+	var docs []fileRecord
+	if err == nil {
+		err = cursor.All(ctx, &docs)
+		dbBreaker.Record(err)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	type buildEntry struct {
+		artifactInfo
+		UpdatedAt time.Time   `json:"updated_at"`
+		Files     []fileEntry `json:"files"`
+	}
+	builds := []*buildEntry{}
+	index := map[artifactInfo]*buildEntry{}
+	for i := range docs {
+		info := *docs[i].Metadata.Artifact
+		b, ok := index[info]
+		if !ok {
+			b = &buildEntry{artifactInfo: info, UpdatedAt: docs[i].UploadDate, Files: []fileEntry{}}
+			index[info] = b
+			builds = append(builds, b)
+		}
+		b.Files = append(b.Files, newFileEntry(&docs[i]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"builds": builds})
+}
+
+// handleArtifactLatest redirects to the newest artifact called ?name= of a
+// pipeline and branch, for "download the last good build" links.
+func handleArtifactLatest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, key := requestAuth(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if r.URL.Query().Get("pipeline") == "" || r.URL.Query().Get("branch") == "" || name == "" {
+		jsonError(w, "pipeline, branch and name are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	filter := artifactFilter(r, user, key)
+	filter["filename"] = name
+	var f fileRecord
+	err := gfsBucket.GetFilesCollection().FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: "uploadDate", Value: -1}})).Decode(&f)
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		jsonError(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, fmt.Sprintf("%s/raw/%s", config().Upload.BaseURL, f.Metadata.ShortID), http.StatusFound)
+}
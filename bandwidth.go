@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A file may carry a monthly bandwidth cap in metadata.bandwidth_cap, set by
+// its owner or an admin. Bytes sent by /raw/ are counted in
+// metadata.bandwidth for the current UTC month; once they reach the cap,
+// /raw/ answers 429 with a page saying when downloads resume, so one viral
+// file cannot use up the egress of the whole instance. Files without a cap
+// are not counted.
+
+// bandwidthUse is the traffic of a capped file in one month.
+type bandwidthUse struct {
+	Month string `bson:"month"`
+	Bytes int64  `bson:"bytes"`
+}
+
+func bandwidthMonth(t time.Time) string {
+	return t.UTC().Format(statsMonthFormat)
+}
+
+// bandwidthReset is when the current month's count starts over.
+func bandwidthReset(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// bandwidthUsed returns the bytes f has sent this month.
+func bandwidthUsed(f *fileRecord) int64 {
+	if u := f.Metadata.Bandwidth; u != nil && u.Month == bandwidthMonth(time.Now()) {
+		return u.Bytes
+	}
+	return 0
+}
+
+func bandwidthExceeded(f *fileRecord) bool {
+	return f.Metadata.BandwidthCap > 0 && bandwidthUsed(f) >= f.Metadata.BandwidthCap
+}
+
+// recordBandwidth adds n bytes to this month's count of a capped file. A
+// count from an earlier month is replaced rather than added to.
+func recordBandwidth(f *fileRecord, n int64) {
+	if f.Metadata.BandwidthCap <= 0 || n <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	files := gfsBucket.GetFilesCollection()
+	month := bandwidthMonth(time.Now())
+	for attempt := 0; attempt < 2; attempt++ {
+		res, err := files.UpdateOne(ctx,
+			bson.M{"_id": f.ID, "metadata.bandwidth.month": month},
+			bson.M{"$inc": bson.M{"metadata.bandwidth.bytes": n}})
+		dbBreaker.Record(err)
+		if err != nil || res.MatchedCount > 0 {
+			return
+		}
+		res, err = files.UpdateOne(ctx,
+			bson.M{"_id": f.ID, "metadata.bandwidth.month": bson.M{"$ne": month}},
+			bson.M{"$set": bson.M{"metadata.bandwidth": bandwidthUse{Month: month, Bytes: n}}})
+		dbBreaker.Record(err)
+		if err != nil || res.MatchedCount > 0 {
+			return
+		}
+		// Another download started the month in between; add to its count.
+	}
+}
+
+// serveBandwidthExceeded answers a /raw/ request for a file over its cap.
+func serveBandwidthExceeded(w http.ResponseWriter, r *http.Request) {
+	reset := bandwidthReset(time.Now())
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	loc := requestLocale(r)
+	tmpl := template.Must(template.ParseFiles("templates/bandwidth.html"))
+	tmpl.Execute(w, struct {
+		Lang  string
+		Text  *bandwidthText
+		Reset string
+	}{loc.tag, &loc.bandwidth, loc.formatDate(reset)})
+}
+
+// handleFileBandwidth sets or clears (cap 0) the monthly cap of a file. The
+// owner may change their own files, admins any file.
+func handleFileBandwidth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID  string `json:"id"`
+		Cap int64  `json:"cap"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" || req.Cap < 0 {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	doc, err := findManagedFile(ctx, user, req.ID)
+	if err == errFileNotFound {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"metadata.bandwidth_cap": req.Cap}}
+	if req.Cap == 0 {
+		update = bson.M{"$unset": bson.M{"metadata.bandwidth_cap": "", "metadata.bandwidth": ""}}
+	}
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": doc.ID}, update)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if doc.Metadata.OwnerID != user.ID {
+		log.Printf("Admin %s set the bandwidth cap of %s to %d", user.Username, req.ID, req.Cap)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   req.ID,
+		"cap":  req.Cap,
+		"used": bandwidthUsed(doc),
+	})
+}
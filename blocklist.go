@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admins can cut off addresses and networks in the ip_blocks collection,
+// managed with /api/admin/blocklist (GET lists, POST adds, DELETE ?id=
+// removes) and on the admin page. A blocked client cannot upload, over
+// HTTP or SFTP; an entry with downloads set also keeps it from viewing and
+// downloading files. The
+// list is held in memory and reloaded every minute, so entries added on
+// another instance apply here too. Entries may expire on their own.
+
+const blocklistRefresh = time.Minute
+
+type ipBlock struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	CIDR      string             `bson:"cidr" json:"cidr"`
+	Note      string             `bson:"note,omitempty" json:"note,omitempty"`
+	Downloads bool               `bson:"downloads,omitempty" json:"downloads"`
+	CreatedBy string             `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+
+	prefix netip.Prefix
+}
+
+var (
+	ipBlocksColl *mongo.Collection
+
+	blocklistMu sync.RWMutex
+	blocklist   []ipBlock
+)
+
+func initBlocklist(ctx context.Context) {
+	ipBlocksColl = db.Collection("ip_blocks")
+	_, err := ipBlocksColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "cidr", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("Error creating ip_blocks index: %v", err)
+	}
+	if err := loadBlocklist(ctx); err != nil {
+		log.Printf("Error loading IP blocklist: %v", err)
+	}
+}
+
+func runBlocklistRefresh() {
+	ticker := time.NewTicker(blocklistRefresh)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := loadBlocklist(ctx); err != nil {
+			log.Printf("Error loading IP blocklist: %v", err)
+		}
+		cancel()
+	}
+}
+
+// loadBlocklist replaces the in-memory list with the database's.
+func loadBlocklist(ctx context.Context) error {
+	cursor, err := ipBlocksColl.Find(ctx, bson.M{"$or": []bson.M{
+		{"expires_at": bson.M{"$exists": false}},
+		{"expires_at": bson.M{"$gt": time.Now()}},
+	}}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var blocks []ipBlock
+	err = cursor.All(ctx, &blocks)
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	for i := range blocks {
+		blocks[i].prefix, _ = parseBlockCIDR(blocks[i].CIDR)
+	}
+
+	blocklistMu.Lock()
+	blocklist = blocks
+	blocklistMu.Unlock()
+	return nil
+}
+
+// parseBlockCIDR reads an address or a network; a bare address stands for
+// itself alone.
+func parseBlockCIDR(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if p.Addr().Is4In6() {
+		if p.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("%s mixes IPv4 and IPv6", s)
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// blockFor returns the entry that blocks ip, if any.
+func blockFor(ip string) *ipBlock {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	now := time.Now()
+
+	blocklistMu.RLock()
+	defer blocklistMu.RUnlock()
+	for i := range blocklist {
+		b := &blocklist[i]
+		if b.prefix.IsValid() && b.prefix.Contains(addr) && (b.ExpiresAt == nil || now.Before(*b.ExpiresAt)) {
+			return b
+		}
+	}
+	return nil
+}
+
+// blockGuard refuses blocked clients. Requests that only read (GET, HEAD)
+// are refused by entries that cover downloads; everything else, uploads
+// above all, by any entry.
+func blockGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := blockFor(clientIP(r))
+		if b == nil {
+			next(w, r)
+			return
+		}
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		if read && !b.Downloads {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if read {
+			http.Error(w, "access blocked", http.StatusForbidden)
+			return
+		}
+		jsonError(w, "Access blocked", http.StatusForbidden)
+	}
+}
+
+func handleAdminBlocklist(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r, true)
+	if admin == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		blocklistMu.RLock()
+		blocks := append([]ipBlock{}, blocklist...)
+		blocklistMu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"blocks": blocks,
+			"ip":     clientIP(r),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			CIDR      string `json:"cidr"`
+			Note      string `json:"note"`
+			Downloads bool   `json:"downloads"`
+			ExpiresIn int64  `json:"expires_in"` // seconds, 0 for never
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		prefix, err := parseBlockCIDR(req.CIDR)
+		if err != nil || req.ExpiresIn < 0 {
+			jsonError(w, "Invalid address or network", http.StatusBadRequest)
+			return
+		}
+		if ip, err := netip.ParseAddr(clientIP(r)); err == nil && prefix.Contains(ip.Unmap()) {
+			jsonError(w, "This would block your own address", http.StatusConflict)
+			return
+		}
+
+		b := ipBlock{
+			CIDR:      prefix.String(),
+			Note:      strings.TrimSpace(req.Note),
+			Downloads: req.Downloads,
+			CreatedBy: admin.Username,
+			CreatedAt: time.Now(),
+		}
+		if req.ExpiresIn > 0 {
+			t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+			b.ExpiresAt = &t
+		}
+		res, err := ipBlocksColl.InsertOne(ctx, b)
+		dbBreaker.Record(err)
+		if mongo.IsDuplicateKeyError(err) {
+			jsonError(w, "Already blocked", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		b.ID = res.InsertedID.(primitive.ObjectID)
+		log.Printf("Admin %s blocked %s (downloads=%t): %s", admin.Username, b.CIDR, b.Downloads, b.Note)
+		if err := loadBlocklist(ctx); err != nil {
+			log.Printf("Error loading IP blocklist: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(b)
+
+	case http.MethodDelete:
+		id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+		if err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		res, err := ipBlocksColl.DeleteOne(ctx, bson.M{"_id": id})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if res.DeletedCount == 0 {
+			jsonError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Admin %s removed IP block %s", admin.Username, id.Hex())
+		if err := loadBlocklist(ctx); err != nil {
+			log.Printf("Error loading IP blocklist: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
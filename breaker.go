@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// circuitBreaker stops sending requests to MongoDB once outage errors pile up,
+// so handlers fail fast instead of each waiting out its own timeout.
+type circuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	failures     []time.Time
+	openUntil    time.Time
+	probeStarted time.Time
+}
+
+var dbBreaker *circuitBreaker
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown}
+}
+
+// Allow reports whether a request may touch the database. After the cooldown
+// a single probe request is let through; its outcome closes or reopens the breaker.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	if !b.probeStarted.IsZero() && now.Sub(b.probeStarted) < b.cooldown {
+		return false
+	}
+	b.probeStarted = now
+	return true
+}
+
+// Record feeds the result of a database call into the breaker. Only errors
+// that indicate an unreachable or overloaded server count as failures.
+func (b *circuitBreaker) Record(err error) {
+	countMongoError(err)
+	outage := isMongoOutage(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if !outage {
+		if !b.probeStarted.IsZero() {
+			b.openUntil = time.Time{}
+			b.probeStarted = time.Time{}
+			b.failures = nil
+			resolveIncident("database")
+		}
+		return
+	}
+
+	if !b.probeStarted.IsZero() {
+		b.openUntil = now.Add(b.cooldown)
+		b.probeStarted = time.Time{}
+		return
+	}
+
+	cutoff := now.Add(-b.window)
+	kept := b.failures[:0]
+	for _, t := range b.failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	b.failures = append(kept, now)
+
+	if len(b.failures) >= b.threshold && b.openUntil.IsZero() {
+		b.openUntil = now.Add(b.cooldown)
+		b.failures = nil
+		openIncident("database", "Хранилище недоступно, загрузка и просмотр файлов могут не работать")
+	}
+}
+
+// RetryAfter returns the number of seconds until the next probe is allowed.
+func (b *circuitBreaker) RetryAfter() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seconds := int(time.Until(b.openUntil).Seconds()) + 1
+	if seconds < 1 {
+		seconds = int(b.cooldown.Seconds())
+	}
+	return seconds
+}
+
+// Open reports whether the breaker is currently rejecting requests.
+func (b *circuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+func isMongoOutage(err error) bool {
+	if err == nil {
+		return false
+	}
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err)
+}
+
+// serveUnavailable answers with 503 and retry hints, as JSON for API
+// routes and as the static status page for everything else.
+func serveUnavailable(w http.ResponseWriter, api bool) {
+	setUnavailable(w.Header(), time.Duration(dbBreaker.RetryAfter())*time.Second)
+	if api {
+		jsonError(w, "Storage temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	page, err := os.ReadFile("static/unavailable.html")
+	if err != nil {
+		http.Error(w, "storage temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+}
+
+// guardStorage rejects requests to storage-dependent routes while the breaker is open.
+func guardStorage(api bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !dbBreaker.Allow() {
+			serveUnavailable(w, api)
+			return
+		}
+		next(w, r)
+	}
+}
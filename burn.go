@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Uploads sent with max_downloads are deleted once /raw/ has served them
+// that many times. metadata.downloads_left counts down; the request that
+// takes it to zero deletes the file after sending it and leaves the short ID
+// in burned, so the link answers 410 Gone for a while instead of 404.
+// Every /raw/ request uses up a download, ranged or not, and thumbnails and
+// other previews are not served for these files: they would show the
+// content for free.
+
+const (
+	maxDownloadsLimit = 1000000
+	burnedTTL         = 30 * 24 * time.Hour
+)
+
+var (
+	burnedColl *mongo.Collection
+
+	errInvalidMaxDownloads = errors.New("invalid max_downloads value")
+)
+
+func initBurn(ctx context.Context) {
+	burnedColl = db.Collection("burned")
+	_, err := burnedColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(burnedTTL / time.Second)),
+	})
+	if err != nil {
+		log.Printf("Error creating burned index: %v", err)
+	}
+}
+
+// parseMaxDownloads reads the max_downloads upload parameter; "" means no
+// limit.
+func parseMaxDownloads(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 || n > maxDownloadsLimit {
+		return 0, errInvalidMaxDownloads
+	}
+	return n, nil
+}
+
+func burnsAfterDownload(f *fileRecord) bool {
+	return f.Metadata.MaxDownloads > 0
+}
+
+// claimDownload uses up one of the downloads of f. ok is false when none
+// are left; last is true when this was the final one.
+func claimDownload(ctx context.Context, f *fileRecord) (ok, last bool, err error) {
+	var updated fileRecord
+	err = gfsBucket.GetFilesCollection().FindOneAndUpdate(ctx,
+		bson.M{"_id": f.ID, "metadata.downloads_left": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"metadata.downloads_left": -1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, updated.Metadata.DownloadsLeft <= 0, nil
+}
+
+// burnFile deletes a file whose downloads are used up and remembers its
+// short ID.
+func burnFile(f *fileRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := burnedColl.UpdateOne(ctx,
+		bson.M{"_id": f.Metadata.ShortID},
+		bson.M{"$set": bson.M{"at": time.Now()}},
+		options.Update().SetUpsert(true))
+	dbBreaker.Record(err)
+	if err != nil {
+		log.Printf("Error recording burned file %s: %v", f.Metadata.ShortID, err)
+	}
+	if err := deleteStoredFile(ctx, f); err != nil {
+		log.Printf("Error deleting burned file %s: %v", f.Metadata.ShortID, err)
+	}
+}
+
+// wasBurned reports whether shortID belonged to a file deleted after its
+// last download.
+func wasBurned(ctx context.Context, shortID string) bool {
+	err := burnedColl.FindOne(ctx, bson.M{"_id": shortID}).Err()
+	dbBreaker.Record(err)
+	return err == nil
+}
+
+// serveGone answers for a file whose downloads are used up.
+func serveGone(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+
+	loc := requestLocale(r)
+	tmpl := template.Must(template.ParseFiles("templates/gone.html"))
+	tmpl.Execute(w, struct {
+		Lang string
+		Text *goneText
+	}{loc.tag, &loc.gone})
+}
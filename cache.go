@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Stored files never change, but the links to them can stop working: files
+// get disabled, made private, hidden by reports, cut off by bandwidth caps
+// or deleted. So /raw/ and derived images such as /thumb/ answer with strong
+// ETags and Last-Modified and let caches keep a copy, but not reuse it
+// without asking first; the access rules run again and If-None-Match and
+// If-Modified-Since are answered with 304 Not Modified. A file's ETag is its
+// SHA-256 where one was recorded and its id otherwise; compressed responses
+// get the encoding appended, as they are different bytes. Files that can
+// still change or vanish on their own terms (growing uploads, burn after
+// download) are not cached at all. Only URLs that name their content, such
+// as versioned viewer plugin assets, are sent as immutable.
+
+// fileETag is the strong validator of a stored file as sent with encoding.
+func fileETag(f *fileRecord, encoding string) string {
+	tag := f.Metadata.SHA256
+	if tag == "" {
+		tag = f.ID.Hex()
+	}
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// revalidateCacheControl lets caches store a response but makes them
+// revalidate it before every use. Protected files stay out of shared caches.
+func revalidateCacheControl(private bool) string {
+	if private {
+		return "private, no-cache"
+	}
+	return "public, no-cache"
+}
+
+// notModified reports whether the request's validators still match.
+// If-None-Match wins over If-Modified-Since, as RFC 9110 asks.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Header.Get("If-None-Match") != "" {
+		return etagMatches(r, etag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// serveCached sets the caching headers of a stored response and, when
+// the client's copy is current, answers 304 and returns true. A
+// Cache-Control set earlier, such as requireUnlocked's, is kept.
+func serveCached(w http.ResponseWriter, r *http.Request, etag string, modified time.Time, cacheControl string) bool {
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", cacheControl)
+	}
+	if !notModified(r, etag, modified) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// cacheRawFile handles the validators of a /raw/ response; it returns true
+// when it answered 304.
+func cacheRawFile(w http.ResponseWriter, r *http.Request, f *fileRecord, encoding string) bool {
+	if f.Metadata.Growing || f.Metadata.Storage == appendStore.Name() || burnsAfterDownload(f) {
+		return false
+	}
+	private := f.Metadata.PasswordHash != "" || f.Metadata.SignedOnly || f.Metadata.Visibility == visibilityPrivate
+	return serveCached(w, r, fileETag(f, encoding), f.UploadDate, revalidateCacheControl(private))
+}
+
+// derivedETag names a derived object; a new render gets a new id.
+func derivedETag(id primitive.ObjectID) string {
+	return `"d-` + id.Hex() + `"`
+}
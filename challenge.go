@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients flagged by the scraping detector are not banned from uploading.
+// Instead the upload endpoint asks them to either wait or solve a small
+// proof of work: find a solution such that sha256(challenge + ":" + solution)
+// starts with the configured number of zero bits. Regular users never see it.
+
+var (
+	challengeKey = make([]byte, 32)
+
+	usedChallengesMu sync.Mutex
+	usedChallenges   = map[string]time.Time{}
+)
+
+func initChallenge() {
+	configureChallenge(config())
+	rand.Read(challengeKey)
+}
+
+// configureChallenge applies defaults to c.Challenge; it runs again on
+// every config reload.
+func configureChallenge(c *Config) {
+	cfg := &c.Challenge
+	if cfg.Mode == "" {
+		cfg.Mode = "pow"
+	}
+	if cfg.Difficulty <= 0 {
+		cfg.Difficulty = 16
+	}
+	if cfg.DelaySeconds <= 0 {
+		cfg.DelaySeconds = 5
+	}
+	if cfg.TTLSeconds <= 0 {
+		cfg.TTLSeconds = 300
+	}
+}
+
+func signChallenge(ip, payload string) string {
+	mac := hmac.New(sha256.New, challengeKey)
+	mac.Write([]byte(ip + "|" + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newChallenge issues a token bound to the client IP: "<expiry>.<nonce>.<mac>".
+func newChallenge(ip string) string {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	expires := time.Now().Add(time.Duration(config().Challenge.TTLSeconds) * time.Second).Unix()
+	payload := strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(nonce)
+	return payload + "." + signChallenge(ip, payload)
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// verifyChallenge checks the token and solution and burns the token so one
+// solution cannot be replayed for further uploads.
+func verifyChallenge(ip, token, solution string) bool {
+	if token == "" || solution == "" || len(solution) > 64 {
+		return false
+	}
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	payload, mac := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(signChallenge(ip, payload))) {
+		return false
+	}
+	expiresText, _, _ := strings.Cut(payload, ".")
+	expires, err := strconv.ParseInt(expiresText, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+	if leadingZeroBits(sum[:]) < config().Challenge.Difficulty {
+		return false
+	}
+
+	usedChallengesMu.Lock()
+	defer usedChallengesMu.Unlock()
+	now := time.Now()
+	for t, exp := range usedChallenges {
+		if now.After(exp) {
+			delete(usedChallenges, t)
+		}
+	}
+	if _, used := usedChallenges[token]; used {
+		return false
+	}
+	usedChallenges[token] = time.Unix(expires, 0)
+	return true
+}
+
+// challengeGuard wraps upload endpoints. Flagged clients either wait out a
+// delay or must send X-Xyli-Challenge and X-Xyli-Solution headers.
+func challengeGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config().Challenge.Enabled || !config().Scraping.Enabled {
+			next(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if !scrapers.Flagged(ip) {
+			next(w, r)
+			return
+		}
+
+		if config().Challenge.Mode == "delay" {
+			select {
+			case <-time.After(time.Duration(config().Challenge.DelaySeconds) * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		if verifyChallenge(ip, r.Header.Get("X-Xyli-Challenge"), r.Header.Get("X-Xyli-Solution")) {
+			next(w, r)
+			return
+		}
+
+		// A solved challenge gets through right away; the reset is when the
+		// flag expires and no challenge is needed at all.
+		setRateLimited(w.Header(), 0, scrapers.FlaggedFor(ip))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      "Proof of work required",
+			"challenge":  newChallenge(ip),
+			"difficulty": config().Challenge.Difficulty,
+		})
+	}
+}
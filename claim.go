@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxClaimTokens bounds one claim request; the upload page keeps at most 50
+// uploads in its history.
+const maxClaimTokens = 100
+
+// deleteTokenFrom accepts a bare deletion token or a whole deletion link.
+func deleteTokenFrom(value string) string {
+	value = strings.TrimRight(strings.TrimSpace(value), "/")
+	if i := strings.LastIndex(value, "/delete/"); i >= 0 {
+		value = value[i+len("/delete/"):]
+	}
+	return value
+}
+
+// handleClaimUploads moves anonymous uploads into the logged-in account.
+// Holding the deletion token proves the upload was the user's; files that
+// already have an owner cannot be claimed this way.
+func handleClaimUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Tokens []string `json:"tokens"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || len(req.Tokens) == 0 || len(req.Tokens) > maxClaimTokens {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	type claimed struct {
+		ID       string `json:"id"`
+		Filename string `json:"filename"`
+		Link     string `json:"link"`
+	}
+	files := []claimed{}
+	for _, value := range req.Tokens {
+		token := deleteTokenFrom(value)
+		if token == "" {
+			continue
+		}
+		var doc fileRecord
+		err := findFile(ctx, bson.M{
+			"metadata.delete_token": token,
+			"metadata.owner_id":     bson.M{"$exists": false},
+			"metadata.expires_at":   notExpired(),
+		}, &doc)
+		if err == errFileNotFound {
+			continue
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		err = transferOwnership(ctx, &doc, user)
+		if isTierLimit(err) {
+			// Report what fitted; the rest stays anonymous.
+			if len(files) == 0 {
+				jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			break
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		files = append(files, claimed{doc.Metadata.ShortID, doc.Filename, doc.Link()})
+	}
+	if len(files) > 0 {
+		log.Printf("%s claimed %d anonymous uploads", user.Username, len(files))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"claimed": len(files), "files": files})
+}
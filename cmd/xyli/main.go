@@ -0,0 +1,344 @@
+// Command xyli uploads to and manages files on a XyliLoader instance.
+//
+//	xyli upload [-expires 1d] [-password p] [-name n] FILE...   ("-" reads stdin)
+//	xyli paste [-lang go] [-expires 1d] [FILE]                  (stdin without FILE)
+//	xyli list [-q text]
+//	xyli delete ID|DELETION-LINK...
+//
+// The server URL and API key come from XYLI_SERVER and XYLI_API_KEY, or from
+// the config.json the integrations page generates, kept in the user config
+// directory (~/.config/xyli/config.json on Linux) or at XYLI_CONFIG. Links
+// are printed to stdout, everything else to stderr, so the output pipes
+// cleanly: cat file | xyli upload - | xclip.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type clientConfig struct {
+	Server string `json:"server"`
+	APIKey string `json:"api_key"`
+}
+
+var cfg clientConfig
+
+func loadConfig() error {
+	path := os.Getenv("XYLI_CONFIG")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			path = filepath.Join(dir, "xyli", "config.json")
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &cfg); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+	if v := os.Getenv("XYLI_SERVER"); v != "" {
+		cfg.Server = v
+	}
+	if v := os.Getenv("XYLI_API_KEY"); v != "" {
+		cfg.APIKey = v
+	}
+	cfg.Server = strings.TrimRight(cfg.Server, "/")
+	if cfg.Server == "" {
+		return errors.New("no server configured: set XYLI_SERVER or download config.json from the integrations page")
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	if err := loadConfig(); err != nil {
+		fatal(err)
+	}
+
+	var err error
+	switch args := os.Args[2:]; os.Args[1] {
+	case "upload":
+		err = cmdUpload(args)
+	case "paste":
+		err = cmdPaste(args)
+	case "list", "ls":
+		err = cmdList(args)
+	case "delete", "rm":
+		err = cmdDelete(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: xyli upload|paste|list|delete [flags] [args]")
+	os.Exit(2)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "xyli:", err)
+	os.Exit(1)
+}
+
+// call sends a request to the server and decodes its JSON answer into v.
+func call(method, path, contentType string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, cfg.Server+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+	req.Header.Set("User-Agent", "xyli-cli")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+type uploadResult struct {
+	Link         string     `json:"link"`
+	DeletionLink string     `json:"deletion_link"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+}
+
+func (u *uploadResult) print() {
+	fmt.Println(u.Link)
+	fmt.Fprintln(os.Stderr, "delete:", u.DeletionLink)
+	if u.ExpiresAt != nil {
+		fmt.Fprintln(os.Stderr, "expires:", u.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+func cmdUpload(args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	expires := fs.String("expires", "", "lifetime such as 1h, 7d or never (account default when empty)")
+	password := fs.String("password", "", "password viewers must enter")
+	name := fs.String("name", "", "file name to store (default: the file's own, or stdin)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("upload: no files given (use - for stdin)")
+	}
+
+	for _, path := range fs.Args() {
+		res, err := uploadFile(path, *name, *expires, *password)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		res.print()
+	}
+	return nil
+}
+
+func uploadFile(path, name, expires, password string) (*uploadResult, error) {
+	var src io.Reader
+	size := int64(-1)
+	if path == "-" {
+		src = os.Stdin
+		if name == "" {
+			name = "stdin"
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil {
+			size = info.Size()
+		}
+		src = f
+		if name == "" {
+			name = filepath.Base(path)
+		}
+	}
+
+	// Stream the multipart body so large files and pipes are never held in
+	// memory.
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := writeUploadForm(mw, name, expires, password, newProgress(name, size, src))
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var res uploadResult
+	err := call(http.MethodPost, "/upload", mw.FormDataContentType(), pr, &res)
+	pr.Close()
+	return &res, err
+}
+
+func writeUploadForm(mw *multipart.Writer, name, expires, password string, src io.Reader) error {
+	fields := map[string]string{"expires": expires, "password": password}
+	for k, v := range fields {
+		if v != "" {
+			if err := mw.WriteField(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, src)
+	return err
+}
+
+func cmdPaste(args []string) error {
+	fs := flag.NewFlagSet("paste", flag.ExitOnError)
+	lang := fs.String("lang", "", "highlighting language (detected when empty)")
+	expires := fs.String("expires", "", "lifetime such as 1h, 7d or never (account default when empty)")
+	password := fs.String("password", "", "password viewers must enter")
+	fs.Parse(args)
+
+	src, filename := io.Reader(os.Stdin), ""
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src, filename = f, filepath.Base(path)
+	}
+	content, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"content":  string(content),
+		"language": *lang,
+		"filename": filename,
+		"expires":  *expires,
+		"password": *password,
+	})
+	var res uploadResult
+	if err := call(http.MethodPost, "/paste", "application/json", bytes.NewReader(body), &res); err != nil {
+		return err
+	}
+	res.print()
+	return nil
+}
+
+type listedFile struct {
+	ID           string     `json:"id"`
+	Filename     string     `json:"filename"`
+	SizeText     string     `json:"size_text"`
+	UploadedAt   time.Time  `json:"uploaded_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Link         string     `json:"link"`
+	DeletionLink string     `json:"deletion_link"`
+}
+
+func listFiles(query string) ([]listedFile, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("listing files needs an API key")
+	}
+	var res struct {
+		Files []listedFile `json:"files"`
+	}
+	path := "/api/dashboard/files"
+	if query != "" {
+		path += "?q=" + url.QueryEscape(query)
+	}
+	err := call(http.MethodGet, path, "", nil, &res)
+	return res.Files, err
+}
+
+func cmdList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	query := fs.String("q", "", "only files whose name or text contains this")
+	fs.Parse(args)
+
+	files, err := listFiles(*query)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Printf("%s\t%s\t%s\t%s\n", f.ID, f.UploadedAt.Local().Format("2006-01-02 15:04"), f.SizeText, f.Filename)
+	}
+	return nil
+}
+
+// cmdDelete takes deletion links or tokens, or IDs of the account's own
+// files.
+func cmdDelete(args []string) error {
+	if len(args) == 0 {
+		return errors.New("delete: nothing to delete")
+	}
+	var owned map[string]string
+	for _, arg := range args {
+		link := arg
+		if !strings.Contains(arg, "/delete/") {
+			if owned == nil {
+				files, err := listFiles("")
+				if err != nil {
+					return err
+				}
+				owned = map[string]string{}
+				for _, f := range files {
+					owned[f.ID] = f.DeletionLink
+				}
+			}
+			var ok bool
+			if link, ok = owned[strings.TrimPrefix(arg, cfg.Server+"/")]; !ok {
+				return fmt.Errorf("%s: no such file in your account", arg)
+			}
+		}
+		token := link[strings.LastIndex(link, "/delete/")+len("/delete/"):]
+		if err := call(http.MethodPost, "/delete/"+url.PathEscape(token), "", nil, nil); err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		fmt.Fprintln(os.Stderr, "deleted", arg)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// progress wraps an upload's source and draws a bar on stderr as it is
+// read. It stays silent when stderr is not a terminal, so scripts and logs
+// only see the links.
+type progress struct {
+	r     io.Reader
+	name  string
+	total int64 // -1 when unknown, as for stdin
+	done  int64
+	drawn time.Time
+}
+
+func newProgress(name string, total int64, r io.Reader) io.Reader {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return r
+	}
+	return &progress{r: r, name: name, total: total}
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if err != nil || time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw(err != nil)
+	}
+	return n, err
+}
+
+func (p *progress) draw(final bool) {
+	p.drawn = time.Now()
+	line := fmt.Sprintf("%s %s", p.name, formatSize(p.done))
+	if p.total > 0 {
+		const width = 30
+		filled := min(int(p.done*width/p.total), width)
+		line = fmt.Sprintf("%s [%s%s] %3d%% %s / %s", p.name, strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+			p.done*100/p.total, formatSize(p.done), formatSize(p.total))
+	}
+	end := ""
+	if final {
+		end = "\n"
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s%s", line, end)
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
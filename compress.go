@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// /raw/ compresses text-like files on the fly when the client accepts zstd
+// or gzip, which pays off for pastes, logs and JSON dumps. Only types on
+// the list below (and compression.types) qualify, so images, archives and
+// media, which are compressed already, go out as stored. Range requests
+// and end-to-end encrypted files are always served as stored, and so are
+// files outside compression.minSize..maxSize.
+
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"application/x-javascript",
+	"application/ecmascript",
+	"application/x-ndjson",
+	"application/x-yaml",
+	"application/yaml",
+	"application/toml",
+	"application/sql",
+	"application/x-sh",
+	"application/x-subrip",
+	"application/wasm",
+	"image/svg+xml",
+	"image/bmp",
+	"image/x-icon",
+	"font/ttf",
+	"font/otf",
+}
+
+func initCompression() {
+	cfg := &config().Compression
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = 1024
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 256 << 20
+	}
+}
+
+// compressible reports whether a file of this type and size is worth
+// compressing.
+func compressible(contentType string, size int64) bool {
+	cfg := config().Compression
+	if !cfg.Enabled || size < cfg.MinSize || size > cfg.MaxSize {
+		return false
+	}
+	mt := mediaType(contentType)
+	if strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml") {
+		return true
+	}
+	for _, t := range append(compressibleTypes, cfg.Types...) {
+		if mt == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mt, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks zstd or gzip from Accept-Encoding, preferring the
+// higher q-value and zstd on a tie. It returns "" for identity.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "zstd" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ || q == bestQ && q > 0 && name == "zstd" {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// countingWriter counts the bytes that reach the client.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeCompressed streams r to w with the given Content-Encoding and
+// returns the number of compressed bytes sent.
+func writeCompressed(w http.ResponseWriter, r io.Reader, encoding string) int64 {
+	out := &countingWriter{w: w}
+	var enc io.WriteCloser
+	if encoding == "zstd" {
+		zw, err := zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return 0
+		}
+		enc = zw
+	} else {
+		enc = gzip.NewWriter(out)
+	}
+	io.Copy(enc, r)
+	enc.Close()
+	return out.n
+}
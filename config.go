@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration comes from three layers: built-in defaults, a config file
+// (optional since every setting can come from the environment) and XYLI_*
+// environment variables, which win. The file is the one named by --config
+// or XYLI_CONFIG, or else the first of config.json, config.yaml, config.yml
+// and config.toml that exists; YAML and TOML use the same keys as JSON. A
+// variable is named after the JSON path of its field: upload.maxSize is
+// XYLI_UPLOAD_MAX_SIZE, storage.s3.accessKey is XYLI_STORAGE_S3_ACCESS_KEY.
+// Lists of strings are comma separated; anything more structured (viewers,
+// tiers.definitions) is given as JSON. Variables may also be put in a .env
+// file.
+
+const envPrefix = "XYLI"
+
+var (
+	configFlag      = flag.String("config", "", "path to the config file (.json, .yaml, .yml or .toml)")
+	configFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+)
+
+// configPath returns the config file to read, or "" if there is none.
+func configPath() string {
+	if *configFlag != "" {
+		return *configFlag
+	}
+	if path := os.Getenv(envPrefix + "_CONFIG"); path != "" {
+		return path
+	}
+	for _, name := range configFileNames {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// decodeConfigFile reads a config file into c according to its extension.
+// YAML and TOML are converted to JSON first, so the json tags on Config
+// remain the only definition of the keys.
+func decodeConfigFile(path string, c *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return json.Unmarshal(data, c)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return fmt.Errorf("unknown config format %q, use .json, .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return err
+	}
+	converted, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(converted, c)
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.MongoDB.Database = "xyliloader"
+	c.Server.Port = 3000
+	c.Server.Host = "0.0.0.0"
+	c.Upload.MaxSize = 100 << 20
+	c.Display.SizeUnits = "iec"
+	return c
+}
+
+// loadConfig fills config from the defaults, config.json and the environment
+// and validates the result.
+func loadConfig() error {
+	c, err := readConfig()
+	if err != nil {
+		return err
+	}
+	loadedConfig = c
+	currentConfig.Store(&c)
+	return nil
+}
+
+func readConfig() (Config, error) {
+	c := defaultConfig()
+
+	path := configPath()
+	if path == "" {
+		log.Printf("No config file found, using defaults and %s_* environment variables", envPrefix)
+	} else if err := decodeConfigFile(path, &c); err != nil {
+		return c, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := applyEnv(reflect.ValueOf(&c).Elem(), envPrefix); err != nil {
+		return c, err
+	}
+	return c, validateConfig(&c)
+}
+
+// envName turns a JSON key into its environment variable segment:
+// "maxSize" -> "MAX_SIZE", "baseURL" -> "BASE_URL".
+func envName(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnv overrides the fields of the struct v from variables named
+// prefix_<FIELD>, descending into nested sections.
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	var errs []error
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + envName(key)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), name); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(v.Field(i), value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func setFromEnv(f reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "[") {
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			f.Set(reflect.ValueOf(list))
+			return nil
+		}
+		fallthrough
+	default:
+		fresh := reflect.New(f.Type())
+		if err := json.Unmarshal([]byte(value), fresh.Interface()); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+		f.Set(fresh.Elem())
+	}
+	return nil
+}
+
+// validateConfig reports every invalid or missing setting at once, naming
+// both the config.json key and the environment variable.
+func validateConfig(c *Config) error {
+	var errs []error
+	invalid := func(path, format string, args ...interface{}) {
+		env := envPrefix
+		for _, key := range strings.Split(path, ".") {
+			env += "_" + envName(key)
+		}
+		errs = append(errs, fmt.Errorf("%s (%s): %s", path, env, fmt.Sprintf(format, args...)))
+	}
+
+	if c.MongoDB.URI == "" {
+		invalid("mongodb.uri", "is required")
+	}
+	if c.MongoDB.Database == "" {
+		invalid("mongodb.database", "is required")
+	}
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		invalid("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Upload.MaxSize <= 0 {
+		invalid("upload.maxSize", "must be positive, got %d", c.Upload.MaxSize)
+	}
+	if base := c.Upload.BaseURL; base != "" {
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("upload.baseURL", "must be an absolute http(s) URL, got %q", base)
+		}
+	}
+	if c.Display.SizeUnits != "iec" && c.Display.SizeUnits != "si" {
+		invalid("display.sizeUnits", "must be iec or si, got %q", c.Display.SizeUnits)
+	}
+	if _, err := parseExpiry(c.Upload.DefaultExpiry); err != nil {
+		invalid("upload.defaultExpiry", "invalid duration %q", c.Upload.DefaultExpiry)
+	}
+	if _, err := parseExpiry(c.Upload.MaxExpiry); err != nil {
+		invalid("upload.maxExpiry", "invalid duration %q", c.Upload.MaxExpiry)
+	}
+	if _, err := parseExpiry(c.Upload.PasteDefaultExpiry); err != nil {
+		invalid("upload.pasteDefaultExpiry", "invalid duration %q", c.Upload.PasteDefaultExpiry)
+	}
+	if _, err := parseExpiry(c.Upload.PasteMaxExpiry); err != nil {
+		invalid("upload.pasteMaxExpiry", "invalid duration %q", c.Upload.PasteMaxExpiry)
+	}
+	switch c.Storage.Backend {
+	case "", "gridfs", "disk", "s3":
+	default:
+		invalid("storage.backend", "must be gridfs, disk or s3, got %q", c.Storage.Backend)
+	}
+	if c.Status.StorageCapacity < 0 {
+		invalid("status.storageCapacity", "must not be negative")
+	}
+	return errors.Join(errs...)
+}
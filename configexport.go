@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admins can move an instance's setup to another one, from staging to
+// production or onto a rebuilt server, as a single JSON document:
+//
+//	GET  /api/admin/config/export   the effective configuration with secrets
+//	                                redacted, plus the policies kept in the
+//	                                database (coupons) and the feature flags
+//	POST /api/admin/config/import   apply such a document
+//
+// Import keeps this instance's own value wherever the document says
+// "<redacted>", so secrets never travel. When the config file is JSON (or
+// there is none yet), the merged configuration is written to it, the old
+// file is kept as .bak and the configuration is reloaded; a YAML or TOML
+// file is left alone and the merged configuration is returned to save by
+// hand. Coupons are created or updated by code; their redemption counts
+// stay those of this instance.
+
+const (
+	exportFormat = "xyliloader-export"
+	redacted     = "<redacted>"
+)
+
+type instanceExport struct {
+	Format        string                 `json:"format"`
+	Version       int                    `json:"version"`
+	ExportedAt    time.Time              `json:"exported_at"`
+	ServerVersion string                 `json:"server_version"`
+	Config        map[string]interface{} `json:"config"`
+	Policies      struct {
+		Features map[string]bool `json:"features"`
+		Coupons  []Coupon        `json:"coupons"`
+	} `json:"policies"`
+}
+
+// secretKey reports whether a config key holds a credential.
+func secretKey(key string) bool {
+	k := strings.ToLower(key)
+	switch {
+	case strings.Contains(k, "secret"), strings.Contains(k, "password"), strings.Contains(k, "token"):
+		return true
+	case k == "uri", k == "webhookurl":
+		return true
+	}
+	return strings.HasSuffix(k, "key") && k != "publickey"
+}
+
+// redactConfig replaces credentials in a decoded config document, and
+// strips user info from URLs.
+func redactConfig(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok && secretKey(k) {
+				if s != "" {
+					v[k] = redacted
+				}
+				continue
+			}
+			v[k] = redactConfig(child)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactConfig(v[i])
+		}
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil && u.Host != "" {
+			u.User = nil
+			return u.String()
+		}
+	}
+	return v
+}
+
+// restoreSecrets puts this instance's values back where the imported
+// document has "<redacted>".
+func restoreSecrets(imported, current interface{}) interface{} {
+	switch v := imported.(type) {
+	case map[string]interface{}:
+		cur, _ := current.(map[string]interface{})
+		for k, child := range v {
+			v[k] = restoreSecrets(child, cur[k])
+		}
+	case []interface{}:
+		cur, _ := current.([]interface{})
+		for i := range v {
+			var c interface{}
+			if i < len(cur) {
+				c = cur[i]
+			}
+			v[i] = restoreSecrets(v[i], c)
+		}
+	case string:
+		if v == redacted {
+			if s, ok := current.(string); ok {
+				return s
+			}
+			return ""
+		}
+	}
+	return imported
+}
+
+// configDocument decodes a Config into a generic document.
+func configDocument(c Config) (map[string]interface{}, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	return doc, json.Unmarshal(data, &doc)
+}
+
+func handleConfigExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	doc, err := configDocument(*config())
+	if err != nil {
+		jsonError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	export := instanceExport{
+		Format:        exportFormat,
+		Version:       1,
+		ExportedAt:    time.Now().UTC(),
+		ServerVersion: serverVersion(),
+		Config:        redactConfig(doc).(map[string]interface{}),
+	}
+	export.Policies.Features = apiFeatures()
+
+	cursor, err := couponsColl.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	dbBreaker.Record(err)
+	export.Policies.Coupons = []Coupon{}
+	if err == nil {
+		err = cursor.All(ctx, &export.Policies.Coupons)
+		dbBreaker.Record(err)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="xyliloader-%s.json"`, export.ExportedAt.Format("2006-01-02")))
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(export)
+}
+
+func handleConfigImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := requireAdmin(w, r, true)
+	if admin == nil {
+		return
+	}
+
+	var doc instanceExport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<20)).Decode(&doc); err != nil {
+		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if doc.Format != exportFormat || doc.Version != 1 {
+		jsonError(w, "Not a XyliLoader export", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	result := map[string]interface{}{}
+	if doc.Config != nil {
+		current, err := configDocument(*config())
+		if err != nil {
+			jsonError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		merged := restoreSecrets(doc.Config, current)
+		data, err := json.MarshalIndent(merged, "", "  ")
+		if err != nil {
+			jsonError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		check := defaultConfig()
+		if err := json.Unmarshal(data, &check); err != nil {
+			jsonError(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateConfig(&check); err != nil {
+			jsonError(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		path := configPath()
+		if path == "" {
+			path = configFileNames[0]
+		}
+		if strings.ToLower(filepath.Ext(path)) != ".json" {
+			result["config_written"] = false
+			result["config"] = merged
+		} else {
+			if err := writeConfigFile(path, data); err != nil {
+				log.Printf("Error writing imported config to %s: %v", path, err)
+				jsonError(w, "Cannot write the config file", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Config imported into %s by %s", path, admin.Username)
+			restart, err := reloadConfig()
+			logReload(restart, err)
+			if err != nil {
+				jsonError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if restart == nil {
+				restart = []string{}
+			}
+			result["config_written"] = true
+			result["restart_required"] = restart
+		}
+	}
+
+	imported := 0
+	for _, c := range doc.Policies.Coupons {
+		if c.Code == "" {
+			continue
+		}
+		_, err := couponsColl.UpdateOne(ctx, bson.M{"_id": c.Code}, bson.M{
+			"$set": bson.M{
+				"note":            c.Note,
+				"extra_storage":   c.ExtraStorage,
+				"extra_files":     c.ExtraFiles,
+				"tier":            c.Tier,
+				"duration_days":   c.DurationDays,
+				"max_redemptions": c.MaxRedemptions,
+				"valid_until":     c.ValidUntil,
+				"disabled":        c.Disabled,
+			},
+			"$setOnInsert": bson.M{
+				"redemptions": 0,
+				"created_by":  admin.Username,
+				"created_at":  time.Now(),
+			},
+		}, options.Update().SetUpsert(true))
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		imported++
+	}
+	result["coupons_imported"] = imported
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeConfigFile replaces the config file, keeping the previous one as
+// .bak, and never leaves a half-written file behind.
+func writeConfigFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	if old, err := os.ReadFile(path); err == nil {
+		if err := os.WriteFile(path+".bak", old, 0o600); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Coupons are codes an admin hands out to give accounts a temporary boost:
+// extra storage or files on top of their tier, a better tier altogether, or
+// both. Each redemption lasts DurationDays; a code can be redeemed at most
+// MaxRedemptions times, at most once per account, and not after ValidUntil.
+
+type Coupon struct {
+	Code           string     `bson:"_id" json:"code"`
+	Note           string     `bson:"note,omitempty" json:"note,omitempty"`
+	ExtraStorage   int64      `bson:"extra_storage,omitempty" json:"extra_storage,omitempty"`
+	ExtraFiles     int64      `bson:"extra_files,omitempty" json:"extra_files,omitempty"`
+	Tier           string     `bson:"tier,omitempty" json:"tier,omitempty"`
+	DurationDays   int        `bson:"duration_days" json:"duration_days"`
+	MaxRedemptions int        `bson:"max_redemptions" json:"max_redemptions"`
+	Redemptions    int        `bson:"redemptions" json:"redemptions"`
+	ValidUntil     *time.Time `bson:"valid_until,omitempty" json:"valid_until,omitempty"`
+	Disabled       bool       `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	CreatedBy      string     `bson:"created_by" json:"created_by"`
+	CreatedAt      time.Time  `bson:"created_at" json:"created_at"`
+}
+
+// boost is one redemption of a coupon by an account.
+type boost struct {
+	Code         string             `bson:"code" json:"code"`
+	UserID       primitive.ObjectID `bson:"user_id" json:"-"`
+	ExtraStorage int64              `bson:"extra_storage,omitempty" json:"extra_storage,omitempty"`
+	ExtraFiles   int64              `bson:"extra_files,omitempty" json:"extra_files,omitempty"`
+	Tier         string             `bson:"tier,omitempty" json:"tier,omitempty"`
+	RedeemedAt   time.Time          `bson:"redeemed_at" json:"redeemed_at"`
+	Until        time.Time          `bson:"until" json:"until"`
+}
+
+var (
+	couponsColl *mongo.Collection
+	boostsColl  *mongo.Collection
+)
+
+func initCoupons(ctx context.Context) {
+	couponsColl = db.Collection("coupons")
+	boostsColl = db.Collection("boosts")
+	_, err := boostsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "code", Value: 1}, {Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "until", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Error creating boosts index: %v", err)
+	}
+}
+
+func activeBoosts(ctx context.Context, userID primitive.ObjectID) ([]boost, error) {
+	cursor, err := boostsColl.Find(ctx, bson.M{"user_id": userID, "until": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "until", Value: 1}}))
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	boosts := []boost{}
+	err = cursor.All(ctx, &boosts)
+	return boosts, err
+}
+
+// effectiveTier is tierFor with the user's active boosts applied. A boosted
+// tier replaces the account's own while it lasts, the latest-ending one
+// winning; extra storage and files add up on top of whichever tier applies.
+func effectiveTier(ctx context.Context, user *User) (string, *Tier) {
+	name, base := tierFor(user)
+	boosts, err := activeBoosts(ctx, user.ID)
+	if err != nil || len(boosts) == 0 {
+		return name, base
+	}
+
+	for _, b := range boosts {
+		if t := config().Tiers.Definitions[b.Tier]; t != nil {
+			name, base = b.Tier, t
+		}
+	}
+	tier := *base
+	for _, b := range boosts {
+		if tier.MaxStorage > 0 {
+			tier.MaxStorage += b.ExtraStorage
+		}
+		if tier.MaxFiles > 0 {
+			tier.MaxFiles += b.ExtraFiles
+		}
+	}
+	return name, &tier
+}
+
+// handleAdminCoupons lists (GET), creates (POST) and disables
+// (DELETE ?code=) coupons.
+func handleAdminCoupons(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r, true)
+	if admin == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		cursor, err := couponsColl.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(200))
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		coupons := []Coupon{}
+		if err := cursor.All(ctx, &coupons); err != nil {
+			jsonError(w, "Decode error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"coupons": coupons})
+
+	case http.MethodPost:
+		var c Coupon
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		c.Code = strings.ToUpper(strings.TrimSpace(c.Code))
+		if c.Code == "" {
+			c.Code = randomString("ABCDEFGHJKLMNPQRSTUVWXYZ23456789", 10)
+		}
+		if c.ExtraStorage < 0 || c.ExtraFiles < 0 || c.DurationDays <= 0 {
+			jsonError(w, "Invalid boost", http.StatusBadRequest)
+			return
+		}
+		if c.Tier != "" && config().Tiers.Definitions[c.Tier] == nil {
+			jsonError(w, "Unknown tier", http.StatusBadRequest)
+			return
+		}
+		if c.ExtraStorage == 0 && c.ExtraFiles == 0 && c.Tier == "" {
+			jsonError(w, "Coupon grants nothing", http.StatusBadRequest)
+			return
+		}
+		if c.MaxRedemptions <= 0 {
+			c.MaxRedemptions = 1
+		}
+		c.Redemptions, c.Disabled = 0, false
+		c.CreatedBy, c.CreatedAt = admin.Username, time.Now()
+
+		_, err := couponsColl.InsertOne(ctx, c)
+		dbBreaker.Record(err)
+		if mongo.IsDuplicateKeyError(err) {
+			jsonError(w, "Code already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodDelete:
+		code := strings.ToUpper(r.URL.Query().Get("code"))
+		res, err := couponsColl.UpdateOne(ctx, bson.M{"_id": code}, bson.M{"$set": bson.M{"disabled": true}})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if res.MatchedCount == 0 {
+			jsonError(w, "Coupon not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "disabled"})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRedeemCoupon applies a coupon to the signed-in account.
+func handleRedeemCoupon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	// Claim a redemption first so concurrent redeems cannot exceed the limit.
+	var c Coupon
+	err := couponsColl.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":         code,
+			"disabled":    bson.M{"$ne": true},
+			"valid_until": bson.M{"$not": bson.M{"$lte": time.Now()}},
+			"$expr":       bson.M{"$lt": bson.A{"$redemptions", "$max_redemptions"}},
+		},
+		bson.M{"$inc": bson.M{"redemptions": 1}},
+	).Decode(&c)
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		jsonError(w, "Invalid or expired code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	b := boost{
+		Code:         c.Code,
+		UserID:       user.ID,
+		ExtraStorage: c.ExtraStorage,
+		ExtraFiles:   c.ExtraFiles,
+		Tier:         c.Tier,
+		RedeemedAt:   now,
+		Until:        now.AddDate(0, 0, c.DurationDays),
+	}
+	_, err = boostsColl.InsertOne(ctx, b)
+	dbBreaker.Record(err)
+	if err != nil {
+		_, undoErr := couponsColl.UpdateOne(context.WithoutCancel(ctx), bson.M{"_id": c.Code}, bson.M{"$inc": bson.M{"redemptions": -1}})
+		dbBreaker.Record(undoErr)
+		if mongo.IsDuplicateKeyError(err) {
+			jsonError(w, "Code already redeemed", http.StatusConflict)
+			return
+		}
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
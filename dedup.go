@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every upload records the SHA-256 of its content in metadata.sha256, plus
+// metadata.md5 and metadata.sha1 when enabled. With deduplication enabled,
+// an upload whose content already exists keeps its own short ID and delete
+// token but points at the existing bytes through metadata.content_id instead
+// of storing a second copy.
+//
+// The document that holds the bytes counts its references in metadata.refs,
+// itself included. Deleting it while other uploads still reference it only
+// strips its identity and marks it as a blob holder; the bytes go away with
+// the last reference.
+
+func initDedup(ctx context.Context) {
+	_, err := gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "metadata.sha256", Value: 1}, {Key: "length", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"metadata.refs": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Error creating sha256 index: %v", err)
+	}
+}
+
+// putContent stores an upload through the configured backend, recording its
+// checksums, scanning it when antivirus is enabled and folding it into an
+// identical existing file when possible. The checksums are also left in
+// metadata for the caller.
+func putContent(ctx context.Context, id primitive.ObjectID, filename string, r io.Reader, metadata bson.M) (int64, error) {
+	hashes := map[string]hash.Hash{"sha256": sha256.New()}
+	if config().Checksums.MD5 {
+		hashes["md5"] = md5.New()
+	}
+	if config().Checksums.SHA1 {
+		hashes["sha1"] = sha1.New()
+	}
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+
+	var scan *clamScan
+	if config().Antivirus.Enabled {
+		var err error
+		scan, err = startScan()
+		if err != nil {
+			log.Printf("Error connecting to clamd: %v", err)
+			if !config().Antivirus.FailOpen {
+				return 0, errScannerUnavailable
+			}
+		} else {
+			defer scan.Close()
+			writers = append(writers, scan)
+		}
+	}
+
+	n, err := store.Put(ctx, id, filename, io.TeeReader(r, io.MultiWriter(writers...)), metadata)
+	if err != nil {
+		return n, err
+	}
+	set := bson.M{}
+	for name, h := range hashes {
+		sum := hex.EncodeToString(h.Sum(nil))
+		metadata[name] = sum
+		set["metadata."+name] = sum
+	}
+	sum := metadata["sha256"].(string)
+
+	if scan != nil {
+		signature, err := scan.Verdict()
+		if err != nil {
+			log.Printf("Error scanning upload %v: %v", metadata["short_id"], err)
+			if !config().Antivirus.FailOpen {
+				store.Delete(ctx, id)
+				return n, errScannerUnavailable
+			}
+		}
+		if signature != "" {
+			_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+			dbBreaker.Record(err)
+			return n, handleInfected(ctx, id, filename, n, signature, metadata)
+		}
+	}
+
+	if config().Dedup.Enabled {
+		deduped, err := deduplicate(ctx, id, filename, n, sum, metadata)
+		if deduped || err != nil {
+			return n, err
+		}
+		set["metadata.refs"] = 1
+	}
+
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	dbBreaker.Record(err)
+	return n, err
+}
+
+// deduplicate replaces the freshly stored file id with a reference to an
+// older file with the same content, if there is one.
+func deduplicate(ctx context.Context, id primitive.ObjectID, filename string, length int64, sum string, metadata bson.M) (bool, error) {
+	var original fileRecord
+	err := gfsBucket.GetFilesCollection().FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":             bson.M{"$ne": id},
+			"length":          length,
+			"metadata.sha256": sum,
+			"metadata.refs":   bson.M{"$gt": 0},
+		},
+		bson.M{"$inc": bson.M{"metadata.refs": 1}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "_id", Value: 1}}),
+	).Decode(&original)
+	dbBreaker.Record(err)
+	if err != nil {
+		return false, nil
+	}
+
+	if err := store.Delete(ctx, id); err != nil {
+		// Keep the duplicate rather than risk losing the upload.
+		releaseContent(ctx, original.ID)
+		return false, nil
+	}
+
+	backend := original.Metadata.Storage
+	if backend == "" {
+		backend = "gridfs"
+	}
+	metadata["content_id"] = original.ID
+	delete(metadata, "refs")
+	if err := insertFileDoc(ctx, id, filename, length, metadata, backend); err != nil {
+		releaseContent(ctx, original.ID)
+		return true, err
+	}
+	return true, nil
+}
+
+// releaseContent drops one reference to a content document and deletes the
+// bytes once nothing references them any more.
+func releaseContent(ctx context.Context, contentID primitive.ObjectID) error {
+	var holder struct {
+		Metadata struct {
+			Refs       int    `bson:"refs"`
+			BlobHolder bool   `bson:"blob_holder"`
+			Storage    string `bson:"storage"`
+		} `bson:"metadata"`
+	}
+	err := gfsBucket.GetFilesCollection().FindOneAndUpdate(ctx,
+		bson.M{"_id": contentID},
+		bson.M{"$inc": bson.M{"metadata.refs": -1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&holder)
+	dbBreaker.Record(err)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+	if holder.Metadata.Refs > 0 || !holder.Metadata.BlobHolder {
+		return nil
+	}
+
+	s, err := storageFor(holder.Metadata.Storage)
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, contentID)
+}
+
+// retireSharedContent turns a file that other uploads still reference into a
+// bare blob holder. It reports false when the file is not shared; its last
+// reference is then claimed (refs set to 0), so that no upload deduplicates
+// against content that is about to be deleted.
+func retireSharedContent(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	files := gfsBucket.GetFilesCollection()
+	for {
+		res, err := files.UpdateOne(ctx,
+			bson.M{"_id": id, "metadata.refs": bson.M{"$gt": 1}},
+			bson.M{
+				"$inc": bson.M{"metadata.refs": -1},
+				"$set": bson.M{"metadata.blob_holder": true},
+				"$unset": bson.M{
+					"metadata.short_id":     "",
+					"metadata.delete_token": "",
+					"metadata.owner_id":     "",
+					"metadata.api_key_id":   "",
+					"metadata.expires_at":   "",
+					"metadata.s3_bucket":    "",
+					"metadata.s3_key":       "",
+					"metadata.s3_etag":      "",
+				},
+			},
+		)
+		dbBreaker.Record(err)
+		if err != nil {
+			return false, err
+		}
+		if res.ModifiedCount > 0 {
+			return true, nil
+		}
+
+		res, err = files.UpdateOne(ctx,
+			bson.M{"_id": id, "metadata.refs": 1},
+			bson.M{"$set": bson.M{"metadata.refs": 0}},
+		)
+		dbBreaker.Record(err)
+		if err != nil || res.MatchedCount > 0 {
+			return false, err
+		}
+		// Either the file never had references, or an upload was just
+		// deduplicated against it and it is shared after all.
+		shared, err := files.CountDocuments(ctx, bson.M{"_id": id, "metadata.refs": bson.M{"$gt": 1}})
+		dbBreaker.Record(err)
+		if err != nil || shared == 0 {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Users can keep defaults for their uploads on their account, in the
+// defaults field of their user document. They apply whenever the request
+// does not set a value of its own, to uploads from the web page and the API
+// (files, /u, the helper, pastes, streams and imports), gRPC, WebDAV and
+// SFTP, with these exceptions:
+//
+//   - EXIF is not stripped from pastes, CI artifacts, streams (their bytes
+//     arrive in pieces) or end-to-end encrypted uploads.
+//   - S3 and Git LFS objects are left alone, and registry blobs only get
+//     the default expiry: those clients expect their objects back byte for
+//     byte, with their own credentials, until they delete them.
+//   - Discord uploads are anonymous, so there is no account to take
+//     defaults from.
+
+type UploadDefaults struct {
+	Expires      string `bson:"expires,omitempty"`
+	PasswordHash string `bson:"password_hash,omitempty"`
+	StripEXIF    bool   `bson:"strip_exif,omitempty"`
+	Visibility   string `bson:"visibility,omitempty"`
+}
+
+// defaultExpires returns the lifetime to use when the request asked for
+// none.
+func defaultExpires(user *User, requested string) string {
+	if requested == "" && user != nil {
+		return user.Defaults.Expires
+	}
+	return requested
+}
+
+// uploadPasswordHash is hashFilePassword with the account's default
+// password as the fallback.
+func uploadPasswordHash(user *User, password string) (string, error) {
+	if password == "" && user != nil {
+		return user.Defaults.PasswordHash, nil
+	}
+	return hashFilePassword(password)
+}
+
+var errInvalidStripEXIF = errors.New("invalid strip_exif value")
+
+// uploadStripEXIF reports whether an upload's image metadata is to be
+// removed (see exif.go), with the account's default as the fallback.
+func uploadStripEXIF(user *User, requested string) (bool, error) {
+	if requested == "" {
+		return user != nil && user.Defaults.StripEXIF, nil
+	}
+	strip, err := strconv.ParseBool(requested)
+	if err != nil {
+		return false, errInvalidStripEXIF
+	}
+	return strip, nil
+}
+
+// uploadVisibility returns the visibility to store for an upload, with the
+// account's default as the fallback.
+func uploadVisibility(user *User, requested string) (string, error) {
+	if requested == "" && user != nil {
+		return user.Defaults.Visibility, nil
+	}
+	visibility, err := parseVisibility(requested)
+	if err == nil && visibility == visibilityPrivate && user == nil {
+		err = errPrivateAnonymous
+	}
+	return visibility, err
+}
+
+// handleAccountDefaults shows (GET) or changes (PUT) the upload defaults of
+// the logged-in user. Fields a PUT leaves out keep their current value. The
+// password is write-only; an empty "password" keeps the current one and
+// "clear_password" removes it.
+func handleAccountDefaults(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Expires       *string `json:"expires"`
+			Password      string  `json:"password"`
+			ClearPassword bool    `json:"clear_password"`
+			StripEXIF     *bool   `json:"strip_exif"`
+			Visibility    *string `json:"visibility"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		defaults := user.Defaults
+		if req.Expires != nil {
+			defaults.Expires = strings.TrimSpace(strings.ToLower(*req.Expires))
+			if _, err := parseExpiry(defaults.Expires); err != nil {
+				jsonError(w, "Invalid expires value", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.StripEXIF != nil {
+			defaults.StripEXIF = *req.StripEXIF
+		}
+		if req.Visibility != nil {
+			visibility, err := parseVisibility(*req.Visibility)
+			if err != nil {
+				jsonError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defaults.Visibility = visibility
+		}
+		switch {
+		case req.ClearPassword:
+			defaults.PasswordHash = ""
+		case req.Password != "":
+			hash, err := hashFilePassword(req.Password)
+			if err == errPasswordTooLong {
+				jsonError(w, "Password too long", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				jsonError(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			defaults.PasswordHash = hash
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		_, err := usersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"defaults": defaults}})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		user.Defaults = defaults
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"expires":      user.Defaults.Expires,
+		"password_set": user.Defaults.PasswordHash != "",
+		"strip_exif":   user.Defaults.StripEXIF,
+		"visibility":   visibilityOrPublic(user.Defaults.Visibility),
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Owners manage what the server made from their files (thumbnails, video
+// posters, document previews and the cached /img/ and /raw/?q= variants)
+// without touching the file itself:
+//
+//	GET    /api/dashboard/files/derivatives?id=         lists them
+//	DELETE /api/dashboard/files/derivatives?id=&kind=   deletes them
+//	POST   /api/dashboard/files/derivatives {"id", "kind"}  deletes and
+//	       makes them again with the current settings
+//
+// kind is thumb, poster, preview or variants; without it every kind is
+// affected. Deleted derivatives are also made again on their next request.
+
+var derivativeKinds = []string{"thumb", "poster", "preview", "variants"}
+
+type derivativeInfo struct {
+	Kind        string    `json:"kind"`
+	Variant     string    `json:"variant"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// fileDerivatives lists the stored derivatives of f, of one kind or all.
+func fileDerivatives(ctx context.Context, f *fileRecord, kind string) ([]fileRecord, error) {
+	filter := bson.M{"metadata.derived_from": f.ID}
+	if kind != "" {
+		filter["metadata.derivative"] = kind
+	}
+	cursor, err := gfsBucket.FindContext(ctx, filter)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	var derived []fileRecord
+	err = cursor.All(ctx, &derived)
+	dbBreaker.Record(err)
+	return derived, err
+}
+
+// dropDerivatives deletes the derivatives of f and returns how many stored
+// objects went and how many bytes that freed.
+func dropDerivatives(ctx context.Context, f *fileRecord, kind string) (int, int64, error) {
+	var count int
+	var freed int64
+	if kind == "" || kind == "variants" {
+		freed += transformCache.Purge(f.Metadata.ShortID + "/")
+	}
+	if kind == "variants" {
+		return count, freed, nil
+	}
+	derived, err := fileDerivatives(ctx, f, kind)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := range derived {
+		if err := deleteStoredFile(ctx, &derived[i]); err != nil {
+			return count, freed, err
+		}
+		count++
+		freed += derived[i].Length
+	}
+	return count, freed, nil
+}
+
+// remakeDerivatives queues the derivatives of f that apply to it.
+func remakeDerivatives(f *fileRecord, kind string) {
+	if (kind == "" || kind == "thumb") && thumbnailable(f.Metadata.ContentType) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			defer cancel()
+			if _, err := thumbnailFor(ctx, f); err != nil {
+				log.Printf("Thumbnail failed for %s: %v", f.Metadata.ShortID, err)
+			}
+		}()
+	}
+	if kind == "" || kind == "poster" {
+		queuePoster(f.ID, f.Metadata.ContentType)
+	}
+	if kind == "" || kind == "preview" {
+		queuePreview(f.ID, f.Filename, f.Length)
+	}
+}
+
+func handleFileDerivatives(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, kind := r.URL.Query().Get("id"), r.URL.Query().Get("kind")
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+	case http.MethodPost:
+		var req struct {
+			ID   string `json:"id"`
+			Kind string `json:"kind"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		id, kind = req.ID, req.Kind
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind = strings.ToLower(kind)
+	if id == "" {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if kind != "" && !containsString(derivativeKinds, kind) {
+		jsonError(w, "Invalid kind", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	doc, err := findManagedFile(ctx, user, id)
+	if err == errFileNotFound {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		derived, err := fileDerivatives(ctx, doc, kind)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		list := make([]derivativeInfo, 0, len(derived))
+		var total int64
+		for _, d := range derived {
+			list = append(list, derivativeInfo{
+				Kind:        d.Metadata.Derivative,
+				Variant:     d.Metadata.Variant,
+				Size:        d.Length,
+				ContentType: d.Metadata.ContentType,
+				CreatedAt:   d.UploadDate,
+			})
+			total += d.Length
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":          id,
+			"derivatives": list,
+			"total_size":  total,
+		})
+		return
+	}
+
+	count, freed, err := dropDerivatives(ctx, doc, kind)
+	if err != nil {
+		jsonError(w, "Delete error", http.StatusInternalServerError)
+		return
+	}
+	status := "deleted"
+	if r.Method == http.MethodPost {
+		remakeDerivatives(doc, kind)
+		status = "regenerating"
+	}
+	if doc.Metadata.OwnerID != user.ID {
+		log.Printf("Admin %s dropped %s derivatives of %s", user.Username, orDefault(kind, "all"), id)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":          id,
+		"status":      status,
+		"deleted":     count,
+		"freed_bytes": freed,
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// An owner (or an admin) can take a link offline without deleting the file
+// by setting metadata.disabled. The viewer page and /raw/ then show a page
+// saying the owner disabled it, previews are refused, and turning it back
+// on restores the same URL.
+
+// serveDisabled answers for a link its owner has disabled.
+func serveDisabled(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+
+	loc := requestLocale(r)
+	tmpl := template.Must(template.ParseFiles("templates/disabled.html"))
+	tmpl.Execute(w, struct {
+		Lang string
+		Text *disabledText
+	}{loc.tag, &loc.disabled})
+}
+
+// requireEnabled answers 403 and returns false for previews and other
+// derived content of a disabled file.
+func requireEnabled(w http.ResponseWriter, f *fileRecord) bool {
+	if !f.Metadata.Disabled {
+		return true
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "disabled by owner", http.StatusForbidden)
+	return false
+}
+
+// handleFileDisable turns a link off or back on.
+func handleFileDisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID       string `json:"id"`
+		Disabled bool   `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	doc, err := findManagedFile(ctx, user, req.ID)
+	if err == errFileNotFound {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"metadata.disabled": true}}
+	if !req.Disabled {
+		update = bson.M{"$unset": bson.M{"metadata.disabled": ""}}
+	}
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": doc.ID}, update)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if doc.Metadata.OwnerID != user.ID {
+		log.Printf("Admin %s set disabled=%t on %s", user.Username, req.Disabled, req.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       req.ID,
+		"disabled": req.Disabled,
+	})
+}
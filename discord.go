@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The Discord bot works over Discord's HTTP interactions, so it needs no
+// gateway connection: point the application's Interactions Endpoint URL at
+// /discord/interactions. At startup the bot registers /upload, which takes
+// an attachment, and a message command that uploads every attachment of the
+// message it is used on; both work in servers and in DMs with the bot. The
+// reply with the links is only shown to the user who asked. With
+// discord.notifyChannelId set, every upload to the instance is also
+// announced in that channel.
+
+const (
+	discordAPI            = "https://discord.com/api/v10"
+	discordUploadCommand  = "upload"
+	discordMessageCommand = "Upload to XyliLoader"
+)
+
+// Interaction and response types used here, from the Discord API.
+const (
+	discordPing               = 1
+	discordCommand            = 2
+	discordPong               = 1
+	discordDeferredMessage    = 5
+	discordEphemeral          = 64
+	discordChatInputCommand   = 1
+	discordMessageCommandType = 3
+	discordAttachmentOption   = 11
+)
+
+var discordPublicKey ed25519.PublicKey
+
+func initDiscord() error {
+	cfg := &config().Discord
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.ApplicationID == "" || cfg.BotToken == "" {
+		return fmt.Errorf("discord: applicationId and botToken are required")
+	}
+	key, err := hex.DecodeString(cfg.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("discord: publicKey must be the application's hex-encoded public key")
+	}
+	discordPublicKey = key
+	if cfg.MaxBytes <= 0 || cfg.MaxBytes > config().Upload.MaxSize {
+		cfg.MaxBytes = config().Upload.MaxSize
+	}
+
+	go func() {
+		if err := registerDiscordCommands(); err != nil {
+			log.Printf("Error registering Discord commands: %v", err)
+		}
+	}()
+	return nil
+}
+
+// discordRequest calls the Discord REST API as the bot.
+func discordRequest(ctx context.Context, method, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, discordAPI+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+config().Discord.BotToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("Discord returned %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+func registerDiscordCommands() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Installable on servers and users, usable in servers, DMs with the bot
+	// and private channels.
+	integrations := []int{0, 1}
+	contexts := []int{0, 1, 2}
+	commands := []map[string]interface{}{
+		{
+			"name":              discordUploadCommand,
+			"type":              discordChatInputCommand,
+			"description":       "Upload a file and get a link",
+			"integration_types": integrations,
+			"contexts":          contexts,
+			"options": []map[string]interface{}{{
+				"name":        "file",
+				"description": "The file to upload",
+				"type":        discordAttachmentOption,
+				"required":    true,
+			}},
+		},
+		{
+			"name":              discordMessageCommand,
+			"type":              discordMessageCommandType,
+			"integration_types": integrations,
+			"contexts":          contexts,
+		},
+	}
+	return discordRequest(ctx, http.MethodPut, "/applications/"+config().Discord.ApplicationID+"/commands", commands)
+}
+
+type discordAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+type discordInteraction struct {
+	Type  int    `json:"type"`
+	Token string `json:"token"`
+	Data  struct {
+		Name     string `json:"name"`
+		Type     int    `json:"type"`
+		TargetID string `json:"target_id"`
+		Options  []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+		Resolved struct {
+			Attachments map[string]discordAttachment `json:"attachments"`
+			Messages    map[string]struct {
+				Attachments []discordAttachment `json:"attachments"`
+			} `json:"messages"`
+		} `json:"resolved"`
+	} `json:"data"`
+}
+
+// attachments returns the files a command invocation refers to.
+func (in *discordInteraction) attachments() []discordAttachment {
+	if in.Data.Type == discordMessageCommandType {
+		return in.Data.Resolved.Messages[in.Data.TargetID].Attachments
+	}
+	var files []discordAttachment
+	for _, opt := range in.Data.Options {
+		var id string
+		if json.Unmarshal(opt.Value, &id) == nil {
+			if a, ok := in.Data.Resolved.Attachments[id]; ok {
+				files = append(files, a)
+			}
+		}
+	}
+	return files
+}
+
+func handleDiscordInteraction(w http.ResponseWriter, r *http.Request) {
+	if !config().Discord.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	// Discord checks that requests with a bad signature are refused.
+	sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	if err != nil || timestamp == "" || !ed25519.Verify(discordPublicKey, append([]byte(timestamp), body...), sig) {
+		jsonError(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var in discordInteraction
+	if err := json.Unmarshal(body, &in); err != nil {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch in.Type {
+	case discordPing:
+		json.NewEncoder(w).Encode(map[string]int{"type": discordPong})
+	case discordCommand:
+		// Fetching and storing the files takes longer than the three seconds
+		// Discord waits, so answer "thinking…" and edit the reply later.
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type": discordDeferredMessage,
+			"data": map[string]int{"flags": discordEphemeral},
+		})
+		go runDiscordUpload(&in)
+	default:
+		jsonError(w, "Unsupported interaction", http.StatusBadRequest)
+	}
+}
+
+func runDiscordUpload(in *discordInteraction) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var lines []string
+	files := in.attachments()
+	if len(files) == 0 {
+		lines = append(lines, "No attachments to upload.")
+	}
+	for _, a := range files {
+		link, deletion, err := storeDiscordAttachment(ctx, a)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%s: %v", a.Filename, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s\nDelete: <%s>", a.Filename, link, deletion))
+	}
+
+	path := fmt.Sprintf("/webhooks/%s/%s/messages/@original", config().Discord.ApplicationID, in.Token)
+	if err := discordRequest(ctx, http.MethodPatch, path, map[string]string{"content": strings.Join(lines, "\n")}); err != nil {
+		log.Printf("Error answering Discord interaction: %v", err)
+	}
+}
+
+// storeDiscordAttachment downloads an attachment from Discord's CDN and
+// stores it as an anonymous upload.
+func storeDiscordAttachment(ctx context.Context, a discordAttachment) (link, deletion string, err error) {
+	max := config().Discord.MaxBytes
+	if a.Size > max {
+		return "", "", fmt.Errorf("file too large (max %s)", formatSize(max))
+	}
+	if !strings.HasPrefix(a.URL, "https://cdn.discordapp.com/") && !strings.HasPrefix(a.URL, "https://media.discordapp.net/") {
+		return "", "", fmt.Errorf("unexpected attachment URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("download failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return "", "", fmt.Errorf("download failed")
+	}
+	if int64(len(data)) > max {
+		return "", "", fmt.Errorf("file too large (max %s)", formatSize(max))
+	}
+	if !dbBreaker.Allow() {
+		return "", "", fmt.Errorf("storage is unavailable, try again later")
+	}
+
+	contentType := detectContentType(a.Filename, data[:min(len(data), sniffLen)], a.ContentType)
+	metadata := newUploadMetadata(contentType, nil)
+	if err := storeUpload(ctx, a.Filename, bytes.NewReader(data), metadata); err != nil {
+		if isInfected(err) {
+			return "", "", fmt.Errorf("rejected: %v", err)
+		}
+		return "", "", fmt.Errorf("upload failed")
+	}
+	shortID := metadata["short_id"].(string)
+	notFoundCache.Forget(shortID)
+	return fmt.Sprintf("%s/%s", config().Upload.BaseURL, shortID),
+		fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"]), nil
+}
+
+// announceDiscordUpload posts an upload to the notification channel.
+func announceDiscordUpload(file webhookFile) {
+	if !config().Discord.Enabled || config().Discord.NotifyChannelID == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		content := fmt.Sprintf("New upload: %s (%s)\n%s", file.Filename, formatSize(file.Size), file.Link)
+		err := discordRequest(ctx, http.MethodPost, "/channels/"+config().Discord.NotifyChannelID+"/messages", map[string]interface{}{
+			"content":          content,
+			"allowed_mentions": map[string][]string{"parse": {}},
+		})
+		if err != nil {
+			log.Printf("Error posting upload to Discord: %v", err)
+		}
+	}()
+}
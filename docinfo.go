@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The title, author and page count of uploaded documents are read in the
+// background and kept in metadata.doc, for the viewer page and for file
+// searches. PDFs go through poppler's pdfinfo; OOXML (docx, pptx, xlsx) and
+// OpenDocument files are zip archives with the properties in XML, which is
+// read directly.
+
+const docInfoTimeout = time.Minute
+
+type docInfo struct {
+	Title  string `bson:"title,omitempty" json:"title,omitempty"`
+	Author string `bson:"author,omitempty" json:"author,omitempty"`
+	Pages  int    `bson:"pages,omitempty" json:"pages,omitempty"`
+}
+
+var docInfoQueue chan primitive.ObjectID
+
+func initDocInfo() {
+	cfg := &config().DocInfo
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.PDFInfo == "" {
+		cfg.PDFInfo = "pdfinfo"
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 100 << 20
+	}
+	if _, err := exec.LookPath(cfg.PDFInfo); err != nil {
+		log.Printf("pdfinfo not found (%v), PDF metadata disabled", err)
+		cfg.PDFInfo = ""
+	}
+
+	docInfoQueue = make(chan primitive.ObjectID, cfg.QueueSize)
+	for i := 0; i < cfg.Workers; i++ {
+		go docInfoWorker()
+	}
+}
+
+// documentKind tells how to read a file's properties: "pdf", "ooxml",
+// "odf" or "" when it is not a document. Office files are zip archives and
+// usually sniffed as application/zip, so the extension decides for them.
+func documentKind(filename, contentType string) string {
+	if mediaType(contentType) == "application/pdf" {
+		return "pdf"
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".docx", ".pptx", ".xlsx":
+		return "ooxml"
+	case ".odt", ".odp", ".ods":
+		return "odf"
+	}
+	return ""
+}
+
+// docInfoApplies reports whether metadata can be extracted from a file.
+func docInfoApplies(filename, contentType string) bool {
+	if !config().DocInfo.Enabled {
+		return false
+	}
+	kind := documentKind(filename, contentType)
+	return kind != "" && (kind != "pdf" || config().DocInfo.PDFInfo != "")
+}
+
+// queueDocInfo schedules metadata extraction for a document. Like
+// queuePoster it never blocks.
+func queueDocInfo(id primitive.ObjectID, filename, contentType string) {
+	if !docInfoApplies(filename, contentType) {
+		return
+	}
+	select {
+	case docInfoQueue <- id:
+	default:
+	}
+}
+
+func docInfoWorker() {
+	for id := range docInfoQueue {
+		if err := extractDocInfo(id); err != nil {
+			log.Printf("Document metadata extraction failed for %s: %v", id.Hex(), err)
+		}
+	}
+}
+
+func extractDocInfo(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), docInfoTimeout)
+	defer cancel()
+
+	var f fileRecord
+	if err := findFile(ctx, bson.M{"_id": id}, &f); err != nil {
+		return err
+	}
+	if f.Length > config().DocInfo.MaxBytes {
+		return nil
+	}
+
+	content, err := openStoredFile(ctx, &f)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	var info docInfo
+	switch documentKind(f.Filename, f.Metadata.ContentType) {
+	case "pdf":
+		info, err = pdfDocInfo(ctx, data)
+	case "ooxml":
+		info, err = ooxmlDocInfo(data)
+	case "odf":
+		info, err = odfDocInfo(data)
+	}
+	if err != nil {
+		return err
+	}
+	info.Title = strings.TrimSpace(info.Title)
+	info.Author = strings.TrimSpace(info.Author)
+	if info == (docInfo{}) {
+		return nil
+	}
+
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"metadata.doc": info}})
+	dbBreaker.Record(err)
+	return err
+}
+
+func pdfDocInfo(ctx context.Context, data []byte) (docInfo, error) {
+	// pdfinfo needs a seekable file: the cross-reference table is at the end.
+	tmp, err := os.CreateTemp("", "xyli-docinfo-*.pdf")
+	if err != nil {
+		return docInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return docInfo{}, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, config().DocInfo.PDFInfo, "-enc", "UTF-8", tmp.Name())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return docInfo{}, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var info docInfo
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Title":
+			info.Title = value
+		case "Author":
+			info.Author = value
+		case "Pages":
+			info.Pages, _ = strconv.Atoi(value)
+		}
+	}
+	return info, nil
+}
+
+// readZipXML decodes one XML member of a zip archive into v, leaving v
+// untouched when the member does not exist.
+func readZipXML(archive *zip.Reader, name string, v interface{}) error {
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	return xml.NewDecoder(io.LimitReader(file, 1<<20)).Decode(v)
+}
+
+func ooxmlDocInfo(data []byte) (docInfo, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return docInfo{}, err
+	}
+	var core struct {
+		Title   string `xml:"title"`
+		Creator string `xml:"creator"`
+	}
+	var app struct {
+		Pages  int `xml:"Pages"`
+		Slides int `xml:"Slides"`
+	}
+	if err := readZipXML(archive, "docProps/core.xml", &core); err != nil {
+		return docInfo{}, err
+	}
+	if err := readZipXML(archive, "docProps/app.xml", &app); err != nil {
+		return docInfo{}, err
+	}
+	return docInfo{Title: core.Title, Author: core.Creator, Pages: max(app.Pages, app.Slides)}, nil
+}
+
+func odfDocInfo(data []byte) (docInfo, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return docInfo{}, err
+	}
+	var meta struct {
+		Meta struct {
+			Title          string `xml:"title"`
+			Creator        string `xml:"creator"`
+			InitialCreator string `xml:"initial-creator"`
+			Statistic      struct {
+				PageCount int `xml:"page-count,attr"`
+			} `xml:"document-statistic"`
+		} `xml:"meta"`
+	}
+	if err := readZipXML(archive, "meta.xml", &meta); err != nil {
+		return docInfo{}, err
+	}
+	author := meta.Meta.InitialCreator
+	if author == "" {
+		author = meta.Meta.Creator
+	}
+	return docInfo{Title: meta.Meta.Title, Author: author, Pages: meta.Meta.Statistic.PageCount}, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// End-to-end encrypted uploads are encrypted in the browser before they are
+// sent, with a key that only ever appears in the fragment of the share link
+// (/{id}#<key>), which browsers do not send to the server. The server stores
+// and serves the ciphertext without knowing what it is; the upload carries
+// e2e=true so the file is marked with metadata.e2e and gets a viewer page
+// that fetches /raw/{id} and decrypts it in the page.
+//
+// The format, written and read by static/e2e.js: a 12-byte IV followed by
+// AES-256-GCM ciphertext of a 4-byte big-endian header length, a JSON header
+// {"name", "type"} with the original file name and type, and the content.
+
+const (
+	e2eViewer      = "viewer_e2e"
+	e2eContentType = "application/octet-stream"
+)
+
+// setE2EHeaders marks a /raw/ response as ciphertext that must reach the
+// client byte for byte.
+func setE2EHeaders(h http.Header, f *fileRecord) {
+	setContentHeaders(h, e2eContentType)
+	h.Set("Content-Disposition", `attachment; filename="`+f.Metadata.ShortID+`.bin"`)
+	h.Set("Cache-Control", "no-transform")
+	h.Set("X-Xyli-E2E", "aes-256-gcm")
+}
+
+// serveE2EViewer renders the page that decrypts an end-to-end encrypted file.
+func serveE2EViewer(w http.ResponseWriter, r *http.Request, f *fileRecord) {
+	loc := requestLocale(r)
+	ago := loc.formatAgo(f.UploadDate)
+	etag := viewerETag(e2eViewer, f.ID.Hex(), f.Filename, f.Metadata.ContentType, f.Length, f.UploadDate, loc.tag+" "+ago)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", viewerCacheControl(f))
+	w.Header().Set("Vary", "Accept-Language")
+	// The key is in the fragment; make sure it never leaks through a Referer.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		recordStat(statEvent{Type: statView, ShortID: f.Metadata.ShortID, OwnerID: f.Metadata.OwnerID})
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles(viewerTemplatePath(e2eViewer)))
+	tmpl.Execute(w, struct {
+		FileID      string
+		FileSize    string
+		Lang        string
+		Uploaded    string
+		UploadedAgo string
+		UploadedISO string
+	}{
+		FileID:      f.Metadata.ShortID,
+		FileSize:    loc.size(f.Length),
+		Lang:        loc.tag,
+		Uploaded:    loc.formatDate(f.UploadDate),
+		UploadedAgo: ago,
+		UploadedISO: f.UploadDate.UTC().Format(time.RFC3339),
+	})
+	recordStat(statEvent{Type: statView, ShortID: f.Metadata.ShortID, OwnerID: f.Metadata.OwnerID})
+}
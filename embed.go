@@ -0,0 +1,69 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"time"
+)
+
+// Viewer pages carry OpenGraph and Twitter Card tags, so links pasted in
+// Discord, Telegram and the like unfurl into a preview. The tags live in
+// templates/embed.html, which every viewer is parsed with and includes as
+// {{template "embed" .Embed}}. Files that burn after download get no media
+// URLs: a link previewer fetching them would use up their downloads.
+
+const embedTemplate = "templates/embed.html"
+
+// embedMeta is what a viewer page says about its file to link previewers.
+type embedMeta struct {
+	Title       string
+	Description string
+	URL         string
+	Type        string // og:type
+	Card        string // twitter:card
+	Image       string
+	Video       string
+	Audio       string
+	MediaType   string
+}
+
+func newEmbedMeta(f *fileRecord, loc *locale) embedMeta {
+	base := config().Upload.BaseURL + "/"
+	id := f.Metadata.ShortID
+	e := embedMeta{
+		Title:       f.Filename,
+		Description: f.Filename + " · " + loc.size(f.Length),
+		URL:         f.Link(),
+		Type:        "website",
+		Card:        "summary",
+		MediaType:   mediaType(f.Metadata.ContentType),
+	}
+	if burnsAfterDownload(f) || f.Metadata.E2E {
+		return e
+	}
+	switch getFileType(f.Metadata.ContentType) {
+	case "image":
+		e.Image, e.Card = base+"thumb/"+id, "summary_large_image"
+	case "video":
+		e.Type, e.Video = "video.other", base+"raw/"+id
+		if config().Posters.Enabled {
+			e.Image, e.Card = base+"poster/"+id, "summary_large_image"
+		}
+	case "audio":
+		e.Type, e.Audio = "music.song", base+"raw/"+id
+	}
+	return e
+}
+
+// parseViewer parses a viewer template together with the embed tags.
+func parseViewer(path string) *template.Template {
+	return template.Must(template.ParseFiles(path, embedTemplate))
+}
+
+// embedModified is when the embed tags last changed, for viewer ETags.
+func embedModified() time.Time {
+	if info, err := os.Stat(embedTemplate); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// With storage.encryption.enabled, content is encrypted with AES-256-GCM
+// before it reaches MongoDB, so a dump of the database does not give away
+// the files. New uploads go to the "gridfs-aes" backend, a GridFS bucket of
+// its own holding only ciphertext; the file documents in fs.files stay in
+// the clear with the real length, so listings and lookups work as before.
+// Files stored earlier remain readable from the plain bucket.
+//
+// Each file gets a random nonce and is sealed in 64 KiB chunks, each under
+// that nonce combined with the chunk number and bound to the file ID and to
+// whether it is the last chunk, so chunks cannot be reordered, moved to
+// another file or cut off. Append-mode segments are sealed one by one with
+// their own random nonces.
+//
+// The key is 32 bytes, base64 encoded, from storage.encryption.key (usually
+// given as XYLI_STORAGE_ENCRYPTION_KEY), or unwrapped at startup by a KMS:
+// storage.encryption.kms.url receives {"ciphertext": wrappedKey} and answers
+// with the key in "plaintext" or, as Vault's transit engine does, in
+// "data.plaintext".
+
+const (
+	encryptedBucket    = "encrypted"
+	encryptionChunk    = 64 << 10
+	encryptionMagic    = "XYE1"
+	encryptionKeyBytes = 32
+)
+
+var (
+	contentAEAD cipher.AEAD
+
+	errDecrypt = errors.New("encrypted content is corrupt or was sealed with another key")
+)
+
+func initEncryption(ctx context.Context) error {
+	cfg := &config().Storage.Encryption
+	if !cfg.Enabled {
+		return nil
+	}
+	if store.Name() != "gridfs" {
+		return fmt.Errorf("storage.encryption: only the gridfs backend is supported, not %q", store.Name())
+	}
+	var key []byte
+	var err error
+	if cfg.KMS.URL != "" {
+		key, err = unwrapKey(ctx)
+	} else {
+		key, err = decodeKey(cfg.Key)
+	}
+	if err != nil {
+		return fmt.Errorf("storage.encryption: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	contentAEAD, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(encryptedBucket))
+	if err != nil {
+		return err
+	}
+	enc := &encryptedStorage{bucket: bucket}
+	backends[enc.Name()] = enc
+	store = enc
+	return nil
+}
+
+// decodeKey accepts the key as base64 or hex.
+func decodeKey(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("no key configured")
+	}
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		key, err = hex.DecodeString(text)
+	}
+	if err != nil || len(key) != encryptionKeyBytes {
+		return nil, fmt.Errorf("the key must be %d bytes, base64 or hex encoded", encryptionKeyBytes)
+	}
+	return key, nil
+}
+
+func unwrapKey(ctx context.Context) ([]byte, error) {
+	cfg := config().Storage.Encryption.KMS
+	body, _ := json.Marshal(map[string]string{"ciphertext": cfg.WrappedKey})
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+		req.Header.Set("X-Vault-Token", cfg.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS returned %s", resp.Status)
+	}
+	var result struct {
+		Plaintext string `json:"plaintext"`
+		Data      struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Plaintext == "" {
+		result.Plaintext = result.Data.Plaintext
+	}
+	return decodeKey(result.Plaintext)
+}
+
+// chunkNonce derives the nonce of chunk i from the file's base nonce.
+func chunkNonce(base []byte, i uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^i)
+	return nonce
+}
+
+func chunkAAD(id primitive.ObjectID, last bool) []byte {
+	aad := append([]byte(nil), id[:]...)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// encryptReader turns plaintext into the sealed stream: the magic, the base
+// nonce, then the chunks.
+type encryptReader struct {
+	id     primitive.ObjectID
+	src    *bufio.Reader
+	nonce  []byte
+	i      uint64
+	buf    []byte
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func newEncryptReader(id primitive.ObjectID, r io.Reader) (*encryptReader, error) {
+	nonce := make([]byte, contentAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		id:    id,
+		src:   bufio.NewReaderSize(r, encryptionChunk),
+		nonce: nonce,
+		buf:   make([]byte, encryptionChunk),
+		out:   append([]byte(encryptionMagic), nonce...),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			if _, err := e.src.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		e.sealed = contentAEAD.Seal(e.sealed[:0], chunkNonce(e.nonce, e.i), e.buf[:n], chunkAAD(e.id, last))
+		e.out = e.sealed
+		e.i++
+		e.done = last
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// decryptReader reverses encryptReader, failing with errDecrypt on any
+// tampering, including a stream that ends early.
+type decryptReader struct {
+	id    primitive.ObjectID
+	src   io.ReadCloser
+	in    *bufio.Reader
+	nonce []byte
+	i     uint64
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+func newDecryptReader(id primitive.ObjectID, rc io.ReadCloser) (*decryptReader, error) {
+	in := bufio.NewReaderSize(rc, encryptionChunk+contentAEAD.Overhead())
+	header := make([]byte, len(encryptionMagic)+contentAEAD.NonceSize())
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		rc.Close()
+		return nil, errDecrypt
+	}
+	return &decryptReader{
+		id:    id,
+		src:   rc,
+		in:    in,
+		nonce: header[len(encryptionMagic):],
+		buf:   make([]byte, encryptionChunk+contentAEAD.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.in, d.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			if _, err := d.in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		out, err := contentAEAD.Open(d.buf[:0], chunkNonce(d.nonce, d.i), d.buf[:n], chunkAAD(d.id, last))
+		if err != nil {
+			return 0, errDecrypt
+		}
+		d.out = out
+		d.i++
+		d.done = last
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+// sealSegment encrypts one append-mode segment, bound to its file and offset.
+func sealSegment(id primitive.ObjectID, offset int64, data []byte) ([]byte, error) {
+	nonce := make([]byte, contentAEAD.NonceSize(), contentAEAD.NonceSize()+len(data)+contentAEAD.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return contentAEAD.Seal(nonce, nonce, data, segmentAAD(id, offset)), nil
+}
+
+func openSegment(id primitive.ObjectID, offset int64, sealed []byte) ([]byte, error) {
+	if contentAEAD == nil || len(sealed) < contentAEAD.NonceSize() {
+		return nil, errDecrypt
+	}
+	nonce, ciphertext := sealed[:contentAEAD.NonceSize()], sealed[contentAEAD.NonceSize():]
+	data, err := contentAEAD.Open(nil, nonce, ciphertext, segmentAAD(id, offset))
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return data, nil
+}
+
+func segmentAAD(id primitive.ObjectID, offset int64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), id[:]...), uint64(offset))
+}
+
+// encryptedStorage keeps sealed content in its own GridFS bucket and the
+// file document, with the plaintext length, in fs.files.
+type encryptedStorage struct {
+	bucket *gridfs.Bucket
+}
+
+func (s *encryptedStorage) Name() string { return "gridfs-aes" }
+
+func (s *encryptedStorage) Put(ctx context.Context, id primitive.ObjectID, filename string, r io.Reader, metadata bson.M) (int64, error) {
+	counted := &countingReader{r: r}
+	sealed, err := newEncryptReader(id, counted)
+	if err != nil {
+		return 0, err
+	}
+	uploadStream, err := s.bucket.OpenUploadStreamWithID(id, id.Hex())
+	dbBreaker.Record(err)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(uploadStream, sealed); err != nil {
+		uploadStream.Abort()
+		dbBreaker.Record(err)
+		return 0, err
+	}
+	err = uploadStream.Close()
+	dbBreaker.Record(err)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := insertFileDoc(ctx, id, filename, counted.n, metadata, s.Name()); err != nil {
+		s.bucket.DeleteContext(ctx, id)
+		return 0, err
+	}
+	return counted.n, nil
+}
+
+func (s *encryptedStorage) Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	downloadStream, err := s.bucket.OpenDownloadStream(id)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(id, downloadStream)
+}
+
+func (s *encryptedStorage) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if err := deleteFileDoc(ctx, id); err != nil {
+		return err
+	}
+	err := s.bucket.DeleteContext(ctx, id)
+	dbBreaker.Record(err)
+	if err == gridfs.ErrFileNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *encryptedStorage) Stat(ctx context.Context, id primitive.ObjectID) (*ObjectInfo, error) {
+	return statFileDoc(ctx, id)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Photos carry EXIF metadata (camera, time and often GPS position). Users
+// can have it removed from their uploads, per upload with strip_exif or for
+// all of them through their account defaults. Uploads marked this way are
+// rewritten on their way into storage:
+//
+//   - JPEG loses its APP1 (EXIF, XMP) and APP13 (IPTC) segments. The
+//     orientation is kept in a minimal EXIF block so photos are not shown
+//     sideways.
+//   - PNG loses its eXIf chunk.
+//
+// Anything else, including end-to-end encrypted uploads, is stored as sent.
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripEXIF returns r with the image metadata removed. The returned reader
+// must be closed, which stops the rewriting if the reader is abandoned.
+func stripEXIF(r io.Reader) io.ReadCloser {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(pngSignature))
+	var strip func(io.Writer, *bufio.Reader) error
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		strip = stripJPEGMetadata
+	case bytes.Equal(head, pngSignature):
+		strip = stripPNGMetadata
+	default:
+		return io.NopCloser(br)
+	}
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(strip(pw, br)) }()
+	return pr
+}
+
+// stripJPEGMetadata copies a JPEG up to its image data segment by segment,
+// leaving out the metadata ones; the rest is copied as is. Malformed input
+// is passed through from where it stops making sense.
+func stripJPEGMetadata(w io.Writer, br *bufio.Reader) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b != 0xFF {
+			if _, err := w.Write([]byte{b}); err != nil {
+				return err
+			}
+			_, err = io.Copy(w, br)
+			return err
+		}
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = br.ReadByte(); err != nil {
+				return passEOF(err)
+			}
+		}
+
+		switch {
+		case marker == 0xDA || marker == 0xD9: // start of scan, end of image
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			_, err = io.Copy(w, br)
+			return err
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7: // no length
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return passEOF(err)
+		}
+		n := int64(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			if _, err := w.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+				return err
+			}
+			_, err = io.Copy(w, br)
+			return err
+		}
+		if marker == 0xE1 || marker == 0xED {
+			segment := make([]byte, n)
+			if _, err := io.ReadFull(br, segment); err != nil {
+				return passEOF(err)
+			}
+			if marker == 0xE1 {
+				if o := exifOrientation(segment); o > 1 {
+					if _, err := w.Write(orientationSegment(o)); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if _, err := w.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, br, n); err != nil {
+			return passEOF(err)
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from the first IFD of an APP1
+// segment's payload, returning 0 when there is none.
+func exifOrientation(segment []byte) uint16 {
+	tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := order.Uint16(tiff[entry+8:]); o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationSegment is an APP1 segment holding nothing but orientation o.
+func orientationSegment(o uint16) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header, first IFD at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(o >> 8), byte(o), 0, 0, // orientation, SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// stripPNGMetadata copies a PNG chunk by chunk, leaving out eXIf.
+func stripPNGMetadata(w io.Writer, br *bufio.Reader) error {
+	if _, err := io.CopyN(w, br, int64(len(pngSignature))); err != nil {
+		return err
+	}
+	for {
+		var header [8]byte
+		if got, err := io.ReadFull(br, header[:]); err != nil {
+			w.Write(header[:got])
+			return passEOF(err)
+		}
+		// Data and CRC follow the length and type.
+		n := int64(binary.BigEndian.Uint32(header[:4])) + 4
+		if string(header[4:]) == "eXIf" {
+			if _, err := br.Discard(int(n)); err != nil {
+				return passEOF(err)
+			}
+			continue
+		}
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if string(header[4:]) == "IEND" {
+			_, err := io.Copy(w, br)
+			return err
+		}
+		if _, err := io.CopyN(w, br, n); err != nil {
+			return passEOF(err)
+		}
+	}
+}
+
+// passEOF treats a file that ends early as done: what there was has been
+// copied, and the image was broken to begin with.
+func passEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
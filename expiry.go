@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errBadExpiry = errors.New("invalid expiry")
+
+// parseExpiry accepts Go durations plus day and week suffixes ("7d", "2w").
+// An empty string, "0" or "never" means the file does not expire.
+func parseExpiry(s string) (time.Duration, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" || s == "0" || s == "never" {
+		return 0, nil
+	}
+
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n <= 0 {
+			return 0, errBadExpiry
+		}
+		return time.Duration(n) * unit, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errBadExpiry
+	}
+	return d, nil
+}
+
+// isPaste reports whether content of this type counts as a text paste for
+// retention purposes: short-lived logs and snippets rather than files.
+func isPaste(contentType string) bool {
+	mt := mediaType(contentType)
+	return strings.HasPrefix(mt, "text/") || mt == "application/json"
+}
+
+// expiryLimits returns the default and maximum lifetime that apply to an
+// upload: the uploader's tier, or the global settings for anonymous uploads,
+// with the paste variants for text.
+func expiryLimits(tier *Tier, paste bool) (defaultExpiry, maxExpiry string) {
+	switch {
+	case tier != nil && paste:
+		return tier.PasteDefaultExpiry, tier.PasteMaxExpiry
+	case tier != nil:
+		return tier.DefaultExpiry, tier.MaxExpiry
+	}
+	defaultExpiry, maxExpiry = config().Upload.DefaultExpiry, config().Upload.MaxExpiry
+	if paste {
+		defaultExpiry = orDefault(config().Upload.PasteDefaultExpiry, defaultExpiry)
+		maxExpiry = orDefault(config().Upload.PasteMaxExpiry, maxExpiry)
+	}
+	return defaultExpiry, maxExpiry
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// uploadExpiry resolves the requested lifetime against the limits from
+// expiryLimits. A zero duration means the file is kept forever.
+func uploadExpiry(requested string, tier *Tier, paste bool) (time.Duration, error) {
+	defaultExpiry, maxExpiry := expiryLimits(tier, paste)
+	if requested == "" {
+		requested = defaultExpiry
+	}
+	ttl, err := parseExpiry(requested)
+	if err != nil {
+		return 0, err
+	}
+
+	maxTTL, _ := parseExpiry(maxExpiry)
+	if maxTTL > 0 && (ttl == 0 || ttl > maxTTL) {
+		ttl = maxTTL
+	}
+	return ttl, nil
+}
+
+// notExpired matches files without an expiry as well as those still alive.
+func notExpired() bson.M {
+	return bson.M{"$not": bson.M{"$lte": time.Now()}}
+}
+
+func initExpiry(ctx context.Context) {
+	_, err := gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "metadata.expires_at", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		log.Printf("Error creating expiry index: %v", err)
+	}
+}
+
+func runExpiryCleaner() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !dbBreaker.Allow() {
+			continue
+		}
+		deleteExpiredFiles()
+	}
+}
+
+func deleteExpiredFiles() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	opts := options.GridFSFind().SetLimit(500)
+	cursor, err := gfsBucket.FindContext(ctx, bson.M{"metadata.expires_at": bson.M{"$lte": time.Now()}}, opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		log.Printf("Error finding expired files: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var expired []fileRecord
+	if err := cursor.All(ctx, &expired); err != nil {
+		dbBreaker.Record(err)
+		return
+	}
+
+	for i := range expired {
+		doc := &expired[i]
+		if err := deleteStoredFile(ctx, doc); err != nil {
+			log.Printf("Error deleting expired file %s: %v", doc.ID.Hex(), err)
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("Deleted %d expired files", len(expired))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /api/v1/files lists files a page at a time for scripts that need to
+// walk every upload. Scoping is the same as for search: the caller's own
+// files, everyone's for admins, one account's with ?owner=.
+//
+//	sort     date (default, newest first), size, name; "-" reverses
+//	limit    up to 200, 50 by default
+//	cursor   next_cursor of the previous page
+//
+// The cursor holds the sort value and id of the last file of a page, so
+// pages stay stable while files are added or removed and never need a skip.
+
+// listCursor is the decoded ?cursor= of a file listing.
+type listCursor struct {
+	Sort  string             `json:"s"`
+	ID    primitive.ObjectID `json:"id"`
+	Date  time.Time          `json:"d,omitzero"`
+	Size  int64              `json:"n,omitempty"`
+	Name  string             `json:"f,omitempty"`
+	Order int                `json:"o"`
+}
+
+func (c listCursor) value() interface{} {
+	switch c.Sort {
+	case "length":
+		return c.Size
+	case "filename":
+		return c.Name
+	}
+	return c.Date
+}
+
+func encodeListCursor(field string, order int, f *fileRecord) string {
+	c := listCursor{Sort: field, ID: f.ID, Order: order}
+	switch field {
+	case "length":
+		c.Size = f.Length
+	case "filename":
+		c.Name = f.Filename
+	default:
+		c.Date = f.UploadDate
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListCursor(v string) (listCursor, bool) {
+	var c listCursor
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID.IsZero() {
+		return c, false
+	}
+	return c, true
+}
+
+func handleFileList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+
+	field, order, ok := fileSort(q.Get("sort"))
+	if !ok {
+		jsonError(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit < 1 {
+		limit = searchPerPage
+	}
+	limit = min(limit, searchMaxPerPage)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	filter, ok := fileScope(ctx, w, user, q.Get("owner"))
+	if !ok {
+		return
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, ok := decodeListCursor(v)
+		if !ok || c.Sort != field || c.Order != order {
+			jsonError(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cmp := "$gt"
+		if order < 0 {
+			cmp = "$lt"
+		}
+		filter["$or"] = bson.A{
+			bson.M{field: bson.M{cmp: c.value()}},
+			bson.M{field: c.value(), "_id": bson.M{cmp: c.ID}},
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: field, Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := gfsBucket.GetFilesCollection().Find(ctx, filter, opts)
+	dbBreaker.Record(err)
+	var docs []fileRecord
+	if err == nil {
+		err = cursor.All(ctx, &docs)
+		dbBreaker.Record(err)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{}
+	if len(docs) > limit {
+		docs = docs[:limit]
+		resp["next_cursor"] = encodeListCursor(field, order, &docs[limit-1])
+	}
+	resp["files"] = listedFiles(ctx, user, docs)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
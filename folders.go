@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Accounts can sort their files into folders. A file's folder is a path
+// such as "/photos/2024" in metadata.folder; files without one are in the
+// root. The folders collection remembers folders created on their own so
+// that empty ones do not vanish; folders that only exist because files are
+// in them are listed too. Moving and renaming only rewrite paths: links stay
+// the same.
+//
+//	GET    /api/folders?path=/a        subfolders and files of /a
+//	POST   /api/folders                create, JSON {path}
+//	DELETE /api/folders?path=/a        remove an empty folder
+//	POST   /api/folders/move           JSON {files, folder}
+//	POST   /api/folders/rename         JSON {path, to}; also moves it
+
+const (
+	maxFolderPath    = 512
+	maxFolderSegment = 100
+)
+
+var errBadFolder = errors.New("Invalid folder path")
+
+var foldersColl *mongo.Collection
+
+func initFolders(ctx context.Context) {
+	foldersColl = db.Collection("folders")
+	_, err := foldersColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "owner_id", Value: 1}, {Key: "path", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Error creating folders index: %v", err)
+	}
+	_, err = gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "metadata.owner_id", Value: 1}, {Key: "metadata.folder", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		log.Printf("Error creating folder index: %v", err)
+	}
+}
+
+// cleanFolder normalizes a folder path to "/a/b", or "" for the root.
+func cleanFolder(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" || p == "/" {
+		return "", nil
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", nil
+	}
+	if len(p) > maxFolderPath {
+		return "", errBadFolder
+	}
+	for _, seg := range strings.Split(p[1:], "/") {
+		if seg == ".." || utf8.RuneCountInString(seg) > maxFolderSegment || strings.IndexFunc(seg, unicode.IsControl) >= 0 {
+			return "", errBadFolder
+		}
+	}
+	return p, nil
+}
+
+// folderFilter matches folder itself and everything below it.
+func folderFilter(folder string) bson.M {
+	return bson.M{"$regex": "^" + regexp.QuoteMeta(folder) + "(/|$)"}
+}
+
+// ensureFolder records folder and its parents for user.
+func ensureFolder(ctx context.Context, user *User, folder string) error {
+	for p := folder; p != "" && p != "/"; p = path.Dir(p) {
+		_, err := foldersColl.UpdateOne(ctx,
+			bson.M{"owner_id": user.ID, "path": p},
+			bson.M{"$setOnInsert": bson.M{"created_at": time.Now()}},
+			options.Update().SetUpsert(true),
+		)
+		dbBreaker.Record(err)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// subfolders lists the names of the folders directly inside folder.
+func subfolders(ctx context.Context, user *User, folder string) ([]string, error) {
+	prefix := folder + "/"
+	below := bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
+	paths, err := gfsBucket.GetFilesCollection().Distinct(ctx, "metadata.folder", bson.M{"metadata.owner_id": user.ID, "metadata.folder": below})
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	explicit, err := foldersColl.Distinct(ctx, "path", bson.M{"owner_id": user.ID, "path": below})
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	names := []string{}
+	for _, v := range append(paths, explicit...) {
+		p, _ := v.(string)
+		name, _, _ := strings.Cut(strings.TrimPrefix(p, prefix), "/")
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func handleFolders(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		folder, err := cleanFolder(r.URL.Query().Get("path"))
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names, err := subfolders(ctx, user, folder)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		filter := bson.M{"metadata.owner_id": user.ID, "metadata.folder": folder}
+		if folder == "" {
+			filter["metadata.folder"] = bson.M{"$in": bson.A{nil, ""}}
+		}
+		opts := options.GridFSFind().SetSort(bson.D{{Key: "uploadDate", Value: -1}}).SetLimit(500)
+		cursor, err := gfsBucket.FindContext(ctx, filter, opts)
+		dbBreaker.Record(err)
+		var docs []fileRecord
+		if err == nil {
+			err = cursor.All(ctx, &docs)
+			dbBreaker.Record(err)
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		folders := make([]map[string]string, 0, len(names))
+		for _, name := range names {
+			folders = append(folders, map[string]string{"name": name, "path": folder + "/" + name})
+		}
+		files := make([]fileEntry, 0, len(docs))
+		for i := range docs {
+			files = append(files, newFileEntry(&docs[i]))
+		}
+		if folder == "" {
+			folder = "/"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"path": folder, "folders": folders, "files": files})
+
+	case http.MethodPost:
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		folder, err := cleanFolder(req.Path)
+		if err != nil || folder == "" {
+			jsonError(w, errBadFolder.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ensureFolder(ctx, user, folder); err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"path": folder})
+
+	case http.MethodDelete:
+		folder, err := cleanFolder(r.URL.Query().Get("path"))
+		if err != nil || folder == "" {
+			jsonError(w, errBadFolder.Error(), http.StatusBadRequest)
+			return
+		}
+		n, err := gfsBucket.GetFilesCollection().CountDocuments(ctx, bson.M{"metadata.owner_id": user.ID, "metadata.folder": folderFilter(folder)}, options.Count().SetLimit(1))
+		dbBreaker.Record(err)
+		if err == nil && n == 0 {
+			n, err = foldersColl.CountDocuments(ctx, bson.M{"owner_id": user.ID, "path": bson.M{"$regex": "^" + regexp.QuoteMeta(folder+"/")}}, options.Count().SetLimit(1))
+			dbBreaker.Record(err)
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n > 0 {
+			jsonError(w, "Folder is not empty", http.StatusConflict)
+			return
+		}
+		_, err = foldersColl.DeleteOne(ctx, bson.M{"owner_id": user.ID, "path": folder})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFolderMove puts files into a folder, creating it if needed.
+func handleFolderMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Files  []string `json:"files"`
+		Folder string   `json:"folder"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || len(req.Files) == 0 {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	folder, err := cleanFolder(req.Folder)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"metadata.folder": folder}}
+	if folder == "" {
+		update = bson.M{"$unset": bson.M{"metadata.folder": ""}}
+	} else if err := ensureFolder(ctx, user, folder); err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	res, err := gfsBucket.GetFilesCollection().UpdateMany(ctx, bson.M{
+		"metadata.owner_id": user.ID,
+		"metadata.short_id": bson.M{"$in": req.Files},
+	}, update)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if folder == "" {
+		folder = "/"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"folder": folder, "moved": res.MatchedCount})
+}
+
+// handleFolderRename moves a folder, with everything in it, to a new path.
+func handleFolderRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	from, err := cleanFolder(req.Path)
+	if err != nil || from == "" {
+		jsonError(w, errBadFolder.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := cleanFolder(req.To)
+	if err != nil || to == "" {
+		jsonError(w, errBadFolder.Error(), http.StatusBadRequest)
+		return
+	}
+	if to == from || strings.HasPrefix(to, from+"/") {
+		jsonError(w, "Cannot move a folder into itself", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	n, err := foldersColl.CountDocuments(ctx, bson.M{"owner_id": user.ID, "path": folderFilter(to)}, options.Count().SetLimit(1))
+	dbBreaker.Record(err)
+	if err == nil && n == 0 {
+		n, err = gfsBucket.GetFilesCollection().CountDocuments(ctx, bson.M{"metadata.owner_id": user.ID, "metadata.folder": folderFilter(to)}, options.Count().SetLimit(1))
+		dbBreaker.Record(err)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n > 0 {
+		jsonError(w, "A folder with this name already exists", http.StatusConflict)
+		return
+	}
+
+	// Replace the leading from of every path below it with to.
+	rewrite := func(field string) bson.A {
+		return bson.A{bson.M{"$set": bson.M{field: bson.M{"$concat": bson.A{
+			to,
+			bson.M{"$substrCP": bson.A{"$" + field, utf8.RuneCountInString(from), maxFolderPath}},
+		}}}}}
+	}
+	res, err := gfsBucket.GetFilesCollection().UpdateMany(ctx,
+		bson.M{"metadata.owner_id": user.ID, "metadata.folder": folderFilter(from)},
+		rewrite("metadata.folder"))
+	dbBreaker.Record(err)
+	if err == nil {
+		_, err = foldersColl.UpdateMany(ctx, bson.M{"owner_id": user.ID, "path": folderFilter(from)}, rewrite("path"))
+		dbBreaker.Record(err)
+	}
+	if err == nil {
+		err = ensureFolder(ctx, user, to)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": to, "moved": res.MatchedCount})
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC API (proto/xyli.proto) serves the same files as HTTP on its own
+// port, for integrations that would rather not build multipart requests.
+// Every call needs an API key. TLS is required unless grpc.insecure is set
+// for a TLS-terminating proxy in front.
+
+const grpcChunkSize = 256 << 10
+
+var grpcServer *grpc.Server
+
+func initGRPC() error {
+	cfg := &config().GRPC
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = ":9443"
+	}
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcCodec{}),
+		grpc.UnaryInterceptor(grpcAuthUnary),
+		grpc.StreamInterceptor(grpcAuthStream),
+	}
+	if !cfg.Insecure {
+		creds, err := credentials.NewServerTLSFromFile(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("grpc: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcServer = grpc.NewServer(opts...)
+	grpcServer.RegisterService(&grpcFilesDesc, grpcFiles{})
+	return nil
+}
+
+func serveGRPC() {
+	lis, err := net.Listen("tcp", config().GRPC.Listen)
+	if err != nil {
+		log.Fatal("Error starting gRPC server:", err)
+	}
+	log.Printf("Starting gRPC server on %s", config().GRPC.Listen)
+	if err := grpcServer.Serve(lis); err != nil {
+		log.Printf("gRPC server stopped: %v", err)
+	}
+}
+
+type grpcAuthKey struct{}
+
+type grpcCaller struct {
+	user *User
+	key  *APIKey
+}
+
+// grpcAuthenticate resolves the API key in the call's metadata.
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 && len(values[0]) > 7 && strings.EqualFold(values[0][:7], "bearer ") {
+		token = strings.TrimSpace(values[0][7:])
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "API key required")
+	}
+	if !dbBreaker.Allow() {
+		return nil, status.Error(codes.Unavailable, "storage is unavailable")
+	}
+	key, user := lookupAPIKey("secret", token)
+	if user == nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	return context.WithValue(ctx, grpcAuthKey{}, &grpcCaller{user, key}), nil
+}
+
+func grpcAuthUnary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type grpcAuthedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcAuthedStream) Context() context.Context { return s.ctx }
+
+func grpcAuthStream(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &grpcAuthedStream{ss, ctx})
+}
+
+func grpcCallerFrom(ctx context.Context) *grpcCaller {
+	c, _ := ctx.Value(grpcAuthKey{}).(*grpcCaller)
+	return c
+}
+
+// grpcFileError maps a lookup error to a status.
+func grpcFileError(err error) error {
+	switch {
+	case err == errFileNotFound:
+		return status.Error(codes.NotFound, "file not found")
+	case isMongoOutage(err):
+		return status.Error(codes.Unavailable, "storage is unavailable")
+	default:
+		return status.Error(codes.Internal, "database error")
+	}
+}
+
+type grpcFilesServer interface {
+	Upload(grpc.ServerStream) error
+	Download(*grpcIDRequest, grpc.ServerStream) error
+	Delete(context.Context, *grpcIDRequest) (*grpcEmpty, error)
+	Stat(context.Context, *grpcIDRequest) (*grpcFileInfo, error)
+}
+
+var grpcFilesDesc = grpc.ServiceDesc{
+	ServiceName: "xyli.v1.Files",
+	HandlerType: (*grpcFilesServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Delete", Handler: grpcUnaryHandler("Delete", grpcFilesServer.Delete)},
+		{MethodName: "Stat", Handler: grpcUnaryHandler("Stat", grpcFilesServer.Stat)},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Upload", ClientStreams: true, Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(grpcFilesServer).Upload(stream)
+		}},
+		{StreamName: "Download", ServerStreams: true, Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := &grpcIDRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(grpcFilesServer).Download(req, stream)
+		}},
+	},
+	Metadata: "proto/xyli.proto",
+}
+
+// grpcUnaryHandler adapts a unary method taking an ID request, the shape
+// generated code would have.
+func grpcUnaryHandler[T wireMessage](name string, method func(grpcFilesServer, context.Context, *grpcIDRequest) (T, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := &grpcIDRequest{}
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		call := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return method(srv.(grpcFilesServer), ctx, req.(*grpcIDRequest))
+		}
+		if interceptor == nil {
+			return call(ctx, req)
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/xyli.v1.Files/" + name}, call)
+	}
+}
+
+type grpcFiles struct{}
+
+func (grpcFiles) Upload(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	caller := grpcCallerFrom(ctx)
+
+	first := &grpcUploadRequest{}
+	if err := stream.RecvMsg(first); err != nil {
+		return err
+	}
+	info := first.Info
+	if info == nil {
+		return status.Error(codes.InvalidArgument, "the first message must be UploadInfo")
+	}
+
+	// Buffer to disk: the quota check needs the size before storing.
+	tmp, err := os.CreateTemp("", "xyli-grpc-*")
+	if err != nil {
+		return status.Error(codes.Internal, "upload error")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var size int64
+	for {
+		msg := &grpcUploadRequest{}
+		err := stream.RecvMsg(msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if size += int64(len(msg.Chunk)); size > config().Upload.MaxSize {
+			return status.Errorf(codes.ResourceExhausted, "file too large (max %s)", formatSize(config().Upload.MaxSize))
+		}
+		if _, err := tmp.Write(msg.Chunk); err != nil {
+			return status.Error(codes.Internal, "upload error")
+		}
+	}
+
+	user := caller.user
+	qctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	_, tier := effectiveTier(qctx, user)
+	err = checkTierQuota(qctx, user, size)
+	cancel()
+	if isTierLimit(err) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	name := strings.TrimSpace(info.Filename)
+	if name == "" {
+		name = "upload"
+	}
+	head := make([]byte, sniffLen)
+	n, _ := tmp.ReadAt(head, 0)
+	contentType := detectContentType(name, head[:n], info.ContentType)
+
+	ttl, err := uploadExpiry(defaultExpires(user, info.Expires), tier, isPaste(contentType))
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid expires value")
+	}
+	visibility, err := uploadVisibility(user, info.Visibility)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	passwordHash, err := uploadPasswordHash(user, info.Password)
+	if err == errPasswordTooLong {
+		return status.Error(codes.InvalidArgument, "password too long")
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "upload error")
+	}
+	stripEXIF, err := uploadStripEXIF(user, info.StripEXIF)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	metadata := newUploadMetadata(contentType, user)
+	metadata["api_key_id"] = caller.key.KeyID
+	if passwordHash != "" {
+		metadata["password_hash"] = passwordHash
+	}
+	if stripEXIF {
+		metadata["strip_exif"] = true
+	}
+	if visibility != "" {
+		metadata["visibility"] = visibility
+	}
+	res := &grpcUploadResponse{}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+		metadata["expires_at"] = expiresAt
+		res.ExpiresAt = expiresAt.Unix()
+	}
+
+	err = storeUpload(ctx, name, io.NewSectionReader(tmp, 0, size), metadata)
+	switch {
+	case isInfected(err):
+		return status.Error(codes.FailedPrecondition, "file rejected: "+err.Error())
+	case err == errScannerUnavailable:
+		return status.Error(codes.Unavailable, "virus scanner unavailable")
+	case isMongoOutage(err):
+		return status.Error(codes.Unavailable, "storage is unavailable")
+	case err != nil:
+		return status.Error(codes.Internal, "upload error")
+	}
+	res.ID = metadata["short_id"].(string)
+	notFoundCache.Forget(res.ID)
+	res.Link = fmt.Sprintf("%s/%s", config().Upload.BaseURL, res.ID)
+	res.DeletionLink = fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"])
+	return stream.SendMsg(res)
+}
+
+func grpcInfo(f *fileRecord) *grpcFileInfo {
+	info := &grpcFileInfo{
+		ID:          f.Metadata.ShortID,
+		Filename:    f.Filename,
+		Size:        f.Length,
+		ContentType: f.Metadata.ContentType,
+		UploadedAt:  f.UploadDate.Unix(),
+		Link:        f.Link(),
+		Protected:   f.Metadata.PasswordHash != "",
+		Views:       f.Metadata.Views,
+		Downloads:   f.Metadata.Downloads,
+		SHA256:      f.Metadata.SHA256,
+	}
+	if f.Metadata.ExpiresAt != nil {
+		info.ExpiresAt = f.Metadata.ExpiresAt.Unix()
+	}
+	return info
+}
+
+// grpcReadable applies the visibility and signed-only rules of /raw/:
+// private and signed-only files are only served to their owner and admins,
+// as gRPC has no signed links.
+func grpcReadable(caller *grpcCaller, f *fileRecord) bool {
+	if f.Metadata.Visibility != visibilityPrivate && !f.Metadata.SignedOnly {
+		return true
+	}
+	return caller.user.ID == f.Metadata.OwnerID || isAdmin(caller.user)
+}
+
+// Download follows the rules of /raw/: visibility, signed-only files,
+// disabled links, passwords, bandwidth caps and download limits all apply.
+func (grpcFiles) Download(req *grpcIDRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	var f fileRecord
+	if err := findFileByShortID(ctx, req.ID, &f); err != nil {
+		if err == errFileNotFound && wasBurned(ctx, req.ID) {
+			return status.Error(codes.NotFound, "file was deleted after its last download")
+		}
+		return grpcFileError(err)
+	}
+	if !grpcReadable(grpcCallerFrom(ctx), &f) {
+		return grpcFileError(errFileNotFound)
+	}
+	switch {
+	case f.Metadata.Disabled:
+		return status.Error(codes.PermissionDenied, "the link is disabled")
+	case f.Metadata.PasswordHash != "" && !checkFilePassword(&f, req.Password):
+		return status.Error(codes.PermissionDenied, "wrong or missing password")
+	case bandwidthExceeded(&f):
+		return status.Error(codes.ResourceExhausted, "bandwidth limit reached for this month")
+	}
+	lastDownload := false
+	if burnsAfterDownload(&f) {
+		ok, last, err := claimDownload(ctx, &f)
+		if err != nil {
+			return status.Error(codes.Internal, "database error")
+		}
+		if !ok {
+			burnFile(&f)
+			return status.Error(codes.NotFound, "file was deleted after its last download")
+		}
+		lastDownload = last
+	}
+
+	var content io.ReadCloser
+	var err error
+	if f.Metadata.Storage == appendStore.Name() {
+		content, err = appendStore.OpenRange(ctx, f.ID, 0, f.Length)
+	} else {
+		content, err = openStoredFile(ctx, &f)
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "download error")
+	}
+	defer content.Close()
+
+	if err := stream.SendMsg(&grpcDownloadResponse{Info: grpcInfo(&f)}); err != nil {
+		return err
+	}
+	var sent int64
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, rerr := content.Read(buf)
+		if n > 0 {
+			if err := stream.SendMsg(&grpcDownloadResponse{Chunk: buf[:n]}); err != nil {
+				break
+			}
+			sent += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			recordBandwidth(&f, sent)
+			return status.Error(codes.Internal, "download error")
+		}
+	}
+	recordBandwidth(&f, sent)
+	recordStat(statEvent{Type: statDownload, ShortID: f.Metadata.ShortID, OwnerID: f.Metadata.OwnerID, KeyID: f.Metadata.APIKeyID, Bytes: sent})
+	if lastDownload {
+		burnFile(&f)
+	}
+	return nil
+}
+
+func (grpcFiles) Delete(ctx context.Context, req *grpcIDRequest) (*grpcEmpty, error) {
+	f, err := findManagedFile(ctx, grpcCallerFrom(ctx).user, req.ID)
+	if err != nil {
+		return nil, grpcFileError(err)
+	}
+	if err := deleteStoredFile(ctx, f); err != nil {
+		return nil, status.Error(codes.Internal, "delete error")
+	}
+	return &grpcEmpty{}, nil
+}
+
+// Stat describes one of the caller's files (any file for admins).
+func (grpcFiles) Stat(ctx context.Context, req *grpcIDRequest) (*grpcFileInfo, error) {
+	f, err := findManagedFile(ctx, grpcCallerFrom(ctx).user, req.ID)
+	if err != nil {
+		return nil, grpcFileError(err)
+	}
+	return grpcInfo(f), nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of proto/xyli.proto, encoded by hand with protowire so the
+// build needs no protoc step. Unknown fields are skipped, as generated code
+// would.
+
+// wireMessage is what grpcCodec can marshal.
+type wireMessage interface {
+	marshalWire() []byte
+	unmarshalWire(b []byte) error
+}
+
+// grpcCodec replaces the proto codec on the gRPC server.
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string { return "proto" }
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("grpc: cannot marshal %T", v)
+	}
+	return m.marshalWire(), nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("grpc: cannot unmarshal into %T", v)
+	}
+	return m.unmarshalWire(data)
+}
+
+// walkWire calls field for every field of a message with its varint or
+// length-delimited value.
+func walkWire(b []byte, field func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			if err := field(num, v, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, data []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, data)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+type grpcUploadInfo struct {
+	Filename, ContentType, Expires, Password, StripEXIF, Visibility string
+}
+
+func (m *grpcUploadInfo) marshalWire() []byte {
+	b := appendString(nil, 1, m.Filename)
+	b = appendString(b, 2, m.ContentType)
+	b = appendString(b, 3, m.Expires)
+	b = appendString(b, 4, m.Password)
+	b = appendString(b, 5, m.StripEXIF)
+	return appendString(b, 6, m.Visibility)
+}
+
+func (m *grpcUploadInfo) unmarshalWire(b []byte) error {
+	return walkWire(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Filename = string(data)
+		case 2:
+			m.ContentType = string(data)
+		case 3:
+			m.Expires = string(data)
+		case 4:
+			m.Password = string(data)
+		case 5:
+			m.StripEXIF = string(data)
+		case 6:
+			m.Visibility = string(data)
+		}
+		return nil
+	})
+}
+
+type grpcUploadRequest struct {
+	Info  *grpcUploadInfo
+	Chunk []byte
+}
+
+func (m *grpcUploadRequest) marshalWire() []byte {
+	if m.Info != nil {
+		return appendBytes(nil, 1, m.Info.marshalWire())
+	}
+	return appendBytes(nil, 2, m.Chunk)
+}
+
+func (m *grpcUploadRequest) unmarshalWire(b []byte) error {
+	*m = grpcUploadRequest{}
+	return walkWire(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Info = &grpcUploadInfo{}
+			return m.Info.unmarshalWire(data)
+		case 2:
+			m.Chunk = data
+		}
+		return nil
+	})
+}
+
+type grpcUploadResponse struct {
+	ID, Link, DeletionLink string
+	ExpiresAt              int64
+}
+
+func (m *grpcUploadResponse) marshalWire() []byte {
+	b := appendString(nil, 1, m.ID)
+	b = appendString(b, 2, m.Link)
+	b = appendString(b, 3, m.DeletionLink)
+	return appendInt(b, 4, m.ExpiresAt)
+}
+
+func (m *grpcUploadResponse) unmarshalWire(b []byte) error {
+	return walkWire(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.ID = string(data)
+		case 2:
+			m.Link = string(data)
+		case 3:
+			m.DeletionLink = string(data)
+		case 4:
+			m.ExpiresAt = int64(v)
+		}
+		return nil
+	})
+}
+
+// grpcIDRequest is DownloadRequest, DeleteRequest and StatRequest; only
+// DownloadRequest has a password.
+type grpcIDRequest struct {
+	ID, Password string
+}
+
+func (m *grpcIDRequest) marshalWire() []byte {
+	return appendString(appendString(nil, 1, m.ID), 2, m.Password)
+}
+
+func (m *grpcIDRequest) unmarshalWire(b []byte) error {
+	return walkWire(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.ID = string(data)
+		case 2:
+			m.Password = string(data)
+		}
+		return nil
+	})
+}
+
+type grpcEmpty struct{}
+
+func (*grpcEmpty) marshalWire() []byte { return nil }
+
+func (*grpcEmpty) unmarshalWire(b []byte) error {
+	return walkWire(b, func(protowire.Number, uint64, []byte) error { return nil })
+}
+
+type grpcFileInfo struct {
+	ID, Filename, ContentType, Link, SHA256 string
+	Size, UploadedAt, ExpiresAt             int64
+	Views, Downloads                        int64
+	Protected                               bool
+}
+
+func (m *grpcFileInfo) marshalWire() []byte {
+	b := appendString(nil, 1, m.ID)
+	b = appendString(b, 2, m.Filename)
+	b = appendInt(b, 3, m.Size)
+	b = appendString(b, 4, m.ContentType)
+	b = appendInt(b, 5, m.UploadedAt)
+	b = appendInt(b, 6, m.ExpiresAt)
+	b = appendString(b, 7, m.Link)
+	if m.Protected {
+		b = appendInt(b, 8, 1)
+	}
+	b = appendInt(b, 9, m.Views)
+	b = appendInt(b, 10, m.Downloads)
+	return appendString(b, 11, m.SHA256)
+}
+
+func (m *grpcFileInfo) unmarshalWire(b []byte) error {
+	return walkWire(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.ID = string(data)
+		case 2:
+			m.Filename = string(data)
+		case 3:
+			m.Size = int64(v)
+		case 4:
+			m.ContentType = string(data)
+		case 5:
+			m.UploadedAt = int64(v)
+		case 6:
+			m.ExpiresAt = int64(v)
+		case 7:
+			m.Link = string(data)
+		case 8:
+			m.Protected = v != 0
+		case 9:
+			m.Views = int64(v)
+		case 10:
+			m.Downloads = int64(v)
+		case 11:
+			m.SHA256 = string(data)
+		}
+		return nil
+	})
+}
+
+type grpcDownloadResponse struct {
+	Info  *grpcFileInfo
+	Chunk []byte
+}
+
+func (m *grpcDownloadResponse) marshalWire() []byte {
+	if m.Info != nil {
+		return appendBytes(nil, 1, m.Info.marshalWire())
+	}
+	return appendBytes(nil, 2, m.Chunk)
+}
+
+func (m *grpcDownloadResponse) unmarshalWire(b []byte) error {
+	*m = grpcDownloadResponse{}
+	return walkWire(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Info = &grpcFileInfo{}
+			return m.Info.unmarshalWire(data)
+		case 2:
+			m.Chunk = data
+		}
+		return nil
+	})
+}
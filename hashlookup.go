@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /hash/{sha256} redirects to /raw/ of a stored file with that content,
+// and answers 404 when there is none. Clients can ask with HEAD whether the
+// instance already has a file before uploading it, and integrations can link
+// to content by its digest. Only public files without a download limit are
+// found this way; owners also find their own unlisted, private, protected,
+// signed-only and limited files, admins find everything. Disabled and
+// growing files are never matched.
+
+func initHashLookup(ctx context.Context) {
+	_, err := gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "metadata.sha256", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"metadata.short_id": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Error creating sha256 lookup index: %v", err)
+	}
+}
+
+// parseSHA256 returns the lowercase hex digest, or "" when s is not one.
+func parseSHA256(s string) string {
+	s = strings.ToLower(s)
+	if len(s) != 64 {
+		return ""
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return ""
+	}
+	return s
+}
+
+func handleHashLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sum := parseSHA256(strings.TrimPrefix(r.URL.Path, "/hash/"))
+	if sum == "" {
+		http.Error(w, "invalid sha256", http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.M{
+		"metadata.sha256":     sum,
+		"metadata.short_id":   bson.M{"$exists": true},
+		"metadata.expires_at": notExpired(),
+		"metadata.quarantine": bson.M{"$exists": false},
+		"metadata.disabled":   bson.M{"$ne": true},
+		"metadata.growing":    bson.M{"$ne": true},
+	}
+	public := bson.M{
+		"metadata.visibility":    bson.M{"$exists": false},
+		"metadata.signed_only":   bson.M{"$ne": true},
+		"metadata.password_hash": bson.M{"$exists": false},
+		// A redirect to a file with a download limit would spend one of
+		// its downloads on behalf of a stranger.
+		"metadata.max_downloads": bson.M{"$exists": false},
+	}
+	user := requestUser(r)
+	switch {
+	case user == nil:
+		for k, v := range public {
+			filter[k] = v
+		}
+	case !isAdmin(user):
+		filter["$or"] = []bson.M{public, {"metadata.owner_id": user.ID}}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var doc fileRecord
+	err := gfsBucket.GetFilesCollection().FindOne(ctx, filter,
+		options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})).Decode(&doc)
+	dbBreaker.Record(err)
+	if isMongoOutage(err) {
+		serveUnavailable(w, false)
+		return
+	}
+
+	// The answer depends on who is asking.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Cookie, Authorization")
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "decode error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Checksum-SHA256", sum)
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"alternate\"", doc.Link()))
+	http.Redirect(w, r, fmt.Sprintf("%s/raw/%s", config().Upload.BaseURL, doc.Metadata.ShortID), http.StatusFound)
+}
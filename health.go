@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// /healthz tells an orchestrator the process is alive and should not be
+// restarted; /readyz tells a load balancer whether to send it traffic. Neither
+// goes through guardStorage; a readiness probe doubles as the breaker's
+// probe request once its cooldown is over.
+
+const readyTimeout = 2 * time.Second
+
+// shuttingDown is set once a shutdown signal arrives, so the instance is
+// taken out of rotation while in-flight requests drain.
+var shuttingDown atomic.Bool
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports ready when MongoDB answers a ping and the GridFS files
+// collection, the index of every stored file, can be queried, both within
+// readyTimeout.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	fail := func(check, reason string) {
+		checks[check] = reason
+		ready = false
+	}
+
+	switch {
+	case shuttingDown.Load():
+		fail("server", "shutting down")
+	case !dbBreaker.Allow():
+		fail("mongodb", "circuit breaker open")
+	default:
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		err := client.Ping(ctx, nil)
+		dbBreaker.Record(err)
+		if err != nil {
+			fail("mongodb", err.Error())
+			break
+		}
+		checks["mongodb"] = "ok"
+
+		err = gfsBucket.GetFilesCollection().FindOne(ctx, bson.M{},
+			options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+		dbBreaker.Record(err)
+		if err != nil && err != mongo.ErrNoDocuments {
+			fail("gridfs", err.Error())
+			break
+		}
+		checks["gridfs"] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+		setUnavailable(w.Header(), time.Duration(dbBreaker.RetryAfter())*time.Second)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "checks": checks})
+}
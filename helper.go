@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// /api/helper/upload is for small native helpers such as a Windows "Send To
+// → XyliLoader" shortcut: one authenticated request per file, the answer
+// carries the text to put on the clipboard, and every failure has a code
+// from a fixed list so the helper can show its own message:
+//
+//	unauthorized, bad_request, empty, too_large, quota_exceeded,
+//	invalid_expires, password_too_long, rejected, scanner_unavailable,
+//	unavailable, server_error
+//
+// The file is the raw body (name in ?name=) or the only part of a multipart
+// form. Sending a file the account already has, unexpired, returns the
+// existing link with "duplicate" set instead of storing it again, so a
+// double click or a retry after a lost answer gives the same link.
+// ?copy=raw puts the direct link on the clipboard and ?copy=markdown a
+// Markdown link or image; the default is the file page.
+
+type helperResult struct {
+	OK           bool   `json:"ok"`
+	Code         string `json:"code"`
+	Error        string `json:"error,omitempty"`
+	Link         string `json:"link,omitempty"`
+	RawLink      string `json:"raw_link,omitempty"`
+	DeletionLink string `json:"deletion_link,omitempty"`
+	Clipboard    string `json:"clipboard,omitempty"`
+	Duplicate    bool   `json:"duplicate,omitempty"`
+}
+
+func writeHelperResult(w http.ResponseWriter, status int, res helperResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func helperFail(w http.ResponseWriter) uploadFailer {
+	return func(status int, code, message string) {
+		switch code {
+		case "unavailable":
+			setUnavailable(w.Header(), time.Duration(dbBreaker.RetryAfter())*time.Second)
+		case "scanner_unavailable":
+			setUnavailable(w.Header(), scannerRetryAfter)
+		}
+		writeHelperResult(w, status, helperResult{Code: code, Error: message})
+	}
+}
+
+func handleHelperUpload(w http.ResponseWriter, r *http.Request) {
+	fail := helperFail(w)
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		fail(http.StatusMethodNotAllowed, "bad_request", "Method not allowed")
+		return
+	}
+	if bearerToken(r) == "" || requestUser(r) == nil {
+		fail(http.StatusUnauthorized, "unauthorized", "API key required")
+		return
+	}
+	if r.ContentLength > config().Upload.MaxSize {
+		fail(http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("File too large (max %s)", formatSize(config().Upload.MaxSize)))
+		return
+	}
+	copyAs := r.URL.Query().Get("copy")
+	if copyAs != "" && copyAs != "page" && copyAs != "raw" && copyAs != "markdown" {
+		fail(http.StatusBadRequest, "bad_request", "Invalid copy value")
+		return
+	}
+
+	body, name, claimed := io.Reader(r.Body), r.URL.Query().Get("name"), r.Header.Get("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(claimed); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			fail(http.StatusBadRequest, "bad_request", "Bad request")
+			return
+		}
+		part, err := mr.NextPart()
+		if err != nil {
+			fail(http.StatusBadRequest, "empty", "File not found")
+			return
+		}
+		defer part.Close()
+		body, claimed = part, part.Header.Get("Content-Type")
+		if name == "" {
+			name = part.FileName()
+		}
+	}
+	// Helpers send full Windows paths.
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		name = ""
+	}
+
+	metadata, ok := storeSimpleUpload(w, r, fail, simpleUpload{
+		Body:       body,
+		Name:       name,
+		Claimed:    claimed,
+		MaxSize:    config().Upload.MaxSize,
+		Expires:    r.URL.Query().Get("expires"),
+		Password:   r.URL.Query().Get("password"),
+		Visibility: r.URL.Query().Get("visibility"),
+		Dedupe:     true,
+	})
+	if !ok {
+		return
+	}
+	shortID := metadata["short_id"].(string)
+	res := helperResult{
+		OK:           true,
+		Code:         "ok",
+		Link:         fileLink(shortID, name),
+		RawLink:      fmt.Sprintf("%s/raw/%s", config().Upload.BaseURL, shortID),
+		DeletionLink: fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"]),
+		Duplicate:    metadata["duplicate"] == true,
+	}
+	switch copyAs {
+	case "raw":
+		res.Clipboard = res.RawLink
+	case "markdown":
+		label := name
+		if label == "" {
+			label = shortID
+		}
+		res.Clipboard = fmt.Sprintf("[%s](%s)", label, res.Link)
+		if ct, _ := metadata["content_type"].(string); strings.HasPrefix(mediaType(ct), "image/") {
+			res.Clipboard = fmt.Sprintf("![%s](%s)", label, res.RawLink)
+		}
+	default:
+		res.Clipboard = res.Link
+	}
+	status := http.StatusCreated
+	if res.Duplicate {
+		status = http.StatusOK
+	}
+	writeHelperResult(w, status, res)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pages shown to people who open a shared link format sizes and dates for
+// the language their browser asks for in Accept-Language. API responses keep
+// using formatSize, which is the English form, but JSON errors add a message
+// in the client's language (see apierrors.go). Units follow display.sizeUnits
+// everywhere.
+
+type locale struct {
+	tag     string
+	decimal string
+	si      [7]string // B, kB, MB, ... EB
+	iec     [7]string // B, KiB, MiB, ... EiB
+	months  [12]string
+	// date formats day, month name, year and time.
+	date    func(day int, month string, year int, clock string) string
+	clock   string // time.Format layout for the time of day
+	justNow string
+	ago     string // fmt format taking the count and the unit
+	// relative holds the one/few/many forms of second, minute, hour, day,
+	// month and year, in that order; plural picks the form for a count.
+	relative  [6][3]string
+	plural    func(n int64) int
+	page      [3]string // one/few/many forms of "page"
+	views     [3]string
+	downloads [3]string
+	password  passwordText
+	bandwidth bandwidthText
+	gone      goneText
+	disabled  disabledText
+	report    reportText
+	album     albumText
+	apiErrors map[string]string // API error messages by code, see apierrors.go
+}
+
+// passwordText is the wording of the page that asks for a file's password.
+type passwordText struct {
+	Title, Prompt, Placeholder, Unlock, Wrong string
+}
+
+// goneText is the wording of the page shown for a file deleted after its
+// last allowed download.
+type goneText struct {
+	Title, Message string
+}
+
+// disabledText is the wording of the page shown for a link its owner has
+// turned off.
+type disabledText struct {
+	Title, Message string
+}
+
+// reportText is the wording of the form for reporting a file. Reasons
+// are labels for the codes in reportReasons, in the same order.
+type reportText struct {
+	Title, Prompt, Details, Submit, Thanks string
+	Reasons                                [5]string
+}
+
+// albumText is the wording of an album's gallery page.
+type albumText struct {
+	Untitled, Empty string
+	Files           [3]string
+}
+
+// bandwidthText is the wording of the page shown when a file has used up
+// its monthly bandwidth. Reset takes the date downloads resume.
+type bandwidthText struct {
+	Title, Message, Reset string
+}
+
+func englishPlural(n int64) int {
+	if n == 1 {
+		return 0
+	}
+	return 2
+}
+
+var locales = map[string]*locale{
+	"en": {
+		tag:     "en",
+		decimal: ".",
+		si:      [7]string{"B", "kB", "MB", "GB", "TB", "PB", "EB"},
+		iec:     [7]string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"},
+		months:  [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		date: func(day int, month string, year int, clock string) string {
+			return fmt.Sprintf("%s %d, %d, %s", month, day, year, clock)
+		},
+		clock:   "3:04 PM",
+		justNow: "just now",
+		ago:     "%d %s ago",
+		relative: [6][3]string{
+			{"second", "seconds", "seconds"},
+			{"minute", "minutes", "minutes"},
+			{"hour", "hours", "hours"},
+			{"day", "days", "days"},
+			{"month", "months", "months"},
+			{"year", "years", "years"},
+		},
+		plural:    englishPlural,
+		page:      [3]string{"page", "pages", "pages"},
+		views:     [3]string{"view", "views", "views"},
+		downloads: [3]string{"download", "downloads", "downloads"},
+		password: passwordText{
+			Title:       "Protected file",
+			Prompt:      "This file is protected with a password.",
+			Placeholder: "Password",
+			Unlock:      "Open",
+			Wrong:       "Wrong password",
+		},
+		bandwidth: bandwidthText{
+			Title:   "Download limit reached",
+			Message: "This file has used up its bandwidth for this month.",
+			Reset:   "Downloads resume on %s.",
+		},
+		gone: goneText{
+			Title:   "File is gone",
+			Message: "This file could only be downloaded a limited number of times and has been deleted.",
+		},
+		disabled: disabledText{
+			Title:   "Link disabled",
+			Message: "The owner has disabled this link for now.",
+		},
+		report: reportText{
+			Title:   "Report file",
+			Prompt:  "Tell us what is wrong with %s.",
+			Details: "Details (optional)",
+			Submit:  "Send report",
+			Thanks:  "Thank you. The report will be reviewed.",
+			Reasons: [5]string{"Illegal content", "Copyright infringement", "Malware or phishing", "Spam", "Something else"},
+		},
+		album: albumText{
+			Untitled: "Album",
+			Empty:    "This album is empty.",
+			Files:    [3]string{"file", "files", "files"},
+		},
+	},
+	"ru": {
+		tag:     "ru",
+		decimal: ",",
+		si:      [7]string{"Б", "кБ", "МБ", "ГБ", "ТБ", "ПБ", "ЭБ"},
+		iec:     [7]string{"Б", "КиБ", "МиБ", "ГиБ", "ТиБ", "ПиБ", "ЭиБ"},
+		months:  [12]string{"января", "февраля", "марта", "апреля", "мая", "июня", "июля", "августа", "сентября", "октября", "ноября", "декабря"},
+		date: func(day int, month string, year int, clock string) string {
+			return fmt.Sprintf("%d %s %d, %s", day, month, year, clock)
+		},
+		clock:   "15:04",
+		justNow: "только что",
+		ago:     "%d %s назад",
+		relative: [6][3]string{
+			{"секунду", "секунды", "секунд"},
+			{"минуту", "минуты", "минут"},
+			{"час", "часа", "часов"},
+			{"день", "дня", "дней"},
+			{"месяц", "месяца", "месяцев"},
+			{"год", "года", "лет"},
+		},
+		plural: func(n int64) int {
+			switch {
+			case n%10 == 1 && n%100 != 11:
+				return 0
+			case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+				return 1
+			}
+			return 2
+		},
+		page:      [3]string{"страница", "страницы", "страниц"},
+		views:     [3]string{"просмотр", "просмотра", "просмотров"},
+		downloads: [3]string{"скачивание", "скачивания", "скачиваний"},
+		password: passwordText{
+			Title:       "Файл защищён",
+			Prompt:      "Этот файл защищён паролем.",
+			Placeholder: "Пароль",
+			Unlock:      "Открыть",
+			Wrong:       "Неверный пароль",
+		},
+		bandwidth: bandwidthText{
+			Title:   "Лимит скачиваний исчерпан",
+			Message: "Этот файл израсходовал свой трафик за этот месяц.",
+			Reset:   "Скачивание снова будет доступно %s.",
+		},
+		gone: goneText{
+			Title:   "Файл удалён",
+			Message: "Этот файл можно было скачать ограниченное число раз, и он уже удалён.",
+		},
+		disabled: disabledText{
+			Title:   "Ссылка отключена",
+			Message: "Владелец временно отключил эту ссылку.",
+		},
+		report: reportText{
+			Title:   "Пожаловаться на файл",
+			Prompt:  "Расскажите, что не так с файлом %s.",
+			Details: "Подробности (необязательно)",
+			Submit:  "Отправить жалобу",
+			Thanks:  "Спасибо. Жалоба будет рассмотрена.",
+			Reasons: [5]string{"Незаконный контент", "Нарушение авторских прав", "Вирус или фишинг", "Спам", "Другое"},
+		},
+		album: albumText{
+			Untitled: "Альбом",
+			Empty:    "В этом альбоме пока ничего нет.",
+			Files:    [3]string{"файл", "файла", "файлов"},
+		},
+		apiErrors: map[string]string{
+			"database_error":        "Ошибка базы данных",
+			"method_not_allowed":    "Метод не поддерживается",
+			"unauthorized":          "Требуется авторизация",
+			"forbidden":             "Доступ запрещён",
+			"bad_request":           "Некорректный запрос",
+			"not_found":             "Не найдено",
+			"file_not_found":        "Файл не найден",
+			"user_not_found":        "Пользователь не найден",
+			"album_not_found":       "Альбом не найден",
+			"server_error":          "Внутренняя ошибка сервера",
+			"invalid_json":          "Некорректный JSON",
+			"invalid_expires":       "Некорректный срок хранения",
+			"invalid_max_downloads": "Некорректное число скачиваний",
+			"invalid_strip_exif":    "Некорректное значение strip_exif",
+			"invalid_sort":          "Некорректная сортировка",
+			"invalid_cursor":        "Некорректный курсор",
+			"invalid_parameter":     "Некорректный параметр",
+			"password_too_long":     "Слишком длинный пароль",
+			"empty":                 "Файл пуст",
+			"title_too_long":        "Слишком длинное название",
+			"api_key_required":      "Нужен API-ключ",
+			"too_many_api_keys":     "Слишком много API-ключей",
+			"scanner_unavailable":   "Антивирус временно недоступен",
+			"unavailable":           "Хранилище временно недоступно",
+			"folder_not_empty":      "Папка не пуста",
+			"ip_blocked":            "Доступ с этого адреса заблокирован",
+			"under_review":          "Файл на проверке после жалоб",
+			"checksum_mismatch":     "Контрольная сумма не совпадает",
+			"remote_error":          "Не удалось получить файл с другого сервера",
+			"captcha_required":      "Пройдите проверку на робота",
+			"captcha_failed":        "Проверка на робота не пройдена, попробуйте ещё раз",
+			"last_sign_in_method":   "Нельзя отвязать последний способ входа",
+			"reprocess_running":     "Задача повторной обработки уже выполняется",
+			"job_not_found":         "Задача не найдена",
+			"invalid_credentials":   "Неверное имя пользователя или пароль",
+			"invalid_refresh_token": "Токен обновления недействителен, войдите заново",
+			"too_large":             "Файл слишком большой",
+			"rejected":              "Файл отклонён",
+			"quota_exceeded":        "Превышена квота",
+			"rate_limited":          "Слишком много запросов",
+		},
+	},
+	"de": {
+		tag:     "de",
+		decimal: ",",
+		si:      [7]string{"B", "kB", "MB", "GB", "TB", "PB", "EB"},
+		iec:     [7]string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"},
+		months:  [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		date: func(day int, month string, year int, clock string) string {
+			return fmt.Sprintf("%d. %s %d, %s", day, month, year, clock)
+		},
+		clock:   "15:04",
+		justNow: "gerade eben",
+		ago:     "vor %d %s",
+		relative: [6][3]string{
+			{"Sekunde", "Sekunden", "Sekunden"},
+			{"Minute", "Minuten", "Minuten"},
+			{"Stunde", "Stunden", "Stunden"},
+			{"Tag", "Tagen", "Tagen"},
+			{"Monat", "Monaten", "Monaten"},
+			{"Jahr", "Jahren", "Jahren"},
+		},
+		plural:    englishPlural,
+		page:      [3]string{"Seite", "Seiten", "Seiten"},
+		views:     [3]string{"Aufruf", "Aufrufe", "Aufrufe"},
+		downloads: [3]string{"Download", "Downloads", "Downloads"},
+		password: passwordText{
+			Title:       "Geschützte Datei",
+			Prompt:      "Diese Datei ist mit einem Passwort geschützt.",
+			Placeholder: "Passwort",
+			Unlock:      "Öffnen",
+			Wrong:       "Falsches Passwort",
+		},
+		bandwidth: bandwidthText{
+			Title:   "Download-Limit erreicht",
+			Message: "Diese Datei hat ihr Datenvolumen für diesen Monat aufgebraucht.",
+			Reset:   "Downloads sind ab dem %s wieder möglich.",
+		},
+		gone: goneText{
+			Title:   "Datei gelöscht",
+			Message: "Diese Datei konnte nur begrenzt oft heruntergeladen werden und wurde gelöscht.",
+		},
+		disabled: disabledText{
+			Title:   "Link deaktiviert",
+			Message: "Der Besitzer hat diesen Link vorübergehend deaktiviert.",
+		},
+		report: reportText{
+			Title:   "Datei melden",
+			Prompt:  "Was stimmt mit %s nicht?",
+			Details: "Details (optional)",
+			Submit:  "Meldung senden",
+			Thanks:  "Danke. Die Meldung wird geprüft.",
+			Reasons: [5]string{"Illegale Inhalte", "Urheberrechtsverletzung", "Schadsoftware oder Phishing", "Spam", "Etwas anderes"},
+		},
+		album: albumText{
+			Untitled: "Album",
+			Empty:    "Dieses Album ist leer.",
+			Files:    [3]string{"Datei", "Dateien", "Dateien"},
+		},
+		apiErrors: map[string]string{
+			"database_error":        "Datenbankfehler",
+			"method_not_allowed":    "Methode nicht erlaubt",
+			"unauthorized":          "Anmeldung erforderlich",
+			"forbidden":             "Zugriff verweigert",
+			"bad_request":           "Ungültige Anfrage",
+			"not_found":             "Nicht gefunden",
+			"file_not_found":        "Datei nicht gefunden",
+			"user_not_found":        "Benutzer nicht gefunden",
+			"album_not_found":       "Album nicht gefunden",
+			"server_error":          "Interner Serverfehler",
+			"invalid_json":          "Ungültiges JSON",
+			"invalid_expires":       "Ungültige Ablaufzeit",
+			"invalid_max_downloads": "Ungültige Download-Anzahl",
+			"invalid_strip_exif":    "Ungültiger Wert für strip_exif",
+			"invalid_sort":          "Ungültige Sortierung",
+			"invalid_cursor":        "Ungültiger Cursor",
+			"invalid_parameter":     "Ungültiger Parameter",
+			"password_too_long":     "Passwort zu lang",
+			"empty":                 "Die Datei ist leer",
+			"title_too_long":        "Titel zu lang",
+			"api_key_required":      "API-Schlüssel erforderlich",
+			"too_many_api_keys":     "Zu viele API-Schlüssel",
+			"scanner_unavailable":   "Virenscanner vorübergehend nicht verfügbar",
+			"unavailable":           "Speicher vorübergehend nicht verfügbar",
+			"folder_not_empty":      "Der Ordner ist nicht leer",
+			"ip_blocked":            "Der Zugriff von dieser Adresse ist gesperrt",
+			"under_review":          "Die Datei wird nach Meldungen geprüft",
+			"checksum_mismatch":     "Die Prüfsumme stimmt nicht überein",
+			"remote_error":          "Die Datei konnte nicht vom anderen Server geholt werden",
+			"captcha_required":      "Bitte bestätigen Sie, dass Sie kein Roboter sind",
+			"captcha_failed":        "Die Roboterprüfung ist fehlgeschlagen, bitte erneut versuchen",
+			"last_sign_in_method":   "Die letzte Anmeldemöglichkeit kann nicht entfernt werden",
+			"reprocess_running":     "Eine Neuverarbeitung läuft bereits",
+			"job_not_found":         "Auftrag nicht gefunden",
+			"invalid_credentials":   "Benutzername oder Passwort ist falsch",
+			"invalid_refresh_token": "Das Aktualisierungstoken ist ungültig, bitte erneut anmelden",
+			"too_large":             "Datei zu groß",
+			"rejected":              "Datei abgelehnt",
+			"quota_exceeded":        "Kontingent überschritten",
+			"rate_limited":          "Zu viele Anfragen",
+		},
+	},
+}
+
+const defaultLocale = "en"
+
+// requestLocale picks the supported language the client prefers most,
+// falling back to English.
+func requestLocale(r *http.Request) *locale {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := locales[base]; ok && q > 0 {
+			choices = append(choices, choice{base, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) > 0 {
+		return locales[choices[0].tag]
+	}
+	return locales[defaultLocale]
+}
+
+// size formats a byte count with the locale's decimal separator, in SI
+// (1000-based) or IEC (1024-based) units as set by display.sizeUnits.
+func (l *locale) size(bytes int64) string {
+	unit, labels := int64(1024), &l.iec
+	if config().Display.SizeUnits == "si" {
+		unit, labels = 1000, &l.si
+	}
+	if bytes < unit {
+		return fmt.Sprintf("%d %s", bytes, labels[0])
+	}
+	div, exp := unit, 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	number := strings.TrimSuffix(fmt.Sprintf("%.1f", float64(bytes)/float64(div)), ".0")
+	return strings.Replace(number, ".", l.decimal, 1) + " " + labels[exp+1]
+}
+
+// formatDate writes t as a full date and time of day, in the server's zone.
+func (l *locale) formatDate(t time.Time) string {
+	t = t.Local()
+	return l.date(t.Day(), l.months[t.Month()-1], t.Year(), t.Format(l.clock))
+}
+
+// formatAgo describes how long ago t was, in the largest whole unit.
+func (l *locale) formatAgo(t time.Time) string {
+	elapsed := time.Since(t)
+	if elapsed < 10*time.Second {
+		return l.justNow
+	}
+	steps := []struct {
+		unit int
+		size time.Duration
+	}{
+		{5, 365 * 24 * time.Hour},
+		{4, 30 * 24 * time.Hour},
+		{3, 24 * time.Hour},
+		{2, time.Hour},
+		{1, time.Minute},
+		{0, time.Second},
+	}
+	for _, s := range steps {
+		if n := int64(elapsed / s.size); n >= 1 {
+			return fmt.Sprintf(l.ago, n, l.relative[s.unit][l.plural(n)])
+		}
+	}
+	return l.justNow
+}
+
+// pageCount writes a document's number of pages, as in "12 pages".
+func (l *locale) pageCount(n int) string {
+	return fmt.Sprintf("%d %s", n, l.page[l.plural(int64(n))])
+}
+
+// albumCount writes the number of files in an album, as in "12 files".
+func (l *locale) albumCount(n int) string {
+	return fmt.Sprintf("%d %s", n, l.album.Files[l.plural(int64(n))])
+}
+
+// fileCounters writes how often a file was viewed and downloaded, as in
+// "12 views · 3 downloads".
+func (l *locale) fileCounters(views, downloads int64) string {
+	return fmt.Sprintf("%d %s · %d %s", views, l.views[l.plural(views)], downloads, l.downloads[l.plural(downloads)])
+}
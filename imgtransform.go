@@ -0,0 +1,389 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/sync/singleflight"
+)
+
+// /img/{id}?w=&h=&fit=&format=&q= resizes images at request time. Results
+// are kept in an in-memory LRU bounded by total bytes. Content behind a
+// short ID never changes, but the file is still looked up on every request
+// so that deleted files stop being served from the cache.
+//
+// /raw/{id}?q= serves an image recompressed at that JPEG quality from the
+// same cache, and so does a plain /raw/ request with "Save-Data: on" when
+// imageTransform.saveDataQuality is set. A variant that would not be
+// smaller than the original is not used.
+
+const maxTransformSize = 4096
+
+type transformParams struct {
+	Width, Height int
+	Fit           string
+	Format        string
+	Quality       int // 0 is imageTransform.quality
+}
+
+func (p transformParams) key(shortID string) string {
+	return fmt.Sprintf("%s/%dx%d/%s/%s/q%d", shortID, p.Width, p.Height, p.Fit, p.Format, p.Quality)
+}
+
+// parseQuality reads the q parameter, 0 when absent.
+func parseQuality(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("q")
+	if raw == "" {
+		return 0, nil
+	}
+	q, err := strconv.Atoi(raw)
+	if err != nil || q < 1 || q > 100 {
+		return 0, fmt.Errorf("q must be between 1 and 100")
+	}
+	return q, nil
+}
+
+func parseTransformParams(r *http.Request) (transformParams, error) {
+	q := r.URL.Query()
+	var p transformParams
+	var err error
+
+	for _, dim := range []struct {
+		name string
+		v    *int
+	}{{"w", &p.Width}, {"h", &p.Height}} {
+		raw := q.Get(dim.name)
+		if raw == "" {
+			continue
+		}
+		*dim.v, err = strconv.Atoi(raw)
+		if err != nil || *dim.v < 1 || *dim.v > maxTransformSize {
+			return p, fmt.Errorf("%s must be between 1 and %d", dim.name, maxTransformSize)
+		}
+	}
+
+	p.Fit = q.Get("fit")
+	switch p.Fit {
+	case "":
+		p.Fit = "contain"
+	case "contain", "cover", "fill":
+	default:
+		return p, fmt.Errorf("fit must be contain, cover or fill")
+	}
+
+	p.Format = q.Get("format")
+	switch p.Format {
+	case "", "jpeg", "png":
+	case "jpg":
+		p.Format = "jpeg"
+	default:
+		return p, fmt.Errorf("format must be jpeg or png")
+	}
+
+	p.Quality, err = parseQuality(r)
+	return p, err
+}
+
+// transformImage scales src according to p. contain never upscales, cover
+// crops to fill the box exactly and fill stretches.
+func transformImage(src image.Image, p transformParams) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	w, h := p.Width, p.Height
+	switch {
+	case w == 0 && h == 0:
+		w, h = sw, sh
+	case w == 0:
+		w = max(1, sw*h/sh)
+	case h == 0:
+		h = max(1, sh*w/sw)
+	}
+
+	srcRect := b
+	switch p.Fit {
+	case "contain":
+		w, h = fitWithin(sw, sh, w, h)
+	case "cover":
+		// Crop the source to the target aspect ratio around its centre.
+		cw, ch := sw, sh
+		if sw*h > sh*w {
+			cw = max(1, sh*w/h)
+		} else {
+			ch = max(1, sw*h/w)
+		}
+		x0 := b.Min.X + (sw-cw)/2
+		y0 := b.Min.Y + (sh-ch)/2
+		srcRect = image.Rect(x0, y0, x0+cw, y0+ch)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+	return dst
+}
+
+type transformResult struct {
+	key         string
+	data        []byte
+	contentType string
+}
+
+// imageLRU is a byte-bounded least-recently-used cache of rendered images.
+type imageLRU struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	size     int64
+	maxBytes int64
+}
+
+func newImageLRU(maxBytes int64) *imageLRU {
+	return &imageLRU{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		maxBytes: maxBytes,
+	}
+}
+
+func (c *imageLRU) Get(key string) (*transformResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*transformResult), true
+}
+
+func (c *imageLRU) Add(res *transformResult) {
+	n := int64(len(res.data))
+	if n > c.maxBytes/4 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[res.key]; ok {
+		return
+	}
+	c.entries[res.key] = c.order.PushFront(res)
+	c.size += n
+	for c.size > c.maxBytes {
+		oldest := c.order.Back()
+		old := oldest.Value.(*transformResult)
+		c.order.Remove(oldest)
+		delete(c.entries, old.key)
+		c.size -= int64(len(old.data))
+	}
+}
+
+// Purge drops every cached render whose key starts with prefix and returns
+// how many bytes were freed.
+func (c *imageLRU) Purge(prefix string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var freed int64
+	for key, el := range c.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		res := el.Value.(*transformResult)
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.size -= int64(len(res.data))
+		freed += int64(len(res.data))
+	}
+	return freed
+}
+
+var (
+	transformCache *imageLRU
+	transformGroup singleflight.Group
+
+	errNotAnImage = errors.New("not a supported image")
+)
+
+func initImageTransforms() {
+	cfg := &config().ImageTransform
+	if cfg.CacheBytes <= 0 {
+		cfg.CacheBytes = 64 << 20
+	}
+	if cfg.Quality <= 0 || cfg.Quality > 100 {
+		cfg.Quality = 85
+	}
+	if cfg.SaveDataQuality < 0 || cfg.SaveDataQuality > 100 {
+		cfg.SaveDataQuality = 0
+	}
+	transformCache = newImageLRU(cfg.CacheBytes)
+}
+
+func handleImageTransform(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shortID := strings.TrimPrefix(r.URL.Path, "/img/")
+
+	params, err := parseTransformParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	var fileDoc fileRecord
+	err = findFileByShortID(ctx, shortID, &fileDoc)
+	if err == errFileNotFound {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !requireVisible(w, r, &fileDoc) {
+		return
+	}
+	if !requireSigned(w, r, &fileDoc) {
+		return
+	}
+	if !requireUnlocked(w, r, &fileDoc) {
+		return
+	}
+	if burnsAfterDownload(&fileDoc) {
+		http.Error(w, "no previews for this file", http.StatusNotFound)
+		return
+	}
+	if !requireEnabled(w, &fileDoc) {
+		return
+	}
+	if !thumbnailable(fileDoc.Metadata.ContentType) {
+		http.Error(w, "not a supported image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	res, err := imageVariant(ctx, &fileDoc, params)
+	if err == errNotAnImage {
+		http.Error(w, "not a supported image", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, "transform error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", res.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(res.data)))
+	if w.Header().Get("Cache-Control") == "" { // set by requireUnlocked for protected files
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(res.data)
+}
+
+// imageVariant returns f rendered with params, from the cache when it can.
+func imageVariant(ctx context.Context, f *fileRecord, params transformParams) (*transformResult, error) {
+	key := params.key(f.Metadata.ShortID)
+	if res, ok := transformCache.Get(key); ok {
+		return res, nil
+	}
+	v, err, _ := transformGroup.Do(key, func() (interface{}, error) {
+		// Shared with concurrent requests for the same variant.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 60*time.Second)
+		defer cancel()
+		return renderTransform(ctx, f, key, params)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := v.(*transformResult)
+	transformCache.Add(res)
+	return res, nil
+}
+
+func renderTransform(ctx context.Context, f *fileRecord, key string, params transformParams) (*transformResult, error) {
+	content, err := openStoredFile(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	src, err := decodeImage(content)
+	if err != nil {
+		return nil, errNotAnImage
+	}
+	quality := config().ImageTransform.Quality
+	if params.Quality > 0 {
+		quality = params.Quality
+	}
+	data, contentType, err := encodeImage(transformImage(src, params), params.Format, quality)
+	if err != nil {
+		return nil, err
+	}
+	return &transformResult{key: key, data: data, contentType: contentType}, nil
+}
+
+// rawQuality is the quality a /raw/ request asks for, 0 for the original.
+func rawQuality(r *http.Request) (int, error) {
+	q, err := parseQuality(r)
+	if q == 0 && err == nil && strings.EqualFold(r.Header.Get("Save-Data"), "on") {
+		q = config().ImageTransform.SaveDataQuality
+	}
+	return q, err
+}
+
+// serveRawVariant answers a /raw/ request for an image with a recompressed
+// copy when one was asked for and is smaller. It returns false when the
+// original should be served instead.
+func serveRawVariant(w http.ResponseWriter, r *http.Request, f *fileRecord) bool {
+	if f.Metadata.E2E || f.Metadata.Growing || burnsAfterDownload(f) || !thumbnailable(f.Metadata.ContentType) {
+		return false
+	}
+	if config().ImageTransform.SaveDataQuality > 0 {
+		w.Header().Add("Vary", "Save-Data")
+	}
+	quality, err := rawQuality(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	if quality == 0 || r.Header.Get("Range") != "" {
+		return false
+	}
+
+	res, err := imageVariant(r.Context(), f, transformParams{Fit: "contain", Quality: quality})
+	if err != nil || int64(len(res.data)) >= f.Length {
+		return false
+	}
+	if cacheRawFile(w, r, f, "q"+strconv.Itoa(quality)) {
+		return true
+	}
+	h := w.Header()
+	setRawHeaders(h, f)
+	for _, name := range []string{"X-Checksum-SHA256", "X-Checksum-MD5", "X-Checksum-SHA1", "Accept-Ranges"} {
+		h.Del(name)
+	}
+	h.Set("Content-Type", res.contentType)
+	h.Set("Content-Length", strconv.Itoa(len(res.data)))
+	if r.Method == http.MethodHead {
+		return true
+	}
+	n, _ := w.Write(res.data)
+	recordBandwidth(f, int64(n))
+	recordStat(statEvent{Type: statDownload, ShortID: f.Metadata.ShortID, OwnerID: f.Metadata.OwnerID, KeyID: f.Metadata.APIKeyID, Bytes: int64(n)})
+	return true
+}
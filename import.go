@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// With import.enabled, signed-in users can copy a file from another
+// XyliLoader instance without downloading it themselves:
+//
+//	POST /api/v1/files/import   {"url", "sha256", "source_password", "expires", "visibility", "strip_exif"}
+//
+// url is the file's page or /raw/ link; a signed /raw/ link works for
+// private files. The server fetches /raw/, checks the content against the
+// X-Checksum-SHA256 the other instance sends (and against sha256, when
+// given) and stores it under the original filename and content type, as a
+// new upload of the caller. import.hosts limits which instances may be
+// copied from; without it any public address is allowed. Addresses on the
+// local network never are, and redirects are held to the same rules as the
+// link itself.
+
+var (
+	errImportAddress = errors.New("address not allowed")
+
+	importClient *http.Client
+)
+
+func initImport() {
+	cfg := &config().Import
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 300
+	}
+	// The address is checked as it is dialed, after the name is resolved,
+	// so a name that points somewhere else by the time of the request gets
+	// caught too.
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !importAddressAllowed(net.ParseIP(host)) {
+				return errImportAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	importClient = &http.Client{
+		Timeout:       time.Duration(cfg.TimeoutSeconds) * time.Second,
+		Transport:     transport,
+		CheckRedirect: checkImportRedirect,
+	}
+}
+
+// importAddressAllowed keeps imports off loopback, link-local and private
+// addresses.
+func importAddressAllowed(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// importHostAllowed reports whether import.hosts, when set, lists host.
+// Ports do not matter: host is a name or address without one.
+func importHostAllowed(host string) bool {
+	hosts := config().Import.Hosts
+	return len(hosts) == 0 || containsString(hosts, strings.ToLower(host))
+}
+
+// checkImportRedirect holds every hop of a redirect to the rules of the
+// original link. Addresses given by name are checked again when dialed. The
+// source password is only sent to the host it was given for.
+func checkImportRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	u := req.URL
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errImportAddress
+	}
+	if !importHostAllowed(u.Hostname()) {
+		return errImportAddress
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !importAddressAllowed(ip) {
+		return errImportAddress
+	}
+	if u.Host != via[0].URL.Host {
+		req.Header.Del(filePasswordHeader)
+	}
+	return nil
+}
+
+// importSource turns a file link of another instance into its /raw/ URL,
+// keeping a signature if the link has one.
+func importSource(link string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return "", errors.New("Invalid url")
+	}
+	if !importHostAllowed(u.Hostname()) {
+		return "", errors.New("Remote host not allowed")
+	}
+	id := splitSlug(strings.TrimPrefix(strings.TrimPrefix(u.Path, "/"), "raw/"))
+	if id == "" || strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+		return "", errors.New("Invalid url")
+	}
+
+	src := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/raw/" + id}
+	q := u.Query()
+	if q.Has(signatureParam) {
+		src.RawQuery = url.Values{expiryParam: {q.Get(expiryParam)}, signatureParam: {q.Get(signatureParam)}}.Encode()
+	}
+	return src.String(), nil
+}
+
+// importFilename reads the filename from a /raw/ response, falling back to
+// the last part of its path.
+func importFilename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if name := strings.TrimSpace(params["filename"]); name != "" {
+			return name
+		}
+	}
+	return resp.Request.URL.Path[strings.LastIndex(resp.Request.URL.Path, "/")+1:]
+}
+
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if !config().Import.Enabled {
+		jsonError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, key := requestAuth(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		URL            string `json:"url"`
+		SHA256         string `json:"sha256"`
+		SourcePassword string `json:"source_password"`
+		Expires        string `json:"expires"`
+		Visibility     string `json:"visibility"`
+		StripEXIF      string `json:"strip_exif"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	src, err := importSource(req.URL)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expected := ""
+	if req.SHA256 != "" {
+		if expected = parseSHA256(req.SHA256); expected == "" {
+			jsonError(w, "Invalid sha256", http.StatusBadRequest)
+			return
+		}
+	}
+	visibility, err := uploadVisibility(user, req.Visibility)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stripEXIF, err := uploadStripEXIF(user, req.StripEXIF)
+	if err != nil {
+		jsonError(w, "Invalid strip_exif value", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	_, tier := effectiveTier(ctx, user)
+	cancel()
+
+	fetchCtx, cancel := context.WithTimeout(r.Context(), time.Duration(config().Import.TimeoutSeconds)*time.Second)
+	defer cancel()
+	fetch, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, src, nil)
+	if err != nil {
+		jsonError(w, "Invalid url", http.StatusBadRequest)
+		return
+	}
+	// Compressed responses would not match the checksum.
+	fetch.Header.Set("Accept-Encoding", "identity")
+	if req.SourcePassword != "" {
+		fetch.Header.Set(filePasswordHeader, req.SourcePassword)
+	}
+	resp, err := importClient.Do(fetch)
+	if err != nil {
+		log.Printf("Error importing %s: %v", src, err)
+		jsonError(w, "Remote file could not be fetched", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		jsonError(w, fmt.Sprintf("Remote file could not be fetched: %s", resp.Status), http.StatusBadGateway)
+		return
+	}
+	remoteSum := parseSHA256(resp.Header.Get("X-Checksum-SHA256"))
+	if remoteSum == "" {
+		jsonError(w, "Remote file has no checksum", http.StatusBadGateway)
+		return
+	}
+	if expected != "" && remoteSum != expected {
+		jsonError(w, "Checksum mismatch", http.StatusBadGateway)
+		return
+	}
+
+	if resp.ContentLength > tier.MaxFileSize {
+		jsonError(w, fmt.Sprintf("File too large (max %s)", formatSize(tier.MaxFileSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if resp.ContentLength > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		err := checkTierQuota(ctx, user, resp.ContentLength)
+		cancel()
+		if isTierLimit(err) {
+			jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	// The content is checked in full before anything is stored.
+	tmp, err := os.CreateTemp("", "xyli-import-*")
+	if err != nil {
+		jsonError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(resp.Body, tier.MaxFileSize+1))
+	if err != nil {
+		log.Printf("Error importing %s: %v", src, err)
+		jsonError(w, "Remote file could not be fetched", http.StatusBadGateway)
+		return
+	}
+	if size > tier.MaxFileSize {
+		jsonError(w, fmt.Sprintf("File too large (max %s)", formatSize(tier.MaxFileSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != remoteSum {
+		jsonError(w, "Checksum mismatch", http.StatusBadGateway)
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(r.Context(), 10*time.Second)
+	err = checkTierQuota(ctx, user, size)
+	cancel()
+	if isTierLimit(err) {
+		jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	filename := importFilename(resp)
+	e2e := resp.Header.Get("X-Xyli-E2E") != ""
+	contentType := safeContentType(resp.Header.Get("Content-Type"))
+	if mediaType(contentType) == "" {
+		contentType = "application/octet-stream"
+	}
+	if e2e {
+		contentType = e2eContentType
+	}
+	ttl, err := uploadExpiry(defaultExpires(user, req.Expires), tier, isPaste(contentType))
+	if err != nil {
+		jsonError(w, "Invalid expires value", http.StatusBadRequest)
+		return
+	}
+	if !dbBreaker.Allow() {
+		serveUnavailable(w, true)
+		return
+	}
+
+	metadata := newUploadMetadata(contentType, user)
+	if key != nil {
+		metadata["api_key_id"] = key.KeyID
+	}
+	if hash, _ := uploadPasswordHash(user, ""); hash != "" {
+		metadata["password_hash"] = hash
+	}
+	if visibility != "" {
+		metadata["visibility"] = visibility
+	}
+	if e2e {
+		metadata["e2e"] = true
+	} else if stripEXIF {
+		metadata["strip_exif"] = true
+	}
+	shortID := metadata["short_id"].(string)
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+		metadata["expires_at"] = expiresAt
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		jsonError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	err = storeUpload(r.Context(), filename, tmp, metadata)
+	if isInfected(err) {
+		jsonError(w, "File rejected: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err == errScannerUnavailable {
+		setUnavailable(w.Header(), scannerRetryAfter)
+		jsonError(w, "Virus scanner unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if isMongoOutage(err) {
+		serveUnavailable(w, true)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	notFoundCache.Forget(shortID)
+	source, _, _ := strings.Cut(src, "?")
+	log.Printf("User %s imported %s as %s", user.Username, source, shortID)
+
+	response := map[string]interface{}{
+		"link":          fileLink(shortID, filename),
+		"raw_link":      fmt.Sprintf("%s/raw/%s", config().Upload.BaseURL, shortID),
+		"deletion_link": fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"]),
+		"filename":      filename,
+		"content_type":  contentType,
+		"size":          size,
+		"sha256":        remoteSum,
+		"source":        source,
+	}
+	if ttl > 0 {
+		response["expires_at"] = expiresAt
+	}
+	setQuotaHeaders(r.Context(), w.Header(), user, tier)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The integrations page downloads client configs that are generated here,
+// with the instance URL and, for logged-in users, one of their API keys
+// already filled in. The user picks the key; without one, a key named after
+// the integration is reused or created, so downloading the same config
+// twice does not pile up keys. Anonymous visitors get configs that upload
+// anonymously.
+
+type integration struct {
+	filename    string
+	contentType string
+	keyName     string
+	render      func(baseURL, secret string) string
+}
+
+var integrations = map[string]integration{
+	"sharex": {"XyliLoader.sxcu", "application/json", "ShareX", shareXConfig},
+	"flameshot": {"xyli-flameshot.sh", "text/x-shellscript", "Flameshot", func(baseURL, secret string) string {
+		return screenshotScript("Flameshot", "flameshot gui -r", baseURL, secret)
+	}},
+	"maim": {"xyli-maim.sh", "text/x-shellscript", "maim", func(baseURL, secret string) string {
+		return screenshotScript("maim", "maim -s", baseURL, secret)
+	}},
+	"curl": {"xyli-curl.txt", "text/plain; charset=utf-8", "curl", func(baseURL, secret string) string {
+		return fmt.Sprintf("curl%s -F \"file=@picture.png\" %s/upload\n", curlAuth(secret), baseURL)
+	}},
+	"cli": {"config.json", "application/json", "xyli CLI", func(baseURL, secret string) string {
+		data, _ := json.MarshalIndent(map[string]string{"server": baseURL, "api_key": secret}, "", "  ")
+		return string(data) + "\n"
+	}},
+}
+
+// screenshotScript takes a screenshot with capture, pipes it to /u and
+// copies the link it answers with.
+func screenshotScript(tool, capture, baseURL, secret string) string {
+	return fmt.Sprintf(`#!/bin/sh
+# Takes a region screenshot with %[1]s, uploads it to %[3]s and copies the
+# link to the clipboard. Bind it to a hotkey in your desktop settings.
+set -e
+link=$(%[2]s | curl -fsS%[4]s --data-binary @- "%[3]s/u?name=screenshot.png")
+[ -n "$link" ] || exit 0
+if command -v wl-copy >/dev/null; then
+	printf %%s "$link" | wl-copy
+else
+	printf %%s "$link" | xclip -selection clipboard
+fi
+notify-send "XyliLoader" "$link" 2>/dev/null || echo "$link"
+`, tool, capture, baseURL, curlAuth(secret))
+}
+
+// curlAuth is the curl option sending secret, if there is one.
+func curlAuth(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return fmt.Sprintf(` -H "Authorization: Bearer %s"`, secret)
+}
+
+func shareXConfig(baseURL, secret string) string {
+	sxcu := map[string]interface{}{
+		"Version":         "14.1.0",
+		"Name":            "XyliUploader",
+		"DestinationType": "ImageUploader, TextUploader, FileUploader",
+		"RequestMethod":   "POST",
+		"RequestURL":      baseURL + "/upload",
+		"Body":            "MultipartFormData",
+		"FileFormName":    "file",
+		"URL":             "{json:link}",
+		"DeletionURL":     "{json:deletion_link}",
+		"ErrorMessage":    "{json:error}",
+	}
+	if secret != "" {
+		sxcu["Headers"] = map[string]string{"Authorization": "Bearer " + secret}
+	}
+	data, _ := json.MarshalIndent(sxcu, "", "  ")
+	return string(data)
+}
+
+// integrationKey returns the user's key keyID, or the key named name,
+// creating it when there is none.
+func integrationKey(ctx context.Context, user *User, keyID, name string) (*APIKey, error) {
+	var key APIKey
+	filter := bson.M{"user_id": user.ID, "name": name}
+	if keyID != "" {
+		filter = bson.M{"user_id": user.ID, "key_id": keyID}
+	}
+	err := apiKeysColl.FindOne(ctx, filter).Decode(&key)
+	dbBreaker.Record(err)
+	if err == nil || err != mongo.ErrNoDocuments || keyID != "" {
+		return &key, err
+	}
+
+	count, err := apiKeysColl.CountDocuments(ctx, bson.M{"user_id": user.ID})
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxAPIKeysPerUser {
+		return nil, errTooManyKeys
+	}
+	created := newAPIKey(user.ID, name)
+	_, err = apiKeysColl.InsertOne(ctx, created)
+	dbBreaker.Record(err)
+	return created, err
+}
+
+// handleIntegrationConfig serves POST /api/integrations/{name} {key_id}.
+// Like key management, keys are only handed out to a browser session.
+func handleIntegrationConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/integrations/")
+	target, ok := integrations[name]
+	if !ok {
+		jsonError(w, "Unknown integration", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		KeyID string `json:"key_id"`
+	}
+	json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req)
+
+	var secret string
+	if user := currentUser(r); user != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		key, err := integrationKey(ctx, user, strings.TrimSpace(req.KeyID), target.keyName)
+		if err == mongo.ErrNoDocuments {
+			jsonError(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		if err == errTooManyKeys {
+			jsonError(w, "Too many API keys", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		secret = key.Secret
+	}
+
+	w.Header().Set("Content-Type", target.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", target.filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(target.render(config().Upload.BaseURL, secret)))
+}
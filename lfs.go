@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A Git LFS server for the basic transfer adapter. Point a repository at it
+// with
+//
+//	git config -f .lfsconfig lfs.url https://host/lfs/team/repo
+//
+// and give Git an API key as the password (any username). The batch API at
+// /lfs/{repo}/objects/batch answers with upload and download links signed
+// for lfs.linkTTLSeconds, so the transfers themselves need no credentials.
+// Objects are regular uploads of the account, named after their OID and
+// counted against its plan; they are shared between all of the account's
+// repositories, the repository name only being recorded with the object.
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+var (
+	lfsKey  = make([]byte, 32)
+	lfsOID  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	lfsRepo = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+)
+
+func initLFS(ctx context.Context) {
+	rand.Read(lfsKey)
+	if config().LFS.LinkTTLSeconds <= 0 {
+		config().LFS.LinkTTLSeconds = 3600
+	}
+	if !config().LFS.Enabled {
+		return
+	}
+	_, err := gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "metadata.owner_id", Value: 1}, {Key: "metadata.lfs_oid", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"metadata.lfs_oid": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Error creating LFS index: %v", err)
+	}
+}
+
+type lfsObject struct {
+	OID           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError      `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href      string    `json:"href"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func lfsError(w http.ResponseWriter, message string, status int) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("LFS-Authenticate", `Basic realm="XyliLoader"`)
+		w.Header().Set("WWW-Authenticate", `Basic realm="XyliLoader"`)
+	}
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// lfsSign signs a transfer of oid for owner until expires.
+func lfsSign(method string, owner primitive.ObjectID, repo, oid string, size, expires int64) string {
+	mac := hmac.New(sha256.New, lfsKey)
+	fmt.Fprintf(mac, "%s|%s|%s|%s|%d|%d", method, owner.Hex(), repo, oid, size, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func lfsHref(method string, owner primitive.ObjectID, repo, oid string, size int64, expires time.Time) string {
+	q := url.Values{
+		"owner":   {owner.Hex()},
+		"size":    {strconv.FormatInt(size, 10)},
+		"expires": {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":     {lfsSign(method, owner, repo, oid, size, expires.Unix())},
+	}
+	return fmt.Sprintf("%s/lfs/%s/objects/%s?%s", config().Upload.BaseURL, repo, oid, q.Encode())
+}
+
+// findLFSObject returns the stored object oid of owner.
+func findLFSObject(ctx context.Context, owner primitive.ObjectID, oid string) (*fileRecord, error) {
+	var f fileRecord
+	err := findFile(ctx, bson.M{
+		"metadata.owner_id":   owner,
+		"metadata.lfs_oid":    oid,
+		"metadata.expires_at": notExpired(),
+	}, &f)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// handleLFS routes /lfs/{repo}/objects/batch and the signed transfer links
+// /lfs/{repo}/objects/{oid}.
+func handleLFS(w http.ResponseWriter, r *http.Request) {
+	if !config().LFS.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	repo, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/lfs/"), "/objects/")
+	if !ok || !lfsRepo.MatchString(repo) || len(repo) > 200 {
+		lfsError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if rest == "batch" {
+		handleLFSBatch(w, r, repo)
+		return
+	}
+	if !lfsOID.MatchString(rest) {
+		lfsError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	handleLFSTransfer(w, r, repo, rest)
+}
+
+func handleLFSBatch(w http.ResponseWriter, r *http.Request, repo string) {
+	if r.Method != http.MethodPost {
+		lfsError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, secret, ok := r.BasicAuth()
+	if !ok {
+		secret = bearerToken(r)
+	}
+	_, user := lookupAPIKey("secret", secret)
+	if user == nil {
+		lfsError(w, "Credentials needed", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Operation string      `json:"operation"`
+		Transfers []string    `json:"transfers"`
+		Objects   []lfsObject `json:"objects"`
+		HashAlgo  string      `json:"hash_algo"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		lfsError(w, "Invalid JSON", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Operation != "upload" && req.Operation != "download" {
+		lfsError(w, "Unknown operation", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		lfsError(w, "Only sha256 is supported", http.StatusConflict)
+		return
+	}
+	if len(req.Transfers) > 0 && !containsString(req.Transfers, "basic") {
+		lfsError(w, "Only the basic transfer adapter is supported", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	expires := time.Now().Add(time.Duration(config().LFS.LinkTTLSeconds) * time.Second).UTC().Truncate(time.Second)
+	objects := make([]lfsObject, 0, len(req.Objects))
+	for _, o := range req.Objects {
+		out := lfsObject{OID: o.OID, Size: o.Size}
+		if !lfsOID.MatchString(o.OID) || o.Size < 0 {
+			out.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+			objects = append(objects, out)
+			continue
+		}
+		f, err := findLFSObject(ctx, user.ID, o.OID)
+		if err != nil && err != errFileNotFound {
+			if isMongoOutage(err) {
+				lfsError(w, "Storage temporarily unavailable", http.StatusServiceUnavailable)
+			} else {
+				lfsError(w, "Database error", http.StatusInternalServerError)
+			}
+			return
+		}
+		switch {
+		case req.Operation == "download" && f == nil:
+			out.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "Object does not exist"}
+		case req.Operation == "download":
+			out.Size = f.Length
+			out.Authenticated = true
+			out.Actions = map[string]lfsAction{"download": {lfsHref(http.MethodGet, user.ID, repo, o.OID, f.Length, expires), expires}}
+		case f != nil:
+			// Already stored: no actions tells the client to skip it.
+			out.Size = f.Length
+		case o.Size > config().Upload.MaxSize:
+			out.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: fmt.Sprintf("Object too large (max %s)", formatSize(config().Upload.MaxSize))}
+		default:
+			out.Authenticated = true
+			out.Actions = map[string]lfsAction{"upload": {lfsHref(http.MethodPut, user.ID, repo, o.OID, o.Size, expires), expires}}
+		}
+		objects = append(objects, out)
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transfer":  "basic",
+		"objects":   objects,
+		"hash_algo": "sha256",
+	})
+}
+
+// handleLFSTransfer serves a signed upload or download link.
+func handleLFSTransfer(w http.ResponseWriter, r *http.Request, repo, oid string) {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodPut {
+		lfsError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	owner, err := primitive.ObjectIDFromHex(q.Get("owner"))
+	size, _ := strconv.ParseInt(q.Get("size"), 10, 64)
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(q.Get("sig")), []byte(lfsSign(method, owner, repo, oid, size, expires))) {
+		lfsError(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		lfsError(w, "Link expired", http.StatusForbidden)
+		return
+	}
+
+	if method == http.MethodGet {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		f, err := findLFSObject(ctx, owner, oid)
+		cancel()
+		if err == errFileNotFound {
+			lfsError(w, "Object does not exist", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			lfsError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if bandwidthExceeded(f) {
+			lfsError(w, "Bandwidth limit reached", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(f.Length, 10))
+		if r.Method == http.MethodHead {
+			return
+		}
+		rc, err := openStoredFile(r.Context(), f)
+		if err != nil {
+			lfsError(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+		n, _ := io.Copy(w, rc)
+		recordBandwidth(f, n)
+		return
+	}
+
+	var user User
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	err = usersColl.FindOne(ctx, bson.M{"_id": owner}).Decode(&user)
+	dbBreaker.Record(err)
+	if err == nil {
+		err = checkTierQuota(ctx, &user, size)
+	}
+	cancel()
+	if isTierLimit(err) {
+		lfsError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		lfsError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "xyli-lfs-*")
+	if err != nil {
+		lfsError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(r.Body, size+1))
+	if err != nil {
+		lfsError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if n != size || hex.EncodeToString(sum.Sum(nil)) != oid {
+		lfsError(w, "Content does not match the object ID", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
+	// Two clients pushing the same object both get a link; keep the first.
+	if _, err := findLFSObject(ctx, owner, oid); err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	_, tier := effectiveTier(ctx, &user)
+	ttl, err := uploadExpiry("never", tier, false)
+	if err != nil {
+		lfsError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	metadata := newUploadMetadata("application/octet-stream", &user)
+	metadata["lfs_oid"] = oid
+	metadata["lfs_repo"] = repo
+	if ttl > 0 {
+		metadata["expires_at"] = time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+	}
+	err = storeUpload(ctx, oid, io.NewSectionReader(tmp, 0, size), metadata)
+	if isInfected(err) {
+		lfsError(w, "Object rejected: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err == errScannerUnavailable {
+		setUnavailable(w.Header(), scannerRetryAfter)
+		lfsError(w, "Virus scanner unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		lfsError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	notFoundCache.Forget(metadata["short_id"].(string))
+	w.WriteHeader(http.StatusOK)
+}
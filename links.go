@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Short links live next to files: POST /shorten stores a target URL under a
+// short ID, and /{id} redirects to it when no file has that ID. They are
+// deleted through /delete/{token} like files, and expire the same way,
+// through a TTL index rather than the expiry cleaner since there is no
+// content to remove.
+
+const maxLinkTarget = 2048
+
+type shortLink struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	ShortID     string             `bson:"short_id"`
+	Target      string             `bson:"target"`
+	DeleteToken string             `bson:"delete_token"`
+	OwnerID     primitive.ObjectID `bson:"owner_id,omitempty"`
+	APIKeyID    string             `bson:"api_key_id,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	ExpiresAt   *time.Time         `bson:"expires_at,omitempty"`
+	Clicks      int64              `bson:"clicks"`
+}
+
+var linksColl *mongo.Collection
+
+func initLinks(ctx context.Context) {
+	linksColl = db.Collection("links")
+	_, err := linksColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "short_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "delete_token", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("Error creating links indexes: %v", err)
+	}
+}
+
+// validLinkTarget reports whether target is an absolute http(s) URL that
+// does not point back at this instance, which could make redirect loops.
+func validLinkTarget(target string) bool {
+	if len(target) > maxLinkTarget {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if base, err := url.Parse(config().Upload.BaseURL); err == nil && base.Host != "" && strings.EqualFold(base.Host, u.Host) {
+		return false
+	}
+	return true
+}
+
+func handleShorten(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		URL     string `json:"url"`
+		Expires string `json:"expires"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.URL = r.FormValue("url")
+		req.Expires = r.FormValue("expires")
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if !validLinkTarget(req.URL) {
+		jsonError(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	user, key := requestAuth(r)
+	var tier *Tier
+	if user != nil {
+		_, tier = effectiveTier(ctx, user)
+	} else if !allowAnonUpload(w, r, 0) {
+		return
+	}
+	ttl, err := uploadExpiry(req.Expires, tier, false)
+	if err != nil {
+		jsonError(w, "Invalid expires value", http.StatusBadRequest)
+		return
+	}
+
+	link := shortLink{
+		ShortID:     generateID(),
+		Target:      req.URL,
+		DeleteToken: generateID() + generateID(),
+		CreatedAt:   time.Now(),
+	}
+	if user != nil {
+		link.OwnerID = user.ID
+	}
+	if key != nil {
+		link.APIKeyID = key.KeyID
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+		link.ExpiresAt = &expiresAt
+	}
+
+	_, err = linksColl.InsertOne(ctx, link)
+	dbBreaker.Record(err)
+	if isMongoOutage(err) {
+		serveUnavailable(w, true)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	notFoundCache.Forget(link.ShortID)
+
+	response := map[string]interface{}{
+		"link":          fmt.Sprintf("%s/%s", config().Upload.BaseURL, link.ShortID),
+		"deletion_link": fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, link.DeleteToken),
+		"target":        link.Target,
+	}
+	if link.ExpiresAt != nil {
+		response["expires_at"] = link.ExpiresAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveShortLink redirects to the target of the short link with this ID and
+// reports whether there was one.
+func serveShortLink(ctx context.Context, w http.ResponseWriter, r *http.Request, shortID string) bool {
+	var link shortLink
+	err := linksColl.FindOneAndUpdate(ctx,
+		bson.M{"short_id": shortID, "expires_at": notExpired()},
+		bson.M{"$inc": bson.M{"clicks": 1}},
+	).Decode(&link)
+	dbBreaker.Record(err)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, link.Target, http.StatusFound)
+	return true
+}
+
+// deleteShortLink removes the link with this deletion token, reporting
+// whether there was one.
+func deleteShortLink(ctx context.Context, deleteToken string) (bool, error) {
+	res, err := linksColl.DeleteOne(ctx, bson.M{"delete_token": deleteToken})
+	dbBreaker.Record(err)
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
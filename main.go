@@ -5,17 +5,25 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -27,21 +35,327 @@ type Config struct {
 		Database string `json:"database"`
 	} `json:"mongodb"`
 	Server struct {
-		Port int    `json:"port"`
-		Host string `json:"host"`
+		Port                   int    `json:"port"`
+		Host                   string `json:"host"`
+		TrustProxy             bool   `json:"trustProxy"`
+		ShutdownTimeoutSeconds int    `json:"shutdownTimeoutSeconds"`
+		TLS                    struct {
+			CertFile string `json:"certFile"`
+			KeyFile  string `json:"keyFile"`
+			ACME     struct {
+				Enabled      bool     `json:"enabled"`
+				Domains      []string `json:"domains"`
+				Email        string   `json:"email"`
+				CacheDir     string   `json:"cacheDir"`
+				DirectoryURL string   `json:"directoryURL"`
+			} `json:"acme"`
+			RedirectPort int `json:"redirectPort"`
+		} `json:"tls"`
 	} `json:"server"`
+	Display struct {
+		SizeUnits string `json:"sizeUnits"`
+	} `json:"display"`
 	Upload struct {
-		MaxSize int64  `json:"maxSize"`
-		BaseURL string `json:"baseURL"`
+		MaxSize       int64  `json:"maxSize"`
+		BaseURL       string `json:"baseURL"`
+		DefaultExpiry string `json:"defaultExpiry"`
+		MaxExpiry     string `json:"maxExpiry"`
+		// Pastes (text uploads) may have their own lifetimes; empty falls
+		// back to the ones above.
+		PasteDefaultExpiry string `json:"pasteDefaultExpiry"`
+		PasteMaxExpiry     string `json:"pasteMaxExpiry"`
+		// Slugs adds a transliterated filename to links: /abc12/otchet.pdf.
+		Slugs bool `json:"slugs"`
 	} `json:"upload"`
+	Paste struct {
+		MaxSize int64  `json:"maxSize"`
+		Style   string `json:"style"`
+	} `json:"paste"`
+	Storage struct {
+		Backend string `json:"backend"`
+		Disk    struct {
+			Dir string `json:"dir"`
+		} `json:"disk"`
+		S3 struct {
+			Endpoint  string `json:"endpoint"`
+			Region    string `json:"region"`
+			Bucket    string `json:"bucket"`
+			Prefix    string `json:"prefix"`
+			AccessKey string `json:"accessKey"`
+			SecretKey string `json:"secretKey"`
+			PathStyle bool   `json:"pathStyle"`
+		} `json:"s3"`
+		Encryption struct {
+			Enabled bool   `json:"enabled"`
+			Key     string `json:"key"`
+			KMS     struct {
+				URL        string `json:"url"`
+				Token      string `json:"token"`
+				WrappedKey string `json:"wrappedKey"`
+			} `json:"kms"`
+		} `json:"encryption"`
+	} `json:"storage"`
+	Thumbnails struct {
+		MaxWidth  int `json:"maxWidth"`
+		MaxHeight int `json:"maxHeight"`
+		Quality   int `json:"quality"`
+	} `json:"thumbnails"`
+	ImageTransform struct {
+		CacheBytes int64 `json:"cacheBytes"`
+		Quality    int   `json:"quality"`
+		// SaveDataQuality recompresses images on /raw/ for clients that
+		// send Save-Data: on; 0 serves them the original.
+		SaveDataQuality int `json:"saveDataQuality"`
+	} `json:"imageTransform"`
+	Posters struct {
+		Enabled       bool   `json:"enabled"`
+		FFmpeg        string `json:"ffmpeg"`
+		Workers       int    `json:"workers"`
+		QueueSize     int    `json:"queueSize"`
+		OffsetSeconds int    `json:"offsetSeconds"`
+	} `json:"posters"`
+	Updates struct {
+		Enabled       bool   `json:"enabled"`
+		URL           string `json:"url"`
+		IntervalHours int    `json:"intervalHours"`
+	} `json:"updates"`
+	SignedURLs struct {
+		Secret      string `json:"secret"`
+		MaxTTLHours int    `json:"maxTTLHours"`
+	} `json:"signedURLs"`
+	API struct {
+		Deprecations []deprecation `json:"deprecations"`
+	} `json:"api"`
+	Compression struct {
+		Enabled bool     `json:"enabled"`
+		MinSize int64    `json:"minSize"`
+		MaxSize int64    `json:"maxSize"`
+		Types   []string `json:"types"`
+	} `json:"compression"`
+	OCR struct {
+		Enabled   bool   `json:"enabled"`
+		Tesseract string `json:"tesseract"`
+		Languages string `json:"languages"`
+		URL       string `json:"url"`
+		Token     string `json:"token"`
+		Workers   int    `json:"workers"`
+		QueueSize int    `json:"queueSize"`
+		MaxBytes  int64  `json:"maxBytes"`
+	} `json:"ocr"`
+	DocInfo struct {
+		Enabled   bool   `json:"enabled"`
+		PDFInfo   string `json:"pdfinfo"`
+		Workers   int    `json:"workers"`
+		QueueSize int    `json:"queueSize"`
+		MaxBytes  int64  `json:"maxBytes"`
+	} `json:"docInfo"`
+	Previews struct {
+		Enabled      bool   `json:"enabled"`
+		Soffice      string `json:"soffice"`
+		GotenbergURL string `json:"gotenbergUrl"`
+		Workers      int    `json:"workers"`
+		QueueSize    int    `json:"queueSize"`
+		MaxBytes     int64  `json:"maxBytes"`
+	} `json:"previews"`
+	Viewers []ViewerRule `json:"viewers"`
+	Tiers   struct {
+		Default     string           `json:"default"`
+		Definitions map[string]*Tier `json:"definitions"`
+	} `json:"tiers"`
+	Checksums struct {
+		MD5  bool `json:"md5"`
+		SHA1 bool `json:"sha1"`
+	} `json:"checksums"`
+	Dedup struct {
+		Enabled bool `json:"enabled"`
+	} `json:"dedup"`
+	Antivirus struct {
+		Enabled        bool   `json:"enabled"`
+		Address        string `json:"address"`
+		Action         string `json:"action"`
+		TimeoutSeconds int    `json:"timeoutSeconds"`
+		FailOpen       bool   `json:"failOpen"`
+	} `json:"antivirus"`
+	Admin struct {
+		Users []string `json:"users"`
+	} `json:"admin"`
+	Spool struct {
+		Enabled  bool   `json:"enabled"`
+		Dir      string `json:"dir"`
+		MaxBytes int64  `json:"maxBytes"`
+	} `json:"spool"`
+	AnonQuota struct {
+		Enabled       bool   `json:"enabled"`
+		MaxUploads    int    `json:"maxUploads"`
+		MaxBytes      int64  `json:"maxBytes"`
+		WindowSeconds int    `json:"windowSeconds"`
+		IPMultiplier  int    `json:"ipMultiplier"`
+		Secret        string `json:"secret"`
+	} `json:"anonQuota"`
+	OAuth struct {
+		Providers []*OAuthProvider `json:"providers"`
+	} `json:"oauth"`
+	Tokens struct {
+		Enabled          bool   `json:"enabled"`
+		Secret           string `json:"secret"`
+		AccessTTLMinutes int    `json:"accessTTLMinutes"`
+		RefreshTTLDays   int    `json:"refreshTTLDays"`
+	} `json:"tokens"`
+	Captcha struct {
+		Provider string `json:"provider"` // "hcaptcha" or "turnstile"; empty disables
+		SiteKey  string `json:"siteKey"`
+		Secret   string `json:"secret"`
+	} `json:"captcha"`
+	NegativeCache struct {
+		TTLSeconds int `json:"ttlSeconds"`
+		MaxEntries int `json:"maxEntries"`
+	} `json:"negativeCache"`
+	Scraping struct {
+		Enabled           bool     `json:"enabled"`
+		Action            string   `json:"action"`
+		NotFoundThreshold int      `json:"notFoundThreshold"`
+		WindowSeconds     int      `json:"windowSeconds"`
+		FlagSeconds       int      `json:"flagSeconds"`
+		TarpitSeconds     int      `json:"tarpitSeconds"`
+		UserAgentPatterns []string `json:"userAgentPatterns"`
+	} `json:"scraping"`
+	Challenge struct {
+		Enabled      bool   `json:"enabled"`
+		Mode         string `json:"mode"`
+		Difficulty   int    `json:"difficulty"`
+		DelaySeconds int    `json:"delaySeconds"`
+		TTLSeconds   int    `json:"ttlSeconds"`
+	} `json:"challenge"`
+	S3API struct {
+		Enabled bool `json:"enabled"`
+	} `json:"s3api"`
+	Notify struct {
+		WebhookURL string `json:"webhookURL"`
+	} `json:"notify"`
+	Webhooks []WebhookConfig `json:"webhooks"`
+	Discord  struct {
+		Enabled         bool   `json:"enabled"`
+		ApplicationID   string `json:"applicationId"`
+		PublicKey       string `json:"publicKey"`
+		BotToken        string `json:"botToken"`
+		NotifyChannelID string `json:"notifyChannelId"`
+		MaxBytes        int64  `json:"maxBytes"`
+	} `json:"discord"`
+	GRPC struct {
+		Enabled  bool   `json:"enabled"`
+		Listen   string `json:"listen"`
+		CertFile string `json:"certFile"`
+		KeyFile  string `json:"keyFile"`
+		Insecure bool   `json:"insecure"` // plaintext, for a TLS proxy in front
+	} `json:"grpc"`
+	Shortcuts struct {
+		MaxBytes int64 `json:"maxBytes"`
+	} `json:"shortcuts"`
+	WebDAV struct {
+		Enabled bool `json:"enabled"`
+	} `json:"webdav"`
+	SFTP struct {
+		Enabled     bool   `json:"enabled"`
+		Listen      string `json:"listen"`
+		HostKeyFile string `json:"hostKeyFile"`
+	} `json:"sftp"`
+	Reports struct {
+		// AutoHideThreshold makes a file private at this many open
+		// reports; 0 never hides files on its own.
+		AutoHideThreshold int `json:"autoHideThreshold"`
+	} `json:"reports"`
+	Receipts struct {
+		Enabled bool   `json:"enabled"`
+		KeyFile string `json:"keyFile"`
+	} `json:"receipts"`
+	Import struct {
+		Enabled        bool     `json:"enabled"`
+		Hosts          []string `json:"hosts"` // empty allows any public address
+		TimeoutSeconds int      `json:"timeoutSeconds"`
+	} `json:"import"`
+	LFS struct {
+		Enabled        bool `json:"enabled"`
+		LinkTTLSeconds int  `json:"linkTTLSeconds"`
+	} `json:"lfs"`
+	Registry struct {
+		Enabled bool `json:"enabled"`
+	} `json:"registry"`
+	Artifacts struct {
+		KeepBuilds    int `json:"keepBuilds"`
+		MaxKeepBuilds int `json:"maxKeepBuilds"`
+	} `json:"artifacts"`
+	SLO struct {
+		Enabled            bool     `json:"enabled"`
+		Routes             []string `json:"routes"`
+		Availability       float64  `json:"availability"`
+		LatencyMs          int      `json:"latencyMs"`
+		LatencyTarget      float64  `json:"latencyTarget"`
+		ShortWindowMinutes int      `json:"shortWindowMinutes"`
+		LongWindowMinutes  int      `json:"longWindowMinutes"`
+		BurnRate           float64  `json:"burnRate"`
+		MinRequests        int      `json:"minRequests"`
+	} `json:"slo"`
+	Status struct {
+		StorageCapacity int64  `json:"storageCapacity"`
+		Incident        string `json:"incident"`
+		IncidentHours   int    `json:"incidentHours"`
+	} `json:"status"`
+	Prometheus struct {
+		Enabled bool   `json:"enabled"`
+		Token   string `json:"token"`
+		Push    struct {
+			URL             string `json:"url"`
+			Job             string `json:"job"`
+			Instance        string `json:"instance"`
+			IntervalSeconds int    `json:"intervalSeconds"`
+			Username        string `json:"username"`
+			Password        string `json:"password"`
+			BearerToken     string `json:"bearerToken"`
+		} `json:"push"`
+	} `json:"prometheus"`
+	Stats struct {
+		RawRetentionDays  int `json:"rawRetentionDays"`
+		FileRetentionDays int `json:"fileRetentionDays"`
+	} `json:"stats"`
+	VideoQoE struct {
+		Enabled         bool  `json:"enabled"`
+		SmallRangeBytes int64 `json:"smallRangeBytes"`
+	} `json:"videoQoe"`
+	Metering struct {
+		Enabled bool `json:"enabled"`
+		Webhook struct {
+			URL    string `json:"url"`
+			Secret string `json:"secret"`
+		} `json:"webhook"`
+		Stripe struct {
+			SecretKey      string `json:"secretKey"`
+			StorageEvent   string `json:"storageEvent"`
+			BandwidthEvent string `json:"bandwidthEvent"`
+			APIBase        string `json:"apiBase"`
+		} `json:"stripe"`
+	} `json:"metering"`
+	Breaker struct {
+		FailureThreshold int `json:"failureThreshold"`
+		WindowSeconds    int `json:"windowSeconds"`
+		CooldownSeconds  int `json:"cooldownSeconds"`
+	} `json:"breaker"`
 }
 
 var (
 	client    *mongo.Client
+	db        *mongo.Database
 	gfsBucket *gridfs.Bucket
-	config    Config
+
+	currentConfig atomic.Pointer[Config]
 )
 
+// config returns the configuration in effect. A reload publishes a new
+// snapshot rather than changing this one, so it must not be modified once
+// the server is running.
+func config() *Config {
+	return currentConfig.Load()
+}
+
 // =-=-=-=-=-=-=-=-XYLIUPLOADER-=-=-=-=-=-=-=-=
 
 // Привет. Это Манук. Пару слов о проекте: Здесь используется база данных MongoDB для хранения файлов в GridFS.
@@ -52,35 +366,154 @@ var (
 
 // =-=-=-=-=-=-=-=-BY=MANUKQ-=-=-=-=-=-=-=-=-=
 
-func init() {
+// setup reads the flags and the configuration and connects everything the
+// server needs. main runs it first; in init it would parse flags for any
+// program that merely links the package, tests included.
+func setup() {
 	godotenv.Load()
+	flag.Parse()
 
-	configFile, err := os.ReadFile("config.json")
-	if err != nil {
-		log.Fatal("Error reading config.json:", err)
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-	err = json.Unmarshal(configFile, &config)
-	if err != nil {
-		log.Fatal("Error parsing config.json:", err)
+	if config().Breaker.FailureThreshold <= 0 {
+		config().Breaker.FailureThreshold = 5
+	}
+	if config().Breaker.WindowSeconds <= 0 {
+		config().Breaker.WindowSeconds = 30
+	}
+	if config().Breaker.CooldownSeconds <= 0 {
+		config().Breaker.CooldownSeconds = 15
 	}
 
+	if config().NegativeCache.TTLSeconds <= 0 {
+		config().NegativeCache.TTLSeconds = 60
+	}
+	if config().NegativeCache.MaxEntries <= 0 {
+		config().NegativeCache.MaxEntries = 100000
+	}
+	notFoundCache = newMissCache(
+		time.Duration(config().NegativeCache.TTLSeconds)*time.Second,
+		config().NegativeCache.MaxEntries,
+	)
+
+	dbBreaker = newCircuitBreaker(
+		config().Breaker.FailureThreshold,
+		time.Duration(config().Breaker.WindowSeconds)*time.Second,
+		time.Duration(config().Breaker.CooldownSeconds)*time.Second,
+	)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(config.MongoDB.URI))
+	var err error
+	client, err = mongo.Connect(ctx, options.Client().ApplyURI(config().MongoDB.URI))
 	if err != nil {
 		log.Fatal("Error connecting to MongoDB:", err)
 	}
 
-	db := client.Database(config.MongoDB.Database)
+	db = client.Database(config().MongoDB.Database)
 	gfsBucket, err = gridfs.NewBucket(db)
 	if err != nil {
 		log.Fatal("Error creating GridFS bucket:", err)
 	}
 
-	log.Printf("Connected to MongoDB at %s", config.MongoDB.URI)
-	log.Printf("Using database: %s", config.MongoDB.Database)
+	if err := initStorage(); err != nil {
+		log.Fatal("Error initialising storage:", err)
+	}
+	if err := initEncryption(ctx); err != nil {
+		log.Fatal(err)
+	}
+	initAppend(ctx)
+
+	initAccounts(ctx)
+	if err := initOAuth(ctx); err != nil {
+		log.Fatal(err)
+	}
+	initTokens(ctx)
+	initAPIKeys(ctx)
+	initCoupons(ctx)
+	initLinks(ctx)
+	initAlbums(ctx)
+	initFolders(ctx)
+	initArtifacts(ctx)
+	initSearch(ctx)
+	initLFS(ctx)
+	initRegistry(ctx)
+	initDedup(ctx)
+	initHashLookup(ctx)
+	initAntivirus(ctx)
+	initReprocess(ctx)
+	initExpiry(ctx)
+	initS3API(ctx)
+	initScraping(ctx)
+	initBlocklist(ctx)
+	initReports(ctx)
+	initChallenge()
+	initFilePasswords()
+	initSignedURLs()
+	initImport()
+	initThumbnails()
+	initPosters()
+	initOCR()
+	initDocInfo()
+	initImageTransforms()
+	if err := initViewers(); err != nil {
+		log.Fatal(err)
+	}
+	initPreviews()
+	if err := initTiers(config()); err != nil {
+		log.Fatal(err)
+	}
+	if err := initPaste(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initWebhooks(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initDiscord(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initGRPC(); err != nil {
+		log.Fatal(err)
+	}
+	initShortcuts()
+	if err := initSFTP(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initReceipts(); err != nil {
+		log.Fatal(err)
+	}
+	initAnonQuota()
+	if err := initCaptcha(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initTLS(); err != nil {
+		log.Fatal(err)
+	}
+	initSLO()
+	initCompression()
+	initMeta(config())
+	initUpdates()
+	initMetricsPush()
+	initStatus(config())
+	initStats(ctx)
+	initVideoQoE()
+	initBurn(ctx)
+	initMetering(ctx)
+
+	if config().Spool.Enabled {
+		if config().Spool.Dir == "" {
+			config().Spool.Dir = "spool"
+		}
+		if err := os.MkdirAll(config().Spool.Dir, 0o700); err != nil {
+			log.Fatal("Error creating spool directory:", err)
+		}
+	}
+
+	log.Printf("Connected to MongoDB at %s", config().MongoDB.URI)
+	log.Printf("Using database: %s", config().MongoDB.Database)
 }
 
 func generateID() string {
@@ -103,112 +536,366 @@ func getFileType(contentType string) string {
 }
 
 func formatSize(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
+	return locales[defaultLocale].size(bytes)
+}
+
+// fileRecord is the part of a GridFS files document that listings work with.
+type fileRecord struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Filename   string             `bson:"filename"`
+	Length     int64              `bson:"length"`
+	UploadDate time.Time          `bson:"uploadDate"`
+	Metadata   struct {
+		ShortID       string             `bson:"short_id"`
+		DeleteToken   string             `bson:"delete_token"`
+		ContentType   string             `bson:"content_type"`
+		OwnerID       primitive.ObjectID `bson:"owner_id,omitempty"`
+		APIKeyID      string             `bson:"api_key_id,omitempty"`
+		ExpiresAt     *time.Time         `bson:"expires_at,omitempty"`
+		Storage       string             `bson:"storage,omitempty"`
+		ContentID     primitive.ObjectID `bson:"content_id,omitempty"`
+		SHA256        string             `bson:"sha256,omitempty"`
+		MD5           string             `bson:"md5,omitempty"`
+		SHA1          string             `bson:"sha1,omitempty"`
+		Growing       bool               `bson:"growing,omitempty"`
+		AppendToken   string             `bson:"append_token,omitempty"`
+		Paste         bool               `bson:"paste,omitempty"`
+		Language      string             `bson:"language,omitempty"`
+		Doc           *docInfo           `bson:"doc,omitempty"`
+		PasswordHash  string             `bson:"password_hash,omitempty"`
+		E2E           bool               `bson:"e2e,omitempty"`
+		BandwidthCap  int64              `bson:"bandwidth_cap,omitempty"`
+		Bandwidth     *bandwidthUse      `bson:"bandwidth,omitempty"`
+		Views         int64              `bson:"views,omitempty"`
+		Downloads     int64              `bson:"downloads,omitempty"`
+		MaxDownloads  int64              `bson:"max_downloads,omitempty"`
+		DownloadsLeft int64              `bson:"downloads_left,omitempty"`
+		Disabled      bool               `bson:"disabled,omitempty"`
+		SignedOnly    bool               `bson:"signed_only,omitempty"`
+		Visibility    string             `bson:"visibility,omitempty"`
+		ReportHold    string             `bson:"report_hold,omitempty"`
+		Derivative    string             `bson:"derivative,omitempty"`
+		Variant       string             `bson:"variant,omitempty"`
+		OCIDigest     string             `bson:"oci_digest,omitempty"`
+		OCIMediaType  string             `bson:"oci_media_type,omitempty"`
+		Folder        string             `bson:"folder,omitempty"`
+		Artifact      *artifactInfo      `bson:"artifact,omitempty"`
+	} `bson:"metadata"`
+}
+
+// setChecksumHeaders lets clients verify downloads against the checksums
+// recorded at upload time.
+func setChecksumHeaders(h http.Header, f *fileRecord) {
+	if f.Metadata.SHA256 != "" {
+		h.Set("X-Checksum-SHA256", f.Metadata.SHA256)
+	}
+	if f.Metadata.MD5 != "" {
+		h.Set("X-Checksum-MD5", f.Metadata.MD5)
+	}
+	if f.Metadata.SHA1 != "" {
+		h.Set("X-Checksum-SHA1", f.Metadata.SHA1)
+	}
+}
+
+// setRawHeaders sets the headers /raw/ sends for a file, for GET and HEAD
+// alike.
+func setRawHeaders(h http.Header, f *fileRecord) {
+	if f.Metadata.E2E {
+		setE2EHeaders(h, f)
+	} else {
+		disposition := "attachment"
+		if f.Metadata.Paste {
+			disposition = "inline"
+		}
+		setContentHeaders(h, f.Metadata.ContentType)
+		h.Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, f.Filename))
+	}
+	if f.Metadata.Growing {
+		h.Set("X-Xyli-Growing", "true")
+		h.Set("Cache-Control", "no-store")
+	} else {
+		setChecksumHeaders(h, f)
+	}
+	if burnsAfterDownload(f) {
+		h.Set("Cache-Control", "private, no-store, no-transform")
+	}
+	h.Set("Accept-Ranges", "bytes")
+}
+
+func (f *fileRecord) Link() string {
+	return fileLink(f.Metadata.ShortID, f.Filename)
+}
+
+func (f *fileRecord) DeletionLink() string {
+	return fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, f.Metadata.DeleteToken)
+}
+
+// newUploadMetadata returns the metadata every stored file starts with: a
+// fresh short ID and deletion token, the content type and the owner, if any.
+func newUploadMetadata(contentType string, owner *User) bson.M {
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+	metadata := bson.M{
+		"short_id":     generateID(),
+		"delete_token": generateID() + generateID(),
+		"content_type": contentType,
 	}
-	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+	if owner != nil {
+		metadata["owner_id"] = owner.ID
+	}
+	return metadata
+}
+
+// storeUpload writes r to the configured storage backend under a new file ID.
+func storeUpload(ctx context.Context, filename string, r io.Reader, metadata bson.M) error {
+	id := primitive.NewObjectID()
+	if strip, _ := metadata["strip_exif"].(bool); strip {
+		stripped := stripEXIF(r)
+		defer stripped.Close()
+		r = stripped
+	}
+	n, err := putContent(ctx, id, filename, r, metadata)
+	if err == nil {
+		recordUploadStat(metadata, n)
+		uploadWebhook(filename, n, metadata)
+		contentType, _ := metadata["content_type"].(string)
+		queuePoster(id, contentType)
+		queueOCR(id, contentType)
+		queueDocInfo(id, filename, contentType)
+		queuePreview(id, filename, n)
+	}
+	return err
+}
+
+var errFileNotFound = errors.New("file not found")
+
+// findFile decodes the first GridFS file document matching filter into v and
+// reports the outcome to the circuit breaker.
+func findFile(ctx context.Context, filter bson.M, v interface{}) error {
+	cursor, err := gfsBucket.FindContext(ctx, filter)
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		dbBreaker.Record(cursor.Err())
+		if cursor.Err() != nil {
+			return cursor.Err()
+		}
+		return errFileNotFound
+	}
+	return cursor.Decode(v)
+}
+
+// clientIP returns the address of the requesting client, honouring
+// X-Forwarded-For only when the server is configured to sit behind a proxy.
+func clientIP(r *http.Request) string {
+	if config().Server.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder remembers the status code written by a wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	req    *http.Request
+}
+
+// locale is the language of the request, for localized API errors.
+func (r *statusRecorder) locale() *locale {
+	if r.req == nil {
+		return nil
+	}
+	return requestLocale(r.req)
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
 
 func jsonError(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	jsonErrorCode(w, apiErrorCode(message, status), message, status)
 }
 
 func main() {
+	setup()
 	defer client.Disconnect(context.Background())
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
+	http.HandleFunc("/viewer-assets/", handleViewerAssets)
+
 	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "static/favicon.ico")
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/", blockGuard(scrapeGuard("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			if r.Method != http.MethodGet {
 				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 				return
 			}
+			user, loc := currentUser(r), requestLocale(r)
 			tmpl := template.Must(template.ParseFiles("templates/index.html"))
-			err := tmpl.Execute(w, nil)
+			err := tmpl.Execute(w, struct {
+				User            *User
+				MaxSize         string
+				Recent          []recentUpload
+				CaptchaProvider string
+				CaptchaSiteKey  string
+			}{user, loc.size(config().Upload.MaxSize), recentUploads(r.Context(), user, loc), config().Captcha.Provider, config().Captcha.SiteKey})
 			if err != nil {
 				http.Error(w, "template error", http.StatusInternalServerError)
 			}
 			return
 		}
 
-		fileID := r.URL.Path[1:]
+		fileID := splitSlug(r.URL.Path[1:])
 		if fileID == "" {
 			http.NotFound(w, r)
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		cursor, err := gfsBucket.Find(bson.M{"metadata.short_id": fileID})
-		if err != nil {
-			http.Error(w, "file not found", http.StatusNotFound)
+		if !dbBreaker.Allow() {
+			serveUnavailable(w, false)
 			return
 		}
-		defer cursor.Close(ctx)
 
-		var fileDoc struct {
-			Filename string `bson:"filename"`
-			Length   int64  `bson:"length"`
-			Metadata struct {
-				ContentType string `bson:"content_type"`
-			} `bson:"metadata"`
-		}
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
 
-		if !cursor.Next(ctx) {
+		var fileDoc fileRecord
+		err := findFileByShortID(ctx, fileID, &fileDoc)
+		if isMongoOutage(err) {
+			serveUnavailable(w, false)
+			return
+		}
+		if err == errFileNotFound {
+			if serveShortLink(ctx, w, r, fileID) {
+				return
+			}
+			if wasBurned(ctx, fileID) {
+				serveGone(w, r)
+				return
+			}
 			http.Error(w, "file not found", http.StatusNotFound)
 			return
 		}
-
-		err = cursor.Decode(&fileDoc)
 		if err != nil {
 			http.Error(w, "decode error", http.StatusInternalServerError)
 			return
 		}
 
-		fileType := getFileType(fileDoc.Metadata.ContentType)
+		if !requireVisible(w, r, &fileDoc) {
+			return
+		}
+		if fileDoc.Metadata.Disabled {
+			serveDisabled(w, r)
+			return
+		}
+		if !requireSigned(w, r, &fileDoc) {
+			return
+		}
+		if !fileUnlocked(r, &fileDoc) {
+			servePasswordPage(w, r, &fileDoc)
+			return
+		}
+		if fileDoc.Metadata.Paste {
+			servePasteViewer(ctx, w, r, &fileDoc)
+			return
+		}
+		if fileDoc.Metadata.E2E {
+			serveE2EViewer(w, r, &fileDoc)
+			return
+		}
+
+		// Repeat visits revalidate and get a 304 without rendering the page.
+		// The relative upload time is part of the tag so that it never goes stale.
+		loc := requestLocale(r)
+		ago := loc.formatAgo(fileDoc.UploadDate)
+		viewer := viewerFor(fileDoc.Filename, fileDoc.Metadata.ContentType)
+		preview := viewer == fallbackViewer && previewable(fileDoc.Filename, fileDoc.Length)
+		if preview {
+			viewer = previewViewer
+		}
+		etag := viewerETag(viewer, fileDoc.ID.Hex(), fileDoc.Filename, fileDoc.Metadata.ContentType, fileDoc.Length, fileDoc.UploadDate, fmt.Sprintf("%s %s %t %v", loc.tag, ago, fileDoc.Metadata.Growing, fileDoc.Metadata.Doc))
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", viewerCacheControl(&fileDoc))
+		w.Header().Set("Vary", "Accept-Language")
+		if etagMatches(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			recordStat(statEvent{Type: statView, ShortID: fileID, OwnerID: fileDoc.Metadata.OwnerID})
+			return
+		}
 
 		data := struct {
-			FileID   string
-			Filename string
-			FileSize string
+			FileID      string
+			Filename    string
+			FileSize    string
+			Lang        string
+			Uploaded    string
+			UploadedAgo string
+			UploadedISO string
+			BaseURL     string
+			Poster      bool
+			Growing     bool
+			Doc         *docInfo
+			Pages       string
+			Preview     bool
+			Assets      ViewerAssets
+			Embed       embedMeta
 		}{
-			FileID:   fileID,
-			Filename: fileDoc.Filename,
-			FileSize: formatSize(fileDoc.Length),
+			FileID:      fileID,
+			Filename:    fileDoc.Filename,
+			FileSize:    loc.size(fileDoc.Length),
+			Lang:        loc.tag,
+			Uploaded:    loc.formatDate(fileDoc.UploadDate),
+			UploadedAgo: ago,
+			UploadedISO: fileDoc.UploadDate.UTC().Format(time.RFC3339),
+			BaseURL:     config().Upload.BaseURL,
+			Poster:      config().Posters.Enabled,
+			Growing:     fileDoc.Metadata.Growing,
+			Doc:         fileDoc.Metadata.Doc,
+			Preview:     preview,
+			Embed:       newEmbedMeta(&fileDoc, loc),
 		}
-
-		var tmpl *template.Template
-		switch fileType {
-		case "image":
-			tmpl = template.Must(template.ParseFiles("templates/viewer_image.html"))
-		case "video":
-			tmpl = template.Must(template.ParseFiles("templates/viewer_video.html"))
-		case "audio":
-			tmpl = template.Must(template.ParseFiles("templates/viewer_audio.html"))
-		default:
-			tmpl = template.Must(template.ParseFiles("templates/viewer_file.html"))
+		if data.Doc != nil && data.Doc.Pages > 0 {
+			data.Pages = loc.pageCount(data.Doc.Pages)
 		}
 
+		tmpl, assets := viewerTemplate(viewer)
+		data.Assets = assets
 		tmpl.Execute(w, data)
-	})
+		recordStat(statEvent{Type: statView, ShortID: fileID, OwnerID: fileDoc.Metadata.OwnerID})
+	})))
+
+	http.HandleFunc("/paste", blockGuard(challengeGuard(handlePaste)))
+	http.HandleFunc("/shorten", blockGuard(challengeGuard(guardStorage(true, handleShorten))))
+	http.HandleFunc("/paste.css", handlePasteCSS)
 
 	http.HandleFunc("/integrations", func(w http.ResponseWriter, r *http.Request) {
 		tmpl := template.Must(template.ParseFiles("templates/integrations.html"))
-		tmpl.Execute(w, nil)
+		tmpl.Execute(w, map[string]string{
+			"BaseURL":      config().Upload.BaseURL,
+			"ShortcutsMax": formatSize(config().Shortcuts.MaxBytes),
+		})
 	})
 
 	http.HandleFunc("/deployment", func(w http.ResponseWriter, r *http.Request) {
@@ -216,66 +903,207 @@ func main() {
 		tmpl.Execute(w, nil)
 	})
 
-	http.HandleFunc("/raw/", func(w http.ResponseWriter, r *http.Request) {
-		fileID := r.URL.Path[len("/raw/"):]
+	http.HandleFunc("/raw/", blockGuard(scrapeGuard("/raw/", guardStorage(false, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fileID := splitSlug(r.URL.Path[len("/raw/"):])
 		if fileID == "" {
 			http.Error(w, "no file id", http.StatusBadRequest)
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 		defer cancel()
 
-		cursor, err := gfsBucket.Find(bson.M{"metadata.short_id": fileID})
-		if err != nil {
-			http.Error(w, "file not found", http.StatusNotFound)
-			return
-		}
-		defer cursor.Close(ctx)
+		var fileDoc fileRecord
 
-		var fileDoc struct {
-			ID       interface{} `bson:"_id"`
-			Filename string      `bson:"filename"`
-			Metadata struct {
-				ContentType string `bson:"content_type"`
-			} `bson:"metadata"`
+		err := findFileByShortID(ctx, fileID, &fileDoc)
+		if isMongoOutage(err) {
+			serveUnavailable(w, false)
+			return
 		}
-
-		if !cursor.Next(ctx) {
+		if err == errFileNotFound {
+			if wasBurned(ctx, fileID) {
+				serveGone(w, r)
+				return
+			}
 			http.Error(w, "file not found", http.StatusNotFound)
 			return
 		}
-
-		err = cursor.Decode(&fileDoc)
 		if err != nil {
 			http.Error(w, "decode error", http.StatusInternalServerError)
 			return
 		}
+		if !requireVisible(w, r, &fileDoc) {
+			return
+		}
+		if fileDoc.Metadata.Disabled {
+			serveDisabled(w, r)
+			return
+		}
+		if !requireSigned(w, r, &fileDoc) {
+			return
+		}
+		if !requireUnlocked(w, r, &fileDoc) {
+			return
+		}
+		if bandwidthExceeded(&fileDoc) {
+			serveBandwidthExceeded(w, r)
+			return
+		}
+		if serveRawVariant(w, r, &fileDoc) {
+			return
+		}
+		encoding := ""
+		if !fileDoc.Metadata.E2E && compressible(fileDoc.Metadata.ContentType, fileDoc.Length) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Header.Get("Range") == "" {
+				encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			}
+		}
+		if cacheRawFile(w, r, &fileDoc, encoding) {
+			return
+		}
+		if r.Method == http.MethodHead {
+			// Answered from the metadata alone: nothing is read from
+			// storage and no download is counted.
+			setRawHeaders(w.Header(), &fileDoc)
+			if encoding != "" {
+				w.Header().Set("Content-Encoding", encoding)
+			} else {
+				w.Header().Set("Content-Length", strconv.FormatInt(fileDoc.Length, 10))
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		lastDownload := false
+		if burnsAfterDownload(&fileDoc) {
+			ok, last, err := claimDownload(ctx, &fileDoc)
+			if err != nil {
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				// An earlier last download did not get to delete the file.
+				burnFile(&fileDoc)
+				serveGone(w, r)
+				return
+			}
+			lastDownload = last
+		}
+
+		if fileDoc.Metadata.Storage == appendStore.Name() {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileDoc.Filename))
+			n := serveAppendFile(w, r, &fileDoc)
+			recordBandwidth(&fileDoc, n)
+			recordStat(statEvent{Type: statDownload, ShortID: fileID, OwnerID: fileDoc.Metadata.OwnerID, KeyID: fileDoc.Metadata.APIKeyID, Bytes: n})
+			return
+		}
 
-		downloadStream, err := gfsBucket.OpenDownloadStream(fileDoc.ID)
+		downloadStream, err := openStoredFile(r.Context(), &fileDoc)
 		if err != nil {
 			http.Error(w, "download error", http.StatusInternalServerError)
 			return
 		}
 		defer downloadStream.Close()
 
-		w.Header().Set("Content-Type", fileDoc.Metadata.ContentType)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileDoc.Filename))
-		io.Copy(w, downloadStream)
-	})
+		setRawHeaders(w.Header(), &fileDoc)
 
-	http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+			w.WriteHeader(http.StatusOK)
+			n := writeCompressed(w, downloadStream, encoding)
+			recordBandwidth(&fileDoc, n)
+			recordStat(statEvent{Type: statDownload, ShortID: fileID, OwnerID: fileDoc.Metadata.OwnerID, KeyID: fileDoc.Metadata.APIKeyID, Bytes: n})
+			if lastDownload {
+				burnFile(&fileDoc)
+			}
+			return
+		}
+
+		start, end := int64(0), fileDoc.Length-1
+		status := http.StatusOK
+		rangeHeader := r.Header.Get("Range")
+		if rangeHeader != "" && fileDoc.Length > 0 {
+			var ok bool
+			start, end, ok = parseByteRange(rangeHeader, fileDoc.Length)
+			if !ok {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileDoc.Length))
+				http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileDoc.Length))
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+
+		if start > 0 {
+			if _, err := skipContent(downloadStream, start); err != nil {
+				http.Error(w, "download error", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(status)
+		n, _ := io.CopyN(w, downloadStream, end-start+1)
+		recordVideoRange(&fileDoc, status == http.StatusPartialContent, start, end, n)
+		recordBandwidth(&fileDoc, n)
+		recordStat(statEvent{Type: statDownload, ShortID: fileID, OwnerID: fileDoc.Metadata.OwnerID, KeyID: fileDoc.Metadata.APIKeyID, Bytes: n, Partial: start > 0})
+		if lastDownload {
+			burnFile(&fileDoc)
+		}
+	}))))
+
+	http.HandleFunc("/thumb/", blockGuard(scrapeGuard("/thumb/", guardStorage(false, handleThumb))))
+	http.HandleFunc("/img/", blockGuard(scrapeGuard("/img/", guardStorage(false, handleImageTransform))))
+	http.HandleFunc("/poster/", blockGuard(scrapeGuard("/poster/", guardStorage(false, handlePoster))))
+	http.HandleFunc("/a/", blockGuard(scrapeGuard("/a/", guardStorage(false, handleAlbumPage))))
+	http.HandleFunc("/hash/", blockGuard(guardStorage(false, handleHashLookup)))
+	http.HandleFunc("/report/", blockGuard(guardStorage(false, handleReport)))
+	http.HandleFunc("/preview/", blockGuard(scrapeGuard("/preview/", guardStorage(false, handlePreview))))
+	http.HandleFunc("/stats/", blockGuard(scrapeGuard("/stats/", guardStorage(true, handleFileStats))))
+
+	http.HandleFunc("/upload", blockGuard(challengeGuard(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		err := r.ParseMultipartForm(config.Upload.MaxSize)
+		storageUp := dbBreaker.Allow()
+		if !storageUp && !config().Spool.Enabled {
+			serveUnavailable(w, true)
+			return
+		}
+
+		err := r.ParseMultipartForm(config().Upload.MaxSize)
 		if err != nil {
 			jsonError(w, "Bad request", http.StatusBadRequest)
 			return
 		}
 
+		// Append-mode files are written segment by segment into MongoDB,
+		// so they cannot wait in the spool.
+		appendMode, _ := strconv.ParseBool(r.FormValue("append"))
+		if appendMode && !storageUp {
+			serveUnavailable(w, true)
+			return
+		}
+		e2e, _ := strconv.ParseBool(r.FormValue("e2e"))
+		if e2e && appendMode {
+			jsonError(w, "Encrypted uploads cannot be appended to", http.StatusBadRequest)
+			return
+		}
+		maxDownloads, err := parseMaxDownloads(r.FormValue("max_downloads"))
+		if err != nil {
+			jsonError(w, "Invalid max_downloads value", http.StatusBadRequest)
+			return
+		}
+		if maxDownloads > 0 && appendMode {
+			jsonError(w, "Appendable uploads cannot have a download limit", http.StatusBadRequest)
+			return
+		}
+
 		file, header, err := r.FormFile("file")
 		if err != nil {
 			jsonError(w, "File not found", http.StatusBadRequest)
@@ -283,47 +1111,196 @@ func main() {
 		}
 		defer file.Close()
 
-		if header.Size > config.Upload.MaxSize {
-			jsonError(w, fmt.Sprintf("File too large (max %d MB)", config.Upload.MaxSize/(1024*1024)), http.StatusBadRequest)
+		if header.Size > config().Upload.MaxSize {
+			jsonError(w, fmt.Sprintf("File too large (max %s)", formatSize(config().Upload.MaxSize)), http.StatusBadRequest)
 			return
 		}
 
-		shortID := generateID()
-		deleteToken := generateID() + generateID()
-		contentType := header.Header.Get("Content-Type")
-		if contentType == "" {
-			contentType = "application/octet-stream"
+		user, key := requestAuth(r)
+		var tier *Tier
+		if user != nil && storageUp {
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			_, tier = effectiveTier(ctx, user)
+			cancel()
+		} else if user != nil {
+			_, tier = tierFor(user)
 		}
 
-		opts := options.GridFSUpload().SetMetadata(bson.M{
-			"short_id":     shortID,
-			"delete_token": deleteToken,
-			"content_type": contentType,
-		})
+		if user == nil && !allowAnonUpload(w, r, header.Size) {
+			return
+		}
+		if user != nil && storageUp {
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			err := checkTierQuota(ctx, user, header.Size)
+			cancel()
+			if isTierLimit(err) {
+				jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+
+		head := make([]byte, sniffLen)
+		n, _ := io.ReadFull(file, head)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			jsonError(w, "Upload error", http.StatusInternalServerError)
+			return
+		}
+		contentType := detectContentType(header.Filename, head[:n], header.Header.Get("Content-Type"))
+		if e2e {
+			// The content is ciphertext; there is nothing to sniff.
+			contentType = e2eContentType
+		}
+
+		ttl, err := uploadExpiry(defaultExpires(user, r.FormValue("expires")), tier, isPaste(contentType))
+		if err != nil {
+			jsonError(w, "Invalid expires value", http.StatusBadRequest)
+			return
+		}
 
-		uploadStream, err := gfsBucket.OpenUploadStream(header.Filename, opts)
+		passwordHash, err := uploadPasswordHash(user, r.FormValue("password"))
+		if err == errPasswordTooLong {
+			jsonError(w, "Password too long", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			jsonError(w, "Upload error", http.StatusInternalServerError)
 			return
 		}
-		defer uploadStream.Close()
+		stripEXIF, err := uploadStripEXIF(user, r.FormValue("strip_exif"))
+		if err != nil {
+			jsonError(w, "Invalid strip_exif value", http.StatusBadRequest)
+			return
+		}
+		visibility, err := uploadVisibility(user, r.FormValue("visibility"))
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		metadata := newUploadMetadata(contentType, user)
+		if key != nil {
+			metadata["api_key_id"] = key.KeyID
+		}
+		if passwordHash != "" {
+			metadata["password_hash"] = passwordHash
+		}
+		if visibility != "" {
+			metadata["visibility"] = visibility
+		}
+		if e2e {
+			metadata["e2e"] = true
+		} else if stripEXIF && !appendMode {
+			metadata["strip_exif"] = true
+		}
+		if maxDownloads > 0 {
+			metadata["max_downloads"] = maxDownloads
+			metadata["downloads_left"] = maxDownloads
+		}
+		shortID := metadata["short_id"].(string)
+		deleteToken := metadata["delete_token"].(string)
+		var expiresAt time.Time
+		if ttl > 0 {
+			expiresAt = time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+			metadata["expires_at"] = expiresAt
+		}
 
-		_, err = io.Copy(uploadStream, file)
+		provisional := false
+		var appendToken string
+		if appendMode {
+			appendToken, err = appendUpload(r.Context(), header.Filename, file, metadata)
+		} else if storageUp {
+			err = storeUpload(r.Context(), header.Filename, file, metadata)
+			if isMongoOutage(err) && config().Spool.Enabled {
+				_, err = file.Seek(0, io.SeekStart)
+				storageUp = false
+			}
+		}
+		if !storageUp && !appendMode {
+			err = spoolUpload(header.Filename, file, metadata)
+			if err == errSpoolFull {
+				serveUnavailable(w, true)
+				return
+			}
+			provisional = true
+		}
+		if isInfected(err) {
+			jsonError(w, "File rejected: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err == errScannerUnavailable {
+			setUnavailable(w.Header(), scannerRetryAfter)
+			jsonError(w, "Virus scanner unavailable", http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
-			jsonError(w, "Write error", http.StatusInternalServerError)
+			jsonError(w, "Upload error", http.StatusInternalServerError)
 			return
 		}
+		notFoundCache.Forget(shortID)
 
-		response := map[string]string{
-			"link":          fmt.Sprintf("%s/%s", config.Upload.BaseURL, shortID),
-			"deletion_link": fmt.Sprintf("%s/delete/%s", config.Upload.BaseURL, deleteToken),
+		response := map[string]interface{}{
+			"link":          fileLink(shortID, header.Filename),
+			"deletion_link": fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, deleteToken),
+		}
+		if provisional {
+			response["provisional"] = true
+		}
+		if passwordHash != "" {
+			response["protected"] = true
+		}
+		if e2e {
+			response["e2e"] = true
+		}
+		if maxDownloads > 0 {
+			response["max_downloads"] = maxDownloads
+		}
+		if appendMode {
+			response["append_url"] = fmt.Sprintf("%s/append/%s", config().Upload.BaseURL, shortID)
+			response["append_token"] = appendToken
+		}
+		if ttl > 0 {
+			response["expires_at"] = expiresAt
+		}
+		checksums := map[string]string{}
+		for _, name := range []string{"sha256", "md5", "sha1"} {
+			if sum, ok := metadata[name].(string); ok {
+				checksums[name] = sum
+			}
+		}
+		if len(checksums) > 0 {
+			response["checksums"] = checksums
+		}
+		if rc := newReceipt(shortID, checksums["sha256"], header.Size); rc != nil && !appendMode {
+			response["receipt"] = rc
 		}
 
+		setQuotaHeaders(r.Context(), w.Header(), user, tier)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	})
+	})))
 
-	http.HandleFunc("/delete/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/u", blockGuard(challengeGuard(guardStorage(true, handleQuickUpload))))
+	http.HandleFunc("/api/shortcuts/upload", blockGuard(guardStorage(true, handleShortcutsUpload)))
+	http.HandleFunc("/api/helper/upload", blockGuard(guardStorage(true, handleHelperUpload)))
+	http.HandleFunc("/api/artifacts", blockGuard(guardStorage(true, handleArtifacts)))
+	http.HandleFunc("/api/artifacts/latest", guardStorage(true, handleArtifactLatest))
+	http.HandleFunc("/api/v1/meta", handleMeta)
+	http.HandleFunc("/api/verify-receipt", handleVerifyReceipt)
+	http.HandleFunc("/api/v1/files", guardStorage(true, handleFileList))
+	http.HandleFunc("/api/v1/files/search", guardStorage(true, handleFileSearch))
+	http.HandleFunc("/api/v1/files/sign", guardStorage(true, handleSignFile))
+	http.HandleFunc("/api/v1/files/import", blockGuard(guardStorage(true, handleImport)))
+	http.HandleFunc("/api/v1/files/reprocess", guardStorage(true, handleReprocess))
+	http.HandleFunc("/api/v1/files/reprocess/", guardStorage(true, handleReprocess))
+	http.HandleFunc("/dav/", blockGuard(guardStorage(true, handleWebDAV)))
+	http.HandleFunc("/dav", blockGuard(guardStorage(true, handleWebDAV)))
+	http.HandleFunc("/lfs/", blockGuard(guardStorage(true, handleLFS)))
+	http.HandleFunc("/v2/", blockGuard(guardStorage(true, handleRegistry)))
+	http.HandleFunc("/append/", blockGuard(guardStorage(true, handleAppend)))
+	http.HandleFunc("/api/streams", blockGuard(guardStorage(true, handleStreamOpen)))
+	http.HandleFunc("/api/streams/", blockGuard(guardStorage(true, handleStream)))
+
+	http.HandleFunc("/delete/", guardStorage(true, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost && r.Method != http.MethodGet {
 			jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -335,32 +1312,35 @@ func main() {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 		defer cancel()
 
-		cursor, err := gfsBucket.Find(bson.M{"metadata.delete_token": deleteToken})
-		if err != nil {
-			jsonError(w, "File not found", http.StatusNotFound)
+		var fileDoc fileRecord
+		err := findFile(ctx, bson.M{"metadata.delete_token": deleteToken}, &fileDoc)
+		if isMongoOutage(err) {
+			serveUnavailable(w, true)
 			return
 		}
-		defer cursor.Close(ctx)
-
-		var fileDoc struct {
-			ID interface{} `bson:"_id"`
-		}
-
-		if !cursor.Next(ctx) {
-			jsonError(w, "File not found", http.StatusNotFound)
+		if err == errFileNotFound {
+			deleted, err := deleteShortLink(ctx, deleteToken)
+			if err != nil {
+				jsonError(w, "Delete error", http.StatusInternalServerError)
+				return
+			}
+			if !deleted {
+				jsonError(w, "File not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
 			return
 		}
-
-		err = cursor.Decode(&fileDoc)
 		if err != nil {
 			jsonError(w, "Decode error", http.StatusInternalServerError)
 			return
 		}
 
-		err = gfsBucket.Delete(fileDoc.ID)
+		err = deleteStoredFile(ctx, &fileDoc)
 		if err != nil {
 			jsonError(w, "Delete error", http.StatusInternalServerError)
 			return
@@ -368,9 +1348,146 @@ func main() {
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
-	})
+	}))
+
+	http.HandleFunc("/api/config", handleAPIConfig)
+	http.HandleFunc("/discord/interactions", handleDiscordInteraction)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/status", handleStatusPage)
+	http.HandleFunc("/api/status", handleStatusAPI)
+	http.HandleFunc("/api/stats/export", guardStorage(true, handleStatsExport))
 
-	addr := fmt.Sprintf("%s:%d", config.Server.Host, config.Server.Port)
-	log.Printf("Starting server on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	http.HandleFunc("/register", guardStorage(false, handleRegister))
+	http.HandleFunc("/login", guardStorage(false, handleLogin))
+	http.HandleFunc("/logout", guardStorage(false, handleLogout))
+	http.HandleFunc("/auth/", guardStorage(false, handleOAuth))
+	http.HandleFunc("/dashboard", guardStorage(false, handleDashboard))
+	http.HandleFunc("/api/dashboard/files", guardStorage(true, handleDashboardFiles))
+	http.HandleFunc("/api/dashboard/files/bandwidth", guardStorage(true, handleFileBandwidth))
+	http.HandleFunc("/api/dashboard/files/disable", guardStorage(true, handleFileDisable))
+	http.HandleFunc("/api/dashboard/files/visibility", guardStorage(true, handleFileVisibility))
+	http.HandleFunc("/api/dashboard/files/derivatives", guardStorage(true, handleFileDerivatives))
+	http.HandleFunc("/api/dashboard/files/transfer", guardStorage(true, handleFileTransfer))
+	http.HandleFunc("/api/folders", guardStorage(true, handleFolders))
+	http.HandleFunc("/api/folders/move", guardStorage(true, handleFolderMove))
+	http.HandleFunc("/api/folders/rename", guardStorage(true, handleFolderRename))
+	http.HandleFunc("/api/albums", guardStorage(true, handleAlbums))
+	http.HandleFunc("/api/albums/", guardStorage(true, handleAlbum))
+	http.HandleFunc("/api/transfers/claim", guardStorage(true, handleTransferClaim))
+	http.HandleFunc("/api/dashboard/claim", guardStorage(true, handleClaimUploads))
+	http.HandleFunc("/api/account/defaults", guardStorage(true, handleAccountDefaults))
+	http.HandleFunc("/api/account/identities", guardStorage(true, handleAccountIdentities))
+	http.HandleFunc("/api/account/tokens", guardStorage(true, handleAccountTokens))
+	http.HandleFunc("/api/v1/auth/token", blockGuard(guardStorage(true, handleTokenLogin)))
+	http.HandleFunc("/api/v1/auth/refresh", blockGuard(guardStorage(true, handleTokenRefresh)))
+	http.HandleFunc("/api/v1/auth/revoke", guardStorage(true, handleTokenRevoke))
+	http.HandleFunc("/api/keys", guardStorage(true, handleAPIKeys))
+	http.HandleFunc("/api/keys/", guardStorage(true, handleAPIKeyDelete))
+	http.HandleFunc("/api/integrations/", guardStorage(true, handleIntegrationConfig))
+	http.HandleFunc("/api/usage", guardStorage(true, handleUsage))
+	http.HandleFunc("/api/coupons/redeem", guardStorage(true, handleRedeemCoupon))
+	http.HandleFunc("/s3/", blockGuard(handleS3))
+
+	http.HandleFunc("/admin", guardStorage(false, handleAdmin))
+	http.HandleFunc("/api/admin/files", guardStorage(true, handleAdminFiles))
+	http.HandleFunc("/api/admin/files/delete", guardStorage(true, handleAdminDelete))
+	http.HandleFunc("/api/admin/scraping", guardStorage(true, handleAdminScraping))
+	http.HandleFunc("/api/admin/blocklist", guardStorage(true, handleAdminBlocklist))
+	http.HandleFunc("/api/admin/reports", guardStorage(true, handleAdminReports))
+	http.HandleFunc("/api/admin/metrics", guardStorage(true, handleAdminMetrics))
+	if config().Prometheus.Enabled {
+		http.HandleFunc("/metrics", handlePrometheus)
+	}
+	http.HandleFunc("/api/admin/stats", guardStorage(true, handleAdminStats))
+	http.HandleFunc("/api/admin/qoe", guardStorage(true, handleAdminQoE))
+	http.HandleFunc("/api/admin/antivirus", guardStorage(true, handleAdminAntivirus))
+	http.HandleFunc("/api/admin/tiers", guardStorage(true, handleAdminTiers))
+	http.HandleFunc("/api/admin/users/tier", guardStorage(true, handleAdminUserTier))
+	http.HandleFunc("/api/admin/coupons", guardStorage(true, handleAdminCoupons))
+	http.HandleFunc("/api/admin/reload", guardStorage(true, handleAdminReload))
+	http.HandleFunc("/api/admin/update", guardStorage(true, handleAdminUpdate))
+	http.HandleFunc("/api/admin/config/export", guardStorage(true, handleConfigExport))
+	http.HandleFunc("/api/admin/config/import", guardStorage(true, handleConfigImport))
+
+	if config().Spool.Enabled {
+		go runSpoolFlusher()
+	}
+	go runExpiryCleaner()
+	go watchReloadSignal()
+	go runStatsWriter()
+	go runStatsRollup()
+	go runReprocessJobs()
+	go runBlocklistRefresh()
+	if config().VideoQoE.Enabled {
+		go runVideoQoEFlusher()
+	}
+	if config().Metering.Enabled {
+		go runMetering()
+	}
+	if config().SLO.Enabled {
+		go runSLOEvaluator()
+	}
+	if config().Prometheus.Push.URL != "" {
+		go runMetricsPush()
+	}
+	if config().Updates.Enabled {
+		go runUpdateChecker()
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config().Server.Host, config().Server.Port),
+		Handler: withMetrics(http.DefaultServeMux),
+	}
+	go func() {
+		log.Printf("Starting server on %s", srv.Addr)
+		if err := serveHTTP(srv); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	if redirectServer != nil {
+		go serveRedirects()
+	}
+	if grpcServer != nil {
+		go serveGRPC()
+	}
+	if sftpConfig != nil {
+		go serveSFTP()
+	}
+
+	// On SIGINT/SIGTERM stop accepting connections and let in-flight uploads
+	// and downloads finish, up to server.shutdownTimeoutSeconds.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	shuttingDown.Store(true)
+
+	timeout := time.Duration(config().Server.ShutdownTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	log.Printf("Shutting down, waiting up to %s for open requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcServer.Stop()
+		}
+	}
+	stopStats(shutdownCtx)
+	log.Printf("Server stopped")
 }
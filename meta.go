@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /api/v1/meta tells client libraries what they are talking to: the
+// server version, the features turned on, the API changelog and endpoints
+// that are going away. Operators announce deprecations in
+// api.deprecations; requests to a deprecated endpoint also get the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers, with a Link to the
+// replacement when there is one.
+
+// version is set at build time with -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// deprecation announces that an endpoint, or a path prefix ending in "/",
+// will stop working. Since and Sunset are dates as YYYY-MM-DD; Since
+// defaults to the day the server starts with the notice.
+type deprecation struct {
+	Endpoint    string `json:"endpoint"`
+	Message     string `json:"message"`
+	Since       string `json:"since,omitempty"`
+	Sunset      string `json:"sunset,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+
+	since, sunset time.Time
+}
+
+// changelogEntry is one release of API changes, newest first in
+// apiChangelog.
+type changelogEntry struct {
+	Date    string   `json:"date"`
+	Changes []string `json:"changes"`
+}
+
+var apiChangelog = []changelogEntry{
+	{Date: "2026-10-15", Changes: []string{
+		"The server can serve HTTPS itself, from certificate files or with Let's Encrypt certificates (server.tls).",
+		"POST /api/v1/auth/token issues JWT access tokens with rotating refresh tokens as an alternative to the session cookie (tokens.enabled).",
+		"/api/v1/files/reprocess runs existing files through scanning, thumbnails, posters, previews, OCR and metadata extraction again.",
+		"Accounts can sign in with GitHub, Google, Discord or OpenID Connect (oauth.providers).",
+		"/api/dashboard/files/derivatives lists, deletes and regenerates thumbnails, posters, previews and cached variants.",
+		"Anonymous uploads can require an hCaptcha or Turnstile check (captcha.provider).",
+		"Upload responses carry X-Max-File-Size, X-Storage-Remaining and X-RateLimit-* headers.",
+		"POST /api/v1/files/import copies a file from another XyliLoader instance, checked against its SHA-256.",
+		"GET /hash/{sha256} redirects to a stored file with that content, or answers 404.",
+		"POST /report/{id} takes abuse reports; heavily reported files are hidden until reviewed.",
+		"Uploads can return an Ed25519-signed receipt, checked with /api/verify-receipt.",
+		"Uploads take visibility=public|unlisted|private; private files answer 404 to everyone but the owner.",
+		"/raw/ and /img/ take ?q= to recompress images at a lower quality; /raw/ can honor Save-Data.",
+		"POST /api/v1/files/sign mints expiring signed /raw/ links and can require them for a file.",
+		"The viewer and /raw/ accept a filename slug after the short ID: /{id}/{slug}.",
+		"GET /api/v1/meta reports the server version, features, changelog and deprecations.",
+		"HEAD /raw/{id} answers with the file's headers without counting a download.",
+		"/raw/ and thumbnails send ETag and Last-Modified and answer conditional requests with 304.",
+		"/raw/ compresses text-like files with zstd or gzip when the client accepts it.",
+		"JSON errors carry a stable code and a message in the Accept-Language of the request.",
+		"GET /api/v1/files lists files with cursor pagination.",
+		"GET /api/v1/files/search searches files by name, type, size and upload date.",
+	}},
+}
+
+func initMeta(c *Config) {
+	valid := c.API.Deprecations[:0]
+	for _, d := range c.API.Deprecations {
+		var err error
+		if d.Since == "" {
+			d.Since = time.Now().UTC().Format(time.DateOnly)
+		}
+		if d.since, err = time.Parse(time.DateOnly, d.Since); err != nil {
+			log.Printf("Ignoring deprecation of %s: bad since date %q", d.Endpoint, d.Since)
+			continue
+		}
+		if d.Sunset != "" {
+			if d.sunset, err = time.Parse(time.DateOnly, d.Sunset); err != nil {
+				log.Printf("Ignoring deprecation of %s: bad sunset date %q", d.Endpoint, d.Sunset)
+				continue
+			}
+		}
+		if !strings.HasPrefix(d.Endpoint, "/") {
+			log.Printf("Ignoring deprecation of %q: the endpoint must be a path", d.Endpoint)
+			continue
+		}
+		valid = append(valid, d)
+	}
+	c.API.Deprecations = valid
+}
+
+// serverVersion is the version set at build time or, failing that, the
+// commit the binary was built from.
+func serverVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				return "dev+" + s.Value[:12]
+			}
+		}
+	}
+	return version
+}
+
+// setDeprecationHeaders marks responses of deprecated endpoints.
+func setDeprecationHeaders(h http.Header, path string) {
+	for _, d := range config().API.Deprecations {
+		if path != d.Endpoint && !(strings.HasSuffix(d.Endpoint, "/") && strings.HasPrefix(path, d.Endpoint)) {
+			continue
+		}
+		h.Set("Deprecation", "@"+strconv.FormatInt(d.since.Unix(), 10))
+		if !d.sunset.IsZero() {
+			h.Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+		}
+		h.Add("Link", `</api/v1/meta>; rel="deprecation"; type="application/json"`)
+		if d.Replacement != "" {
+			h.Add("Link", "<"+d.Replacement+`>; rel="successor-version"`)
+		}
+		return
+	}
+}
+
+func handleMeta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deprecations := config().API.Deprecations
+	if deprecations == nil {
+		deprecations = []deprecation{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":      serverVersion(),
+		"go_version":   runtime.Version(),
+		"api_version":  "v1",
+		"features":     apiFeatures(),
+		"changelog":    apiChangelog,
+		"deprecations": deprecations,
+	})
+}
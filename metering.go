@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Metering turns each finished UTC day into usage records, one per user and
+// API key ("" for uploads made through the web UI), holding the storage
+// used that day (byte-days) and the bandwidth served. Records are kept in
+// usage_records and delivered to every configured sink until each sink has
+// accepted them, so a sink outage only delays billing.
+
+type usageRecord struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Period        string             `bson:"period" json:"period"`
+	UserID        primitive.ObjectID `bson:"user_id" json:"user_id"`
+	KeyID         string             `bson:"key_id" json:"key_id,omitempty"`
+	Files         int64              `bson:"files" json:"files"`
+	StorageBytes  int64              `bson:"storage_bytes" json:"storage_byte_days"`
+	Downloads     int64              `bson:"downloads" json:"downloads"`
+	DownloadBytes int64              `bson:"download_bytes" json:"download_bytes"`
+	Sent          map[string]bool    `bson:"sent" json:"-"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// usageSink delivers usage records to a billing system. Send must be safe
+// to repeat for records it has already seen.
+type usageSink interface {
+	Name() string
+	Send(ctx context.Context, records []usageRecord) error
+}
+
+var (
+	usageColl     *mongo.Collection
+	meteredColl   *mongo.Collection
+	meteringSinks []usageSink
+)
+
+func initMetering(ctx context.Context) {
+	usageColl = db.Collection("usage_records")
+	meteredColl = db.Collection("metered_days")
+	_, err := usageColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "period", Value: 1}, {Key: "user_id", Value: 1}, {Key: "key_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "period", Value: -1}}},
+	})
+	if err != nil {
+		log.Printf("Error creating usage_records indexes: %v", err)
+	}
+
+	cfg := &config().Metering
+	if cfg.Webhook.URL != "" {
+		meteringSinks = append(meteringSinks, &webhookSink{url: cfg.Webhook.URL, secret: cfg.Webhook.Secret})
+	}
+	if cfg.Stripe.SecretKey != "" {
+		if cfg.Stripe.APIBase == "" {
+			cfg.Stripe.APIBase = "https://api.stripe.com"
+		}
+		meteringSinks = append(meteringSinks, &stripeSink{
+			apiBase:        strings.TrimSuffix(cfg.Stripe.APIBase, "/"),
+			secretKey:      cfg.Stripe.SecretKey,
+			storageEvent:   cfg.Stripe.StorageEvent,
+			bandwidthEvent: cfg.Stripe.BandwidthEvent,
+		})
+	}
+}
+
+func runMetering() {
+	time.Sleep(2 * time.Minute)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if dbBreaker.Allow() {
+			meterPendingDays()
+			deliverUsage()
+		}
+		<-ticker.C
+	}
+}
+
+// meterPendingDays meters every finished day of the last week that has not
+// been metered yet.
+func meterPendingDays() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for day := today.AddDate(0, 0, -7); day.Before(today); day = day.AddDate(0, 0, 1) {
+		period := day.Format(statsDayFormat)
+		err := meteredColl.FindOne(ctx, bson.M{"_id": period}).Err()
+		dbBreaker.Record(err)
+		if err == nil {
+			continue
+		}
+		if err != mongo.ErrNoDocuments {
+			return
+		}
+		if err := meterDay(ctx, day); err != nil {
+			log.Printf("Error metering %s: %v", period, err)
+			return
+		}
+	}
+}
+
+type usageKey struct {
+	user primitive.ObjectID
+	key  string
+}
+
+func meterDay(ctx context.Context, day time.Time) error {
+	period := day.Format(statsDayFormat)
+	end := day.AddDate(0, 0, 1)
+
+	// Bandwidth comes from the per-file stats, which must be complete first.
+	if time.Since(day) < time.Duration(config().Stats.RawRetentionDays)*24*time.Hour {
+		if err := rollupDay(ctx, day); err != nil {
+			return err
+		}
+	}
+
+	records := map[usageKey]*usageRecord{}
+	record := func(user primitive.ObjectID, key string) *usageRecord {
+		k := usageKey{user, key}
+		if records[k] == nil {
+			records[k] = &usageRecord{Period: period, UserID: user, KeyID: key, Sent: map[string]bool{}, CreatedAt: time.Now()}
+		}
+		return records[k]
+	}
+
+	// Storage is what existed at some point of the day and still exists now:
+	// uploaded before the day ended and not expired before it began.
+	cursor, err := gfsBucket.GetFilesCollection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"metadata.owner_id":     bson.M{"$exists": true},
+			"metadata.derived_from": bson.M{"$exists": false},
+			"uploadDate":            bson.M{"$lt": end},
+			"metadata.expires_at":   bson.M{"$not": bson.M{"$lt": day}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"user": "$metadata.owner_id", "key": bson.M{"$ifNull": bson.A{"$metadata.api_key_id", ""}}},
+			"files": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$length"},
+		}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var storage []struct {
+		ID struct {
+			User primitive.ObjectID `bson:"user"`
+			Key  string             `bson:"key"`
+		} `bson:"_id"`
+		Files int64 `bson:"files"`
+		Bytes int64 `bson:"bytes"`
+	}
+	if err := cursor.All(ctx, &storage); err != nil {
+		return err
+	}
+	for _, s := range storage {
+		rec := record(s.ID.User, s.ID.Key)
+		rec.Files, rec.StorageBytes = s.Files, s.Bytes
+	}
+
+	cursor, err = statsFilesColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"day": period, "owner_id": bson.M{"$exists": true}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            bson.M{"user": "$owner_id", "key": bson.M{"$ifNull": bson.A{"$key_id", ""}}},
+			"downloads":      bson.M{"$sum": "$downloads"},
+			"download_bytes": bson.M{"$sum": "$download_bytes"},
+		}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var bandwidth []struct {
+		ID struct {
+			User primitive.ObjectID `bson:"user"`
+			Key  string             `bson:"key"`
+		} `bson:"_id"`
+		Downloads     int64 `bson:"downloads"`
+		DownloadBytes int64 `bson:"download_bytes"`
+	}
+	if err := cursor.All(ctx, &bandwidth); err != nil {
+		return err
+	}
+	for _, b := range bandwidth {
+		rec := record(b.ID.User, b.ID.Key)
+		rec.Downloads, rec.DownloadBytes = b.Downloads, b.DownloadBytes
+	}
+
+	if len(records) > 0 {
+		models := make([]mongo.WriteModel, 0, len(records))
+		for _, rec := range records {
+			models = append(models, mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"period": rec.Period, "user_id": rec.UserID, "key_id": rec.KeyID}).
+				SetReplacement(rec).
+				SetUpsert(true))
+		}
+		_, err = usageColl.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		dbBreaker.Record(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = meteredColl.InsertOne(ctx, bson.M{"_id": period, "records": len(records), "at": time.Now()})
+	dbBreaker.Record(err)
+	return err
+}
+
+// deliverUsage hands every sink the records it has not accepted yet.
+func deliverUsage() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	for _, sink := range meteringSinks {
+		field := "sent." + sink.Name()
+		for {
+			cursor, err := usageColl.Find(ctx, bson.M{field: bson.M{"$ne": true}},
+				options.Find().SetSort(bson.D{{Key: "period", Value: 1}}).SetLimit(200))
+			dbBreaker.Record(err)
+			if err != nil {
+				return
+			}
+			var batch []usageRecord
+			if err := cursor.All(ctx, &batch); err != nil || len(batch) == 0 {
+				break
+			}
+
+			if err := sink.Send(ctx, batch); err != nil {
+				log.Printf("Error sending usage to %s: %v", sink.Name(), err)
+				break
+			}
+			ids := make([]primitive.ObjectID, len(batch))
+			for i, rec := range batch {
+				ids[i] = rec.ID
+			}
+			_, err = usageColl.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{field: true}})
+			dbBreaker.Record(err)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// webhookSink POSTs records as JSON. With a secret set, the body is signed
+// with HMAC-SHA256 in X-Xyli-Signature.
+type webhookSink struct {
+	url    string
+	secret string
+}
+
+func (s *webhookSink) Name() string { return "webhook" }
+
+func (s *webhookSink) Send(ctx context.Context, records []usageRecord) error {
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		req.Header.Set("X-Xyli-Signature", webhookSignature(s.secret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// stripeSink reports per-user totals as Stripe billing meter events, storage
+// in MiB-days and bandwidth in MiB. Users are matched to Stripe customers by
+// the stripe_customer_id field of their user document; users without one
+// are not billed.
+type stripeSink struct {
+	apiBase        string
+	secretKey      string
+	storageEvent   string
+	bandwidthEvent string
+}
+
+func (s *stripeSink) Name() string { return "stripe" }
+
+func (s *stripeSink) Send(ctx context.Context, records []usageRecord) error {
+	type total struct{ storage, bandwidth int64 }
+	totals := map[string]*total{}
+	var users []primitive.ObjectID
+	for _, rec := range records {
+		k := rec.Period + "/" + rec.UserID.Hex()
+		if totals[k] == nil {
+			totals[k] = &total{}
+			users = append(users, rec.UserID)
+		}
+		totals[k].storage += rec.StorageBytes
+		totals[k].bandwidth += rec.DownloadBytes
+	}
+
+	cursor, err := usersColl.Find(ctx, bson.M{"_id": bson.M{"$in": users}, "stripe_customer_id": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"stripe_customer_id": 1}))
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var customers []struct {
+		ID         primitive.ObjectID `bson:"_id"`
+		CustomerID string             `bson:"stripe_customer_id"`
+	}
+	if err := cursor.All(ctx, &customers); err != nil {
+		return err
+	}
+	customerOf := make(map[string]string, len(customers))
+	for _, c := range customers {
+		customerOf[c.ID.Hex()] = c.CustomerID
+	}
+
+	const mib = 1 << 20
+	for k, t := range totals {
+		period, user, _ := strings.Cut(k, "/")
+		customer := customerOf[user]
+		if customer == "" {
+			continue
+		}
+		day, _ := time.Parse(statsDayFormat, period)
+		at := day.Add(24*time.Hour - time.Second)
+
+		for _, ev := range []struct {
+			name  string
+			value int64
+		}{
+			{s.storageEvent, (t.storage + mib - 1) / mib},
+			{s.bandwidthEvent, (t.bandwidth + mib - 1) / mib},
+		} {
+			if ev.name == "" || ev.value == 0 {
+				continue
+			}
+			form := url.Values{
+				"event_name":                  {ev.name},
+				"identifier":                  {fmt.Sprintf("xyli-%s-%s-%s", ev.name, period, user)},
+				"timestamp":                   {strconv.FormatInt(at.Unix(), 10)},
+				"payload[stripe_customer_id]": {customer},
+				"payload[value]":              {strconv.FormatInt(ev.value, 10)},
+			}
+			if err := s.post(ctx, form); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *stripeSink) post(ctx context.Context, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiBase+"/v1/billing/meter_events", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.secretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		// A repeated identifier means the event was delivered before.
+		if resp.StatusCode == http.StatusBadRequest && strings.Contains(body.Error.Message, "identifier") {
+			return nil
+		}
+		return fmt.Errorf("stripe returned %s: %s", resp.Status, body.Error.Message)
+	}
+	return nil
+}
+
+// handleUsage lists the caller's usage records for the last ?days= days.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 || days > 366 {
+		days = 30
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days).Format(statsDayFormat)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := usageColl.Find(ctx, bson.M{"user_id": user.ID, "period": bson.M{"$gte": since}},
+		options.Find().SetSort(bson.D{{Key: "period", Value: -1}, {Key: "key_id", Value: 1}}))
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	records := []usageRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+
+	summary, err := tierSummary(ctx, user)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	summary["records"] = records
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
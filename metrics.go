@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Request metrics are recorded per route, labelled by the mux pattern that
+// served the request ("/raw/", "/upload", ...). Besides lifetime totals each
+// route keeps a per-minute ring of the last hour, which the optional SLO
+// evaluator uses to spot error budgets burning too fast.
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const sloRingMinutes = 60
+
+type minuteStats struct {
+	minute int64
+	total  uint64
+	errors uint64
+	slow   uint64
+}
+
+type routeStats struct {
+	requests   uint64
+	errors     uint64
+	latency    []uint64 // per bucket, the last one catching everything slower
+	latencySum float64
+	ring       [sloRingMinutes]minuteStats
+}
+
+type requestMetrics struct {
+	mu     sync.Mutex
+	routes map[string]*routeStats
+}
+
+var metrics = &requestMetrics{routes: map[string]*routeStats{}}
+
+func (m *requestMetrics) observe(route string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rs, ok := m.routes[route]
+	if !ok {
+		rs = &routeStats{latency: make([]uint64, len(latencyBuckets)+1)}
+		m.routes[route] = rs
+	}
+
+	failed := status >= 500
+	seconds := elapsed.Seconds()
+	rs.requests++
+	if failed {
+		rs.errors++
+	}
+	rs.latencySum += seconds
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	rs.latency[i]++
+
+	minute := time.Now().Unix() / 60
+	slot := &rs.ring[minute%sloRingMinutes]
+	if slot.minute != minute {
+		*slot = minuteStats{minute: minute}
+	}
+	slot.total++
+	if failed {
+		slot.errors++
+	}
+	if config().SLO.LatencyMs > 0 && elapsed > time.Duration(config().SLO.LatencyMs)*time.Millisecond {
+		slot.slow++
+	}
+}
+
+// window sums the last n minutes of a route.
+func (rs *routeStats) window(n int) (total, errors, slow uint64) {
+	now := time.Now().Unix() / 60
+	for _, slot := range rs.ring {
+		if slot.minute > now-int64(n) {
+			total += slot.total
+			errors += slot.errors
+			slow += slot.slow
+		}
+	}
+	return
+}
+
+// withMetrics records every request against the pattern that handles it.
+func withMetrics(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		setDeprecationHeaders(w.Header(), r.URL.Path)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK, req: r}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+		metrics.observe(route, rec.status, time.Since(start))
+	})
+}
+
+type sloAlert struct {
+	firing bool
+	since  time.Time
+}
+
+var sloAlerts = map[string]*sloAlert{}
+
+func initSLO() {
+	cfg := &config().SLO
+	if cfg.Availability <= 0 || cfg.Availability >= 1 {
+		cfg.Availability = 0.995
+	}
+	if cfg.LatencyTarget <= 0 || cfg.LatencyTarget >= 1 {
+		cfg.LatencyTarget = 0.99
+	}
+	if cfg.ShortWindowMinutes <= 0 {
+		cfg.ShortWindowMinutes = 5
+	}
+	if cfg.LongWindowMinutes <= 0 || cfg.LongWindowMinutes > sloRingMinutes {
+		cfg.LongWindowMinutes = sloRingMinutes
+	}
+	if cfg.BurnRate <= 0 {
+		cfg.BurnRate = 14.4
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+}
+
+// runSLOEvaluator checks every minute whether any route burns its error or
+// latency budget faster than allowed in both the short and the long window,
+// and notifies when an alert starts or stops firing.
+func runSLOEvaluator() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		evaluateSLOs()
+	}
+}
+
+func evaluateSLOs() {
+	cfg := config().SLO
+	type burn struct {
+		route, kind string
+		short, long float64
+	}
+	var results []burn
+
+	// Alert state is shared with handleAdminMetrics and guarded by the same lock.
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	for route, rs := range metrics.routes {
+		if len(cfg.Routes) > 0 && !containsString(cfg.Routes, route) {
+			continue
+		}
+		sTotal, sErrors, sSlow := rs.window(cfg.ShortWindowMinutes)
+		lTotal, lErrors, lSlow := rs.window(cfg.LongWindowMinutes)
+		if sTotal < uint64(cfg.MinRequests) {
+			sTotal, sErrors, sSlow = 0, 0, 0
+		}
+
+		ratio := func(bad, total uint64, budget float64) float64 {
+			if total == 0 {
+				return 0
+			}
+			return float64(bad) / float64(total) / budget
+		}
+		results = append(results, burn{route, "error_rate",
+			ratio(sErrors, sTotal, 1-cfg.Availability), ratio(lErrors, lTotal, 1-cfg.Availability)})
+		if cfg.LatencyMs > 0 {
+			results = append(results, burn{route, "latency",
+				ratio(sSlow, sTotal, 1-cfg.LatencyTarget), ratio(lSlow, lTotal, 1-cfg.LatencyTarget)})
+		}
+	}
+
+	for _, b := range results {
+		key := b.kind + " " + b.route
+		alert, ok := sloAlerts[key]
+		if !ok {
+			alert = &sloAlert{}
+			sloAlerts[key] = alert
+		}
+
+		burning := b.short >= cfg.BurnRate && b.long >= cfg.BurnRate
+		details := map[string]interface{}{
+			"route":      b.route,
+			"slo":        b.kind,
+			"burn_short": b.short,
+			"burn_long":  b.long,
+			"threshold":  cfg.BurnRate,
+		}
+		switch {
+		case burning && !alert.firing:
+			alert.firing, alert.since = true, time.Now()
+			if b.kind == "latency" {
+				openIncident(key, fmt.Sprintf("Медленные ответы на %s", b.route))
+			} else {
+				openIncident(key, fmt.Sprintf("Повышенное число ошибок на %s", b.route))
+			}
+			notify(notifyEvent{
+				Type:    "slo_burn",
+				Message: fmt.Sprintf("%s SLO for %s is burning at %.1fx (%dm) / %.1fx (%dm)", b.kind, b.route, b.short, cfg.ShortWindowMinutes, b.long, cfg.LongWindowMinutes),
+				Details: details,
+			})
+		case !burning && alert.firing && b.short < cfg.BurnRate:
+			alert.firing = false
+			resolveIncident(key)
+			details["firing_for"] = time.Since(alert.since).Round(time.Second).String()
+			notify(notifyEvent{
+				Type:    "slo_resolved",
+				Message: fmt.Sprintf("%s SLO for %s recovered", b.kind, b.route),
+				Details: details,
+			})
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdminMetrics reports per-route success ratios and latencies.
+func handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	type routeEntry struct {
+		Route         string  `json:"route"`
+		Requests      uint64  `json:"requests"`
+		Errors        uint64  `json:"errors"`
+		SuccessRatio  float64 `json:"success_ratio"`
+		AvgLatencyMs  float64 `json:"avg_latency_ms"`
+		Recent        uint64  `json:"recent_requests"`
+		RecentErrors  uint64  `json:"recent_errors"`
+		RecentSlow    uint64  `json:"recent_slow"`
+		ErrorFiring   bool    `json:"error_alert"`
+		LatencyFiring bool    `json:"latency_alert"`
+	}
+
+	metrics.mu.Lock()
+	routes := make([]routeEntry, 0, len(metrics.routes))
+	for route, rs := range metrics.routes {
+		e := routeEntry{Route: route, Requests: rs.requests, Errors: rs.errors, SuccessRatio: 1}
+		if rs.requests > 0 {
+			e.SuccessRatio = 1 - float64(rs.errors)/float64(rs.requests)
+			e.AvgLatencyMs = rs.latencySum / float64(rs.requests) * 1000
+		}
+		e.Recent, e.RecentErrors, e.RecentSlow = rs.window(sloRingMinutes)
+		if a := sloAlerts["error_rate "+route]; a != nil {
+			e.ErrorFiring = a.firing
+		}
+		if a := sloAlerts["latency "+route]; a != nil {
+			e.LatencyFiring = a.firing
+		}
+		routes = append(routes, e)
+	}
+	metrics.mu.Unlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"slo_enabled": config().SLO.Enabled,
+		"routes":      routes,
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Instances that cannot be scraped, behind NAT for example, can push the
+// same metrics /metrics serves to a Prometheus Pushgateway instead. Set
+// prometheus.push.url to the gateway's base URL and the metrics are PUT to
+// /metrics/job/{job}/instance/{instance} every intervalSeconds, replacing
+// the previous push. A URL with a path of its own is used as is, which
+// suits receivers that import the text format directly, such as
+// VictoriaMetrics' /api/v1/import/prometheus. Pushing works whether or not
+// the /metrics endpoint is enabled.
+
+var metricsPushClient = &http.Client{Timeout: 30 * time.Second}
+
+func initMetricsPush() {
+	cfg := &config().Prometheus.Push
+	if cfg.URL == "" {
+		return
+	}
+	if cfg.Job == "" {
+		cfg.Job = "xyliloader"
+	}
+	if cfg.Instance == "" {
+		cfg.Instance, _ = os.Hostname()
+	}
+	if cfg.IntervalSeconds <= 0 {
+		cfg.IntervalSeconds = 30
+	}
+}
+
+// metricsPushURL is where pushes go: the gateway's grouping key path unless
+// the configured URL already names one.
+func metricsPushURL() (string, error) {
+	cfg := config().Prometheus.Push
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return "", err
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/metrics/job/" + url.PathEscape(cfg.Job)
+		if cfg.Instance != "" {
+			u.Path += "/instance/" + url.PathEscape(cfg.Instance)
+		}
+		u.RawPath = ""
+	}
+	return u.String(), nil
+}
+
+func runMetricsPush() {
+	ticker := time.NewTicker(time.Duration(config().Prometheus.Push.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	failing := false
+	for range ticker.C {
+		err := pushMetrics()
+		switch {
+		case err != nil && !failing:
+			log.Printf("Error pushing metrics: %v", err)
+		case err == nil && failing:
+			log.Printf("Pushing metrics works again")
+		}
+		failing = err != nil
+	}
+}
+
+func pushMetrics() error {
+	cfg := config().Prometheus.Push
+	target, err := metricsPushURL()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	writePrometheus(&body)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	switch {
+	case cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken)
+	case cfg.Username != "":
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	resp, err := metricsPushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
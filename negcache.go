@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// missCache remembers short IDs that recently resolved to nothing, so repeated
+// probes for random IDs are answered without a database round trip. Entries
+// are dropped when an upload claims the ID; with several instances behind a
+// balancer a fresh upload may 404 elsewhere for up to the TTL.
+type missCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]time.Time
+	order   []string
+}
+
+var notFoundCache *missCache
+
+func newMissCache(ttl time.Duration, max int) *missCache {
+	return &missCache{ttl: ttl, max: max, entries: make(map[string]time.Time)}
+}
+
+func (c *missCache) Has(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.entries[id]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.entries, id)
+		return false
+	}
+	return true
+}
+
+func (c *missCache) Add(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.entries) >= c.max && len(c.order) > 0 {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	if len(c.order) > 2*c.max {
+		kept := make([]string, 0, len(c.entries))
+		for _, key := range c.order {
+			if _, ok := c.entries[key]; ok {
+				kept = append(kept, key)
+			}
+		}
+		c.order = kept
+	}
+
+	c.entries[id] = time.Now().Add(c.ttl)
+	c.order = append(c.order, id)
+}
+
+func (c *missCache) Forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// findFileByShortID is findFile for public short links, backed by the miss cache.
+func findFileByShortID(ctx context.Context, shortID string, v interface{}) error {
+	if notFoundCache.Has(shortID) {
+		return errFileNotFound
+	}
+	err := findFile(ctx, bson.M{
+		"metadata.short_id":   shortID,
+		"metadata.expires_at": notExpired(),
+		"metadata.quarantine": bson.M{"$exists": false},
+	}, v)
+	if err == errFileNotFound {
+		notFoundCache.Add(shortID)
+	}
+	return err
+}
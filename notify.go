@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// notifyEvent is an operator-facing event such as an SLO alert. Events are
+// always logged and, when notify.webhookURL is set, POSTed there as JSON.
+type notifyEvent struct {
+	Type    string                 `json:"type"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	At      time.Time              `json:"at"`
+}
+
+func notify(ev notifyEvent) {
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	log.Printf("[%s] %s", ev.Type, ev.Message)
+
+	if config().Notify.WebhookURL == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, config().Notify.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error creating notify request: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Error sending notification: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Notification webhook returned %s", resp.Status)
+		}
+	}()
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Accounts can sign in with GitHub, Google, Discord or any OpenID Connect
+// provider listed in oauth.providers, next to or instead of a password:
+//
+//	GET /auth/{provider}            starts the sign-in; ?link=1 links the
+//	                                provider to the signed-in account instead
+//	GET /auth/{provider}/callback   where the provider sends the user back
+//	GET    /api/account/identities             linked providers
+//	DELETE /api/account/identities?provider=   unlinks one
+//
+// A provider with allowedDomains only lets in people with a verified email
+// address at one of those domains, on every sign-in. Unknown identities get
+// a new account when the provider has signup set; otherwise they must be
+// linked from the dashboard of an existing account first.
+
+// OAuthProvider is one entry of oauth.providers.
+type OAuthProvider struct {
+	Name           string   `json:"name"`
+	Type           string   `json:"type"`   // github, google, discord or oidc; defaults to name
+	Label          string   `json:"label"`  // button text
+	Issuer         string   `json:"issuer"` // oidc only
+	ClientID       string   `json:"clientId"`
+	ClientSecret   string   `json:"clientSecret"`
+	AllowedDomains []string `json:"allowedDomains"`
+	Signup         bool     `json:"signup"`
+
+	authURL, tokenURL, userInfoURL string
+	scopes                         []string
+}
+
+// UserIdentity links an account to a provider's user.
+type UserIdentity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+// oauthUser is what a provider tells about the person signing in.
+type oauthUser struct {
+	Subject string
+	Login   string
+	Emails  []string // verified addresses only
+}
+
+const oauthCookie = "xyli_oauth"
+
+var (
+	oauthClient = &http.Client{Timeout: 15 * time.Second}
+
+	providerNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+func initOAuth(ctx context.Context) error {
+	for _, p := range config().OAuth.Providers {
+		p.Name = strings.ToLower(p.Name)
+		if !providerNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("oauth: invalid provider name %q", p.Name)
+		}
+		if p.Type == "" {
+			p.Type = p.Name
+		}
+		if p.ClientID == "" || p.ClientSecret == "" {
+			return fmt.Errorf("oauth %s: clientId and clientSecret are required", p.Name)
+		}
+		for i, d := range p.AllowedDomains {
+			p.AllowedDomains[i] = strings.ToLower(strings.TrimPrefix(d, "@"))
+		}
+
+		switch p.Type {
+		case "github":
+			p.authURL = "https://github.com/login/oauth/authorize"
+			p.tokenURL = "https://github.com/login/oauth/access_token"
+			p.userInfoURL = "https://api.github.com/user"
+			p.scopes = []string{"read:user", "user:email"}
+			p.Label = orDefault(p.Label, "GitHub")
+		case "google":
+			p.authURL = "https://accounts.google.com/o/oauth2/v2/auth"
+			p.tokenURL = "https://oauth2.googleapis.com/token"
+			p.userInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+			p.scopes = []string{"openid", "email", "profile"}
+			p.Label = orDefault(p.Label, "Google")
+		case "discord":
+			p.authURL = "https://discord.com/oauth2/authorize"
+			p.tokenURL = "https://discord.com/api/oauth2/token"
+			p.userInfoURL = "https://discord.com/api/users/@me"
+			p.scopes = []string{"identify", "email"}
+			p.Label = orDefault(p.Label, "Discord")
+		case "oidc":
+			if err := discoverOIDC(ctx, p); err != nil {
+				return fmt.Errorf("oauth %s: %v", p.Name, err)
+			}
+			p.scopes = []string{"openid", "email", "profile"}
+			p.Label = orDefault(p.Label, p.Name)
+		default:
+			return fmt.Errorf("oauth %s: unknown type %q", p.Name, p.Type)
+		}
+	}
+
+	if len(config().OAuth.Providers) > 0 {
+		_, err := usersColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+		})
+		if err != nil {
+			log.Printf("Error creating identities index: %v", err)
+		}
+	}
+	return nil
+}
+
+// discoverOIDC reads the endpoints of an OpenID Connect issuer.
+func discoverOIDC(ctx context.Context, p *OAuthProvider) error {
+	if p.Issuer == "" {
+		return errors.New("issuer is required")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := oauthGet(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", "", &doc); err != nil {
+		return err
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.UserinfoEndpoint == "" {
+		return errors.New("incomplete discovery document")
+	}
+	p.authURL, p.tokenURL, p.userInfoURL = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.UserinfoEndpoint
+	return nil
+}
+
+func oauthProvider(name string) *OAuthProvider {
+	for _, p := range config().OAuth.Providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *OAuthProvider) redirectURL() string {
+	return config().Upload.BaseURL + "/auth/" + p.Name + "/callback"
+}
+
+// allows reports whether the provider's domain restriction lets u in.
+func (p *OAuthProvider) allows(u *oauthUser) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+	for _, email := range u.Emails {
+		if i := strings.LastIndexByte(email, '@'); i >= 0 && containsString(p.AllowedDomains, strings.ToLower(email[i+1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// oauthGet fetches JSON, with a bearer token when one is given.
+func oauthGet(ctx context.Context, target, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// exchange trades the authorization code for an access token.
+func (p *OAuthProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL()},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token (%s)", orDefault(token.Error, resp.Status))
+	}
+	return token.AccessToken, nil
+}
+
+// identify asks the provider who the token belongs to.
+func (p *OAuthProvider) identify(ctx context.Context, token string) (*oauthUser, error) {
+	u := &oauthUser{}
+	switch p.Type {
+	case "github":
+		var info struct {
+			ID    int64  `json:"id"`
+			Login string `json:"login"`
+		}
+		if err := oauthGet(ctx, p.userInfoURL, token, &info); err != nil {
+			return nil, err
+		}
+		var emails []struct {
+			Email    string `json:"email"`
+			Verified bool   `json:"verified"`
+		}
+		if err := oauthGet(ctx, "https://api.github.com/user/emails", token, &emails); err != nil {
+			return nil, err
+		}
+		u.Subject, u.Login = fmt.Sprint(info.ID), info.Login
+		for _, e := range emails {
+			if e.Verified {
+				u.Emails = append(u.Emails, e.Email)
+			}
+		}
+	case "discord":
+		var info struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+			Email    string `json:"email"`
+			Verified bool   `json:"verified"`
+		}
+		if err := oauthGet(ctx, p.userInfoURL, token, &info); err != nil {
+			return nil, err
+		}
+		u.Subject, u.Login = info.ID, info.Username
+		if info.Verified && info.Email != "" {
+			u.Emails = []string{info.Email}
+		}
+	default:
+		var info struct {
+			Subject           string `json:"sub"`
+			Email             string `json:"email"`
+			EmailVerified     bool   `json:"email_verified"`
+			PreferredUsername string `json:"preferred_username"`
+		}
+		if err := oauthGet(ctx, p.userInfoURL, token, &info); err != nil {
+			return nil, err
+		}
+		u.Subject, u.Login = info.Subject, info.PreferredUsername
+		if info.EmailVerified && info.Email != "" {
+			u.Emails = []string{info.Email}
+		}
+		if u.Login == "" && info.Email != "" {
+			u.Login, _, _ = strings.Cut(info.Email, "@")
+		}
+	}
+	if u.Subject == "" || u.Subject == "0" {
+		return nil, errors.New("provider returned no user ID")
+	}
+	return u, nil
+}
+
+// oauthUsername derives a free, valid username from the provider's login.
+func oauthUsername(ctx context.Context, login string) (string, error) {
+	base := strings.Map(func(r rune) rune {
+		if r < 128 && (r == '_' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return -1
+	}, login)
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+	name := base
+	for i := 0; i < 5; i++ {
+		n, err := usersColl.CountDocuments(ctx, bson.M{"username": name})
+		dbBreaker.Record(err)
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return name, nil
+		}
+		name = base + "-" + strings.ToLower(generateID())
+	}
+	return "", errors.New("no free username")
+}
+
+func findUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	var user User
+	err := usersColl.FindOne(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"provider": provider,
+		"subject":  subject,
+	}}}).Decode(&user)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// handleOAuth serves /auth/{provider} and its callback.
+func handleOAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/auth/"), "/")
+	p := oauthProvider(name)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch rest {
+	case "":
+		startOAuth(w, r, p)
+	case "callback":
+		finishOAuth(w, r, p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startOAuth sends the browser to the provider. The state, the PKCE
+// verifier and whether this is a link request travel in a short-lived cookie.
+func startOAuth(w http.ResponseWriter, r *http.Request, p *OAuthProvider) {
+	mode := "login"
+	if r.URL.Query().Get("link") == "1" {
+		if currentUser(r) == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		mode = "link"
+	}
+	state, verifier := generateToken(), generateToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookie,
+		Value:    state + "." + mode + "." + verifier,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config().Upload.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.redirectURL()},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if p.Type == "google" && len(p.AllowedDomains) == 1 {
+		q.Set("hd", p.AllowedDomains[0])
+	}
+	http.Redirect(w, r, p.authURL+"?"+q.Encode(), http.StatusFound)
+}
+
+func finishOAuth(w http.ResponseWriter, r *http.Request, p *OAuthProvider) {
+	cookie, err := r.Cookie(oauthCookie)
+	http.SetCookie(w, &http.Cookie{Name: oauthCookie, Value: "", Path: "/auth/", MaxAge: -1, HttpOnly: true})
+	if err != nil {
+		renderAuth(w, "login", "", "Вход не удался: сессия входа истекла, попробуйте ещё раз")
+		return
+	}
+	parts := strings.SplitN(cookie.Value, ".", 3)
+	if len(parts) != 3 || parts[0] == "" || r.URL.Query().Get("state") != parts[0] {
+		renderAuth(w, "login", "", "Вход не удался: сессия входа истекла, попробуйте ещё раз")
+		return
+	}
+	mode, verifier := parts[1], parts[2]
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		renderAuth(w, "login", "", "Вход через "+p.Label+" отменён")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	token, err := p.exchange(ctx, code, verifier)
+	var ident *oauthUser
+	if err == nil {
+		ident, err = p.identify(ctx, token)
+	}
+	if err != nil {
+		log.Printf("OAuth sign-in with %s failed: %v", p.Name, err)
+		renderAuth(w, "login", "", "Не удалось получить данные от "+p.Label)
+		return
+	}
+	if !p.allows(ident) {
+		renderAuth(w, "login", "", "Вход через "+p.Label+" разрешён только для адресов "+strings.Join(p.AllowedDomains, ", "))
+		return
+	}
+	identity := UserIdentity{Provider: p.Name, Subject: ident.Subject, LinkedAt: time.Now()}
+	if len(ident.Emails) > 0 {
+		identity.Email = ident.Emails[0]
+	}
+
+	existing, err := findUserByIdentity(ctx, p.Name, ident.Subject)
+	if err != nil && err != mongo.ErrNoDocuments {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if mode == "link" {
+		user := currentUser(r)
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if existing != nil && existing.ID != user.ID {
+			renderAuth(w, "login", "", "Этот аккаунт "+p.Label+" уже привязан к другому пользователю")
+			return
+		}
+		if existing == nil {
+			_, err := usersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$push": bson.M{"identities": identity}})
+			dbBreaker.Record(err)
+			if mongo.IsDuplicateKeyError(err) {
+				renderAuth(w, "login", "", "Этот аккаунт "+p.Label+" уже привязан к другому пользователю")
+				return
+			}
+			if err != nil {
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s linked %s account %s", user.Username, p.Name, ident.Subject)
+		}
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	if existing == nil {
+		if !p.Signup {
+			renderAuth(w, "login", "", "Этот аккаунт "+p.Label+" не привязан. Войдите с паролем и привяжите его в личном кабинете")
+			return
+		}
+		username, err := oauthUsername(ctx, ident.Login)
+		if err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		existing = &User{
+			ID:         primitive.NewObjectID(),
+			Username:   username,
+			CreatedAt:  time.Now(),
+			Identities: []UserIdentity{identity},
+		}
+		_, err = usersColl.InsertOne(ctx, existing)
+		dbBreaker.Record(err)
+		if err != nil {
+			renderAuth(w, "login", "", "Не удалось создать аккаунт, попробуйте ещё раз")
+			return
+		}
+		log.Printf("Created user %s from %s account %s", username, p.Name, ident.Subject)
+	}
+
+	if err := startSession(ctx, w, existing.ID); err != nil {
+		http.Error(w, "session error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// handleAccountIdentities lists and unlinks the caller's providers. Like
+// API keys, this needs a browser session.
+func handleAccountIdentities(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		providers := make([]map[string]string, 0, len(config().OAuth.Providers))
+		for _, p := range config().OAuth.Providers {
+			providers = append(providers, map[string]string{"name": p.Name, "label": p.Label})
+		}
+		identities := user.Identities
+		if identities == nil {
+			identities = []UserIdentity{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"identities": identities,
+			"providers":  providers,
+			"password":   user.PasswordHash != "",
+		})
+
+	case http.MethodDelete:
+		provider := r.URL.Query().Get("provider")
+		linked := false
+		for _, id := range user.Identities {
+			linked = linked || id.Provider == provider
+		}
+		if !linked {
+			jsonError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if user.PasswordHash == "" && len(user.Identities) == 1 {
+			jsonError(w, "Cannot unlink the last login", http.StatusConflict)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		_, err := usersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %s unlinked %s", user.Username, provider)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "unlinked"})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
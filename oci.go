@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A small subset of the OCI distribution API under /v2/, enough for docker
+// push/pull, crane and ORAS to use the instance as a scratch cache for CI
+// images and artifacts. Clients log in with any username and an API key as
+// the password. Repositories are per account and only a name: blobs and
+// manifests are addressed by digest within the account, so layers pushed to
+// one repository are mounted into others for free. Tags live in
+// registry_tags.
+//
+// Blob uploads are append-mode files (see streams.go): POST opens one,
+// PATCH appends, PUT with ?digest= closes it and checks the digest against
+// the SHA-256 that closing computes. Open uploads expire after a day; blobs
+// and manifests then get the account's default expiry, capped by its plan.
+// Manifests are kept as regular uploads with their media type in metadata.
+
+const (
+	ociUploadTTL    = 24 * time.Hour
+	ociMaxManifest  = 4 << 20
+	ociVersionValue = "registry/2.0"
+)
+
+var (
+	ociName   = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	ociTag    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+	ociDigest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+)
+
+type ociTagRecord struct {
+	OwnerID   primitive.ObjectID `bson:"owner_id"`
+	Repo      string             `bson:"repo"`
+	Tag       string             `bson:"tag"`
+	Digest    string             `bson:"digest"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+}
+
+var registryTagsColl *mongo.Collection
+
+func initRegistry(ctx context.Context) {
+	registryTagsColl = db.Collection("registry_tags")
+	if !config().Registry.Enabled {
+		return
+	}
+	_, err := registryTagsColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "owner_id", Value: 1}, {Key: "repo", Value: 1}, {Key: "tag", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Error creating registry_tags index: %v", err)
+	}
+	_, err = gfsBucket.GetFilesCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "metadata.owner_id", Value: 1}, {Key: "metadata.oci_digest", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"metadata.oci_digest": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "metadata.oci_upload", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating registry indexes: %v", err)
+	}
+}
+
+func ociError(w http.ResponseWriter, code, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// ociStorageError answers a storage failure in the registry's error format.
+func ociStorageError(w http.ResponseWriter, err error) {
+	if isMongoOutage(err) {
+		setUnavailable(w.Header(), time.Duration(dbBreaker.RetryAfter())*time.Second)
+		ociError(w, "UNAVAILABLE", "Storage temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	ociError(w, "UNKNOWN", "Storage error", http.StatusInternalServerError)
+}
+
+func handleRegistry(w http.ResponseWriter, r *http.Request) {
+	if !config().Registry.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", ociVersionValue)
+	_, secret, ok := r.BasicAuth()
+	if !ok {
+		secret = bearerToken(r)
+	}
+	key, user := lookupAPIKey("secret", secret)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="XyliLoader"`)
+		ociError(w, "UNAUTHORIZED", "API key required", http.StatusUnauthorized)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2")
+	if p == "" || p == "/" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+		return
+	}
+	p = strings.TrimPrefix(p, "/")
+
+	var name, kind, ref string
+	switch {
+	case strings.HasSuffix(p, "/tags/list"):
+		name, kind = strings.TrimSuffix(p, "/tags/list"), "tags"
+	case strings.Contains(p, "/blobs/uploads"):
+		i := strings.LastIndex(p, "/blobs/uploads")
+		name, kind, ref = p[:i], "uploads", strings.Trim(p[i+len("/blobs/uploads"):], "/")
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		name, kind, ref = p[:i], "blobs", p[i+len("/blobs/"):]
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		name, kind, ref = p[:i], "manifests", p[i+len("/manifests/"):]
+	}
+	if !ociName.MatchString(name) || len(name) > 255 {
+		ociError(w, "NAME_INVALID", "Invalid repository name", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
+
+	switch kind {
+	case "tags":
+		ociListTags(ctx, w, r, user, name)
+	case "uploads":
+		ociUpload(ctx, w, r, user, key, name, ref)
+	case "blobs":
+		ociBlob(ctx, w, r, user, name, ref)
+	case "manifests":
+		ociManifest(ctx, w, r, user, key, name, ref)
+	default:
+		ociError(w, "UNSUPPORTED", "Not supported", http.StatusNotFound)
+	}
+}
+
+// findOCIObject returns the blob or manifest of user with this digest.
+func findOCIObject(ctx context.Context, user *User, digest string) (*fileRecord, error) {
+	var o fileRecord
+	err := findFile(ctx, bson.M{
+		"metadata.owner_id":   user.ID,
+		"metadata.oci_digest": digest,
+		"metadata.expires_at": notExpired(),
+	}, &o)
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// ociExpiry is when a finished blob or manifest of user expires, if ever.
+func ociExpiry(ctx context.Context, user *User) (*time.Time, error) {
+	_, tier := effectiveTier(ctx, user)
+	ttl, err := uploadExpiry(defaultExpires(user, ""), tier, false)
+	if err != nil || ttl == 0 {
+		return nil, err
+	}
+	at := time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+	return &at, nil
+}
+
+func ociSetLocation(w http.ResponseWriter, name, kind, ref string) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/%s/%s", name, kind, ref))
+}
+
+func ociSetRange(w http.ResponseWriter, length int64) {
+	w.Header().Set("Range", fmt.Sprintf("0-%d", max(length-1, 0)))
+}
+
+func ociUpload(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, key *APIKey, name, id string) {
+	if id == "" {
+		if r.Method != http.MethodPost {
+			ociError(w, "UNSUPPORTED", "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Cross-repository mount: every repository of the account already
+		// sees every blob.
+		if mount := r.URL.Query().Get("mount"); mount != "" {
+			if _, err := findOCIObject(ctx, user, mount); err == nil {
+				ociSetLocation(w, name, "blobs", mount)
+				w.Header().Set("Docker-Content-Digest", mount)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		ociOpenUpload(ctx, w, r, user, key, name)
+		return
+	}
+
+	var f fileRecord
+	err := findFile(ctx, bson.M{
+		"metadata.oci_upload": id,
+		"metadata.owner_id":   user.ID,
+		"metadata.storage":    appendStore.Name(),
+		"metadata.expires_at": notExpired(),
+	}, &f)
+	if err == errFileNotFound {
+		ociError(w, "BLOB_UPLOAD_UNKNOWN", "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ociStorageError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ociSetLocation(w, name, "blobs/uploads", id)
+		ociSetRange(w, f.Length)
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		if !ociAppend(ctx, w, r, user, &f) {
+			return
+		}
+		ociSetLocation(w, name, "blobs/uploads", id)
+		ociSetRange(w, f.Length)
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		if !ociAppend(ctx, w, r, user, &f) {
+			return
+		}
+		ociFinishUpload(ctx, w, r, user, name, &f)
+	case http.MethodDelete:
+		if err := deleteStoredFile(ctx, &f); err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		ociError(w, "UNSUPPORTED", "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ociOpenUpload starts a blob upload. With ?digest= the body is the whole
+// blob and the upload finishes straight away.
+func ociOpenUpload(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, key *APIKey, name string) {
+	if err := checkTierQuota(ctx, user, max(r.ContentLength, 0)); isTierLimit(err) {
+		ociError(w, "DENIED", err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		ociStorageError(w, err)
+		return
+	}
+
+	id := generateID() + generateID() + generateID()
+	metadata := newUploadMetadata("application/octet-stream", user)
+	metadata["oci_upload"] = id
+	metadata["oci_repo"] = name
+	metadata["expires_at"] = time.Now().Add(ociUploadTTL).UTC().Truncate(time.Millisecond)
+	if key != nil {
+		metadata["api_key_id"] = key.KeyID
+	}
+	f := fileRecord{ID: primitive.NewObjectID(), Filename: "blob"}
+	if _, err := appendStore.Put(ctx, f.ID, f.Filename, strings.NewReader(""), metadata); err != nil {
+		ociStorageError(w, err)
+		return
+	}
+	f.Metadata.ShortID = metadata["short_id"].(string)
+	f.Metadata.Growing = true
+
+	if r.URL.Query().Get("digest") != "" {
+		if !ociAppend(ctx, w, r, user, &f) {
+			return
+		}
+		ociFinishUpload(ctx, w, r, user, name, &f)
+		return
+	}
+	ociSetLocation(w, name, "blobs/uploads", id)
+	ociSetRange(w, 0)
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ociAppend adds the request body to an open upload, honouring
+// Content-Range, and updates f.Length.
+func ociAppend(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, f *fileRecord) bool {
+	at := f.Length
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		start, _, ok := strings.Cut(strings.TrimPrefix(cr, "bytes "), "-")
+		n, err := strconv.ParseInt(start, 10, 64)
+		if !ok || err != nil || n != f.Length {
+			ociSetRange(w, f.Length)
+			ociError(w, "BLOB_UPLOAD_INVALID", "Content-Range does not continue the upload", http.StatusRequestedRangeNotSatisfiable)
+			return false
+		}
+	}
+	if r.ContentLength == 0 {
+		return true
+	}
+	allowance, err := streamAllowance(ctx, user, f)
+	if err != nil {
+		ociStorageError(w, err)
+		return false
+	}
+	if r.ContentLength > allowance {
+		ociError(w, "DENIED", errTierStorage.Error(), http.StatusForbidden)
+		return false
+	}
+	length, err := appendStore.Append(ctx, f.ID, at, http.MaxBytesReader(w, r.Body, allowance))
+	if err == errAppendOffset {
+		ociSetRange(w, length)
+		ociError(w, "BLOB_UPLOAD_INVALID", "Upload offset does not match", http.StatusRequestedRangeNotSatisfiable)
+		return false
+	}
+	if err == errAppendTooLarge {
+		ociError(w, "SIZE_INVALID", "Blob too large (max "+formatSize(config().Upload.MaxSize)+")", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		ociStorageError(w, err)
+		return false
+	}
+	f.Length = length
+	return true
+}
+
+// ociFinishUpload closes an upload and keeps it as the blob named by
+// ?digest= if its content matches.
+func ociFinishUpload(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, name string, f *fileRecord) {
+	digest := r.URL.Query().Get("digest")
+	if !ociDigest.MatchString(digest) {
+		ociError(w, "DIGEST_INVALID", "Unsupported or missing digest", http.StatusBadRequest)
+		return
+	}
+	err := finishAppend(ctx, f)
+	if isInfected(err) {
+		deleteStoredFile(ctx, f)
+		ociError(w, "DENIED", "Blob rejected: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err == errScannerUnavailable {
+		setUnavailable(w.Header(), scannerRetryAfter)
+		ociError(w, "UNAVAILABLE", "Virus scanner unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil && err != errAppendClosed {
+		ociStorageError(w, err)
+		return
+	}
+	if err := findFile(ctx, bson.M{"_id": f.ID}, f); err != nil {
+		ociStorageError(w, err)
+		return
+	}
+	if "sha256:"+f.Metadata.SHA256 != digest {
+		deleteStoredFile(ctx, f)
+		ociError(w, "DIGEST_INVALID", "Content does not match the digest", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := findOCIObject(ctx, user, digest); err == nil {
+		// Pushed twice, e.g. by two jobs at once: keep the first.
+		deleteStoredFile(ctx, f)
+	} else {
+		set, unset := bson.M{"metadata.oci_digest": digest}, bson.M{"metadata.oci_upload": ""}
+		expires, err := ociExpiry(ctx, user)
+		if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		if expires != nil {
+			set["metadata.expires_at"] = *expires
+		} else {
+			unset["metadata.expires_at"] = ""
+		}
+		_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": f.ID}, bson.M{"$set": set, "$unset": unset})
+		dbBreaker.Record(err)
+		if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		notFoundCache.Forget(f.Metadata.ShortID)
+		metadata := bson.M{"short_id": f.Metadata.ShortID, "content_type": f.Metadata.ContentType, "owner_id": f.Metadata.OwnerID, "api_key_id": f.Metadata.APIKeyID}
+		recordUploadStat(metadata, f.Length)
+	}
+
+	ociSetLocation(w, name, "blobs", digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func ociBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, name, digest string) {
+	o, err := findOCIObject(ctx, user, digest)
+	if err == errFileNotFound {
+		ociError(w, "BLOB_UNKNOWN", "Blob unknown", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ociStorageError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		ociServe(w, r, o, "application/octet-stream")
+	case http.MethodDelete:
+		if err := deleteStoredFile(ctx, o); err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		ociError(w, "UNSUPPORTED", "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ociServe sends a blob or manifest.
+func ociServe(w http.ResponseWriter, r *http.Request, o *fileRecord, contentType string) {
+	if bandwidthExceeded(o) {
+		ociError(w, "TOOMANYREQUESTS", "Bandwidth limit reached", http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(o.Length, 10))
+	w.Header().Set("Docker-Content-Digest", o.Metadata.OCIDigest)
+	w.Header().Set("ETag", `"`+o.Metadata.OCIDigest+`"`)
+	if r.Method == http.MethodHead {
+		return
+	}
+	rc, err := openStoredFile(r.Context(), o)
+	if err != nil {
+		ociStorageError(w, err)
+		return
+	}
+	defer rc.Close()
+	n, _ := io.Copy(w, rc)
+	recordBandwidth(o, n)
+	recordStat(statEvent{Type: statDownload, ShortID: o.Metadata.ShortID, OwnerID: o.Metadata.OwnerID, Bytes: n})
+}
+
+func ociManifest(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, key *APIKey, name, ref string) {
+	isDigest := ociDigest.MatchString(ref)
+	if !isDigest && !ociTag.MatchString(ref) {
+		ociError(w, "MANIFEST_INVALID", "Invalid reference", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		ociPutManifest(ctx, w, r, user, key, name, ref, isDigest)
+		return
+	}
+
+	digest := ref
+	if !isDigest {
+		var tag ociTagRecord
+		err := registryTagsColl.FindOne(ctx, bson.M{"owner_id": user.ID, "repo": name, "tag": ref}).Decode(&tag)
+		dbBreaker.Record(err)
+		if err == mongo.ErrNoDocuments {
+			ociError(w, "MANIFEST_UNKNOWN", "Manifest unknown", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		digest = tag.Digest
+	}
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		o, err := findOCIObject(ctx, user, digest)
+		if err == errFileNotFound || (err == nil && o.Metadata.OCIMediaType == "") {
+			ociError(w, "MANIFEST_UNKNOWN", "Manifest unknown", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		ociServe(w, r, o, o.Metadata.OCIMediaType)
+	case http.MethodDelete:
+		filter := bson.M{"owner_id": user.ID, "repo": name, "tag": ref}
+		if isDigest {
+			filter = bson.M{"owner_id": user.ID, "repo": name, "digest": digest}
+		}
+		res, err := registryTagsColl.DeleteMany(ctx, filter)
+		dbBreaker.Record(err)
+		if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		if isDigest {
+			o, err := findOCIObject(ctx, user, digest)
+			if err == nil {
+				err = deleteStoredFile(ctx, o)
+			}
+			if err == errFileNotFound && res.DeletedCount == 0 {
+				ociError(w, "MANIFEST_UNKNOWN", "Manifest unknown", http.StatusNotFound)
+				return
+			}
+			if err != nil && err != errFileNotFound {
+				ociStorageError(w, err)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		ociError(w, "UNSUPPORTED", "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func ociPutManifest(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, key *APIKey, name, ref string, isDigest bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ociMaxManifest))
+	if err != nil {
+		ociError(w, "SIZE_INVALID", "Manifest too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(body, &probe) != nil {
+		ociError(w, "MANIFEST_INVALID", "Manifest is not JSON", http.StatusBadRequest)
+		return
+	}
+	mediaType := mediaType(r.Header.Get("Content-Type"))
+	if mediaType == "" {
+		mediaType = probe.MediaType
+	}
+	if mediaType == "" {
+		mediaType = "application/vnd.oci.image.manifest.v1+json"
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if isDigest && digest != ref {
+		ociError(w, "DIGEST_INVALID", "Manifest does not match the digest", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := findOCIObject(ctx, user, digest); err == errFileNotFound {
+		if err := checkTierQuota(ctx, user, int64(len(body))); isTierLimit(err) {
+			ociError(w, "DENIED", err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		expires, err := ociExpiry(ctx, user)
+		if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		// The client's media type is kept apart from content_type, which
+		// /raw/ serves and must stay safe.
+		metadata := newUploadMetadata(safeContentType("application/json"), user)
+		metadata["oci_digest"] = digest
+		metadata["oci_media_type"] = mediaType
+		metadata["oci_repo"] = name
+		if key != nil {
+			metadata["api_key_id"] = key.KeyID
+		}
+		if expires != nil {
+			metadata["expires_at"] = *expires
+		}
+		if err := storeUpload(ctx, "manifest.json", strings.NewReader(string(body)), metadata); err != nil {
+			ociStorageError(w, err)
+			return
+		}
+		notFoundCache.Forget(metadata["short_id"].(string))
+	} else if err != nil {
+		ociStorageError(w, err)
+		return
+	}
+
+	if !isDigest {
+		_, err := registryTagsColl.UpdateOne(ctx,
+			bson.M{"owner_id": user.ID, "repo": name, "tag": ref},
+			bson.M{"$set": bson.M{"digest": digest, "updated_at": time.Now()}},
+			options.Update().SetUpsert(true),
+		)
+		dbBreaker.Record(err)
+		if err != nil {
+			ociStorageError(w, err)
+			return
+		}
+	}
+
+	ociSetLocation(w, name, "manifests", digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func ociListTags(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, name string) {
+	if r.Method != http.MethodGet {
+		ociError(w, "UNSUPPORTED", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter := bson.M{"owner_id": user.ID, "repo": name}
+	if last := r.URL.Query().Get("last"); last != "" {
+		filter["tag"] = bson.M{"$gt": last}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "tag", Value: 1}}).SetLimit(1000)
+	if n, err := strconv.ParseInt(r.URL.Query().Get("n"), 10, 64); err == nil && n > 0 && n < 1000 {
+		opts.SetLimit(n)
+	}
+	cursor, err := registryTagsColl.Find(ctx, filter, opts)
+	dbBreaker.Record(err)
+	var records []ociTagRecord
+	if err == nil {
+		err = cursor.All(ctx, &records)
+		dbBreaker.Record(err)
+	}
+	if err != nil {
+		ociStorageError(w, err)
+		return
+	}
+	tags := make([]string, 0, len(records))
+	for _, t := range records {
+		tags = append(tags, t.Tag)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tags})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Text in uploaded images (screenshots, mostly) is recognised in the
+// background, either by a local tesseract or by an external OCR service
+// given as ocr.url, and kept in metadata.ocr_text where the dashboard and
+// admin file searches look for it. The service receives the image as the
+// request body and answers with {"text": "..."} or with plain text.
+
+const (
+	ocrTimeout       = 2 * time.Minute
+	ocrMaxTextLength = 64 << 10
+)
+
+var ocrQueue chan primitive.ObjectID
+
+func initOCR() {
+	cfg := &config().OCR
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Tesseract == "" {
+		cfg.Tesseract = "tesseract"
+	}
+	if cfg.Languages == "" {
+		cfg.Languages = "eng+rus"
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 20 << 20
+	}
+	if cfg.URL == "" {
+		if _, err := exec.LookPath(cfg.Tesseract); err != nil {
+			log.Printf("tesseract not found (%v), OCR disabled", err)
+			cfg.Enabled = false
+			return
+		}
+	}
+
+	ocrQueue = make(chan primitive.ObjectID, cfg.QueueSize)
+	for i := 0; i < cfg.Workers; i++ {
+		go ocrWorker()
+	}
+}
+
+// queueOCR schedules text recognition for an image. Like queuePoster it
+// never blocks; an image that does not fit in the queue stays unindexed.
+func queueOCR(id primitive.ObjectID, contentType string) {
+	if !ocrable(contentType) {
+		return
+	}
+	select {
+	case ocrQueue <- id:
+	default:
+	}
+}
+
+// ocrable reports whether text recognition applies to a content type.
+func ocrable(contentType string) bool {
+	if !config().OCR.Enabled {
+		return false
+	}
+	switch mediaType(contentType) {
+	case "image/png", "image/jpeg", "image/webp", "image/gif", "image/bmp", "image/tiff":
+		return true
+	}
+	return false
+}
+
+func ocrWorker() {
+	for id := range ocrQueue {
+		if err := recognizeText(id); err != nil {
+			log.Printf("OCR failed for %s: %v", id.Hex(), err)
+		}
+	}
+}
+
+func recognizeText(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ocrTimeout)
+	defer cancel()
+
+	var f fileRecord
+	if err := findFile(ctx, bson.M{"_id": id}, &f); err != nil {
+		return err
+	}
+	if f.Length > config().OCR.MaxBytes {
+		return nil
+	}
+
+	content, err := openStoredFile(ctx, &f)
+	if err != nil {
+		return err
+	}
+	image, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	var text string
+	if config().OCR.URL != "" {
+		text, err = ocrService(ctx, image, f.Metadata.ContentType)
+	} else {
+		text, err = ocrTesseract(ctx, image)
+	}
+	if err != nil {
+		return err
+	}
+
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > ocrMaxTextLength {
+		cut := ocrMaxTextLength
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"metadata.ocr_text": text,
+		"metadata.ocr_at":   time.Now(),
+	}})
+	dbBreaker.Record(err)
+	return err
+}
+
+func ocrTesseract(ctx context.Context, image []byte) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, config().OCR.Tesseract, "stdin", "stdout", "-l", config().OCR.Languages)
+	cmd.Stdin = bytes.NewReader(image)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func ocrService(ctx context.Context, image []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config().OCR.URL, bytes.NewReader(image))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if config().OCR.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config().OCR.Token)
+	}
+	if config().OCR.Languages != "" {
+		req.Header.Set("X-OCR-Languages", config().OCR.Languages)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4*ocrMaxTextLength))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OCR service returned %s", resp.Status)
+	}
+
+	if mediaType(resp.Header.Get("Content-Type")) == "application/json" {
+		var result struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", err
+		}
+		return result.Text, nil
+	}
+	return string(body), nil
+}
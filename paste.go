@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// Pastes are text snippets sent from the /paste form or API instead of a
+// file. They are stored like any other upload, as plain text with the
+// language recorded in metadata.language, and their page is highlighted on
+// the server with numbered, linkable lines. /raw/ shows a paste's text in
+// the browser instead of downloading it.
+
+const pasteViewer = "viewer_paste"
+
+// pasteLanguages are offered in the form; the API accepts any name or alias
+// the highlighter knows.
+var pasteLanguages = []string{
+	"bash", "c", "cpp", "csharp", "css", "diff", "docker", "go", "html", "ini",
+	"java", "javascript", "json", "kotlin", "lua", "markdown", "php",
+	"powershell", "python", "ruby", "rust", "sql", "toml", "typescript",
+	"xml", "yaml",
+}
+
+var pasteCSS []byte
+
+func initPaste() error {
+	cfg := &config().Paste
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 1 << 20
+	}
+	cfg.MaxSize = min(cfg.MaxSize, config().Upload.MaxSize)
+	if cfg.Style == "" {
+		cfg.Style = "monokai"
+	}
+	style, ok := styles.Registry[cfg.Style]
+	if !ok {
+		return fmt.Errorf("paste.style: unknown style %q", cfg.Style)
+	}
+
+	var buf bytes.Buffer
+	if err := pasteFormatter().WriteCSS(&buf, style); err != nil {
+		return err
+	}
+	pasteCSS = buf.Bytes()
+	return nil
+}
+
+func pasteFormatter() *chromahtml.Formatter {
+	return chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.LineNumbersInTable(true),
+		chromahtml.WithLinkableLineNumbers(true, "L"),
+		chromahtml.TabWidth(4),
+	)
+}
+
+// pasteLexer picks the highlighter for a paste: the language hint, then the
+// file name, then a guess from the content.
+func pasteLexer(language, filename, content string) chroma.Lexer {
+	var lexer chroma.Lexer
+	if language != "" {
+		lexer = lexers.Get(language)
+	}
+	if lexer == nil && filename != "" {
+		lexer = lexers.Match(filename)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(content)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return lexer
+}
+
+// pasteFilename names a paste that came without a name after its language.
+func pasteFilename(lexer chroma.Lexer) string {
+	for _, pattern := range lexer.Config().Filenames {
+		if ext, ok := strings.CutPrefix(pattern, "*."); ok && !strings.ContainsAny(ext, "*?[") {
+			return "paste." + ext
+		}
+	}
+	return "paste.txt"
+}
+
+func handlePasteCSS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(pasteCSS)
+}
+
+func handlePaste(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		type option struct{ Value, Label string }
+		languages := make([]option, 0, len(pasteLanguages))
+		for _, name := range pasteLanguages {
+			if lexer := lexers.Get(name); lexer != nil {
+				languages = append(languages, option{name, lexer.Config().Name})
+			}
+		}
+		tmpl := template.Must(template.ParseFiles("templates/paste.html"))
+		err := tmpl.Execute(w, struct {
+			User            *User
+			MaxSize         string
+			Languages       []option
+			CaptchaProvider string
+			CaptchaSiteKey  string
+		}{currentUser(r), requestLocale(r).size(config().Paste.MaxSize), languages, config().Captcha.Provider, config().Captcha.SiteKey})
+		if err != nil {
+			http.Error(w, "template error", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		createPaste(w, r)
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createPaste stores a paste sent as JSON or as a form with the fields
+// content, language, filename and expires.
+func createPaste(w http.ResponseWriter, r *http.Request) {
+	if !dbBreaker.Allow() {
+		serveUnavailable(w, true)
+		return
+	}
+
+	var req struct {
+		Content    string `json:"content"`
+		Language   string `json:"language"`
+		Filename   string `json:"filename"`
+		Expires    string `json:"expires"`
+		Password   string `json:"password"`
+		Visibility string `json:"visibility"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, config().Paste.MaxSize+64<<10)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseMultipartForm(config().Paste.MaxSize + 64<<10); err != nil && err != http.ErrNotMultipart {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		req.Content = r.FormValue("content")
+		req.Language = r.FormValue("language")
+		req.Filename = r.FormValue("filename")
+		req.Expires = r.FormValue("expires")
+		req.Password = r.FormValue("password")
+		req.Visibility = r.FormValue("visibility")
+	}
+
+	size := int64(len(req.Content))
+	if strings.TrimSpace(req.Content) == "" {
+		jsonError(w, "Paste is empty", http.StatusBadRequest)
+		return
+	}
+	if size > config().Paste.MaxSize {
+		jsonError(w, fmt.Sprintf("Paste too large (max %s)", formatSize(config().Paste.MaxSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !utf8.ValidString(req.Content) {
+		jsonError(w, "Paste must be UTF-8 text", http.StatusBadRequest)
+		return
+	}
+	req.Language = strings.TrimSpace(req.Language)
+	if req.Language != "" && req.Language != "auto" && lexers.Get(req.Language) == nil {
+		jsonError(w, "Unknown language", http.StatusBadRequest)
+		return
+	}
+	if req.Language == "auto" {
+		req.Language = ""
+	}
+
+	user, key := requestAuth(r)
+	var tier *Tier
+	if user != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		_, tier = effectiveTier(ctx, user)
+		err := checkTierQuota(ctx, user, size)
+		cancel()
+		if isTierLimit(err) {
+			jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	} else if !allowAnonUpload(w, r, size) {
+		return
+	}
+
+	ttl, err := uploadExpiry(defaultExpires(user, req.Expires), tier, true)
+	if err != nil {
+		jsonError(w, "Invalid expires value", http.StatusBadRequest)
+		return
+	}
+
+	passwordHash, err := uploadPasswordHash(user, req.Password)
+	if err == errPasswordTooLong {
+		jsonError(w, "Password too long", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	visibility, err := uploadVisibility(user, req.Visibility)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filename := strings.TrimSpace(req.Filename)
+	lexer := pasteLexer(req.Language, filename, req.Content)
+	if filename == "" {
+		filename = pasteFilename(lexer)
+	}
+
+	metadata := newUploadMetadata(plainText, user)
+	metadata["paste"] = true
+	metadata["language"] = lexer.Config().Name
+	if key != nil {
+		metadata["api_key_id"] = key.KeyID
+	}
+	if passwordHash != "" {
+		metadata["password_hash"] = passwordHash
+	}
+	if visibility != "" {
+		metadata["visibility"] = visibility
+	}
+	shortID := metadata["short_id"].(string)
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+		metadata["expires_at"] = expiresAt
+	}
+
+	err = storeUpload(r.Context(), filename, strings.NewReader(req.Content), metadata)
+	if isInfected(err) {
+		jsonError(w, "File rejected: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err == errScannerUnavailable {
+		setUnavailable(w.Header(), scannerRetryAfter)
+		jsonError(w, "Virus scanner unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if isMongoOutage(err) {
+		serveUnavailable(w, true)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	notFoundCache.Forget(shortID)
+
+	response := map[string]interface{}{
+		"link":          fmt.Sprintf("%s/%s", config().Upload.BaseURL, shortID),
+		"raw_link":      fmt.Sprintf("%s/raw/%s", config().Upload.BaseURL, shortID),
+		"deletion_link": fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"]),
+		"filename":      filename,
+		"language":      metadata["language"],
+	}
+	if ttl > 0 {
+		response["expires_at"] = expiresAt
+	}
+	if passwordHash != "" {
+		response["protected"] = true
+	}
+	if sum, _ := metadata["sha256"].(string); sum != "" {
+		if rc := newReceipt(shortID, sum, size); rc != nil {
+			response["receipt"] = rc
+		}
+	}
+	setQuotaHeaders(r.Context(), w.Header(), user, tier)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// servePasteViewer renders a paste's page with its highlighted text.
+func servePasteViewer(ctx context.Context, w http.ResponseWriter, r *http.Request, f *fileRecord) {
+	loc := requestLocale(r)
+	ago := loc.formatAgo(f.UploadDate)
+	etag := viewerETag(pasteViewer, f.ID.Hex(), f.Filename, f.Metadata.ContentType, f.Length, f.UploadDate,
+		fmt.Sprintf("%s %s %s %s %d", loc.tag, ago, f.Metadata.Language, config().Paste.Style, config().Paste.MaxSize))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", viewerCacheControl(f))
+	w.Header().Set("Vary", "Accept-Language")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		recordStat(statEvent{Type: statView, ShortID: f.Metadata.ShortID, OwnerID: f.Metadata.OwnerID})
+		return
+	}
+
+	rc, err := openStoredFile(ctx, f)
+	if err != nil {
+		http.Error(w, "download error", http.StatusInternalServerError)
+		return
+	}
+	content, err := io.ReadAll(io.LimitReader(rc, config().Paste.MaxSize))
+	rc.Close()
+	if err != nil {
+		http.Error(w, "download error", http.StatusInternalServerError)
+		return
+	}
+
+	lexer := pasteLexer(f.Metadata.Language, f.Filename, string(content))
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, string(content))
+	var code bytes.Buffer
+	if err == nil {
+		err = pasteFormatter().Format(&code, styles.Get(config().Paste.Style), tokens)
+	}
+	if err != nil {
+		http.Error(w, "highlight error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		FileID      string
+		Filename    string
+		FileSize    string
+		Lang        string
+		Uploaded    string
+		UploadedAgo string
+		UploadedISO string
+		Language    string
+		Truncated   bool
+		Code        template.HTML
+		Embed       embedMeta
+	}{
+		FileID:      f.Metadata.ShortID,
+		Filename:    f.Filename,
+		FileSize:    loc.size(f.Length),
+		Lang:        loc.tag,
+		Uploaded:    loc.formatDate(f.UploadDate),
+		UploadedAgo: ago,
+		UploadedISO: f.UploadDate.UTC().Format(time.RFC3339),
+		Language:    lexer.Config().Name,
+		Truncated:   f.Length > int64(len(content)),
+		Code:        template.HTML(code.String()),
+		Embed:       newEmbedMeta(f, loc),
+	}
+	tmpl := parseViewer(viewerTemplatePath(pasteViewer))
+	tmpl.Execute(w, data)
+	recordStat(statEvent{Type: statView, ShortID: f.Metadata.ShortID, OwnerID: f.Metadata.OwnerID})
+}
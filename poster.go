@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Poster frames for videos are extracted with ffmpeg by a small pool of
+// background workers and stored as derived objects, like thumbnails. New
+// video uploads are queued right away; older ones are queued the first
+// time their poster is requested.
+
+const posterTimeout = 2 * time.Minute
+
+var (
+	posterQueue chan primitive.ObjectID
+
+	posterPendingMu sync.Mutex
+	posterPending   = map[primitive.ObjectID]bool{}
+)
+
+func initPosters() {
+	cfg := &config().Posters
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.FFmpeg == "" {
+		cfg.FFmpeg = "ffmpeg"
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 2
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.OffsetSeconds <= 0 {
+		cfg.OffsetSeconds = 1
+	}
+	if _, err := exec.LookPath(cfg.FFmpeg); err != nil {
+		log.Printf("ffmpeg not found (%v), video posters disabled", err)
+		cfg.Enabled = false
+		return
+	}
+
+	posterQueue = make(chan primitive.ObjectID, cfg.QueueSize)
+	for i := 0; i < cfg.Workers; i++ {
+		go posterWorker()
+	}
+}
+
+// queuePoster schedules poster extraction for a video. It never blocks:
+// when the queue is full the job is dropped and retried on first view.
+func queuePoster(id primitive.ObjectID, contentType string) {
+	if !config().Posters.Enabled || !strings.HasPrefix(contentType, "video/") {
+		return
+	}
+
+	posterPendingMu.Lock()
+	defer posterPendingMu.Unlock()
+	if posterPending[id] {
+		return
+	}
+	select {
+	case posterQueue <- id:
+		posterPending[id] = true
+	default:
+	}
+}
+
+func posterWorker() {
+	for id := range posterQueue {
+		if err := generatePoster(id); err != nil {
+			log.Printf("Poster extraction failed for %s: %v", id.Hex(), err)
+		}
+		posterPendingMu.Lock()
+		delete(posterPending, id)
+		posterPendingMu.Unlock()
+	}
+}
+
+func generatePoster(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), posterTimeout)
+	defer cancel()
+
+	if _, err := findDerived(ctx, id, "poster", "jpg"); err != errFileNotFound {
+		return err
+	}
+
+	var f fileRecord
+	if err := findFile(ctx, bson.M{"_id": id}, &f); err != nil {
+		return err
+	}
+
+	// ffmpeg needs a seekable input: MP4 files often keep their index at the end.
+	tmp, err := os.CreateTemp("", "xyli-poster-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	content, err := openStoredFile(ctx, &f)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	frame, err := extractFrame(ctx, tmp.Name(), config().Posters.OffsetSeconds)
+	if err == nil && len(frame) == 0 {
+		// Clips shorter than the offset produce no output; take the first frame.
+		frame, err = extractFrame(ctx, tmp.Name(), 0)
+	}
+	if err != nil {
+		return err
+	}
+	if len(frame) == 0 {
+		return fmt.Errorf("no video frames")
+	}
+
+	metadata := bson.M{
+		"content_type": "image/jpeg",
+		"derived_from": id,
+		"derivative":   "poster",
+		"variant":      "jpg",
+	}
+	_, err = store.Put(ctx, primitive.NewObjectID(), "poster-"+f.Filename+".jpg", bytes.NewReader(frame), metadata)
+	return err
+}
+
+func extractFrame(ctx context.Context, input string, offset int) ([]byte, error) {
+	cfg := config().Thumbnails
+	scale := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", cfg.MaxWidth, cfg.MaxHeight)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, config().Posters.FFmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-ss", strconv.Itoa(offset),
+		"-i", input,
+		"-frames:v", "1",
+		"-vf", scale,
+		"-f", "image2", "-c:v", "mjpeg",
+		"pipe:1",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func handlePoster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shortID := strings.TrimPrefix(r.URL.Path, "/poster/")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var fileDoc fileRecord
+	err := findFileByShortID(ctx, shortID, &fileDoc)
+	if err == errFileNotFound {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !requireVisible(w, r, &fileDoc) {
+		return
+	}
+	if !requireSigned(w, r, &fileDoc) {
+		return
+	}
+	if !requireUnlocked(w, r, &fileDoc) {
+		return
+	}
+	if burnsAfterDownload(&fileDoc) {
+		http.Error(w, "no previews for this file", http.StatusNotFound)
+		return
+	}
+	if !requireEnabled(w, &fileDoc) {
+		return
+	}
+
+	poster, err := findDerived(ctx, fileDoc.ID, "poster", "jpg")
+	if err == errFileNotFound {
+		queuePoster(fileDoc.ID, fileDoc.Metadata.ContentType)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "poster not ready", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	serveDerived(w, r, poster)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Office documents are converted to PDF in the background, by a local
+// LibreOffice or by a Gotenberg service given as previews.gotenbergUrl, and
+// the PDF is kept as a derived object. Their viewer page then shows it with
+// the PDF viewer, so recipients can read a document without the program
+// that made it. Like posters, older uploads are converted the first time
+// their preview is requested.
+
+const (
+	previewTimeout = 3 * time.Minute
+	previewViewer  = "viewer_pdf"
+)
+
+var (
+	previewQueue chan primitive.ObjectID
+
+	previewPendingMu sync.Mutex
+	previewPending   = map[primitive.ObjectID]bool{}
+)
+
+func initPreviews() {
+	cfg := &config().Previews
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Soffice == "" {
+		cfg.Soffice = "soffice"
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 50 << 20
+	}
+	cfg.GotenbergURL = strings.TrimSuffix(cfg.GotenbergURL, "/")
+	if cfg.GotenbergURL == "" {
+		if _, err := exec.LookPath(cfg.Soffice); err != nil {
+			log.Printf("soffice not found (%v), document previews disabled", err)
+			cfg.Enabled = false
+			return
+		}
+	}
+	if _, ok := viewerPlugins[previewViewer]; !ok {
+		log.Printf("The %s viewer is missing, document previews disabled", previewViewer)
+		cfg.Enabled = false
+		return
+	}
+
+	previewQueue = make(chan primitive.ObjectID, cfg.QueueSize)
+	for i := 0; i < cfg.Workers; i++ {
+		go previewWorker()
+	}
+}
+
+// previewable reports whether a file is an office document that gets a PDF
+// preview.
+func previewable(filename string, size int64) bool {
+	if !config().Previews.Enabled || size > config().Previews.MaxBytes {
+		return false
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".docx", ".xlsx", ".pptx", ".doc", ".xls", ".ppt", ".odt", ".ods", ".odp", ".rtf":
+		return true
+	}
+	return false
+}
+
+// queuePreview schedules the conversion of an office document. It never
+// blocks: when the queue is full the job is dropped and retried on first view.
+func queuePreview(id primitive.ObjectID, filename string, size int64) {
+	if !previewable(filename, size) {
+		return
+	}
+
+	previewPendingMu.Lock()
+	defer previewPendingMu.Unlock()
+	if previewPending[id] {
+		return
+	}
+	select {
+	case previewQueue <- id:
+		previewPending[id] = true
+	default:
+	}
+}
+
+func previewWorker() {
+	for id := range previewQueue {
+		if err := generatePreview(id); err != nil {
+			log.Printf("Preview conversion failed for %s: %v", id.Hex(), err)
+		}
+		previewPendingMu.Lock()
+		delete(previewPending, id)
+		previewPendingMu.Unlock()
+	}
+}
+
+func generatePreview(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+
+	if _, err := findDerived(ctx, id, "preview", "pdf"); err != errFileNotFound {
+		return err
+	}
+
+	var f fileRecord
+	if err := findFile(ctx, bson.M{"_id": id}, &f); err != nil {
+		return err
+	}
+
+	content, err := openStoredFile(ctx, &f)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	// The converters pick the import filter by extension.
+	input := "document" + strings.ToLower(path.Ext(f.Filename))
+	var pdf []byte
+	if config().Previews.GotenbergURL != "" {
+		pdf, err = convertGotenberg(ctx, input, data)
+	} else {
+		pdf, err = convertSoffice(ctx, input, data)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF")) {
+		return fmt.Errorf("converter returned no PDF")
+	}
+
+	metadata := bson.M{
+		"content_type": "application/pdf",
+		"derived_from": id,
+		"derivative":   "preview",
+		"variant":      "pdf",
+	}
+	_, err = store.Put(ctx, primitive.NewObjectID(), "preview-"+f.Filename+".pdf", bytes.NewReader(pdf), metadata)
+	return err
+}
+
+func convertSoffice(ctx context.Context, input string, data []byte) ([]byte, error) {
+	// Each conversion gets its own LibreOffice profile: instances sharing one
+	// wait for each other or fail.
+	dir, err := os.MkdirTemp("", "xyli-preview-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, input), data, 0o600); err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, config().Previews.Soffice,
+		"-env:UserInstallation=file://"+filepath.ToSlash(filepath.Join(dir, "profile")),
+		"--headless", "--norestore",
+		"--convert-to", "pdf",
+		"--outdir", dir,
+		filepath.Join(dir, input),
+	)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(filepath.Join(dir, strings.TrimSuffix(input, path.Ext(input))+".pdf"))
+}
+
+func convertGotenberg(ctx context.Context, input string, data []byte) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", input)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(data)
+	form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config().Previews.GotenbergURL+"/forms/libreoffice/convert", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Gotenberg returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, config().Upload.MaxSize))
+}
+
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shortID := strings.TrimPrefix(r.URL.Path, "/preview/")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var fileDoc fileRecord
+	err := findFileByShortID(ctx, shortID, &fileDoc)
+	if err == errFileNotFound {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !requireVisible(w, r, &fileDoc) {
+		return
+	}
+	if !requireSigned(w, r, &fileDoc) {
+		return
+	}
+	if !requireUnlocked(w, r, &fileDoc) {
+		return
+	}
+	if burnsAfterDownload(&fileDoc) {
+		http.Error(w, "no previews for this file", http.StatusNotFound)
+		return
+	}
+	if !requireEnabled(w, &fileDoc) {
+		return
+	}
+	if !previewable(fileDoc.Filename, fileDoc.Length) {
+		http.Error(w, "no preview for this file type", http.StatusNotFound)
+		return
+	}
+
+	preview, err := findDerived(ctx, fileDoc.ID, "preview", "pdf")
+	if err == errFileNotFound {
+		queuePreview(fileDoc.ID, fileDoc.Filename, fileDoc.Length)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "preview not ready", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	serveDerived(w, r, preview)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Counters exported on /metrics in addition to the per-route request
+// metrics. They live for the lifetime of the process, as Prometheus expects.
+var (
+	uploadsTotal      atomic.Int64
+	uploadedBytes     atomic.Int64
+	downloadsTotal    atomic.Int64
+	downloadedBytes   atomic.Int64
+	mongoOutageErrors atomic.Int64
+	mongoOtherErrors  atomic.Int64
+	activeStreams     sync.Map // backend name -> *atomic.Int64
+)
+
+// countMongoError tallies a failed database call. A missing document is an
+// answer, not an error.
+func countMongoError(err error) {
+	switch {
+	case err == nil || err == mongo.ErrNoDocuments:
+	case isMongoOutage(err):
+		mongoOutageErrors.Add(1)
+	default:
+		mongoOtherErrors.Add(1)
+	}
+}
+
+func streamGauge(backend string) *atomic.Int64 {
+	if backend == "" {
+		backend = "gridfs"
+	}
+	g, _ := activeStreams.LoadOrStore(backend, new(atomic.Int64))
+	return g.(*atomic.Int64)
+}
+
+// countedStream keeps the active stream gauge of its backend up to date.
+type countedStream struct {
+	io.ReadCloser
+	gauge  *atomic.Int64
+	closed atomic.Bool
+}
+
+func newCountedStream(rc io.ReadCloser, backend string) io.ReadCloser {
+	s := &countedStream{ReadCloser: rc, gauge: streamGauge(backend)}
+	s.gauge.Add(1)
+	return s
+}
+
+func (s *countedStream) Close() error {
+	if s.closed.CompareAndSwap(false, true) {
+		s.gauge.Add(-1)
+	}
+	return s.ReadCloser.Close()
+}
+
+func promLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// handlePrometheus writes all metrics in the Prometheus text format. When
+// prometheus.token is set, scrapers must send it as a Bearer token.
+func handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	if token := config().Prometheus.Token; token != "" && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writePrometheus(w)
+}
+
+// writePrometheus writes every metric in the text format, for /metrics and
+// for the push loop alike.
+func writePrometheus(w io.Writer) {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	type routeSnapshot struct {
+		route      string
+		requests   uint64
+		errors     uint64
+		latency    []uint64
+		latencySum float64
+	}
+	metrics.mu.Lock()
+	routes := make([]routeSnapshot, 0, len(metrics.routes))
+	for route, rs := range metrics.routes {
+		routes = append(routes, routeSnapshot{route, rs.requests, rs.errors, append([]uint64(nil), rs.latency...), rs.latencySum})
+	}
+	metrics.mu.Unlock()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].route < routes[j].route })
+
+	metric("xyli_http_requests_total", "counter", "HTTP requests by route.")
+	for _, rs := range routes {
+		fmt.Fprintf(out, "xyli_http_requests_total{route=\"%s\"} %d\n", promLabel(rs.route), rs.requests)
+	}
+	metric("xyli_http_request_errors_total", "counter", "HTTP requests answered with a 5xx status, by route.")
+	for _, rs := range routes {
+		fmt.Fprintf(out, "xyli_http_request_errors_total{route=\"%s\"} %d\n", promLabel(rs.route), rs.errors)
+	}
+	metric("xyli_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, rs := range routes {
+		label := promLabel(rs.route)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += rs.latency[i]
+			fmt.Fprintf(out, "xyli_http_request_duration_seconds_bucket{route=\"%s\",le=\"%s\"} %d\n", label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(out, "xyli_http_request_duration_seconds_bucket{route=\"%s\",le=\"+Inf\"} %d\n", label, rs.requests)
+		fmt.Fprintf(out, "xyli_http_request_duration_seconds_sum{route=\"%s\"} %g\n", label, rs.latencySum)
+		fmt.Fprintf(out, "xyli_http_request_duration_seconds_count{route=\"%s\"} %d\n", label, rs.requests)
+	}
+
+	metric("xyli_uploads_total", "counter", "Stored uploads.")
+	fmt.Fprintf(out, "xyli_uploads_total %d\n", uploadsTotal.Load())
+	metric("xyli_upload_bytes_total", "counter", "Bytes stored by uploads.")
+	fmt.Fprintf(out, "xyli_upload_bytes_total %d\n", uploadedBytes.Load())
+	metric("xyli_downloads_total", "counter", "File downloads.")
+	fmt.Fprintf(out, "xyli_downloads_total %d\n", downloadsTotal.Load())
+	metric("xyli_download_bytes_total", "counter", "Bytes sent by file downloads.")
+	fmt.Fprintf(out, "xyli_download_bytes_total %d\n", downloadedBytes.Load())
+
+	if config().VideoQoE.Enabled {
+		metric("xyli_video_range_requests_total", "counter", "Range requests for videos on /raw/.")
+		fmt.Fprintf(out, "xyli_video_range_requests_total %d\n", qoeRangeRequests.Load())
+		metric("xyli_video_seeks_total", "counter", "Video range requests starting past the beginning of the file.")
+		fmt.Fprintf(out, "xyli_video_seeks_total %d\n", qoeSeeks.Load())
+		metric("xyli_video_small_ranges_total", "counter", "Video range requests smaller than videoQoe.smallRangeBytes.")
+		fmt.Fprintf(out, "xyli_video_small_ranges_total %d\n", qoeSmallRanges.Load())
+		metric("xyli_video_aborted_total", "counter", "Video responses the client closed before receiving everything it asked for.")
+		fmt.Fprintf(out, "xyli_video_aborted_total %d\n", qoeAborted.Load())
+	}
+
+	metric("xyli_storage_active_streams", "gauge", "Open read streams by storage backend.")
+	var backends []string
+	activeStreams.Range(func(k, _ interface{}) bool {
+		backends = append(backends, k.(string))
+		return true
+	})
+	sort.Strings(backends)
+	for _, b := range backends {
+		fmt.Fprintf(out, "xyli_storage_active_streams{backend=\"%s\"} %d\n", promLabel(b), streamGauge(b).Load())
+	}
+
+	metric("xyli_mongo_errors_total", "counter", "Failed MongoDB calls; outage errors are network errors and timeouts.")
+	fmt.Fprintf(out, "xyli_mongo_errors_total{kind=\"outage\"} %d\n", mongoOutageErrors.Load())
+	fmt.Fprintf(out, "xyli_mongo_errors_total{kind=\"other\"} %d\n", mongoOtherErrors.Load())
+	metric("xyli_mongo_breaker_open", "gauge", "1 while the MongoDB circuit breaker rejects requests.")
+	open := 0
+	if dbBreaker.Open() {
+		open = 1
+	}
+	fmt.Fprintf(out, "xyli_mongo_breaker_open %d\n", open)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Uploads may carry a password, kept as a bcrypt hash in
+// metadata.password_hash. The viewer page then asks for it and, once it is
+// right, sets a cookie for that one file so the page and the /raw/,
+// /thumb/, /img/ and /poster/ URLs it embeds work for the rest of the
+// visit. Scripts send the password with /raw/ requests instead, in the
+// X-File-Password header or the password query parameter.
+
+const (
+	maxFilePassword    = 72 // bcrypt ignores anything longer
+	filePasswordHeader = "X-File-Password"
+	unlockCookiePrefix = "xyli_unlock_"
+	unlockTTL          = 12 * time.Hour
+)
+
+var (
+	errPasswordTooLong = errors.New("password is too long")
+
+	unlockKey = make([]byte, 32)
+)
+
+func initFilePasswords() {
+	rand.Read(unlockKey)
+}
+
+// hashFilePassword returns the hash to store for an upload's password, or
+// "" when none was given.
+func hashFilePassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	if len(password) > maxFilePassword {
+		return "", errPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// unlockToken is the cookie value that proves the password of f was
+// entered. It covers the hash, so changing the password locks the file again.
+func unlockToken(f *fileRecord) string {
+	mac := hmac.New(sha256.New, unlockKey)
+	mac.Write([]byte(f.Metadata.ShortID + "|" + f.Metadata.PasswordHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkFilePassword(f *fileRecord, password string) bool {
+	return password != "" && len(password) <= maxFilePassword &&
+		bcrypt.CompareHashAndPassword([]byte(f.Metadata.PasswordHash), []byte(password)) == nil
+}
+
+// fileUnlocked reports whether the request may see the content of f: the
+// file has no password, the unlock cookie is valid, the password came
+// with the request, or the request is signed.
+func fileUnlocked(r *http.Request, f *fileRecord) bool {
+	if f.Metadata.PasswordHash == "" || signedRequest(r, f) {
+		return true
+	}
+	if c, err := r.Cookie(unlockCookiePrefix + f.Metadata.ShortID); err == nil && hmac.Equal([]byte(c.Value), []byte(unlockToken(f))) {
+		return true
+	}
+	password := r.Header.Get(filePasswordHeader)
+	if password == "" {
+		password = r.URL.Query().Get("password")
+	}
+	return checkFilePassword(f, password)
+}
+
+// requireUnlocked answers 401 and returns false when f is password
+// protected and the request has not unlocked it. Responses for protected
+// files must not end up in shared caches.
+func requireUnlocked(w http.ResponseWriter, r *http.Request, f *fileRecord) bool {
+	if f.Metadata.PasswordHash == "" {
+		return true
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	if fileUnlocked(r, f) {
+		return true
+	}
+	http.Error(w, "password required", http.StatusUnauthorized)
+	return false
+}
+
+// viewerCacheControl keeps the page of a protected file out of shared caches.
+func viewerCacheControl(f *fileRecord) string {
+	if f.Metadata.PasswordHash != "" || f.Metadata.Visibility == visibilityPrivate {
+		return "private, no-cache"
+	}
+	return "no-cache"
+}
+
+// servePasswordPage handles the viewer page of a protected file that is
+// still locked: GET shows the form, POST checks the password and, when it
+// is right, sets the unlock cookie and reloads the page.
+func servePasswordPage(w http.ResponseWriter, r *http.Request, f *fileRecord) {
+	w.Header().Set("Cache-Control", "private, no-store")
+	wrong := false
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+		if checkFilePassword(f, r.FormValue("password")) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     unlockCookiePrefix + f.Metadata.ShortID,
+				Value:    unlockToken(f),
+				Path:     "/",
+				MaxAge:   int(unlockTTL / time.Second),
+				HttpOnly: true,
+				Secure:   strings.HasPrefix(config().Upload.BaseURL, "https://"),
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, "/"+f.Metadata.ShortID, http.StatusSeeOther)
+			return
+		}
+		wrong = true
+		w.WriteHeader(http.StatusForbidden)
+	}
+
+	loc := requestLocale(r)
+	tmpl := template.Must(template.ParseFiles("templates/password.html"))
+	tmpl.Execute(w, struct {
+		FileID string
+		Lang   string
+		Text   *passwordText
+		Wrong  bool
+	}{f.Metadata.ShortID, loc.tag, &loc.password, wrong})
+}
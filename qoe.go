@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// With videoQoe.enabled, /raw/ requests for videos are tallied by how the
+// player fetches them: where in the file ranges start, how many are seeks,
+// how many are small (a player that keeps asking for a little more is
+// usually rebuffering) and how many the client abandoned. Counters are kept
+// in memory and added to one document per video in video_qoe every minute;
+// /api/admin/qoe reports them with hints on whether HLS transcoding or a CDN
+// would help.
+
+const (
+	qoeOffsetBuckets = 10
+	qoeMinRequests   = 20
+)
+
+// qoeCounters is both the in-memory tally and the stored document.
+type qoeCounters struct {
+	ShortID   string                  `bson:"_id" json:"short_id"`
+	Length    int64                   `bson:"length" json:"length"`
+	Requests  int64                   `bson:"requests" json:"requests"`
+	Ranged    int64                   `bson:"ranged" json:"ranged"`
+	Probes    int64                   `bson:"probes" json:"probes"`
+	Seeks     int64                   `bson:"seeks" json:"seeks"`
+	Small     int64                   `bson:"small" json:"small"`
+	Aborted   int64                   `bson:"aborted" json:"aborted"`
+	Bytes     int64                   `bson:"bytes" json:"bytes"`
+	Offsets   [qoeOffsetBuckets]int64 `bson:"offsets" json:"offsets"`
+	UpdatedAt time.Time               `bson:"updated_at" json:"updated_at"`
+}
+
+var (
+	videoQoEColl *mongo.Collection
+
+	qoeMu      sync.Mutex
+	qoePending = map[string]*qoeCounters{}
+
+	// Totals for /metrics, by the same classification.
+	qoeRangeRequests atomic.Int64
+	qoeSeeks         atomic.Int64
+	qoeSmallRanges   atomic.Int64
+	qoeAborted       atomic.Int64
+)
+
+func initVideoQoE() {
+	cfg := &config().VideoQoE
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.SmallRangeBytes <= 0 {
+		cfg.SmallRangeBytes = 256 << 10
+	}
+	videoQoEColl = db.Collection("video_qoe")
+}
+
+// recordVideoRange tallies one /raw/ response for f: the requested bytes
+// start to end and how many of them were sent before the request ended.
+func recordVideoRange(f *fileRecord, ranged bool, start, end, sent int64) {
+	if !config().VideoQoE.Enabled || !strings.HasPrefix(f.Metadata.ContentType, "video/") || f.Length <= 0 {
+		return
+	}
+	requested := end - start + 1
+
+	qoeMu.Lock()
+	defer qoeMu.Unlock()
+	c := qoePending[f.Metadata.ShortID]
+	if c == nil {
+		c = &qoeCounters{ShortID: f.Metadata.ShortID}
+		qoePending[f.Metadata.ShortID] = c
+	}
+	c.Length = f.Length
+	c.Requests++
+	c.Bytes += sent
+	if sent < requested {
+		c.Aborted++
+		qoeAborted.Add(1)
+	}
+	if !ranged {
+		return
+	}
+	c.Ranged++
+	qoeRangeRequests.Add(1)
+	// Safari asks for bytes=0-1 before it plays anything.
+	if requested <= 2 {
+		c.Probes++
+		return
+	}
+	c.Offsets[min(start*qoeOffsetBuckets/f.Length, qoeOffsetBuckets-1)]++
+	if start > 0 {
+		c.Seeks++
+		qoeSeeks.Add(1)
+	}
+	if requested < config().VideoQoE.SmallRangeBytes && end < f.Length-1 {
+		c.Small++
+		qoeSmallRanges.Add(1)
+	}
+}
+
+func runVideoQoEFlusher() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushVideoQoE()
+	}
+}
+
+// flushVideoQoE adds the pending counters to video_qoe. They are kept for
+// the next run while the database is down.
+func flushVideoQoE() {
+	if !dbBreaker.Allow() {
+		return
+	}
+	qoeMu.Lock()
+	pending := qoePending
+	qoePending = map[string]*qoeCounters{}
+	qoeMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	now := time.Now()
+	models := make([]mongo.WriteModel, 0, len(pending))
+	for _, c := range pending {
+		inc := bson.M{
+			"requests": c.Requests,
+			"ranged":   c.Ranged,
+			"probes":   c.Probes,
+			"seeks":    c.Seeks,
+			"small":    c.Small,
+			"aborted":  c.Aborted,
+			"bytes":    c.Bytes,
+		}
+		for i, n := range c.Offsets {
+			inc["offsets."+strconv.Itoa(i)] = n
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": c.ShortID}).
+			SetUpdate(bson.M{"$inc": inc, "$set": bson.M{"length": c.Length, "updated_at": now}}).
+			SetUpsert(true))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := videoQoEColl.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	dbBreaker.Record(err)
+	if err != nil {
+		log.Printf("Error writing video QoE counters for %d videos: %v", len(pending), err)
+	}
+}
+
+// handleAdminQoE lists the most requested videos (?limit=, 50 by default)
+// with their range-request ratios.
+func handleAdminQoE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+	if !config().VideoQoE.Enabled {
+		jsonError(w, "Video QoE tracking is disabled", http.StatusNotFound)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var videos []qoeCounters
+	cursor, err := videoQoEColl.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "requests", Value: -1}}).SetLimit(int64(limit)))
+	dbBreaker.Record(err)
+	if err == nil {
+		err = cursor.All(ctx, &videos)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	type videoEntry struct {
+		qoeCounters
+		SeekRatio  float64  `json:"seek_ratio"`
+		SmallRatio float64  `json:"small_ratio"`
+		AbortRatio float64  `json:"abort_ratio"`
+		Plays      float64  `json:"full_plays"`
+		Suggest    []string `json:"suggest"`
+	}
+	ratio := func(n, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) / float64(total)
+	}
+
+	entries := make([]videoEntry, 0, len(videos))
+	for _, v := range videos {
+		e := videoEntry{
+			qoeCounters: v,
+			SeekRatio:   ratio(v.Seeks, v.Ranged-v.Probes),
+			SmallRatio:  ratio(v.Small, v.Ranged-v.Probes),
+			AbortRatio:  ratio(v.Aborted, v.Requests),
+			Plays:       ratio(v.Bytes, v.Length),
+			Suggest:     []string{},
+		}
+		// Players that keep fetching small pieces or give up mid-range are
+		// struggling with a single progressive file; segments adapt to the
+		// connection. A video sent many times over is worth a cache in front.
+		if v.Requests >= qoeMinRequests && (e.SmallRatio >= 0.25 || e.AbortRatio >= 0.25) {
+			e.Suggest = append(e.Suggest, "hls")
+		}
+		if e.Plays >= 10 {
+			e.Suggest = append(e.Suggest, "cdn")
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"small_range_bytes": config().VideoQoE.SmallRangeBytes,
+		"videos":            entries,
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// /u is an upload endpoint shaped for one-liners such as
+//
+//	flameshot gui -r | curl -fsS -H "Authorization: Bearer KEY" --data-binary @- https://host/u | xclip -sel c
+//
+// It takes the file as the raw request body or as the only field of a
+// multipart form (curl -F f=@shot.png), whatever the field is called, and
+// answers with the bare link and no trailing newline, ready for the
+// clipboard. The name comes from ?name=, the form part, or the detected
+// type; ?expires= and ?password= work as on /upload. Append mode, E2E and
+// the spool are left to /upload.
+func handleQuickUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ContentLength > config().Upload.MaxSize {
+		jsonError(w, fmt.Sprintf("File too large (max %s)", formatSize(config().Upload.MaxSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body, name, claimed := io.Reader(r.Body), r.URL.Query().Get("name"), r.Header.Get("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(claimed); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		part, err := mr.NextPart()
+		if err != nil {
+			jsonError(w, "File not found", http.StatusBadRequest)
+			return
+		}
+		defer part.Close()
+		body, claimed = part, part.Header.Get("Content-Type")
+		if name == "" {
+			name = part.FileName()
+		}
+	}
+
+	metadata, ok := storeSimpleUpload(w, r, jsonUploadError(w), simpleUpload{
+		Body:       body,
+		Name:       name,
+		Claimed:    claimed,
+		MaxSize:    config().Upload.MaxSize,
+		Expires:    r.URL.Query().Get("expires"),
+		Password:   r.URL.Query().Get("password"),
+		StripEXIF:  r.URL.Query().Get("strip_exif"),
+		Visibility: r.URL.Query().Get("visibility"),
+	})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Deletion-Link", fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"]))
+	fmt.Fprintf(w, "%s/%s", config().Upload.BaseURL, metadata["short_id"])
+}
+
+// uploadFailer answers a failed simple upload. code is stable for clients
+// to branch on; message is for people.
+type uploadFailer func(status int, code, message string)
+
+// jsonUploadError answers failures the way /upload does.
+func jsonUploadError(w http.ResponseWriter) uploadFailer {
+	return func(status int, code, message string) {
+		switch code {
+		case "unavailable":
+			serveUnavailable(w, true)
+			return
+		case "scanner_unavailable":
+			setUnavailable(w.Header(), scannerRetryAfter)
+		}
+		jsonErrorCode(w, code, message, status)
+	}
+}
+
+// simpleUpload is one file sent to an endpoint that takes a few options.
+type simpleUpload struct {
+	Body              io.Reader
+	Name, Claimed     string // filename and Content-Type as sent, if any
+	MaxSize           int64
+	Expires, Password string
+	StripEXIF         string // account default when empty
+	Visibility        string
+	// Dedupe returns a file the caller already has with the same content
+	// instead, with "duplicate" set in the metadata.
+	Dedupe bool
+	// Metadata is added to the upload's metadata.
+	Metadata bson.M
+}
+
+// storeSimpleUpload stores u as a new upload of the caller and returns its
+// metadata. On failure the request has been answered through fail.
+func storeSimpleUpload(w http.ResponseWriter, r *http.Request, fail uploadFailer, u simpleUpload) (bson.M, bool) {
+	body, name, claimed, max := u.Body, u.Name, u.Claimed, u.MaxSize
+	// Buffer the body on disk: its size is needed before storing, and piped
+	// bodies do not send a length.
+	tmp, err := os.CreateTemp("", "xyli-quick-*")
+	if err != nil {
+		fail(http.StatusInternalServerError, "server_error", "Upload error")
+		return nil, false
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(body, max+1))
+	if err != nil {
+		fail(http.StatusBadRequest, "bad_request", "Bad request")
+		return nil, false
+	}
+	if size == 0 {
+		fail(http.StatusBadRequest, "empty", "File is empty")
+		return nil, false
+	}
+	if size > max {
+		fail(http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("File too large (max %s)", formatSize(max)))
+		return nil, false
+	}
+
+	user, key := requestAuth(r)
+	var tier *Tier
+	if user != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		_, tier = effectiveTier(ctx, user)
+		err := checkTierQuota(ctx, user, size)
+		cancel()
+		if isTierLimit(err) {
+			fail(http.StatusRequestEntityTooLarge, "quota_exceeded", err.Error())
+			return nil, false
+		}
+	} else if !allowAnonUpload(w, r, size) {
+		return nil, false
+	}
+
+	if u.Dedupe && user != nil {
+		var existing fileRecord
+		err := findFile(r.Context(), bson.M{
+			"metadata.owner_id":   user.ID,
+			"metadata.sha256":     hex.EncodeToString(sum.Sum(nil)),
+			"length":              size,
+			"metadata.expires_at": notExpired(),
+			"metadata.disabled":   bson.M{"$ne": true},
+		}, &existing)
+		if err == nil {
+			setQuotaHeaders(r.Context(), w.Header(), user, tier)
+			return bson.M{"short_id": existing.Metadata.ShortID, "delete_token": existing.Metadata.DeleteToken, "content_type": existing.Metadata.ContentType, "duplicate": true}, true
+		}
+		if err != errFileNotFound {
+			fail(http.StatusServiceUnavailable, "unavailable", "Storage unavailable")
+			return nil, false
+		}
+	}
+
+	head := make([]byte, sniffLen)
+	n, _ := tmp.ReadAt(head, 0)
+	contentType := detectContentType(name, head[:n], claimed)
+	if name = strings.TrimSpace(name); name == "" {
+		name = "upload"
+		if exts, _ := mime.ExtensionsByType(mediaType(contentType)); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+
+	ttl, err := uploadExpiry(defaultExpires(user, u.Expires), tier, isPaste(contentType))
+	if err != nil {
+		fail(http.StatusBadRequest, "invalid_expires", "Invalid expires value")
+		return nil, false
+	}
+	passwordHash, err := uploadPasswordHash(user, u.Password)
+	if err == errPasswordTooLong {
+		fail(http.StatusBadRequest, "password_too_long", "Password too long")
+		return nil, false
+	}
+	if err != nil {
+		fail(http.StatusInternalServerError, "server_error", "Upload error")
+		return nil, false
+	}
+	stripEXIF, err := uploadStripEXIF(user, u.StripEXIF)
+	if err != nil {
+		fail(http.StatusBadRequest, "invalid_strip_exif", "Invalid strip_exif value")
+		return nil, false
+	}
+	visibility, err := uploadVisibility(user, u.Visibility)
+	if err != nil {
+		fail(http.StatusBadRequest, "invalid_visibility", err.Error())
+		return nil, false
+	}
+
+	metadata := newUploadMetadata(contentType, user)
+	for k, v := range u.Metadata {
+		metadata[k] = v
+	}
+	if key != nil {
+		metadata["api_key_id"] = key.KeyID
+	}
+	if passwordHash != "" {
+		metadata["password_hash"] = passwordHash
+	}
+	if stripEXIF {
+		metadata["strip_exif"] = true
+	}
+	if visibility != "" {
+		metadata["visibility"] = visibility
+	}
+	if ttl > 0 {
+		metadata["expires_at"] = time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+	}
+
+	err = storeUpload(r.Context(), name, io.NewSectionReader(tmp, 0, size), metadata)
+	if isInfected(err) {
+		fail(http.StatusUnprocessableEntity, "rejected", "File rejected: "+err.Error())
+		return nil, false
+	}
+	if err == errScannerUnavailable {
+		fail(http.StatusServiceUnavailable, "scanner_unavailable", "Virus scanner unavailable")
+		return nil, false
+	}
+	if isMongoOutage(err) {
+		fail(http.StatusServiceUnavailable, "unavailable", "Storage unavailable")
+		return nil, false
+	}
+	if err != nil {
+		fail(http.StatusInternalServerError, "server_error", "Upload error")
+		return nil, false
+	}
+	notFoundCache.Forget(metadata["short_id"].(string))
+	setQuotaHeaders(r.Context(), w.Header(), user, tier)
+	return metadata, true
+}
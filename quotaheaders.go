@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Upload responses tell clients how much room is left, so they can show it
+// or hold back a large file without asking /api/usage first:
+//
+//	X-Max-File-Size       the largest file the caller may upload, in bytes
+//	X-Storage-Remaining   bytes left in the caller's plan; absent when unlimited
+//	X-RateLimit-Limit     anonymous uploads allowed per quota window
+//	X-RateLimit-Remaining anonymous uploads left in the window
+//	X-RateLimit-Reset     seconds until the window starts over
+//
+// The X-RateLimit fields are only sent for anonymous uploads with
+// anonQuota.enabled; accounts are bound by their plan instead.
+
+// setQuotaHeaders adds the size and storage headers for a caller with the
+// given tier; user and tier are nil for anonymous uploads.
+func setQuotaHeaders(ctx context.Context, h http.Header, user *User, tier *Tier) {
+	maxSize := config().Upload.MaxSize
+	if tier != nil {
+		maxSize = tier.MaxFileSize
+	}
+	h.Set("X-Max-File-Size", strconv.FormatInt(maxSize, 10))
+	if user == nil || tier == nil || tier.MaxStorage <= 0 || !dbBreaker.Allow() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, used, err := accountUsage(ctx, user.ID)
+	if err != nil {
+		return
+	}
+	h.Set("X-Storage-Remaining", strconv.FormatInt(max(tier.MaxStorage-used, 0), 10))
+}
+
+// setAnonRateHeaders reports the anonymous quota of the request's identity.
+func setAnonRateHeaders(h http.Header, remaining int, reset time.Duration) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(config().AnonQuota.MaxUploads))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(max(remaining, 0)))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(retrySeconds(reset)))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// With receipts.enabled, uploads from /upload and /paste come back with a
+// receipt: the file's SHA-256, size, short ID and the time it was stored,
+// signed with the instance's Ed25519 key (receipts.keyFile, created on
+// first start). Whoever holds a receipt can later show that the file was
+// on the instance at that time, even after it expired:
+//
+//	GET  /api/verify-receipt   the public key, for checking receipts offline
+//	POST /api/verify-receipt   {"valid": true|false} for a receipt
+//
+// The signature covers the lines of receiptMessage, so it can be checked
+// with any Ed25519 library.
+
+const receiptVersion = 1
+
+type uploadReceipt struct {
+	Version    int       `json:"version"`
+	Instance   string    `json:"instance"`
+	ShortID    string    `json:"short_id"`
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	Signature  string    `json:"signature"`
+}
+
+var receiptKey ed25519.PrivateKey
+
+func initReceipts() error {
+	cfg := &config().Receipts
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.KeyFile == "" {
+		cfg.KeyFile = "receipt_key"
+	}
+	key, err := loadReceiptKey(cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("receipts: %v", err)
+	}
+	receiptKey = key
+	return nil
+}
+
+// loadReceiptKey reads the signing key, creating one on first start.
+func loadReceiptKey(file string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(file, data, 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Created receipt signing key %s", file)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", file)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", file)
+	}
+	return key, nil
+}
+
+// receiptMessage is what a receipt's signature covers.
+func receiptMessage(rc *uploadReceipt) []byte {
+	return []byte("xyliloader-receipt/v" + strconv.Itoa(rc.Version) + "\n" +
+		rc.Instance + "\n" +
+		rc.ShortID + "\n" +
+		rc.SHA256 + "\n" +
+		strconv.FormatInt(rc.Size, 10) + "\n" +
+		rc.UploadedAt.UTC().Format(time.RFC3339) + "\n")
+}
+
+// newReceipt signs a receipt for a stored upload, or returns nil when
+// receipts are off or the checksum is not known yet.
+func newReceipt(shortID, sum string, size int64) *uploadReceipt {
+	if receiptKey == nil || sum == "" {
+		return nil
+	}
+	rc := &uploadReceipt{
+		Version:    receiptVersion,
+		Instance:   config().Upload.BaseURL,
+		ShortID:    shortID,
+		SHA256:     sum,
+		Size:       size,
+		UploadedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	rc.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(receiptKey, receiptMessage(rc)))
+	return rc
+}
+
+func verifyReceipt(rc *uploadReceipt) bool {
+	sig, err := base64.StdEncoding.DecodeString(rc.Signature)
+	if err != nil || rc.Version != receiptVersion {
+		return false
+	}
+	return ed25519.Verify(receiptKey.Public().(ed25519.PublicKey), receiptMessage(rc), sig)
+}
+
+func handleVerifyReceipt(w http.ResponseWriter, r *http.Request) {
+	if receiptKey == nil {
+		jsonError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		der, err := x509.MarshalPKIXPublicKey(receiptKey.Public())
+		if err != nil {
+			jsonError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(map[string]string{
+			"algorithm":  "ed25519",
+			"public_key": base64.StdEncoding.EncodeToString(receiptKey.Public().(ed25519.PublicKey)),
+			"pem":        string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		})
+
+	case http.MethodPost:
+		var rc uploadReceipt
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&rc); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		valid := verifyReceipt(&rc)
+		result := map[string]interface{}{"valid": valid}
+		if valid {
+			result["short_id"] = rc.ShortID
+			result["sha256"] = rc.SHA256
+			result["size"] = rc.Size
+			result["uploaded_at"] = rc.UploadedAt
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
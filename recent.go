@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The index page shows a signed-in user their last few uploads, rendered
+// with the page so it needs no extra request. Anything that goes wrong
+// while loading them just leaves the widget out.
+
+const recentUploadsCount = 5
+
+// recentUpload is one row of the index page's recent uploads.
+type recentUpload struct {
+	ID       string
+	Filename string
+	Size     string
+	Thumb    string // thumbnail URL, empty when the file has none to show
+	Expires  string // empty when the file is kept forever
+}
+
+func recentUploads(ctx context.Context, user *User, loc *locale) []recentUpload {
+	if user == nil || !dbBreaker.Allow() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "uploadDate", Value: -1}}).SetLimit(recentUploadsCount)
+	cursor, err := gfsBucket.GetFilesCollection().Find(ctx, bson.M{
+		"metadata.owner_id":     user.ID,
+		"metadata.short_id":     bson.M{"$exists": true},
+		"metadata.expires_at":   notExpired(),
+		"metadata.derived_from": bson.M{"$exists": false},
+		"metadata.blob_holder":  bson.M{"$ne": true},
+	}, opts)
+	dbBreaker.Record(err)
+	var docs []fileRecord
+	if err == nil {
+		err = cursor.All(ctx, &docs)
+		dbBreaker.Record(err)
+	}
+	if err != nil {
+		return nil
+	}
+
+	uploads := make([]recentUpload, 0, len(docs))
+	for i := range docs {
+		f := &docs[i]
+		u := recentUpload{ID: f.Metadata.ShortID, Filename: f.Filename, Size: loc.size(f.Length)}
+		if !f.Metadata.Disabled && f.Metadata.PasswordHash == "" && !f.Metadata.E2E && !burnsAfterDownload(f) {
+			switch getFileType(f.Metadata.ContentType) {
+			case "image":
+				u.Thumb = "/thumb/" + u.ID
+			case "video":
+				if config().Posters.Enabled {
+					u.Thumb = "/poster/" + u.ID
+				}
+			}
+		}
+		if f.Metadata.ExpiresAt != nil {
+			u.Expires = loc.formatDate(*f.Metadata.ExpiresAt)
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads
+}
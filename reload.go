@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Part of the configuration can change without a restart, so in-flight
+// transfers are not dropped: upload limits and base URL, size units, the
+// admin list, tiers, anonymous quotas, scraping and challenge settings and
+// the status banner. SIGHUP or POST /api/admin/reload reads config.json and the
+// environment again and applies those sections; changes anywhere else are
+// reported and wait for the next restart.
+
+var reloadableSections = map[string]bool{
+	"upload":    true,
+	"display":   true,
+	"admin":     true,
+	"tiers":     true,
+	"anonQuota": true,
+	"scraping":  true,
+	"challenge": true,
+	"status":    true,
+	"api":       true,
+}
+
+var (
+	reloadMu sync.Mutex
+
+	// loadedConfig is the configuration as read, before any init function
+	// filled in defaults, so that reloads compare like with like.
+	loadedConfig Config
+)
+
+// reloadConfig applies the reloadable sections of a freshly read
+// configuration and returns the sections that changed but need a restart.
+// Nothing is applied if the new configuration is invalid.
+func reloadConfig() (restart []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fresh, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The running configuration is never written to: the new one is built
+	// as a copy and published whole, so requests see either one or the other.
+	prev := config()
+	updated := *prev
+	updated.Upload = fresh.Upload
+	updated.Display = fresh.Display
+	updated.Admin = fresh.Admin
+	updated.Status = fresh.Status
+	updated.Tiers = fresh.Tiers
+	updated.Challenge = fresh.Challenge
+	updated.Scraping = fresh.Scraping
+	updated.AnonQuota = fresh.AnonQuota
+	updated.AnonQuota.Secret = prev.AnonQuota.Secret
+	updated.API = fresh.API
+
+	if err := initTiers(&updated); err != nil {
+		return nil, err
+	}
+	if err := configureScraping(&updated); err != nil {
+		return nil, err
+	}
+	initStatus(&updated)
+	configureChallenge(&updated)
+	configureAnonQuota(&updated)
+	initMeta(&updated)
+	currentConfig.Store(&updated)
+
+	current := reflect.ValueOf(&loadedConfig).Elem()
+	next := reflect.ValueOf(fresh)
+	for i := 0; i < current.NumField(); i++ {
+		key, _, _ := strings.Cut(current.Type().Field(i).Tag.Get("json"), ",")
+		if reloadableSections[key] {
+			current.Field(i).Set(next.Field(i))
+		} else if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			restart = append(restart, key)
+		}
+	}
+	if fresh.AnonQuota.Secret != prev.AnonQuota.Secret && fresh.AnonQuota.Secret != "" {
+		restart = append(restart, "anonQuota.secret")
+	}
+	return restart, nil
+}
+
+func logReload(restart []string, err error) {
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current settings:\n%v", err)
+		return
+	}
+	log.Printf("Config reloaded")
+	if len(restart) > 0 {
+		log.Printf("Changed settings that need a restart: %s", strings.Join(restart, ", "))
+	}
+}
+
+// watchReloadSignal reloads the configuration on every SIGHUP.
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		logReload(reloadConfig())
+	}
+}
+
+// handleAdminReload reloads the configuration on request.
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	admin := requireAdmin(w, r, true)
+	if admin == nil {
+		return
+	}
+
+	log.Printf("Config reload requested by %s", admin.Username)
+	restart, err := reloadConfig()
+	logReload(restart, err)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":           "reloaded",
+		"restart_required": restart,
+	})
+}
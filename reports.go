@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Anyone can report a file at /report/{id}: a form in the browser, or a
+// POST with {"reason", "details"} as JSON. Reports land in the reports
+// collection with the reporter's IP, one open report per IP and file. Once
+// a file has reports.autoHideThreshold open reports it is made private
+// until an admin looks at it; its earlier visibility is kept in
+// metadata.report_hold. Admins work through the queue with
+//
+//	GET  /api/admin/reports   reported files, most reported first
+//	POST /api/admin/reports   {"id", "action": "dismiss"|"delete"}
+//
+// Dismissing closes the reports and gives a hidden file its visibility
+// back; deleting removes the file.
+
+const (
+	reportOpen      = "open"
+	reportDismissed = "dismissed"
+	reportDeleted   = "deleted"
+
+	maxReportDetails = 1000
+)
+
+// reportReasons are the reasons a report can give, in the order of
+// reportText.Reasons.
+var reportReasons = [5]string{"illegal", "copyright", "malware", "spam", "other"}
+
+type abuseReport struct {
+	ID         primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	ShortID    string              `bson:"short_id" json:"short_id"`
+	Reason     string              `bson:"reason" json:"reason"`
+	Details    string              `bson:"details,omitempty" json:"details,omitempty"`
+	IP         string              `bson:"ip" json:"ip"`
+	UserID     *primitive.ObjectID `bson:"user_id,omitempty" json:"-"`
+	Status     string              `bson:"status" json:"status"`
+	CreatedAt  time.Time           `bson:"created_at" json:"created_at"`
+	ResolvedBy string              `bson:"resolved_by,omitempty" json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time          `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+}
+
+var (
+	reportsColl *mongo.Collection
+	reportPage  *template.Template
+)
+
+func initReports(ctx context.Context) {
+	reportPage = template.Must(template.ParseFiles("templates/report.html"))
+	reportsColl = db.Collection("reports")
+	_, err := reportsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "short_id", Value: 1}, {Key: "ip", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": reportOpen}),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Printf("Error creating reports index: %v", err)
+	}
+}
+
+func validReportReason(reason string) bool {
+	for _, r := range reportReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// handleReport shows the report form of /report/{id} and takes reports.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	shortID := splitSlug(strings.TrimPrefix(r.URL.Path, "/report/"))
+	jsonAPI := false
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		jsonAPI = true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var f fileRecord
+	err := findFileByShortID(ctx, shortID, &f)
+	if err == nil && !fileVisible(r, &f) {
+		err = errFileNotFound
+	}
+	if err == errFileNotFound {
+		if jsonAPI {
+			jsonError(w, "File not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "file not found", http.StatusNotFound)
+		}
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	loc := requestLocale(r)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		serveReportForm(w, loc, &f, false, "")
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 8<<10)
+	if jsonAPI {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Reason, req.Details = r.FormValue("reason"), r.FormValue("details")
+	}
+	req.Details = strings.TrimSpace(req.Details)
+	if !validReportReason(req.Reason) || len([]rune(req.Details)) > maxReportDetails {
+		if jsonAPI {
+			jsonError(w, "Invalid report", http.StatusBadRequest)
+		} else {
+			serveReportForm(w, loc, &f, false, "Bad request")
+		}
+		return
+	}
+
+	report := abuseReport{
+		ShortID:   f.Metadata.ShortID,
+		Reason:    req.Reason,
+		Details:   req.Details,
+		IP:        clientIP(r),
+		Status:    reportOpen,
+		CreatedAt: time.Now(),
+	}
+	if user := requestUser(r); user != nil {
+		report.UserID = &user.ID
+	}
+	_, err = reportsColl.InsertOne(ctx, report)
+	dbBreaker.Record(err)
+	// A second report from the same address counts as the first one.
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		if jsonAPI {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+		} else {
+			http.Error(w, "database error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err == nil {
+		log.Printf("File %s reported from %s: %s", report.ShortID, report.IP, report.Reason)
+		holdReportedFile(ctx, &f)
+	}
+
+	if jsonAPI {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "received"})
+		return
+	}
+	serveReportForm(w, loc, &f, true, "")
+}
+
+// serveReportForm renders the form, the thanks after a report, or the form
+// again with errText in the page's language when it has one.
+func serveReportForm(w http.ResponseWriter, loc *locale, f *fileRecord, sent bool, errText string) {
+	type reason struct{ Code, Label string }
+	reasons := make([]reason, len(reportReasons))
+	for i, code := range reportReasons {
+		reasons[i] = reason{code, loc.report.Reasons[i]}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if errText != "" {
+		if msg := loc.apiErrors[apiErrorCode(errText, http.StatusBadRequest)]; msg != "" {
+			errText = msg
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	reportPage.Execute(w, struct {
+		Lang    string
+		Text    *reportText
+		FileID  string
+		Prompt  string
+		Reasons []reason
+		Sent    bool
+		Error   string
+	}{loc.tag, &loc.report, f.Metadata.ShortID, fmt.Sprintf(loc.report.Prompt, f.Filename), reasons, sent, errText})
+}
+
+// holdReportedFile makes f private once it has enough open reports.
+func holdReportedFile(ctx context.Context, f *fileRecord) {
+	threshold := config().Reports.AutoHideThreshold
+	if threshold <= 0 || f.Metadata.ReportHold != "" {
+		return
+	}
+	n, err := reportsColl.CountDocuments(ctx, bson.M{"short_id": f.Metadata.ShortID, "status": reportOpen})
+	dbBreaker.Record(err)
+	if err != nil || n < int64(threshold) {
+		return
+	}
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx,
+		bson.M{"_id": f.ID, "metadata.report_hold": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{
+			"metadata.visibility":  visibilityPrivate,
+			"metadata.report_hold": visibilityOrPublic(f.Metadata.Visibility),
+		}})
+	dbBreaker.Record(err)
+	if err != nil {
+		log.Printf("Error hiding reported file %s: %v", f.Metadata.ShortID, err)
+		return
+	}
+	log.Printf("File %s hidden after %d reports", f.Metadata.ShortID, n)
+}
+
+type reportedFile struct {
+	ShortID  string        `json:"short_id"`
+	Filename string        `json:"filename,omitempty"`
+	Link     string        `json:"link,omitempty"`
+	Hidden   bool          `json:"hidden"`
+	Count    int           `json:"count"`
+	Reasons  []string      `json:"reasons"`
+	LastAt   time.Time     `json:"last_at"`
+	Reports  []abuseReport `json:"reports"`
+	Deleted  bool          `json:"deleted,omitempty"`
+}
+
+func handleAdminReports(w http.ResponseWriter, r *http.Request) {
+	admin := requireAdmin(w, r, true)
+	if admin == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		cursor, err := reportsColl.Find(ctx, bson.M{"status": reportOpen},
+			options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(1000))
+		dbBreaker.Record(err)
+		var reports []abuseReport
+		if err == nil {
+			err = cursor.All(ctx, &reports)
+			dbBreaker.Record(err)
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		files := []*reportedFile{}
+		byID := map[string]*reportedFile{}
+		for _, rep := range reports {
+			rf := byID[rep.ShortID]
+			if rf == nil {
+				rf = &reportedFile{ShortID: rep.ShortID, LastAt: rep.CreatedAt}
+				byID[rep.ShortID] = rf
+				files = append(files, rf)
+			}
+			rf.Count++
+			if !containsString(rf.Reasons, rep.Reason) {
+				rf.Reasons = append(rf.Reasons, rep.Reason)
+			}
+			if len(rf.Reports) < 20 {
+				rf.Reports = append(rf.Reports, rep)
+			}
+		}
+		for _, rf := range files {
+			var f fileRecord
+			if err := findFileByShortID(ctx, rf.ShortID, &f); err != nil {
+				rf.Deleted = true
+				continue
+			}
+			rf.Filename, rf.Link, rf.Hidden = f.Filename, f.Link(), f.Metadata.ReportHold != ""
+		}
+		// Most reported first; files come in order of their latest report.
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Count > files[j].Count })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"threshold": config().Reports.AutoHideThreshold,
+			"files":     files,
+		})
+
+	case http.MethodPost:
+		var req struct {
+			ID     string `json:"id"`
+			Action string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		status := map[string]string{"dismiss": reportDismissed, "delete": reportDeleted}[req.Action]
+		if status == "" {
+			jsonError(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+
+		var f fileRecord
+		err := findFileByShortID(ctx, req.ID, &f)
+		found := err == nil
+		if err != nil && err != errFileNotFound {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case found && status == reportDeleted:
+			if err := deleteStoredFile(ctx, &f); err != nil {
+				jsonError(w, "Delete error", http.StatusInternalServerError)
+				return
+			}
+		case found && f.Metadata.ReportHold != "":
+			update := bson.M{"$unset": bson.M{"metadata.report_hold": "", "metadata.visibility": ""}}
+			if f.Metadata.ReportHold != visibilityPublic {
+				update = bson.M{
+					"$unset": bson.M{"metadata.report_hold": ""},
+					"$set":   bson.M{"metadata.visibility": f.Metadata.ReportHold},
+				}
+			}
+			_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": f.ID}, update)
+			dbBreaker.Record(err)
+			if err != nil {
+				jsonError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		now := time.Now()
+		res, err := reportsColl.UpdateMany(ctx, bson.M{"short_id": req.ID, "status": reportOpen}, bson.M{"$set": bson.M{
+			"status":      status,
+			"resolved_by": admin.Username,
+			"resolved_at": now,
+		}})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin %s resolved %d reports on %s: %s", admin.Username, res.ModifiedCount, req.ID, req.Action)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":       req.ID,
+			"status":   status,
+			"resolved": res.ModifiedCount,
+		})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
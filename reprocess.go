@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reprocessing jobs run existing files through the upload pipeline again,
+// e.g. after the thumbnail size changed, a new format got previews or the
+// antivirus signatures were updated:
+//
+//	POST   /api/v1/files/reprocess        {"steps", "ids", "filter"} queues a job
+//	GET    /api/v1/files/reprocess        lists the caller's jobs
+//	GET    /api/v1/files/reprocess/{id}   shows the progress of one
+//	DELETE /api/v1/files/reprocess/{id}   cancels it
+//
+// steps are scan, thumb, poster, preview, variants, ocr and docinfo; each
+// applies only to the files it would apply to on upload. The files are the
+// listed short IDs, or those matching filter, which takes the name, type,
+// min_size, max_size, from and to of the file search. Owners reprocess their
+// own files; admins everyone's, or one account's with filter.owner.
+//
+// Jobs live in reprocess_jobs and are worked through one file at a time by
+// a background worker that holds a lease on the job, so a restart or another
+// instance picks up where it stopped. Finished jobs are kept for 30 days.
+
+const (
+	reprocessMaxIDs      = 1000
+	reprocessBatch       = 50
+	reprocessFileTimeout = 10 * time.Minute
+	reprocessLease       = 15 * time.Minute
+)
+
+// reprocessSteps are the known steps, in the order they run. The scan comes
+// first so an infected file gets no new derivatives.
+var reprocessSteps = []string{"scan", "thumb", "poster", "preview", "variants", "ocr", "docinfo"}
+
+var reprocessFilters = []string{"owner", "name", "type", "min_size", "max_size", "from", "to"}
+
+type reprocessJob struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"-"`
+	Username   string             `bson:"username" json:"username"`
+	OwnerID    primitive.ObjectID `bson:"owner_id,omitempty" json:"-"`
+	Steps      []string           `bson:"steps" json:"steps"`
+	IDs        []string           `bson:"ids,omitempty" json:"ids,omitempty"`
+	Filter     map[string]string  `bson:"filter,omitempty" json:"filter,omitempty"`
+	Status     string             `bson:"status" json:"status"`
+	Total      int64              `bson:"total" json:"total"`
+	Processed  int64              `bson:"processed" json:"processed"`
+	Failed     int64              `bson:"failed" json:"failed"`
+	Infected   int64              `bson:"infected" json:"infected"`
+	LastError  string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	LastID     primitive.ObjectID `bson:"last_id,omitempty" json:"-"`
+	LeaseUntil time.Time          `bson:"lease_until" json:"-"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	StartedAt  *time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	FinishedAt *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+var reprocessJobs *mongo.Collection
+
+func initReprocess(ctx context.Context) {
+	reprocessJobs = db.Collection("reprocess_jobs")
+	_, err := reprocessJobs.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "finished_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600),
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating reprocess_jobs indexes: %v", err)
+	}
+}
+
+// stepEnabled reports whether a step can run with the current settings.
+func stepEnabled(step string) bool {
+	switch step {
+	case "scan":
+		return config().Antivirus.Enabled
+	case "poster":
+		return config().Posters.Enabled
+	case "preview":
+		return config().Previews.Enabled
+	case "ocr":
+		return config().OCR.Enabled
+	case "docinfo":
+		return config().DocInfo.Enabled
+	}
+	return true
+}
+
+// query returns the filter matching the files of the job.
+func (j *reprocessJob) query() (bson.M, error) {
+	filter := listableFiles()
+	filter["metadata.growing"] = bson.M{"$ne": true}
+	filter["metadata.quarantine"] = bson.M{"$exists": false}
+	if !j.OwnerID.IsZero() {
+		filter["metadata.owner_id"] = j.OwnerID
+	}
+	if len(j.IDs) > 0 {
+		filter["metadata.short_id"] = bson.M{"$in": j.IDs}
+	}
+	q := url.Values{}
+	for k, v := range j.Filter {
+		q.Set(k, v)
+	}
+	return filter, applyFileFilters(filter, q)
+}
+
+func runReprocessJobs() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for runReprocessJob() {
+		}
+	}
+}
+
+// runReprocessJob claims the oldest job nobody is working on and works
+// through it. It reports whether there was one.
+func runReprocessJob() bool {
+	if !dbBreaker.Allow() {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var job reprocessJob
+	err := reprocessJobs.FindOneAndUpdate(ctx, bson.M{
+		"status":      bson.M{"$in": []string{"queued", "running"}},
+		"lease_until": bson.M{"$lt": now},
+	}, bson.M{
+		"$set": bson.M{"status": "running", "lease_until": now.Add(reprocessLease)},
+		"$min": bson.M{"started_at": now},
+	}, options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After)).Decode(&job)
+	dbBreaker.Record(err)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Error claiming reprocessing job: %v", err)
+		}
+		return false
+	}
+	job.run()
+	return true
+}
+
+// run processes the files of the job after the last one done, recording
+// progress after each file. It returns when the job is finished, cancelled
+// or the database fails; in the last case the job is taken up again once
+// its lease runs out.
+func (j *reprocessJob) run() {
+	filter, err := j.query()
+	if err != nil {
+		j.finish("failed", err.Error())
+		return
+	}
+	files := gfsBucket.GetFilesCollection()
+	for {
+		if !j.LastID.IsZero() {
+			filter["_id"] = bson.M{"$gt": j.LastID}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		var docs []fileRecord
+		cursor, err := files.Find(ctx, filter, options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(reprocessBatch))
+		dbBreaker.Record(err)
+		if err == nil {
+			err = cursor.All(ctx, &docs)
+			dbBreaker.Record(err)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Error reading files of reprocessing job %s: %v", j.ID.Hex(), err)
+			return
+		}
+		if len(docs) == 0 {
+			j.finish("done", "")
+			return
+		}
+
+		for i := range docs {
+			f := &docs[i]
+			infected, err := reprocessFile(f, j.Steps)
+			set := bson.M{"last_id": f.ID, "lease_until": time.Now().Add(reprocessLease)}
+			inc := bson.M{"processed": 1}
+			if err != nil {
+				inc["failed"] = 1
+				set["last_error"] = fmt.Sprintf("%s: %v", f.Metadata.ShortID, err)
+			}
+			if infected {
+				inc["infected"] = 1
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			res, err := reprocessJobs.UpdateOne(ctx,
+				bson.M{"_id": j.ID, "status": "running"},
+				bson.M{"$set": set, "$inc": inc})
+			cancel()
+			dbBreaker.Record(err)
+			if err != nil {
+				log.Printf("Error updating reprocessing job %s: %v", j.ID.Hex(), err)
+				return
+			}
+			if res.MatchedCount == 0 {
+				// Cancelled.
+				return
+			}
+			j.LastID = f.ID
+		}
+	}
+}
+
+func (j *reprocessJob) finish(status, message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{"status": status, "finished_at": time.Now()}
+	if message != "" {
+		set["last_error"] = message
+	}
+	_, err := reprocessJobs.UpdateOne(ctx, bson.M{"_id": j.ID, "status": "running"}, bson.M{"$set": set})
+	dbBreaker.Record(err)
+	if err != nil {
+		log.Printf("Error finishing reprocessing job %s: %v", j.ID.Hex(), err)
+		return
+	}
+	log.Printf("Reprocessing job %s of %s %s", j.ID.Hex(), j.Username, status)
+}
+
+// reprocessFile runs the steps that apply to f. It reports whether the scan
+// found malware, in which case the remaining steps are skipped, and the
+// first error of a step.
+func reprocessFile(f *fileRecord, steps []string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reprocessFileTimeout)
+	defer cancel()
+
+	var firstErr error
+	for _, step := range steps {
+		var err error
+		switch step {
+		case "scan":
+			var signature string
+			signature, err = rescanFile(ctx, f)
+			if err == nil && signature != "" {
+				infectedFile(ctx, f, signature)
+				return true, nil
+			}
+		case "thumb":
+			if thumbnailable(f.Metadata.ContentType) {
+				if _, _, err = dropDerivatives(ctx, f, step); err == nil {
+					_, err = thumbnailFor(ctx, f)
+				}
+			}
+		case "poster":
+			if strings.HasPrefix(f.Metadata.ContentType, "video/") {
+				if _, _, err = dropDerivatives(ctx, f, step); err == nil {
+					err = generatePoster(f.ID)
+				}
+			}
+		case "preview":
+			if previewable(f.Filename, f.Length) {
+				if _, _, err = dropDerivatives(ctx, f, step); err == nil {
+					err = generatePreview(f.ID)
+				}
+			}
+		case "variants":
+			_, _, err = dropDerivatives(ctx, f, step)
+		case "ocr":
+			if ocrable(f.Metadata.ContentType) {
+				err = recognizeText(f.ID)
+			}
+		case "docinfo":
+			if docInfoApplies(f.Filename, f.Metadata.ContentType) {
+				err = extractDocInfo(f.ID)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", step, err)
+		}
+	}
+	return false, firstErr
+}
+
+// rescanFile streams a stored file through clamd and returns the detected
+// signature, or "" for a clean file.
+func rescanFile(ctx context.Context, f *fileRecord) (string, error) {
+	content, err := openStoredFile(ctx, f)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	scan, err := startScan()
+	if err != nil {
+		return "", errScannerUnavailable
+	}
+	defer scan.Close()
+	if _, err := io.Copy(scan, content); err != nil {
+		return "", err
+	}
+	return scan.Verdict()
+}
+
+// infectedFile applies the configured antivirus action to a stored file
+// that failed a rescan.
+func infectedFile(ctx context.Context, f *fileRecord, signature string) {
+	ev := scanEvent{
+		FileID:    f.ID,
+		ShortID:   f.Metadata.ShortID,
+		Filename:  f.Filename,
+		Size:      f.Length,
+		Signature: signature,
+		Action:    config().Antivirus.Action,
+		OwnerID:   f.Metadata.OwnerID,
+		At:        time.Now(),
+	}
+	if ev.Action == "quarantine" {
+		_, err := gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": f.ID}, bson.M{"$set": bson.M{
+			"metadata.quarantine": bson.M{"signature": signature, "at": ev.At},
+		}})
+		dbBreaker.Record(err)
+		if err != nil {
+			ev.Action = "reject"
+		}
+	}
+	if ev.Action == "reject" {
+		if err := deleteStoredFile(ctx, f); err != nil {
+			log.Printf("Error deleting infected file %s: %v", ev.ShortID, err)
+		}
+	}
+	recordInfection(ctx, ev)
+}
+
+func handleReprocess(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/files/reprocess"), "/"); id != "" {
+		handleReprocessJob(w, r, user, id)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listReprocessJobs(w, r, user)
+	case http.MethodPost:
+		createReprocessJob(w, r, user)
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createReprocessJob(w http.ResponseWriter, r *http.Request, user *User) {
+	var req struct {
+		Steps  []string          `json:"steps"`
+		IDs    []string          `json:"ids"`
+		Filter map[string]string `json:"filter"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	for _, step := range req.Steps {
+		step = strings.ToLower(step)
+		if !containsString(reprocessSteps, step) {
+			jsonError(w, fmt.Sprintf("Invalid step %q", step), http.StatusBadRequest)
+			return
+		}
+		if !stepEnabled(step) {
+			jsonError(w, fmt.Sprintf("Invalid step %q: not enabled", step), http.StatusBadRequest)
+			return
+		}
+	}
+	var steps []string
+	for _, step := range reprocessSteps {
+		for _, s := range req.Steps {
+			if strings.EqualFold(s, step) {
+				steps = append(steps, step)
+				break
+			}
+		}
+	}
+	if len(steps) == 0 {
+		jsonError(w, "Invalid steps", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > reprocessMaxIDs {
+		jsonError(w, fmt.Sprintf("Invalid ids: at most %d", reprocessMaxIDs), http.StatusBadRequest)
+		return
+	}
+	for k := range req.Filter {
+		if !containsString(reprocessFilters, k) {
+			jsonError(w, fmt.Sprintf("Invalid filter %q", k), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	scope, ok := fileScope(ctx, w, user, req.Filter["owner"])
+	if !ok {
+		return
+	}
+	job := reprocessJob{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		Username:  user.Username,
+		Steps:     steps,
+		IDs:       req.IDs,
+		Filter:    req.Filter,
+		Status:    "queued",
+		CreatedAt: time.Now(),
+	}
+	job.OwnerID, _ = scope["metadata.owner_id"].(primitive.ObjectID)
+	filter, err := job.query()
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	active, err := reprocessJobs.CountDocuments(ctx, bson.M{
+		"user_id": user.ID,
+		"status":  bson.M{"$in": []string{"queued", "running"}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if active > 0 {
+		jsonError(w, "Reprocessing already running", http.StatusConflict)
+		return
+	}
+	job.Total, err = gfsBucket.GetFilesCollection().CountDocuments(ctx, filter)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	_, err = reprocessJobs.InsertOne(ctx, job)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s queued reprocessing job %s (%s) for %d files", user.Username, job.ID.Hex(), strings.Join(steps, ","), job.Total)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/files/reprocess/"+job.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func listReprocessJobs(w http.ResponseWriter, r *http.Request, user *User) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": user.ID}
+	if isAdmin(user) {
+		filter = bson.M{}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(100)
+	cursor, err := reprocessJobs.Find(ctx, filter, opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	jobs := []reprocessJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobs})
+}
+
+func handleReprocessJob(w http.ResponseWriter, r *http.Request, user *User, id string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		jsonError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": jobID}
+	if !isAdmin(user) {
+		filter["user_id"] = user.ID
+	}
+	var job reprocessJob
+	if r.Method == http.MethodDelete {
+		filter["status"] = bson.M{"$in": []string{"queued", "running"}}
+		err = reprocessJobs.FindOneAndUpdate(ctx, filter,
+			bson.M{"$set": bson.M{"status": "cancelled", "finished_at": time.Now()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+	} else {
+		err = reprocessJobs.FindOne(ctx, filter).Decode(&job)
+	}
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		jsonError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every 429 and 503 tells the client when to come back: Retry-After as
+// defined by RFC 9110, plus the RateLimit-Limit/Remaining/Reset fields of the
+// IETF RateLimit header draft, which SDKs increasingly read instead. Reset,
+// like Retry-After, is in seconds from now.
+
+// scannerRetryAfter is suggested when the virus scanner cannot be reached.
+const scannerRetryAfter = 30 * time.Second
+
+func retrySeconds(wait time.Duration) int {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// setRateLimited marks a response as rejected by a limit of limit requests
+// (0 when the limit is not a simple count) that resets after wait.
+func setRateLimited(h http.Header, limit int, wait time.Duration) {
+	seconds := strconv.Itoa(retrySeconds(wait))
+	h.Set("Retry-After", seconds)
+	if limit > 0 {
+		h.Set("RateLimit-Limit", strconv.Itoa(limit))
+	}
+	h.Set("RateLimit-Remaining", "0")
+	h.Set("RateLimit-Reset", seconds)
+}
+
+// setUnavailable marks a response as a temporary outage expected to last wait.
+func setUnavailable(h http.Header, wait time.Duration) {
+	setRateLimited(h, 0, wait)
+}
@@ -0,0 +1,905 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A minimal path-style S3 API under /s3/ so rclone, mc and friends can
+// upload, fetch, list and delete files with an API key as credentials. Only
+// single-part uploads are supported; configure clients with a large enough
+// upload cutoff. Objects are regular uploads with short links; the bucket
+// and key are kept in metadata.s3_bucket and metadata.s3_key.
+
+const (
+	s3Namespace    = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxClockSkew = 15 * time.Minute
+	s3MaxChunkSize = 16 << 20
+	streamingSHA   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+)
+
+type s3Bucket struct {
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Name      string             `bson:"name"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+type s3Object struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Length     int64              `bson:"length"`
+	UploadDate time.Time          `bson:"uploadDate"`
+	Metadata   struct {
+		ContentType string             `bson:"content_type"`
+		Storage     string             `bson:"storage,omitempty"`
+		ContentID   primitive.ObjectID `bson:"content_id,omitempty"`
+		ShortID     string             `bson:"short_id"`
+		OwnerID     primitive.ObjectID `bson:"owner_id,omitempty"`
+		APIKeyID    string             `bson:"api_key_id,omitempty"`
+		S3Key       string             `bson:"s3_key"`
+		S3ETag      string             `bson:"s3_etag"`
+	} `bson:"metadata"`
+}
+
+var (
+	s3BucketsColl *mongo.Collection
+
+	s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+	errS3SignatureMismatch = errors.New("signature mismatch")
+	errS3PayloadMismatch   = errors.New("payload hash mismatch")
+)
+
+func initS3API(ctx context.Context) {
+	s3BucketsColl = db.Collection("s3_buckets")
+	_, err := s3BucketsColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Error creating s3_buckets index: %v", err)
+	}
+
+	_, err = gfsBucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "metadata.owner_id", Value: 1},
+			{Key: "metadata.s3_bucket", Value: 1},
+			{Key: "metadata.s3_key", Value: 1},
+		},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"metadata.s3_bucket": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Error creating s3 object index: %v", err)
+	}
+}
+
+type s3ErrorBody struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, code string, status int, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(s3ErrorBody{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+func writeS3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// s3Auth is the verified identity of an S3 request plus what is needed to
+// check streaming chunk signatures.
+type s3Auth struct {
+	user        *User
+	keyID       string
+	payloadHash string
+	signingKey  []byte
+	timestamp   time.Time
+	scope       string
+	signature   string
+}
+
+func parseS3Credential(credential string) (keyID, region, service string, err error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return "", "", "", errors.New("malformed credential")
+	}
+	return parts[0], parts[2], parts[3], nil
+}
+
+// authenticateS3 verifies a SigV4 signature from either the Authorization
+// header or presigned query parameters.
+func authenticateS3(r *http.Request) (*s3Auth, error) {
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	query := r.URL.Query()
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		for _, field := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				signature = v
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = emptyPayloadHash
+		}
+	} else if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = unsignedPayload
+	} else {
+		return nil, errors.New("missing signature")
+	}
+
+	keyID, region, service, err := parseS3Credential(credential)
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		return nil, errors.New("invalid X-Amz-Date")
+	}
+
+	if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		expires, _ := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if expires <= 0 || time.Now().After(t.Add(time.Duration(expires)*time.Second)) {
+			return nil, errors.New("request has expired")
+		}
+	} else if d := time.Since(t); d > s3MaxClockSkew || d < -s3MaxClockSkew {
+		return nil, errors.New("request time too skewed")
+	}
+
+	key, user := lookupAPIKey("key_id", keyID)
+	if key == nil {
+		return nil, errors.New("invalid access key")
+	}
+
+	canonical := canonicalRequest(r, strings.Split(signedHeaders, ";"), payloadHash)
+	expected := sigV4Signature(key.Secret, t, region, service, canonical)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errS3SignatureMismatch
+	}
+
+	return &s3Auth{
+		user:        user,
+		keyID:       key.KeyID,
+		payloadHash: payloadHash,
+		signingKey:  sigV4Key(key.Secret, t, region, service),
+		timestamp:   t,
+		scope:       sigV4Scope(t, region, service),
+		signature:   signature,
+	}, nil
+}
+
+// hashCheckReader fails the read that reaches EOF when the content does not
+// match the SHA-256 the client signed.
+type hashCheckReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (h *hashCheckReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		return n, errS3PayloadMismatch
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes an aws-chunked body and verifies every chunk
+// signature against the previous one, starting from the request signature.
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	auth *s3Auth
+	prev string
+	buf  []byte
+	done bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	sizeHex, sigField, _ := strings.Cut(strings.TrimSpace(line), ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return errors.New("invalid chunk size")
+	}
+	chunkSig := strings.TrimPrefix(sigField, "chunk-signature=")
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if _, err := c.r.Discard(2); err != nil && size > 0 {
+		return err
+	}
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256-PAYLOAD",
+		c.auth.timestamp.Format(sigV4TimeFormat),
+		c.auth.scope,
+		c.prev,
+		emptyPayloadHash,
+		sha256Hex(data),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(c.auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(chunkSig)) {
+		return errS3SignatureMismatch
+	}
+
+	c.prev = chunkSig
+	c.buf = data
+	if size == 0 {
+		c.done = true
+	}
+	return nil
+}
+
+func (a *s3Auth) body(r *http.Request) io.Reader {
+	body := http.MaxBytesReader(nil, r.Body, config().Upload.MaxSize+s3MaxChunkSize)
+	switch a.payloadHash {
+	case unsignedPayload:
+		return body
+	case streamingSHA:
+		return &awsChunkedReader{r: bufio.NewReader(body), auth: a, prev: a.signature}
+	default:
+		return &hashCheckReader{r: body, hash: sha256.New(), expected: a.payloadHash}
+	}
+}
+
+func handleS3(w http.ResponseWriter, r *http.Request) {
+	if !config().S3API.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if !dbBreaker.Allow() {
+		setUnavailable(w.Header(), time.Duration(dbBreaker.RetryAfter())*time.Second)
+		writeS3Error(w, r, "ServiceUnavailable", http.StatusServiceUnavailable, "Storage temporarily unavailable")
+		return
+	}
+
+	auth, err := authenticateS3(r)
+	if err == errS3SignatureMismatch {
+		writeS3Error(w, r, "SignatureDoesNotMatch", http.StatusForbidden, "The request signature we calculated does not match the signature you provided")
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, "AccessDenied", http.StatusForbidden, err.Error())
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s3/"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			writeS3Error(w, r, "MethodNotAllowed", http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s3ListBuckets(w, r, auth.user)
+	case !s3BucketName.MatchString(bucket):
+		writeS3Error(w, r, "InvalidBucketName", http.StatusBadRequest, "The specified bucket is not valid")
+	case key == "":
+		switch {
+		case r.Method == http.MethodGet && query.Has("location"):
+			writeS3XML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		case r.Method == http.MethodGet:
+			s3ListObjects(w, r, auth.user, bucket)
+		case r.Method == http.MethodHead:
+			if !s3BucketExists(auth.user, bucket) {
+				writeS3Error(w, r, "NoSuchBucket", http.StatusNotFound, "The specified bucket does not exist")
+			}
+		case r.Method == http.MethodPut:
+			s3CreateBucket(w, r, auth.user, bucket)
+		case r.Method == http.MethodDelete:
+			s3DeleteBucket(w, r, auth.user, bucket)
+		case r.Method == http.MethodPost && query.Has("delete"):
+			s3DeleteObjects(w, r, auth.user, bucket)
+		default:
+			writeS3Error(w, r, "NotImplemented", http.StatusNotImplemented, "This operation is not supported")
+		}
+	default:
+		switch {
+		case query.Has("uploads") || query.Has("uploadId") || r.Header.Get("X-Amz-Copy-Source") != "":
+			writeS3Error(w, r, "NotImplemented", http.StatusNotImplemented, "Multipart uploads and server-side copies are not supported")
+		case r.Method == http.MethodPut:
+			s3PutObject(w, r, auth, bucket, key)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			s3GetObject(w, r, auth.user, bucket, key)
+		case r.Method == http.MethodDelete:
+			s3DeleteObject(w, r, auth.user, bucket, key)
+		default:
+			writeS3Error(w, r, "MethodNotAllowed", http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+func s3BucketExists(user *User, bucket string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s3BucketsColl.FindOne(ctx, bson.M{"user_id": user.ID, "name": bucket}).Err()
+	dbBreaker.Record(err)
+	return err == nil
+}
+
+func ensureS3Bucket(ctx context.Context, user *User, bucket string) error {
+	_, err := s3BucketsColl.UpdateOne(ctx,
+		bson.M{"user_id": user.ID, "name": bucket},
+		bson.M{"$setOnInsert": s3Bucket{UserID: user.ID, Name: bucket, CreatedAt: time.Now()}},
+		options.Update().SetUpsert(true))
+	dbBreaker.Record(err)
+	return err
+}
+
+func s3ListBuckets(w http.ResponseWriter, r *http.Request, user *User) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := s3BucketsColl.Find(ctx, bson.M{"user_id": user.ID}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	dbBreaker.Record(err)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Database error")
+		return
+	}
+	var buckets []s3Bucket
+	cursor.All(ctx, &buckets)
+
+	type bucketEntry struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+	result := struct {
+		XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Owner   string        `xml:"Owner>DisplayName"`
+		Buckets []bucketEntry `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: user.Username}
+	for _, b := range buckets {
+		result.Buckets = append(result.Buckets, bucketEntry{b.Name, b.CreatedAt.UTC().Format(time.RFC3339)})
+	}
+	writeS3XML(w, result)
+}
+
+func s3CreateBucket(w http.ResponseWriter, r *http.Request, user *User, bucket string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	if err := ensureS3Bucket(ctx, user, bucket); err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Database error")
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+}
+
+func s3DeleteBucket(w http.ResponseWriter, r *http.Request, user *User, bucket string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	n, err := gfsBucket.GetFilesCollection().CountDocuments(ctx, bson.M{
+		"metadata.owner_id":  user.ID,
+		"metadata.s3_bucket": bucket,
+	}, options.Count().SetLimit(1))
+	dbBreaker.Record(err)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Database error")
+		return
+	}
+	if n > 0 {
+		writeS3Error(w, r, "BucketNotEmpty", http.StatusConflict, "The bucket you tried to delete is not empty")
+		return
+	}
+
+	res, err := s3BucketsColl.DeleteOne(ctx, bson.M{"user_id": user.ID, "name": bucket})
+	dbBreaker.Record(err)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Database error")
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeS3Error(w, r, "NoSuchBucket", http.StatusNotFound, "The specified bucket does not exist")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func s3ObjectFilter(user *User, bucket, key string) bson.M {
+	return bson.M{
+		"metadata.owner_id":   user.ID,
+		"metadata.s3_bucket":  bucket,
+		"metadata.s3_key":     key,
+		"metadata.expires_at": notExpired(),
+		"metadata.quarantine": bson.M{"$exists": false},
+	}
+}
+
+// s3SizeLimit fails the upload with errTierFileSize once more than n bytes
+// have been read, as clients do not always announce the size.
+type s3SizeLimit struct {
+	r io.Reader
+	n int64
+}
+
+func (l *s3SizeLimit) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return n, errTierFileSize
+	}
+	return n, err
+}
+
+func s3PutObject(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket, key string) {
+	size := r.ContentLength
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		size, _ = strconv.ParseInt(decoded, 10, 64)
+	}
+
+	// The size may be unknown (-1); the body is cut off at the tier's
+	// limit below in any case.
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	_, tier := effectiveTier(ctx, auth.user)
+	err := checkTierQuota(ctx, auth.user, max(size, 0))
+	if err == nil {
+		err = ensureS3Bucket(ctx, auth.user, bucket)
+	}
+	cancel()
+	if err == errTierFileSize {
+		writeS3Error(w, r, "EntityTooLarge", http.StatusBadRequest, err.Error())
+		return
+	}
+	if isTierLimit(err) {
+		writeS3Error(w, r, "QuotaExceeded", http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	body := bufio.NewReaderSize(&s3SizeLimit{auth.body(r), tier.MaxFileSize}, sniffLen)
+	head, _ := body.Peek(sniffLen)
+	contentType := detectContentType(path.Base(key), head, r.Header.Get("Content-Type"))
+	metadata := newUploadMetadata(contentType, auth.user)
+	metadata["s3_bucket"] = bucket
+	metadata["s3_key"] = key
+	metadata["api_key_id"] = auth.keyID
+	shortID := metadata["short_id"].(string)
+
+	etag := md5.New()
+	err = storeUpload(r.Context(), path.Base(key), io.TeeReader(body, etag), metadata)
+	if err == errTierFileSize {
+		writeS3Error(w, r, "EntityTooLarge", http.StatusBadRequest, fmt.Sprintf("Your proposed upload exceeds the maximum allowed size of %d bytes", tier.MaxFileSize))
+		return
+	}
+	if err == errS3SignatureMismatch {
+		writeS3Error(w, r, "SignatureDoesNotMatch", http.StatusForbidden, "Chunk signature does not match")
+		return
+	}
+	if isInfected(err) {
+		writeS3Error(w, r, "AccessDenied", http.StatusForbidden, "Upload rejected: "+err.Error())
+		return
+	}
+	if err == errScannerUnavailable {
+		setUnavailable(w.Header(), scannerRetryAfter)
+		writeS3Error(w, r, "ServiceUnavailable", http.StatusServiceUnavailable, "Virus scanner unavailable")
+		return
+	}
+	if err == errS3PayloadMismatch {
+		writeS3Error(w, r, "XAmzContentSHA256Mismatch", http.StatusBadRequest, "The provided x-amz-content-sha256 header does not match what was computed")
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Upload error")
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	etagHex := hex.EncodeToString(etag.Sum(nil))
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"metadata.short_id": shortID}, bson.M{"$set": bson.M{"metadata.s3_etag": etagHex}})
+	dbBreaker.Record(err)
+
+	// Replace any previous version only once the new one is safely stored.
+	filter := s3ObjectFilter(auth.user, bucket, key)
+	filter["metadata.short_id"] = bson.M{"$ne": shortID}
+	cursor, err := gfsBucket.FindContext(ctx, filter)
+	dbBreaker.Record(err)
+	if err == nil {
+		var old []fileRecord
+		cursor.All(ctx, &old)
+		for i := range old {
+			deleteStoredFile(ctx, &old[i])
+		}
+	}
+
+	notFoundCache.Forget(shortID)
+	w.Header().Set("ETag", `"`+etagHex+`"`)
+	w.Header().Set("X-Xyli-Link", fmt.Sprintf("%s/%s", config().Upload.BaseURL, metadata["short_id"]))
+}
+
+// parseByteRange understands the single "bytes=start-end" form clients use
+// for resumable and parallel downloads.
+func parseByteRange(header string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	from, to, _ := strings.Cut(spec, "-")
+	var err error
+	switch {
+	case from == "":
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	default:
+		start, err = strconv.ParseInt(from, 10, 64)
+		if err != nil || start >= size {
+			return 0, 0, false
+		}
+		end = size - 1
+		if to != "" {
+			end, err = strconv.ParseInt(to, 10, 64)
+			if err != nil || end < start {
+				return 0, 0, false
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		return start, end, true
+	}
+}
+
+func s3GetObject(w http.ResponseWriter, r *http.Request, user *User, bucket, key string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var obj s3Object
+	err := findFile(ctx, s3ObjectFilter(user, bucket, key), &obj)
+	if err == errFileNotFound {
+		writeS3Error(w, r, "NoSuchKey", http.StatusNotFound, "The specified key does not exist")
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	h := w.Header()
+	setContentHeaders(h, obj.Metadata.ContentType)
+	h.Set("Last-Modified", obj.UploadDate.UTC().Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if obj.Metadata.S3ETag != "" {
+		h.Set("ETag", `"`+obj.Metadata.S3ETag+`"`)
+	}
+
+	start, end := int64(0), obj.Length-1
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && obj.Length > 0 {
+		var ok bool
+		start, end, ok = parseByteRange(rangeHeader, obj.Length)
+		if !ok {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", obj.Length))
+			writeS3Error(w, r, "InvalidRange", http.StatusRequestedRangeNotSatisfiable, "The requested range is not satisfiable")
+			return
+		}
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, obj.Length))
+		status = http.StatusPartialContent
+	}
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	rec := fileRecord{ID: obj.ID}
+	rec.Metadata.Storage = obj.Metadata.Storage
+	rec.Metadata.ContentID = obj.Metadata.ContentID
+	content, err := openStoredFile(r.Context(), &rec)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Download error")
+		return
+	}
+	defer content.Close()
+
+	if start > 0 {
+		if _, err := skipContent(content, start); err != nil {
+			writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Download error")
+			return
+		}
+	}
+	w.WriteHeader(status)
+	n, _ := io.CopyN(w, content, end-start+1)
+	recordStat(statEvent{Type: statDownload, ShortID: obj.Metadata.ShortID, OwnerID: obj.Metadata.OwnerID, KeyID: obj.Metadata.APIKeyID, Bytes: n})
+}
+
+func s3DeleteObject(w http.ResponseWriter, r *http.Request, user *User, bucket, key string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	if err := s3RemoveKey(ctx, user, bucket, key); err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Delete error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3RemoveKey deletes every stored version of a key. Missing keys are not an
+// error, matching S3 semantics.
+func s3RemoveKey(ctx context.Context, user *User, bucket, key string) error {
+	cursor, err := gfsBucket.FindContext(ctx, bson.M{
+		"metadata.owner_id":  user.ID,
+		"metadata.s3_bucket": bucket,
+		"metadata.s3_key":    key,
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var docs []fileRecord
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+	for i := range docs {
+		if err := deleteStoredFile(ctx, &docs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func s3DeleteObjects(w http.ResponseWriter, r *http.Request, user *User, bucket string) {
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil {
+		writeS3Error(w, r, "MalformedXML", http.StatusBadRequest, "The XML you provided was not well-formed")
+		return
+	}
+	if len(req.Objects) > 1000 {
+		writeS3Error(w, r, "MalformedXML", http.StatusBadRequest, "At most 1000 keys can be deleted at once")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	type failed struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Xmlns   string    `xml:"xmlns,attr"`
+		Deleted []deleted `xml:"Deleted"`
+		Errors  []failed  `xml:"Error"`
+	}{Xmlns: s3Namespace}
+
+	for _, obj := range req.Objects {
+		if err := s3RemoveKey(ctx, user, bucket, obj.Key); err != nil {
+			result.Errors = append(result.Errors, failed{obj.Key, "InternalError", err.Error()})
+			continue
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{obj.Key})
+		}
+	}
+	writeS3XML(w, result)
+}
+
+func s3ListObjects(w http.ResponseWriter, r *http.Request, user *User, bucket string) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	maxKeys := 1000
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n >= 0 && n < maxKeys {
+		maxKeys = n
+	}
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			after = token
+		}
+	}
+
+	if !s3BucketExists(user, bucket) {
+		writeS3Error(w, r, "NoSuchBucket", http.StatusNotFound, "The specified bucket does not exist")
+		return
+	}
+
+	keyFilter := bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
+	if after != "" {
+		keyFilter["$gt"] = after
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	cursor, err := gfsBucket.FindContext(ctx, bson.M{
+		"metadata.owner_id":   user.ID,
+		"metadata.s3_bucket":  bucket,
+		"metadata.s3_key":     keyFilter,
+		"metadata.expires_at": notExpired(),
+	}, options.GridFSFind().SetSort(bson.D{{Key: "metadata.s3_key", Value: 1}}))
+	dbBreaker.Record(err)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer cursor.Close(ctx)
+
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+
+	var contents []content
+	var prefixes []commonPrefix
+	truncated := false
+	lastKey := ""
+	lastPrefix := ""
+
+	for cursor.Next(ctx) {
+		var obj s3Object
+		if err := cursor.Decode(&obj); err != nil {
+			continue
+		}
+		key := obj.Metadata.S3Key
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				cp := key[:len(prefix)+i+len(delimiter)]
+				if cp == lastPrefix {
+					lastKey = key
+					continue
+				}
+				if len(contents)+len(prefixes) >= maxKeys {
+					truncated = true
+					break
+				}
+				prefixes = append(prefixes, commonPrefix{cp})
+				lastPrefix = cp
+				lastKey = key
+				continue
+			}
+		}
+
+		if len(contents)+len(prefixes) >= maxKeys {
+			truncated = true
+			break
+		}
+		contents = append(contents, content{
+			Key:          key,
+			LastModified: obj.UploadDate.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"` + obj.Metadata.S3ETag + `"`,
+			Size:         obj.Length,
+			StorageClass: "STANDARD",
+		})
+		lastKey = key
+	}
+
+	result := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Xmlns                 string         `xml:"xmlns,attr"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		Delimiter             string         `xml:"Delimiter,omitempty"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		Marker                *string        `xml:"Marker"`
+		NextMarker            string         `xml:"NextMarker,omitempty"`
+		KeyCount              *int           `xml:"KeyCount"`
+		ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		StartAfter            string         `xml:"StartAfter,omitempty"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{
+		Xmlns:          s3Namespace,
+		Name:           bucket,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
+		MaxKeys:        maxKeys,
+		IsTruncated:    truncated,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	}
+
+	if v2 {
+		count := len(contents) + len(prefixes)
+		result.KeyCount = &count
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = query.Get("start-after")
+		if truncated {
+			result.NextContinuationToken = lastKey
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		if truncated {
+			result.NextMarker = lastKey
+		}
+	}
+	writeS3XML(w, result)
+}
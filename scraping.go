@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// scrapeDetector watches public file routes for clients that look like they
+// are enumerating short IDs: lots of 404s, IDs requested in sequence, or
+// user agents typical for scripts. Flagged clients are logged and, depending
+// on the configured action, throttled or tarpitted for a while.
+type scrapeDetector struct {
+	mu        sync.Mutex
+	clients   map[string]*scrapeClient
+	window    time.Duration
+	flagFor   time.Duration
+	threshold int
+	agents    []*regexp.Regexp
+}
+
+type scrapeClient struct {
+	misses       []time.Time
+	lastID       uint64
+	sequential   int
+	flaggedUntil time.Time
+	lastSeen     time.Time
+}
+
+type scrapeEvent struct {
+	IP        string    `bson:"ip" json:"ip"`
+	Reason    string    `bson:"reason" json:"reason"`
+	UserAgent string    `bson:"user_agent" json:"user_agent"`
+	Path      string    `bson:"path" json:"path"`
+	Action    string    `bson:"action" json:"action"`
+	At        time.Time `bson:"at" json:"at"`
+}
+
+const sequentialProbeRun = 5
+
+var (
+	scrapers     *scrapeDetector
+	scrapeEvents *mongo.Collection
+
+	defaultScraperAgents = []string{`(?i)curl`, `(?i)wget`, `(?i)python`, `(?i)scrapy`, `(?i)go-http-client`, `(?i)httpclient`, `^$`}
+)
+
+func initScraping(ctx context.Context) {
+	scrapers = &scrapeDetector{clients: make(map[string]*scrapeClient)}
+	if err := configureScraping(config()); err != nil {
+		log.Fatal(err)
+	}
+
+	scrapeEvents = db.Collection("scrape_events")
+	_, err := scrapeEvents.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(30 * 24 * 3600),
+	})
+	if err != nil {
+		log.Printf("Error creating scrape_events index: %v", err)
+	}
+
+	go scrapers.janitor()
+}
+
+// configureScraping applies c.Scraping to the detector. It runs again
+// on every config reload; clients already flagged stay flagged.
+func configureScraping(c *Config) error {
+	cfg := &c.Scraping
+	if cfg.Action == "" {
+		cfg.Action = "log"
+	}
+	if cfg.NotFoundThreshold <= 0 {
+		cfg.NotFoundThreshold = 20
+	}
+	if cfg.WindowSeconds <= 0 {
+		cfg.WindowSeconds = 60
+	}
+	if cfg.FlagSeconds <= 0 {
+		cfg.FlagSeconds = 600
+	}
+	if cfg.TarpitSeconds <= 0 {
+		cfg.TarpitSeconds = 10
+	}
+	patterns := cfg.UserAgentPatterns
+	if patterns == nil {
+		patterns = defaultScraperAgents
+	}
+
+	var agents []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid scraping.userAgentPatterns entry %q: %v", p, err)
+		}
+		agents = append(agents, re)
+	}
+
+	scrapers.mu.Lock()
+	defer scrapers.mu.Unlock()
+	scrapers.window = time.Duration(cfg.WindowSeconds) * time.Second
+	scrapers.flagFor = time.Duration(cfg.FlagSeconds) * time.Second
+	scrapers.threshold = cfg.NotFoundThreshold
+	scrapers.agents = agents
+	return nil
+}
+
+// shortIDValue reads a short ID as a base64url number so that neighbouring
+// IDs can be told apart from random ones.
+func shortIDValue(id string) (uint64, bool) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	if id == "" || len(id) > 10 {
+		return 0, false
+	}
+	var v uint64
+	for _, c := range id {
+		i := strings.IndexRune(alphabet, c)
+		if i < 0 {
+			return 0, false
+		}
+		v = v<<6 | uint64(i)
+	}
+	return v, true
+}
+
+func (d *scrapeDetector) Flagged(ip string) bool {
+	return d.FlaggedFor(ip) > 0
+}
+
+// FlaggedFor returns how much longer ip stays flagged.
+func (d *scrapeDetector) FlaggedFor(ip string) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[ip]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(c.flaggedUntil), 0)
+}
+
+func (d *scrapeDetector) suspiciousAgent(ua string) bool {
+	for _, re := range d.agents {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe records one request and returns a reason if it tipped the client
+// into the flagged state.
+func (d *scrapeDetector) observe(ip, ua, id string, status int) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	c, ok := d.clients[ip]
+	if !ok {
+		c = &scrapeClient{}
+		d.clients[ip] = c
+	}
+	c.lastSeen = now
+	if now.Before(c.flaggedUntil) {
+		return ""
+	}
+
+	reason := ""
+
+	if v, ok := shortIDValue(id); ok {
+		if c.lastID != 0 && v > c.lastID && v-c.lastID <= 64 {
+			c.sequential++
+		} else {
+			c.sequential = 0
+		}
+		c.lastID = v
+		if c.sequential >= sequentialProbeRun {
+			reason = "sequential id probing"
+		}
+	}
+
+	if status == http.StatusNotFound {
+		cutoff := now.Add(-d.window)
+		kept := c.misses[:0]
+		for _, t := range c.misses {
+			if t.After(cutoff) {
+				kept = append(kept, t)
+			}
+		}
+		c.misses = append(kept, now)
+
+		threshold := d.threshold
+		if d.suspiciousAgent(ua) {
+			threshold = (threshold + 1) / 2
+		}
+		if len(c.misses) >= threshold && reason == "" {
+			reason = "404 rate " + strconv.Itoa(len(c.misses)) + "/" + d.window.String()
+			if threshold != d.threshold {
+				reason += " with scripted user agent"
+			}
+		}
+	}
+
+	if reason != "" {
+		c.flaggedUntil = now.Add(d.flagFor)
+		c.misses = nil
+		c.sequential = 0
+	}
+	return reason
+}
+
+func (d *scrapeDetector) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.mu.Lock()
+		cutoff := time.Now().Add(-d.window)
+		for ip, c := range d.clients {
+			if c.lastSeen.Before(cutoff) && time.Now().After(c.flaggedUntil) {
+				delete(d.clients, ip)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+func recordScrapeEvent(ev scrapeEvent) {
+	log.Printf("Scraping detected from %s (%s): %s", ev.IP, ev.UserAgent, ev.Reason)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := scrapeEvents.InsertOne(ctx, ev)
+	dbBreaker.Record(err)
+}
+
+// scrapeGuard wraps the public viewer and raw routes. idPrefix is stripped
+// from the path to obtain the requested short ID.
+func scrapeGuard(idPrefix string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config().Scraping.Enabled {
+			next(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if scrapers.Flagged(ip) {
+			switch config().Scraping.Action {
+			case "throttle":
+				setRateLimited(w.Header(), config().Scraping.NotFoundThreshold, scrapers.FlaggedFor(ip))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			case "tarpit":
+				select {
+				case <-time.After(time.Duration(config().Scraping.TarpitSeconds) * time.Second):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		id := strings.TrimPrefix(r.URL.Path, idPrefix)
+		if reason := scrapers.observe(ip, r.UserAgent(), id, rec.status); reason != "" {
+			go recordScrapeEvent(scrapeEvent{
+				IP:        ip,
+				Reason:    reason,
+				UserAgent: r.UserAgent(),
+				Path:      r.URL.Path,
+				Action:    config().Scraping.Action,
+				At:        time.Now(),
+			})
+		}
+	}
+}
+
+func handleAdminScraping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(100)
+	cursor, err := scrapeEvents.Find(ctx, bson.M{}, opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	events := []scrapeEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+
+	flagged := []string{}
+	if scrapers != nil {
+		scrapers.mu.Lock()
+		now := time.Now()
+		for ip, c := range scrapers.clients {
+			if now.Before(c.flaggedUntil) {
+				flagged = append(flagged, ip)
+			}
+		}
+		scrapers.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": config().Scraping.Enabled,
+		"action":  config().Scraping.Action,
+		"flagged": flagged,
+		"events":  events,
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /api/v1/files/search finds the caller's files by metadata; admins
+// search everyone's, or one account's with ?owner=. All filters are
+// optional and combine:
+//
+//	name        substring of the filename, case-insensitive
+//	type        content type, exact ("image/png") or a prefix ("image/")
+//	min_size    bytes, inclusive
+//	max_size    bytes, inclusive
+//	from, to    upload date range, RFC 3339 or YYYY-MM-DD (to is inclusive)
+//	sort        uploaded or date (default, newest first), size, name;
+//	            "-" reverses
+//	page        1-based
+//	per_page    up to 200, 50 by default
+//
+// Every filter but name is served by an index starting with the owner, or
+// with the filtered field for an admin search across accounts.
+
+const (
+	searchPerPage    = 50
+	searchMaxPerPage = 200
+)
+
+func initSearch(ctx context.Context) {
+	_, err := gfsBucket.GetFilesCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "metadata.owner_id", Value: 1}, {Key: "length", Value: 1}}},
+		{Keys: bson.D{{Key: "metadata.owner_id", Value: 1}, {Key: "metadata.content_type", Value: 1}, {Key: "uploadDate", Value: -1}}},
+		{Keys: bson.D{{Key: "metadata.owner_id", Value: 1}, {Key: "filename", Value: 1}}},
+		{Keys: bson.D{{Key: "metadata.content_type", Value: 1}, {Key: "uploadDate", Value: -1}}},
+		{Keys: bson.D{{Key: "uploadDate", Value: -1}}},
+		{Keys: bson.D{{Key: "length", Value: 1}}},
+		{Keys: bson.D{{Key: "filename", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Error creating search indexes: %v", err)
+	}
+}
+
+// parseSearchDate reads a date filter; a bare day as the upper bound
+// includes the whole day.
+func parseSearchDate(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err == nil && end {
+		t = t.Add(24*time.Hour - time.Millisecond)
+	}
+	return t, err
+}
+
+// fileSorts maps the sort names of the file APIs to fields.
+var fileSorts = map[string]string{
+	"uploaded": "uploadDate",
+	"date":     "uploadDate",
+	"size":     "length",
+	"name":     "filename",
+}
+
+func handleFileSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	filter, ok := fileScope(ctx, w, user, q.Get("owner"))
+	if !ok {
+		return
+	}
+
+	if err := applyFileFilters(filter, q); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	field, order, ok := fileSort(q.Get("sort"))
+	if !ok {
+		jsonError(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage < 1 {
+		perPage = searchPerPage
+	}
+	perPage = min(perPage, searchMaxPerPage)
+
+	filesColl := gfsBucket.GetFilesCollection()
+	total, err := filesColl.CountDocuments(ctx, filter)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: field, Value: order}, {Key: "_id", Value: order}}).
+		SetSkip(int64((page - 1) * perPage)).
+		SetLimit(int64(perPage))
+	cursor, err := filesColl.Find(ctx, filter, opts)
+	dbBreaker.Record(err)
+	var docs []fileRecord
+	if err == nil {
+		err = cursor.All(ctx, &docs)
+		dbBreaker.Record(err)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"files":    listedFiles(ctx, user, docs),
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	}
+	if int64(page*perPage) < total {
+		resp["next_page"] = page + 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// applyFileFilters adds the name, type, size and date filters of q to a
+// file listing filter.
+func applyFileFilters(filter bson.M, q url.Values) error {
+	if name := strings.TrimSpace(q.Get("name")); name != "" {
+		filter["filename"] = primitive.Regex{Pattern: regexp.QuoteMeta(name), Options: "i"}
+	}
+	if ct := strings.ToLower(strings.TrimSpace(q.Get("type"))); ct != "" {
+		if strings.HasSuffix(ct, "/") {
+			filter["metadata.content_type"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(ct)}
+		} else {
+			filter["metadata.content_type"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(ct) + "($|;)"}
+		}
+	}
+
+	size := bson.M{}
+	for param, op := range map[string]string{"min_size": "$gte", "max_size": "$lte"} {
+		if v := q.Get(param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("Invalid " + param)
+			}
+			size[op] = n
+		}
+	}
+	if len(size) > 0 {
+		filter["length"] = size
+	}
+	uploaded := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		if v := q.Get(param); v != "" {
+			t, err := parseSearchDate(v, param == "to")
+			if err != nil {
+				return errors.New("Invalid " + param + " date")
+			}
+			uploaded[op] = t
+		}
+	}
+	if len(uploaded) > 0 {
+		filter["uploadDate"] = uploaded
+	}
+	return nil
+}
+
+// fileSort reads ?sort=: a field of fileSorts, "-" in front to reverse.
+// Dates read newest first, sizes and names ascending.
+func fileSort(v string) (field string, order int, ok bool) {
+	field, ok = fileSorts[strings.TrimPrefix(v, "-")]
+	if v == "" {
+		field, ok = "uploadDate", true
+	}
+	order = 1
+	if (field == "uploadDate") != strings.HasPrefix(v, "-") {
+		order = -1
+	}
+	return field, order, ok
+}
+
+// listableFiles matches the files listings show: uploads that have not
+// expired, without derivatives and shared content holders.
+func listableFiles() bson.M {
+	return bson.M{
+		"metadata.short_id":     bson.M{"$exists": true},
+		"metadata.expires_at":   notExpired(),
+		"metadata.derived_from": bson.M{"$exists": false},
+		"metadata.blob_holder":  bson.M{"$ne": true},
+	}
+}
+
+// fileScope starts the filter of a file listing: the caller's own files, or
+// for an admin everyone's unless owner names an account.
+func fileScope(ctx context.Context, w http.ResponseWriter, user *User, owner string) (bson.M, bool) {
+	filter := listableFiles()
+	owner = strings.TrimSpace(owner)
+	switch {
+	case !isAdmin(user):
+		if owner != "" && owner != user.Username {
+			jsonError(w, "Forbidden", http.StatusForbidden)
+			return nil, false
+		}
+		filter["metadata.owner_id"] = user.ID
+	case owner != "":
+		var u User
+		err := usersColl.FindOne(ctx, bson.M{"username": owner}).Decode(&u)
+		dbBreaker.Record(err)
+		if err == mongo.ErrNoDocuments {
+			jsonError(w, "User not found", http.StatusNotFound)
+			return nil, false
+		}
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return nil, false
+		}
+		filter["metadata.owner_id"] = u.ID
+	}
+	return filter, true
+}
+
+// listedFile is a fileEntry with the owner's name, filled in for admins.
+type listedFile struct {
+	fileEntry
+	Owner string `json:"owner,omitempty"`
+}
+
+func listedFiles(ctx context.Context, user *User, docs []fileRecord) []listedFile {
+	owners := map[primitive.ObjectID]string{}
+	if isAdmin(user) {
+		var ids []primitive.ObjectID
+		for _, doc := range docs {
+			if !doc.Metadata.OwnerID.IsZero() {
+				ids = append(ids, doc.Metadata.OwnerID)
+			}
+		}
+		if len(ids) > 0 {
+			cursor, err := usersColl.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+			dbBreaker.Record(err)
+			if err == nil {
+				var users []User
+				cursor.All(ctx, &users)
+				for _, u := range users {
+					owners[u.ID] = u.Username
+				}
+			}
+		}
+	}
+	files := make([]listedFile, 0, len(docs))
+	for i := range docs {
+		files = append(files, listedFile{newFileEntry(&docs[i]), owners[docs[i].Metadata.OwnerID]})
+	}
+	return files
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The embedded SFTP server takes uploads from sftp, scp (OpenSSH 9 and
+// later, which speaks SFTP underneath) and file managers. Users sign in
+// with a public key attached to one of their API keys on the dashboard;
+// the username is ignored. The account's uploads appear as one flat folder,
+// as on WebDAV. Every stored file is handed to the normal upload pipeline,
+// and its link can be read back from "<name>.url", an Internet Shortcut
+// that is listed next to files uploaded in the session and can be fetched
+// for any file. The link is also in /api/dashboard/files.
+
+const sftpLinkSuffix = ".url"
+
+var sftpConfig *ssh.ServerConfig
+
+func initSFTP() error {
+	cfg := &config().SFTP
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = ":2222"
+	}
+	if cfg.HostKeyFile == "" {
+		cfg.HostKeyFile = "sftp_host_key"
+	}
+	signer, err := loadHostKey(cfg.HostKeyFile)
+	if err != nil {
+		return fmt.Errorf("sftp: %v", err)
+	}
+	sftpConfig = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			apiKey, user := lookupAPIKey("ssh_fingerprint", ssh.FingerprintSHA256(key))
+			if user == nil {
+				return nil, fmt.Errorf("unknown public key")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"key_id": apiKey.KeyID}}, nil
+		},
+		ServerVersion: "SSH-2.0-XyliLoader",
+	}
+	sftpConfig.AddHostKey(signer)
+	return nil
+}
+
+// loadHostKey reads the server's host key, creating an Ed25519 key on
+// first start.
+func loadHostKey(file string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "XyliLoader SFTP host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(file, data, 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Created SFTP host key %s", file)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func serveSFTP() {
+	lis, err := net.Listen("tcp", config().SFTP.Listen)
+	if err != nil {
+		log.Fatal("Error starting SFTP server:", err)
+	}
+	log.Printf("Starting SFTP server on %s", config().SFTP.Listen)
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Printf("SFTP accept error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go handleSFTPConn(conn)
+	}
+}
+
+func handleSFTPConn(conn net.Conn) {
+	defer conn.Close()
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && blockFor(host) != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, sftpConfig)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	key, user := lookupAPIKey("key_id", sconn.Permissions.Extensions["key_id"])
+	if user == nil {
+		return
+	}
+	for ch := range chans {
+		if ch.ChannelType() != "session" {
+			ch.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := ch.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSFTPSession(channel, requests, user, key)
+	}
+}
+
+func serveSFTPSession(channel ssh.Channel, requests <-chan *ssh.Request, user *User, key *APIKey) {
+	defer channel.Close()
+	started := false
+	for req := range requests {
+		ok := !started && req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		started = true
+		h := &sftpHandler{fs: &davFS{user: user, key: key}, links: map[string]string{}}
+		go func() {
+			server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+			if err := server.Serve(); err != nil && err != io.EOF {
+				log.Printf("SFTP session of %s ended: %v", user.Username, err)
+			}
+			server.Close()
+		}()
+	}
+}
+
+// sftpHandler serves one session on top of the WebDAV file system.
+type sftpHandler struct {
+	fs *davFS
+
+	mu    sync.Mutex
+	links map[string]string // "<name>.url" of this session's uploads -> link
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	ctx := r.Context()
+	if content, ok := h.linkFile(ctx, r.Filepath); ok {
+		return strings.NewReader(content), nil
+	}
+	f, err := h.fs.lookup(ctx, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpReader{r: &davReader{ctx: ctx, f: f, name: path.Base(r.Filepath)}}, nil
+}
+
+// linkFile returns the Internet Shortcut for "<name>.url" when name is a
+// file and "<name>.url" itself is not.
+func (h *sftpHandler) linkFile(ctx context.Context, name string) (string, bool) {
+	if !strings.HasSuffix(name, sftpLinkSuffix) {
+		return "", false
+	}
+	if _, err := h.fs.lookup(ctx, name); err == nil {
+		return "", false
+	}
+	f, err := h.fs.lookup(ctx, strings.TrimSuffix(name, sftpLinkSuffix))
+	if err != nil {
+		return "", false
+	}
+	return "[InternetShortcut]\r\nURL=" + f.Link() + "\r\n", true
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	name := strings.TrimPrefix(r.Filepath, "/")
+	if name == "" || strings.Contains(name, "/") {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	existing, err := h.fs.lookup(r.Context(), r.Filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "xyli-sftp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{h: h, name: name, tmp: tmp, replaces: existing}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		// scp -p and file managers set times; uploads keep theirs.
+		return nil
+	case "Remove":
+		return h.fs.RemoveAll(ctx, r.Filepath)
+	case "Rename":
+		return h.fs.Rename(ctx, r.Filepath, r.Target)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := r.Context()
+	switch r.Method {
+	case "List":
+		dir := &davDir{fs: h.fs, ctx: ctx}
+		infos, err := dir.Readdir(0)
+		if err != nil {
+			return nil, err
+		}
+		h.mu.Lock()
+		for name, link := range h.links {
+			infos = append(infos, &davFileInfo{f: &fileRecord{Length: int64(len(link)), UploadDate: time.Now()}, name: name})
+		}
+		h.mu.Unlock()
+		return sftpListing(infos), nil
+	case "Stat":
+		if content, ok := h.linkFile(ctx, r.Filepath); ok {
+			f := &fileRecord{Length: int64(len(content)), UploadDate: time.Now()}
+			return sftpListing{&davFileInfo{f: f, name: path.Base(r.Filepath)}}, nil
+		}
+		info, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListing{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(out, l[offset:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpReader serves the requests of a download, which may come out of
+// order, from a davReader.
+type sftpReader struct {
+	mu sync.Mutex
+	r  *davReader
+}
+
+func (s *sftpReader) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.r.Seek(off, io.SeekStart)
+	return io.ReadFull(s.r, p)
+}
+
+func (s *sftpReader) Close() error { return s.r.Close() }
+
+// sftpWriter collects an upload and stores it on Close.
+type sftpWriter struct {
+	h        *sftpHandler
+	name     string
+	tmp      *os.File
+	replaces *fileRecord
+
+	mu   sync.Mutex
+	size int64
+}
+
+func (w *sftpWriter) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > config().Upload.MaxSize {
+		return 0, fmt.Errorf("file too large (max %s)", formatSize(config().Upload.MaxSize))
+	}
+	n, err := w.tmp.WriteAt(p, off)
+	w.mu.Lock()
+	w.size = max(w.size, off+int64(n))
+	w.mu.Unlock()
+	return n, err
+}
+
+func (w *sftpWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+	// The request's context ends with the transfer; storing takes a while
+	// longer.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	metadata, err := storeMountedFile(ctx, w.h.fs.user, w.h.fs.key, w.name, w.tmp, w.size, w.replaces)
+	if err != nil {
+		log.Printf("SFTP upload %s of %s failed: %v", w.name, w.h.fs.user.Username, err)
+		return err
+	}
+	w.h.mu.Lock()
+	w.h.links[w.name+sftpLinkSuffix] = fmt.Sprintf("[InternetShortcut]\r\nURL=%s/%s\r\n", config().Upload.BaseURL, metadata["short_id"])
+	w.h.mu.Unlock()
+	return nil
+}
+
+// sshKeyFingerprint parses an authorized_keys line and returns the key in
+// canonical form with its SHA256 fingerprint.
+func sshKeyFingerprint(line string) (string, string, error) {
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(line)))
+	if err != nil {
+		return "", "", err
+	}
+	canonical := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		canonical += " " + comment
+	}
+	return canonical, ssh.FingerprintSHA256(key), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// /api/shortcuts/upload is shaped for Apple Shortcuts and the iOS share
+// sheet: an API key as Bearer token, the file either as a multipart form
+// ("Get Contents of URL" with a Form body) or as JSON with base64 data
+// ("Base64 Encode" into a JSON body), and an answer with nothing but "url"
+// for "Get Dictionary Value". Uploads are capped at shortcuts.maxBytes,
+// below the instance limit, since phones on mobile data give up on long
+// uploads; oversized requests are refused from their Content-Length before
+// any of the body is read.
+
+// shortcutsBase64Overhead covers the JSON around base64 data.
+const shortcutsBase64Overhead = 64 << 10
+
+func initShortcuts() {
+	cfg := &config().Shortcuts
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 50 << 20
+	}
+	if cfg.MaxBytes > config().Upload.MaxSize {
+		cfg.MaxBytes = config().Upload.MaxSize
+	}
+}
+
+func handleShortcutsUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if bearerToken(r) == "" || requestUser(r) == nil {
+		jsonError(w, "API key required", http.StatusUnauthorized)
+		return
+	}
+
+	max := config().Shortcuts.MaxBytes
+	tooLarge := fmt.Sprintf("File too large (max %s)", formatSize(max))
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	limit := max + 64<<10
+	if mt == "application/json" {
+		limit = int64(base64.StdEncoding.EncodedLen(int(max))) + shortcutsBase64Overhead
+	}
+	if r.ContentLength > limit {
+		jsonError(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	var body io.Reader
+	var name, claimed, expires, password string
+	switch mt {
+	case "application/json":
+		var req struct {
+			Filename    string `json:"filename"`
+			ContentType string `json:"content_type"`
+			Data        string `json:"data"`
+			Expires     string `json:"expires"`
+			Password    string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		// Shortcuts wraps base64 output in lines; data: URLs also work.
+		data := req.Data
+		if i := strings.Index(data, ";base64,"); strings.HasPrefix(data, "data:") && i >= 0 {
+			data = data[i+len(";base64,"):]
+		}
+		data = strings.Map(func(c rune) rune {
+			if c == '\n' || c == '\r' || c == ' ' {
+				return -1
+			}
+			return c
+		}, data)
+		body = base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
+		name, claimed, expires, password = req.Filename, req.ContentType, req.Expires, req.Password
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		// Shortcuts names the file field whatever the user typed; take the
+		// first file there is.
+		for _, files := range r.MultipartForm.File {
+			if len(files) == 0 {
+				continue
+			}
+			f, err := files[0].Open()
+			if err != nil {
+				jsonError(w, "Upload error", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			body, name, claimed = f, files[0].Filename, files[0].Header.Get("Content-Type")
+			break
+		}
+		if body == nil {
+			jsonError(w, "File not found", http.StatusBadRequest)
+			return
+		}
+		expires, password = r.FormValue("expires"), r.FormValue("password")
+	default:
+		jsonError(w, "Send a multipart form or JSON", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	metadata, ok := storeSimpleUpload(w, r, jsonUploadError(w), simpleUpload{
+		Body:     body,
+		Name:     name,
+		Claimed:  claimed,
+		MaxSize:  max,
+		Expires:  expires,
+		Password: password,
+	})
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": fmt.Sprintf("%s/%s", config().Upload.BaseURL, metadata["short_id"])})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Owners can hand out a link that stops working at a set time:
+//
+//	POST /api/v1/files/sign   {"id", "expires_in", "require_signature"}
+//
+// answers with /raw/{id}?exp={unix}&sig={hmac}. The signature covers the
+// short ID and the expiry and works on /raw/, /thumb/, /img/, /poster/ and
+// /preview/ of that file; it also stands in for the file's password. With
+// require_signature the file is only served with a valid signature, or to
+// its owner: the plain link answers 403 to everyone else. Signatures are
+// made with signedURLs.secret; without one a random key is used and signed
+// links stop working when the server restarts.
+
+const (
+	signatureParam = "sig"
+	expiryParam    = "exp"
+)
+
+var signKey []byte
+
+func initSignedURLs() {
+	cfg := &config().SignedURLs
+	if cfg.MaxTTLHours <= 0 {
+		cfg.MaxTTLHours = 24 * 7
+	}
+	if cfg.Secret != "" {
+		signKey = []byte(cfg.Secret)
+		return
+	}
+	signKey = make([]byte, 32)
+	rand.Read(signKey)
+}
+
+func urlSignature(shortID string, expires int64) string {
+	mac := hmac.New(sha256.New, signKey)
+	fmt.Fprintf(mac, "%s|%d", shortID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL is the /raw/ link of shortID, valid until expires.
+func signedURL(shortID string, expires time.Time) string {
+	q := url.Values{
+		expiryParam:    {strconv.FormatInt(expires.Unix(), 10)},
+		signatureParam: {urlSignature(shortID, expires.Unix())},
+	}
+	return fmt.Sprintf("%s/raw/%s?%s", config().Upload.BaseURL, shortID, q.Encode())
+}
+
+// signatureExpiry returns the expiry of a valid, unexpired signature for f
+// in the request.
+func signatureExpiry(r *http.Request, f *fileRecord) (time.Time, bool) {
+	q := r.URL.Query()
+	sig := q.Get(signatureParam)
+	if sig == "" {
+		return time.Time{}, false
+	}
+	exp, err := strconv.ParseInt(q.Get(expiryParam), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(sig), []byte(urlSignature(f.Metadata.ShortID, exp))) {
+		return time.Time{}, false
+	}
+	return time.Unix(exp, 0), true
+}
+
+// signedRequest reports whether the request carries a valid signature for f.
+func signedRequest(r *http.Request, f *fileRecord) bool {
+	_, ok := signatureExpiry(r, f)
+	return ok
+}
+
+// requireSigned answers 403 and returns false when f may only be fetched
+// with a signature and the request has none, and is not from the owner.
+func requireSigned(w http.ResponseWriter, r *http.Request, f *fileRecord) bool {
+	if !f.Metadata.SignedOnly {
+		return true
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	if signedRequest(r, f) {
+		return true
+	}
+	if user := requestUser(r); user != nil && (user.ID == f.Metadata.OwnerID || isAdmin(user)) {
+		return true
+	}
+	if r.URL.Query().Has(signatureParam) {
+		http.Error(w, "link expired or invalid", http.StatusForbidden)
+		return false
+	}
+	http.Error(w, "signed link required", http.StatusForbidden)
+	return false
+}
+
+// handleSignFile mints a signed link for one of the caller's files and can
+// turn the signature requirement on or off.
+func handleSignFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID               string `json:"id"`
+		ExpiresIn        int64  `json:"expires_in"` // seconds
+		RequireSignature *bool  `json:"require_signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	maxTTL := time.Duration(config().SignedURLs.MaxTTLHours) * time.Hour
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if req.ExpiresIn == 0 {
+		ttl = time.Hour
+	}
+	if ttl <= 0 || ttl > maxTTL {
+		jsonError(w, fmt.Sprintf("expires_in must be between 1 and %d seconds", int64(maxTTL/time.Second)), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	doc, err := findManagedFile(ctx, user, req.ID)
+	if err == errFileNotFound {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	signedOnly := doc.Metadata.SignedOnly
+	if req.RequireSignature != nil && *req.RequireSignature != signedOnly {
+		update := bson.M{"$set": bson.M{"metadata.signed_only": true}}
+		if !*req.RequireSignature {
+			update = bson.M{"$unset": bson.M{"metadata.signed_only": ""}}
+		}
+		_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": doc.ID}, update)
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		signedOnly = *req.RequireSignature
+		if doc.Metadata.OwnerID != user.ID {
+			log.Printf("Admin %s set signed_only=%t on %s", user.Username, signedOnly, req.ID)
+		}
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	if doc.Metadata.ExpiresAt != nil && doc.Metadata.ExpiresAt.Before(expires) {
+		expires = doc.Metadata.ExpiresAt.Truncate(time.Second)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":                req.ID,
+		"url":               signedURL(doc.Metadata.ShortID, expires),
+		"expires_at":        expires.UTC(),
+		"require_signature": signedOnly,
+	})
+}
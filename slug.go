@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// With upload.slugs, links carry a readable name after the short ID:
+// "Отчёт 2024.pdf" is shared as /abc12/otchet-2024.pdf. The slug is the
+// filename transliterated to Latin and reduced to lowercase letters, digits
+// and dashes. Only the short ID finds the file; the viewer and /raw/ accept
+// any slug, or none, so renaming a file never breaks a link.
+
+const maxSlugLen = 60
+
+var translit = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	// Ukrainian and Belarusian
+	'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g", 'ў': "u",
+	// German and other Latin letters with diacritics
+	'ä': "ae", 'ö': "oe", 'ü': "ue", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i",
+	'ï': "i", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ý': "y", 'ÿ': "y", 'ł': "l", 'ś': "s",
+	'ź': "z", 'ż': "z", 'ć': "c", 'ń': "n", 'ę': "e", 'ą': "a", 'č': "c",
+	'š': "s", 'ž': "z", 'ř': "r", 'ě': "e", 'ů': "u",
+}
+
+// slugify turns a filename into a slug, keeping its extension. It returns
+// "" when nothing readable is left.
+func slugify(filename string) string {
+	ext := strings.ToLower(path.Ext(filename))
+	base := strings.TrimSuffix(filename, path.Ext(filename))
+	if sanitized := slugPart(ext[min(1, len(ext)):]); sanitized != "" {
+		ext = "." + sanitized
+	} else {
+		ext = ""
+	}
+
+	slug := slugPart(base)
+	if len(slug) > maxSlugLen {
+		slug = strings.TrimRight(slug[:maxSlugLen], "-")
+	}
+	if slug == "" {
+		return ""
+	}
+	return slug + ext
+}
+
+// slugPart transliterates s and replaces every run of other characters
+// with a single dash.
+func slugPart(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		var out string
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			out = string(r)
+		default:
+			out = translit[r]
+		}
+		if out == "" {
+			if _, silent := translit[r]; !silent {
+				dash = b.Len() > 0
+			}
+			continue
+		}
+		if dash {
+			b.WriteByte('-')
+			dash = false
+		}
+		b.WriteString(out)
+	}
+	return b.String()
+}
+
+// splitSlug returns the short ID of a path like "abc12/otchet-2024.pdf".
+func splitSlug(p string) string {
+	id, _, _ := strings.Cut(p, "/")
+	return id
+}
+
+// fileLink is the viewer link of a file, with a slug when they are on.
+func fileLink(shortID, filename string) string {
+	if config().Upload.Slugs {
+		if slug := slugify(filename); slug != "" {
+			return fmt.Sprintf("%s/%s/%s", config().Upload.BaseURL, shortID, slug)
+		}
+	}
+	return fmt.Sprintf("%s/%s", config().Upload.BaseURL, shortID)
+}
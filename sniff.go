@@ -0,0 +1,97 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// The Content-Type a client sends with an upload is only a hint. The stored
+// type is decided from the first bytes of the content, the file extension
+// and that hint, in this order, and types a browser would execute (HTML,
+// SVG, XML, scripts) are never stored or served as such: they become plain
+// text, so a shared link can never run script on this origin.
+
+const sniffLen = 512
+
+var activeContentTypes = map[string]bool{
+	"text/html":                     true,
+	"application/xhtml+xml":         true,
+	"image/svg+xml":                 true,
+	"text/xml":                      true,
+	"application/xml":               true,
+	"text/javascript":               true,
+	"application/javascript":        true,
+	"application/ecmascript":        true,
+	"text/ecmascript":               true,
+	"application/x-shockwave-flash": true,
+}
+
+const plainText = "text/plain; charset=utf-8"
+
+func mediaType(ct string) string {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// detectContentType picks the type to store for an upload whose content
+// starts with head.
+func detectContentType(filename string, head []byte, claimed string) string {
+	sniffed := http.DetectContentType(head)
+	sniffedType := mediaType(sniffed)
+
+	// A hint is only worth considering when it is well-formed; the extension
+	// wins over a generic client type.
+	hint := mediaType(claimed)
+	if hint == "" || hint == "application/octet-stream" || hint == "binary/octet-stream" {
+		hint = mediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))))
+	}
+
+	switch sniffedType {
+	case "text/plain":
+		// Text with nothing recognisable in it: trust a text hint.
+		if strings.HasPrefix(hint, "text/") || hint == "application/json" {
+			charset := "utf-8"
+			if _, params, err := mime.ParseMediaType(claimed); err == nil && params["charset"] != "" {
+				charset = params["charset"]
+			}
+			if ct := mime.FormatMediaType(hint, map[string]string{"charset": charset}); ct != "" {
+				return safeContentType(ct)
+			}
+		}
+		return plainText
+	case "application/octet-stream":
+		// Binary the sniffer does not know (3D models, archives, ...): trust a
+		// binary hint, but never a text one.
+		if hint == "" || strings.HasPrefix(hint, "text/") || activeContentTypes[hint] {
+			return "application/octet-stream"
+		}
+		return hint
+	}
+	return safeContentType(sniffed)
+}
+
+// safeContentType downgrades types a browser would execute to plain text.
+// It is applied when serving, too, so that files stored before sniffing
+// was introduced are covered.
+func safeContentType(ct string) string {
+	mt := mediaType(ct)
+	if mt == "" {
+		return "application/octet-stream"
+	}
+	if activeContentTypes[mt] {
+		return plainText
+	}
+	return ct
+}
+
+// setContentHeaders sets the type of stored content on a response and tells
+// browsers not to second-guess it.
+func setContentHeaders(h http.Header, contentType string) {
+	h.Set("Content-Type", safeContentType(contentType))
+	h.Set("X-Content-Type-Options", "nosniff")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Uploads that arrive while MongoDB is unreachable are written to the spool
+// directory as a pair of files: <short_id>.bin with the content and
+// <short_id>.json with the GridFS filename and metadata. The flusher moves
+// them into GridFS once the database answers pings again.
+
+type spoolEntry struct {
+	Filename  string    `bson:"filename"`
+	Metadata  bson.M    `bson:"metadata"`
+	SpooledAt time.Time `bson:"spooled_at"`
+}
+
+var (
+	errSpoolFull = errors.New("spool is full")
+
+	// spoolMu serialises writers so the size cap is checked consistently.
+	spoolMu sync.Mutex
+)
+
+func spoolSize() int64 {
+	var total int64
+	entries, _ := os.ReadDir(config().Spool.Dir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+func spoolUpload(filename string, r io.Reader, metadata bson.M) error {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+
+	shortID := metadata["short_id"].(string)
+	if config().Spool.MaxBytes > 0 && spoolSize() >= config().Spool.MaxBytes {
+		return errSpoolFull
+	}
+
+	dataPath := filepath.Join(config().Spool.Dir, shortID+".bin")
+	out, err := os.OpenFile(dataPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dataPath)
+		return err
+	}
+
+	entry, err := bson.MarshalExtJSON(spoolEntry{
+		Filename:  filename,
+		Metadata:  metadata,
+		SpooledAt: time.Now(),
+	}, true, false)
+	if err != nil {
+		os.Remove(dataPath)
+		return err
+	}
+
+	metaPath := filepath.Join(config().Spool.Dir, shortID+".json")
+	if err := os.WriteFile(metaPath+".tmp", entry, 0o600); err != nil {
+		os.Remove(dataPath)
+		return err
+	}
+	if err := os.Rename(metaPath+".tmp", metaPath); err != nil {
+		os.Remove(dataPath)
+		return err
+	}
+
+	log.Printf("Spooled upload %s (%s) while storage is unavailable", shortID, filename)
+	return nil
+}
+
+func runSpoolFlusher() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		flushSpool()
+	}
+}
+
+func flushSpool() {
+	pending, _ := filepath.Glob(filepath.Join(config().Spool.Dir, "*.json"))
+	if len(pending) == 0 {
+		return
+	}
+	sort.Strings(pending)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := client.Ping(ctx, nil)
+	cancel()
+	dbBreaker.Record(err)
+	if err != nil {
+		return
+	}
+
+	for _, metaPath := range pending {
+		if err := flushSpoolEntry(metaPath); err != nil {
+			log.Printf("Error flushing spooled upload %s: %v", filepath.Base(metaPath), err)
+			if isMongoOutage(err) {
+				return
+			}
+		}
+	}
+}
+
+func flushSpoolEntry(metaPath string) error {
+	raw, err := os.ReadFile(metaPath)
+	if err != nil {
+		return err
+	}
+
+	var entry spoolEntry
+	if err := bson.UnmarshalExtJSON(raw, true, &entry); err != nil {
+		return err
+	}
+
+	dataPath := strings.TrimSuffix(metaPath, ".json") + ".bin"
+	data, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	err = storeUpload(context.Background(), entry.Filename, data, entry.Metadata)
+	if isInfected(err) {
+		os.Remove(metaPath)
+		os.Remove(dataPath)
+		log.Printf("Dropped spooled upload %s: %v", filepath.Base(strings.TrimSuffix(metaPath, ".json")), err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Remove(metaPath)
+	os.Remove(dataPath)
+	log.Printf("Flushed spooled upload %s into GridFS", filepath.Base(strings.TrimSuffix(metaPath, ".json")))
+	return nil
+}
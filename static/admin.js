@@ -0,0 +1,570 @@
+const filesBody = document.getElementById('filesBody');
+const searchInput = document.getElementById('searchInput');
+const bulkDeleteBtn = document.getElementById('bulkDeleteBtn');
+const selectAll = document.getElementById('selectAll');
+const prevPage = document.getElementById('prevPage');
+const nextPage = document.getElementById('nextPage');
+const pageInfo = document.getElementById('pageInfo');
+const totalCount = document.getElementById('totalCount');
+const scrapeBody = document.getElementById('scrapeBody');
+const flaggedCount = document.getElementById('flaggedCount');
+const statsBody = document.getElementById('statsBody');
+const avBody = document.getElementById('avBody');
+const avStatus = document.getElementById('avStatus');
+const reloadConfigBtn = document.getElementById('reloadConfigBtn');
+const updateBanner = document.getElementById('updateBanner');
+const importConfigBtn = document.getElementById('importConfigBtn');
+const importConfigInput = document.getElementById('importConfigInput');
+const reportsBody = document.getElementById('reportsBody');
+const reportCount = document.getElementById('reportCount');
+const blocksBody = document.getElementById('blocksBody');
+const blockCount = document.getElementById('blockCount');
+const blockCIDR = document.getElementById('blockCIDR');
+const blockNote = document.getElementById('blockNote');
+const blockExpires = document.getElementById('blockExpires');
+const blockDownloads = document.getElementById('blockDownloads');
+const blockBtn = document.getElementById('blockBtn');
+const toast = document.getElementById('toast');
+
+let currentPage = 1;
+let totalPages = 1;
+let searchTimer = null;
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+function documentLine(doc) {
+    if (!doc) return '';
+    const parts = [doc.title, doc.author].filter(Boolean).map(escapeHTML);
+    if (doc.pages) parts.push(doc.pages + ' стр.');
+    return parts.length ? `<div class="file-doc">${parts.join(' · ')}</div>` : '';
+}
+
+function bandwidthLine(item) {
+    if (!item.bandwidth_cap) return '';
+    const mb = (bytes) => (bytes / 1048576).toFixed(1);
+    return `<div class="file-doc">Трафик за месяц: ${mb(item.bandwidth_used || 0)} / ${mb(item.bandwidth_cap)} МБ</div>`;
+}
+
+async function setBandwidthCap(id, current) {
+    const value = prompt('Лимит трафика в месяц, МБ (0 — без лимита):', current ? String(current / 1048576) : '');
+    if (value === null) return;
+    const megabytes = Number(value.replace(',', '.'));
+    if (!Number.isFinite(megabytes) || megabytes < 0) {
+        showToast('Неверное значение');
+        return;
+    }
+
+    try {
+        const response = await fetch('/api/dashboard/files/bandwidth', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ id, cap: Math.round(megabytes * 1048576) })
+        });
+        if (response.ok) {
+            loadFiles();
+            showToast(megabytes ? 'Лимит установлен' : 'Лимит снят');
+        } else {
+            showToast('Ошибка сохранения');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function toggleDisabled(id, disabled) {
+    try {
+        const response = await fetch('/api/dashboard/files/disable', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ id, disabled })
+        });
+        if (response.ok) {
+            loadFiles();
+            showToast(disabled ? 'Ссылка отключена' : 'Ссылка включена');
+        } else {
+            showToast('Ошибка сохранения');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function loadFiles() {
+    const params = new URLSearchParams({ page: currentPage, q: searchInput.value });
+
+    try {
+        const response = await fetch('/api/admin/files?' + params);
+        if (!response.ok) {
+            showToast('Ошибка загрузки списка');
+            return;
+        }
+        const data = await response.json();
+        totalPages = Math.max(data.pages, 1);
+        totalCount.textContent = data.total;
+        pageInfo.textContent = `${data.page} / ${totalPages}`;
+        prevPage.disabled = currentPage <= 1;
+        nextPage.disabled = currentPage >= totalPages;
+        renderFiles(data.files);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function renderPreview(item) {
+    if (item.file_type === 'image') {
+        return `<img class="admin-preview" src="/thumb/${item.short_id}" loading="lazy" alt="">`;
+    }
+    return `<div class="admin-preview">${item.file_type}</div>`;
+}
+
+function renderFiles(files) {
+    selectAll.checked = false;
+    updateBulkButton();
+
+    if (files.length === 0) {
+        filesBody.innerHTML = '<tr><td colspan="7" style="text-align: center; color: #555; padding: 40px;">Ничего не найдено</td></tr>';
+        return;
+    }
+
+    filesBody.innerHTML = files.map((item) => {
+        const date = new Date(item.uploaded_at);
+        const formattedDate = date.toLocaleString('ru-RU', {
+            day: '2-digit',
+            month: '2-digit',
+            year: 'numeric',
+            hour: '2-digit',
+            minute: '2-digit'
+        });
+
+        return `
+            <tr>
+                <td><input type="checkbox" class="file-select" value="${item.short_id}"></td>
+                <td><a href="${item.link}" target="_blank">${renderPreview(item)}</a></td>
+                <td class="file-name"><a href="${item.link}" class="file-link" target="_blank">${escapeHTML(item.filename)}</a>${documentLine(item.document)}${bandwidthLine(item)}${item.disabled ? '<div class="file-doc">Ссылка отключена</div>' : ''}</td>
+                <td class="file-date">${item.size_text}</td>
+                <td class="file-date">${item.owner ? escapeHTML(item.owner) : '—'}</td>
+                <td class="file-date">${formattedDate}</td>
+                <td>
+                    <div class="actions-cell">
+                        <button class="copy-btn-table" onclick="toggleDisabled('${item.short_id}', ${!item.disabled})" title="${item.disabled ? 'Включить ссылку' : 'Отключить ссылку'}">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                ${item.disabled ? '<polygon points="6 4 20 12 6 20 6 4"></polygon>' : '<line x1="9" y1="5" x2="9" y2="19"></line><line x1="15" y1="5" x2="15" y2="19"></line>'}
+                            </svg>
+                        </button>
+                        <button class="copy-btn-table" onclick="setBandwidthCap('${item.short_id}', ${item.bandwidth_cap || 0})" title="Лимит трафика">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M4 18a8 8 0 1 1 16 0"></path>
+                                <line x1="12" y1="18" x2="16" y2="11"></line>
+                            </svg>
+                        </button>
+                        <button class="delete-btn-table" onclick="deleteFiles(['${item.short_id}'])" title="Удалить">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <polyline points="3 6 5 6 21 6"></polyline>
+                                <path d="M19 6v14a2 2 0 0 1-2 2H7a2 2 0 0 1-2-2V6m3 0V4a2 2 0 0 1 2-2h4a2 2 0 0 1 2 2v2"></path>
+                            </svg>
+                        </button>
+                    </div>
+                </td>
+            </tr>
+        `;
+    }).join('');
+
+    document.querySelectorAll('.file-select').forEach((box) => {
+        box.addEventListener('change', updateBulkButton);
+    });
+}
+
+function selectedIDs() {
+    return Array.from(document.querySelectorAll('.file-select:checked')).map((box) => box.value);
+}
+
+function updateBulkButton() {
+    bulkDeleteBtn.disabled = selectedIDs().length === 0;
+}
+
+async function deleteFiles(ids) {
+    if (!confirm(`Удалить файлов: ${ids.length}?`)) return;
+
+    try {
+        const response = await fetch('/api/admin/files/delete', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ ids })
+        });
+
+        if (response.ok) {
+            const data = await response.json();
+            showToast(`Удалено: ${data.deleted}`);
+            loadFiles();
+        } else {
+            showToast('Ошибка удаления');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function formatDate(value) {
+    return new Date(value).toLocaleString('ru-RU', {
+        day: '2-digit',
+        month: '2-digit',
+        year: 'numeric',
+        hour: '2-digit',
+        minute: '2-digit'
+    });
+}
+
+async function loadScraping() {
+    try {
+        const response = await fetch('/api/admin/scraping');
+        if (!response.ok) return;
+        const data = await response.json();
+
+        flaggedCount.textContent = data.enabled ? `сейчас помечено: ${data.flagged.length}` : 'детектор выключен';
+
+        if (data.events.length === 0) {
+            scrapeBody.innerHTML = '<tr><td colspan="5" style="text-align: center; color: #555; padding: 40px;">Событий нет</td></tr>';
+            return;
+        }
+
+        scrapeBody.innerHTML = data.events.map((ev) => `
+            <tr>
+                <td class="file-name">${escapeHTML(ev.ip)}</td>
+                <td class="file-date">${escapeHTML(ev.reason)}</td>
+                <td class="file-date">${escapeHTML(ev.user_agent || '—')}</td>
+                <td class="file-date">${escapeHTML(ev.action)}</td>
+                <td class="file-date">${formatDate(ev.at)} <button class="admin-btn" onclick="prefillBlock('${escapeHTML(ev.ip)}', '${escapeHTML(ev.reason)}')">Блок</button></td>
+            </tr>
+        `).join('');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+const reportReasonNames = {
+    illegal: 'незаконный контент',
+    copyright: 'авторские права',
+    malware: 'вирус или фишинг',
+    spam: 'спам',
+    other: 'другое'
+};
+
+async function loadReports() {
+    try {
+        const response = await fetch('/api/admin/reports');
+        if (!response.ok) return;
+        const data = await response.json();
+
+        reportCount.textContent = data.threshold ? `скрытие после ${data.threshold}` : 'автоскрытие выключено';
+
+        if (data.files.length === 0) {
+            reportsBody.innerHTML = '<tr><td colspan="5" style="text-align: center; color: #555; padding: 40px;">Жалоб нет</td></tr>';
+            return;
+        }
+
+        reportsBody.innerHTML = data.files.map((f) => {
+            const details = f.reports.filter((rep) => rep.details).map((rep) => `<div class="file-doc">${escapeHTML(rep.details)}</div>`).join('');
+            const name = f.deleted ? `${escapeHTML(f.short_id)} (удалён)` : `<a href="${f.link}" class="file-link" target="_blank">${escapeHTML(f.filename)}</a>`;
+            return `
+                <tr>
+                    <td class="file-name">${name}${f.hidden ? '<div class="file-doc">Скрыт до проверки</div>' : ''}${details}</td>
+                    <td class="file-date">${f.count}</td>
+                    <td class="file-date">${f.reasons.map((r) => escapeHTML(reportReasonNames[r] || r)).join(', ')}</td>
+                    <td class="file-date">${formatDate(f.last_at)}</td>
+                    <td>
+                        <div class="actions-cell">
+                            <button class="admin-btn" onclick="resolveReports('${f.short_id}', 'dismiss')">Отклонить</button>
+                            ${f.deleted ? '' : `<button class="admin-btn admin-btn-danger" onclick="resolveReports('${f.short_id}', 'delete')">Удалить файл</button>`}
+                        </div>
+                    </td>
+                </tr>
+            `;
+        }).join('');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function resolveReports(id, action) {
+    if (action === 'delete' && !confirm('Удалить файл ' + id + '?')) return;
+    try {
+        const response = await fetch('/api/admin/reports', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ id, action })
+        });
+        if (response.ok) {
+            showToast(action === 'delete' ? 'Файл удалён' : 'Жалобы отклонены');
+            loadReports();
+            if (action === 'delete') loadFiles();
+        } else {
+            showToast('Ошибка сохранения');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function loadBlocklist() {
+    try {
+        const response = await fetch('/api/admin/blocklist');
+        if (!response.ok) return;
+        const data = await response.json();
+
+        blockCount.textContent = `записей: ${data.blocks.length}`;
+
+        if (data.blocks.length === 0) {
+            blocksBody.innerHTML = '<tr><td colspan="6" style="text-align: center; color: #555; padding: 40px;">Блокировок нет</td></tr>';
+            return;
+        }
+
+        blocksBody.innerHTML = data.blocks.map((b) => `
+            <tr>
+                <td class="file-name">${escapeHTML(b.cidr)}</td>
+                <td class="file-date">${b.downloads ? 'всё' : 'загрузки'}</td>
+                <td class="file-date">${escapeHTML(b.note || '—')}</td>
+                <td class="file-date">${escapeHTML(b.created_by)}</td>
+                <td class="file-date">${b.expires_at ? formatDate(b.expires_at) : 'бессрочно'}</td>
+                <td>
+                    <button class="delete-btn-table" onclick="removeBlock('${b.id}')" title="Снять блокировку">
+                        <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                            <line x1="18" y1="6" x2="6" y2="18"></line>
+                            <line x1="6" y1="6" x2="18" y2="18"></line>
+                        </svg>
+                    </button>
+                </td>
+            </tr>
+        `).join('');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function prefillBlock(ip, reason) {
+    blockCIDR.value = ip;
+    blockNote.value = reason;
+    blockCIDR.scrollIntoView({ behavior: 'smooth', block: 'center' });
+}
+
+async function addBlock() {
+    const cidr = blockCIDR.value.trim();
+    if (!cidr) return;
+    try {
+        const response = await fetch('/api/admin/blocklist', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                cidr,
+                note: blockNote.value,
+                downloads: blockDownloads.checked,
+                expires_in: Number(blockExpires.value)
+            })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.message || data.error || 'Ошибка сохранения');
+            return;
+        }
+        blockCIDR.value = '';
+        blockNote.value = '';
+        blockDownloads.checked = false;
+        showToast('Заблокировано: ' + data.cidr);
+        loadBlocklist();
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function removeBlock(id) {
+    if (!confirm('Снять блокировку?')) return;
+    try {
+        const response = await fetch('/api/admin/blocklist?id=' + encodeURIComponent(id), { method: 'DELETE' });
+        if (response.ok) {
+            showToast('Блокировка снята');
+            loadBlocklist();
+        } else {
+            showToast('Ошибка удаления');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function loadAntivirus() {
+    try {
+        const response = await fetch('/api/admin/antivirus');
+        if (!response.ok) return;
+        const data = await response.json();
+
+        avStatus.textContent = data.enabled ? (data.action === 'quarantine' ? 'карантин' : 'отклонение') : 'проверка выключена';
+
+        if (data.events.length === 0) {
+            avBody.innerHTML = '<tr><td colspan="5" style="text-align: center; color: #555; padding: 40px;">Угроз не найдено</td></tr>';
+            return;
+        }
+
+        avBody.innerHTML = data.events.map((ev) => `
+            <tr>
+                <td class="file-name">${escapeHTML(ev.filename)}</td>
+                <td class="file-date">${escapeHTML(ev.short_id)}</td>
+                <td class="file-date">${escapeHTML(ev.signature)}</td>
+                <td class="file-date">${ev.action === 'quarantine' ? 'карантин' : 'удалён'}</td>
+                <td class="file-date">${formatDate(ev.at)}</td>
+            </tr>
+        `).join('');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function loadStats() {
+    try {
+        const response = await fetch('/api/admin/stats?days=30');
+        if (!response.ok) return;
+        const data = await response.json();
+
+        const rows = [...data.monthly, ...data.daily];
+        if (rows.length === 0) {
+            statsBody.innerHTML = '<tr><td colspan="6" style="text-align: center; color: #555; padding: 40px;">Данных пока нет</td></tr>';
+            return;
+        }
+
+        statsBody.innerHTML = rows.map((row) => `
+            <tr>
+                <td class="file-name">${escapeHTML(row.period)}</td>
+                <td class="file-date">${row.uploads}</td>
+                <td class="file-date">${row.upload_size_text}</td>
+                <td class="file-date">${row.views}</td>
+                <td class="file-date">${row.downloads}</td>
+                <td class="file-date">${row.download_size_text}</td>
+            </tr>
+        `).join('');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function loadUpdate() {
+    try {
+        const response = await fetch('/api/admin/update');
+        if (!response.ok) return;
+        const data = await response.json();
+        if (!data.available) return;
+
+        const link = data.url ? ` <a href="${escapeHTML(data.url)}" target="_blank" rel="noopener">Что нового</a>` : '';
+        updateBanner.innerHTML = `Доступна новая версия ${escapeHTML(data.latest)} (сейчас ${escapeHTML(data.current)}).${link}`;
+        updateBanner.hidden = false;
+    } catch (error) {
+        // The banner is a hint; the page works without it.
+    }
+}
+
+async function reloadConfig() {
+    try {
+        const response = await fetch('/api/admin/reload', { method: 'POST' });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast('Конфиг не применён: ' + data.error);
+            return;
+        }
+        if (data.restart_required.length) {
+            showToast('Применено; нужен перезапуск для: ' + data.restart_required.join(', '));
+        } else {
+            showToast('Конфиг перечитан');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function importConfig(file) {
+    if (!confirm('Применить настройки из ' + file.name + '? Текущий конфиг будет сохранён как .bak.')) return;
+    try {
+        const response = await fetch('/api/admin/config/import', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: await file.text()
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast('Импорт не удался: ' + data.error);
+            return;
+        }
+        if (data.config_written === false) {
+            const blob = new Blob([JSON.stringify(data.config, null, 2)], { type: 'application/json' });
+            const link = document.createElement('a');
+            link.href = URL.createObjectURL(blob);
+            link.download = 'config.json';
+            link.click();
+            URL.revokeObjectURL(link.href);
+            showToast('Конфиг сервера не в JSON: сохраните скачанный файл вручную');
+        } else if (data.restart_required && data.restart_required.length) {
+            showToast('Импортировано; нужен перезапуск для: ' + data.restart_required.join(', '));
+        } else {
+            showToast('Настройки импортированы');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function showToast(message) {
+    const toastSpan = toast.querySelector('span');
+    toastSpan.textContent = message;
+    toast.classList.add('show');
+
+    setTimeout(() => {
+        toast.classList.remove('show');
+    }, 2000);
+}
+
+searchInput.addEventListener('input', () => {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(() => {
+        currentPage = 1;
+        loadFiles();
+    }, 300);
+});
+
+selectAll.addEventListener('change', () => {
+    document.querySelectorAll('.file-select').forEach((box) => {
+        box.checked = selectAll.checked;
+    });
+    updateBulkButton();
+});
+
+bulkDeleteBtn.addEventListener('click', () => deleteFiles(selectedIDs()));
+importConfigBtn.addEventListener('click', () => importConfigInput.click());
+importConfigInput.addEventListener('change', () => {
+    if (importConfigInput.files.length) importConfig(importConfigInput.files[0]);
+    importConfigInput.value = '';
+});
+
+reloadConfigBtn.addEventListener('click', reloadConfig);
+blockBtn.addEventListener('click', addBlock);
+
+prevPage.addEventListener('click', () => {
+    if (currentPage > 1) {
+        currentPage--;
+        loadFiles();
+    }
+});
+
+nextPage.addEventListener('click', () => {
+    if (currentPage < totalPages) {
+        currentPage++;
+        loadFiles();
+    }
+});
+
+loadFiles();
+loadReports();
+loadScraping();
+loadBlocklist();
+loadAntivirus();
+loadStats();
+loadUpdate();
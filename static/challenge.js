@@ -0,0 +1,20 @@
+// solveChallenge finds a nonce whose sha256(challenge + ":" + nonce) starts
+// with the requested number of zero bits.
+async function solveChallenge(challenge, difficulty) {
+    const encoder = new TextEncoder();
+    for (let nonce = 0; ; nonce++) {
+        const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', encoder.encode(`${challenge}:${nonce}`)));
+        let zeros = 0;
+        for (const byte of digest) {
+            if (byte === 0) {
+                zeros += 8;
+                continue;
+            }
+            zeros += Math.clz32(byte) - 24;
+            break;
+        }
+        if (zeros >= difficulty) {
+            return String(nonce);
+        }
+    }
+}
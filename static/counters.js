@@ -0,0 +1,11 @@
+// Fills in how often the file on a viewer page was viewed and downloaded.
+document.querySelectorAll('[data-counters]').forEach(async (el) => {
+    try {
+        const response = await fetch('/stats/' + encodeURIComponent(el.dataset.counters));
+        if (!response.ok) return;
+        const data = await response.json();
+        el.textContent = ' · ' + data.text;
+    } catch (error) {
+        // The counts are a nicety; the page works without them.
+    }
+});
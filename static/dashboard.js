@@ -0,0 +1,673 @@
+const filesBody = document.getElementById('filesBody');
+const toast = document.getElementById('toast');
+const keysBody = document.getElementById('keysBody');
+const keyName = document.getElementById('keyName');
+const keySecret = document.getElementById('keySecret');
+const keySecretText = document.getElementById('keySecretText');
+const couponCode = document.getElementById('couponCode');
+const claimLink = document.getElementById('claimLink');
+const defaultExpires = document.getElementById('defaultExpires');
+const defaultPassword = document.getElementById('defaultPassword');
+const defaultPasswordClear = document.getElementById('defaultPasswordClear');
+const defaultStripExif = document.getElementById('defaultStripExif');
+const defaultVisibility = document.getElementById('defaultVisibility');
+const fileSearch = document.getElementById('fileSearch');
+const folderPath = document.getElementById('folderPath');
+const identitiesSection = document.getElementById('identitiesSection');
+const identitiesList = document.getElementById('identitiesList');
+
+let currentFolder = '/';
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+function documentLine(doc) {
+    if (!doc) return '';
+    const parts = [doc.title, doc.author].filter(Boolean).map(escapeHTML);
+    if (doc.pages) parts.push(doc.pages + ' стр.');
+    return parts.length ? `<div class="file-doc">${parts.join(' · ')}</div>` : '';
+}
+
+function bandwidthLine(item) {
+    if (!item.bandwidth_cap) return '';
+    const mb = (bytes) => (bytes / 1048576).toFixed(1);
+    return `<div class="file-doc">Трафик за месяц: ${mb(item.bandwidth_used || 0)} / ${mb(item.bandwidth_cap)} МБ</div>`;
+}
+
+async function setBandwidthCap(id, current) {
+    const value = prompt('Лимит трафика в месяц, МБ (0 — без лимита):', current ? String(current / 1048576) : '');
+    if (value === null) return;
+    const megabytes = Number(value.replace(',', '.'));
+    if (!Number.isFinite(megabytes) || megabytes < 0) {
+        showToast('Неверное значение');
+        return;
+    }
+
+    try {
+        const response = await fetch('/api/dashboard/files/bandwidth', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ id, cap: Math.round(megabytes * 1048576) })
+        });
+        if (response.ok) {
+            loadFiles();
+            showToast(megabytes ? 'Лимит установлен' : 'Лимит снят');
+        } else {
+            showToast('Ошибка сохранения');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function toggleDisabled(id, disabled) {
+    try {
+        const response = await fetch('/api/dashboard/files/disable', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ id, disabled })
+        });
+        if (response.ok) {
+            loadFiles();
+            showToast(disabled ? 'Ссылка отключена' : 'Ссылка включена');
+        } else {
+            showToast('Ошибка сохранения');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+const visibilityNames = { public: 'Публичный', unlisted: 'Не в списках', private: 'Приватный' };
+const nextVisibility = { public: 'unlisted', unlisted: 'private', private: 'public' };
+
+async function setVisibility(id, visibility) {
+    try {
+        const response = await fetch('/api/dashboard/files/visibility', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ id, visibility })
+        });
+        const data = await response.json();
+        if (response.ok) {
+            loadFiles();
+            showToast('Доступ: ' + visibilityNames[data.visibility]);
+        } else {
+            showToast(data.error || 'Ошибка сохранения');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function transferFile(id) {
+    const to = prompt('Имя пользователя, которому передать файл (оставьте пустым, чтобы получить ссылку):', '');
+    if (to === null) return;
+
+    try {
+        const response = await fetch('/api/dashboard/files/transfer', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ id, to: to.trim() })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка передачи');
+            return;
+        }
+        if (data.claim_link) {
+            copyToClipboard(data.claim_link);
+            showToast('Ссылка для передачи скопирована');
+        } else {
+            loadFiles();
+            showToast('Файл передан ' + data.owner);
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+// claimFromLink accepts a file or album handed over with a
+// /dashboard#claim=… link.
+async function claimFromLink() {
+    const match = location.hash.match(/^#claim=([\w-]+)$/);
+    if (!match) return;
+    history.replaceState(null, '', location.pathname);
+    if (!confirm('Принять файл или альбом в свой аккаунт?')) return;
+
+    try {
+        const response = await fetch('/api/transfers/claim', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ token: match[1] })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка принятия');
+            return;
+        }
+        loadFiles();
+        if (data.album) {
+            showToast('Альбом ' + (data.title || data.album) + ' теперь ваш');
+        } else {
+            showToast('Файл ' + data.filename + ' теперь ваш');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+// loadFiles shows the current folder, or search results across all folders.
+async function loadFiles() {
+    try {
+        const query = fileSearch.value.trim();
+        const url = query
+            ? '/api/dashboard/files?q=' + encodeURIComponent(query)
+            : '/api/folders?path=' + encodeURIComponent(currentFolder);
+        const response = await fetch(url);
+        if (!response.ok) {
+            showToast('Ошибка загрузки списка');
+            return;
+        }
+        const data = await response.json();
+        renderFolderPath(query ? null : data.path);
+        renderFiles(data.files, query ? [] : data.folders);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function openFolder(path) {
+    currentFolder = path;
+    loadFiles();
+}
+
+function renderFolderPath(path) {
+    if (path === null) {
+        folderPath.innerHTML = 'Поиск по всем папкам';
+        return;
+    }
+    const parts = path.split('/').filter(Boolean);
+    let html = `<a onclick="openFolder('/')">Все файлы</a>`;
+    parts.forEach((part, i) => {
+        const target = '/' + parts.slice(0, i + 1).join('/');
+        html += ` / <a onclick="openFolder(decodeURIComponent('${encodeURIComponent(target)}'))">${escapeHTML(part)}</a>`;
+    });
+    if (parts.length > 0) {
+        html += ` · <a onclick="renameFolder()">Переименовать</a> · <a onclick="deleteFolder()">Удалить папку</a>`;
+    }
+    folderPath.innerHTML = html;
+}
+
+async function createFolder() {
+    const name = prompt('Название папки:', '');
+    if (!name || !name.trim()) return;
+    const path = (currentFolder === '/' ? '' : currentFolder) + '/' + name.trim();
+    try {
+        const response = await fetch('/api/folders', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ path })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка создания папки');
+            return;
+        }
+        openFolder(data.path);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function renameFolder() {
+    const to = prompt('Новый путь папки:', currentFolder);
+    if (!to || to.trim() === currentFolder) return;
+    try {
+        const response = await fetch('/api/folders/rename', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ path: currentFolder, to: to.trim() })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка переименования');
+            return;
+        }
+        openFolder(data.path);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function deleteFolder() {
+    if (!confirm('Удалить пустую папку?')) return;
+    try {
+        const response = await fetch('/api/folders?path=' + encodeURIComponent(currentFolder), { method: 'DELETE' });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(response.status === 409 ? 'В папке есть файлы' : (data.error || 'Ошибка удаления'));
+            return;
+        }
+        const parent = currentFolder.substring(0, currentFolder.lastIndexOf('/')) || '/';
+        openFolder(parent);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function moveFile(id) {
+    const folder = prompt('Переместить в папку (например, /фото/2024; / — корень):', currentFolder);
+    if (folder === null) return;
+    try {
+        const response = await fetch('/api/folders/move', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ files: [id], folder: folder.trim() })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка перемещения');
+            return;
+        }
+        loadFiles();
+        showToast('Файл перемещён в ' + data.folder);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+let searchTimer;
+fileSearch.addEventListener('input', () => {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(loadFiles, 300);
+});
+
+function renderFiles(files, folders) {
+    if (files.length === 0 && folders.length === 0) {
+        filesBody.innerHTML = '<tr><td colspan="5" style="text-align: center; color: #555; padding: 40px;">Нет загруженных файлов</td></tr>';
+        return;
+    }
+
+    const folderRows = folders.map((folder) => `
+            <tr class="folder-row" onclick="openFolder(decodeURIComponent('${encodeURIComponent(folder.path)}'))">
+                <td class="file-name">📁 ${escapeHTML(folder.name)}</td>
+                <td></td>
+                <td></td>
+                <td></td>
+                <td></td>
+            </tr>
+        `).join('');
+
+    filesBody.innerHTML = folderRows + files.map((item) => {
+        const date = new Date(item.uploaded_at);
+        const formattedDate = date.toLocaleString('ru-RU', {
+            day: '2-digit',
+            month: '2-digit',
+            year: 'numeric',
+            hour: '2-digit',
+            minute: '2-digit'
+        });
+
+        return `
+            <tr>
+                <td class="file-name">${escapeHTML(item.filename)}${documentLine(item.document)}${bandwidthLine(item)}${item.disabled ? '<div class="file-doc">Ссылка отключена</div>' : ''}${item.visibility && item.visibility !== 'public' ? `<div class="file-doc">${visibilityNames[item.visibility]}</div>` : ''}</td>
+                <td class="file-date">${item.size_text}</td>
+                <td class="file-date">${formattedDate}</td>
+                <td><a href="${item.link}" class="file-link" target="_blank">${item.link}</a></td>
+                <td>
+                    <div class="actions-cell">
+                        <button class="copy-btn-table" onclick="copyToClipboard('${item.link}')" title="Копировать">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <rect x="9" y="9" width="13" height="13" rx="2" ry="2"></rect>
+                                <path d="M5 15H4a2 2 0 0 1-2-2V4a2 2 0 0 1 2-2h9a2 2 0 0 1 2 2v1"></path>
+                            </svg>
+                        </button>
+                        <button class="copy-btn-table" onclick="toggleDisabled('${item.id}', ${!item.disabled})" title="${item.disabled ? 'Включить ссылку' : 'Отключить ссылку'}">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                ${item.disabled ? '<polygon points="6 4 20 12 6 20 6 4"></polygon>' : '<line x1="9" y1="5" x2="9" y2="19"></line><line x1="15" y1="5" x2="15" y2="19"></line>'}
+                            </svg>
+                        </button>
+                        <button class="copy-btn-table" onclick="setVisibility('${item.id}', '${nextVisibility[item.visibility] || 'unlisted'}')" title="Доступ: ${visibilityNames[item.visibility] || visibilityNames.public}">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <rect x="5" y="11" width="14" height="10" rx="2" ry="2"></rect>
+                                <path d="M8 11V7a4 4 0 0 1 8 0v4"></path>
+                            </svg>
+                        </button>
+                        <button class="copy-btn-table" onclick="setBandwidthCap('${item.id}', ${item.bandwidth_cap || 0})" title="Лимит трафика">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M4 18a8 8 0 1 1 16 0"></path>
+                                <line x1="12" y1="18" x2="16" y2="11"></line>
+                            </svg>
+                        </button>
+                        <button class="copy-btn-table" onclick="moveFile('${item.id}')" title="Переместить в папку">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M22 19a2 2 0 0 1-2 2H4a2 2 0 0 1-2-2V5a2 2 0 0 1 2-2h5l2 3h9a2 2 0 0 1 2 2z"></path>
+                            </svg>
+                        </button>
+                        <button class="copy-btn-table" onclick="transferFile('${item.id}')" title="Передать другому пользователю">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <line x1="5" y1="12" x2="19" y2="12"></line>
+                                <polyline points="12 5 19 12 12 19"></polyline>
+                            </svg>
+                        </button>
+                        <button class="delete-btn-table" onclick="deleteFile('${item.deletion_link}')" title="Удалить">
+                            <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                                <polyline points="3 6 5 6 21 6"></polyline>
+                                <path d="M19 6v14a2 2 0 0 1-2 2H7a2 2 0 0 1-2-2V6m3 0V4a2 2 0 0 1 2-2h4a2 2 0 0 1 2 2v2"></path>
+                            </svg>
+                        </button>
+                    </div>
+                </td>
+            </tr>
+        `;
+    }).join('');
+}
+
+async function deleteFile(deletionUrl) {
+    if (!confirm('Удалить файл?')) return;
+
+    try {
+        const response = await fetch(deletionUrl, {
+            method: 'POST'
+        });
+
+        if (response.ok) {
+            loadFiles();
+            showToast('Файл удалён');
+        } else {
+            showToast('Ошибка удаления');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function formatDate(value) {
+    if (!value) return '—';
+    return new Date(value).toLocaleString('ru-RU', {
+        day: '2-digit',
+        month: '2-digit',
+        year: 'numeric',
+        hour: '2-digit',
+        minute: '2-digit'
+    });
+}
+
+async function loadKeys() {
+    try {
+        const response = await fetch('/api/keys');
+        if (!response.ok) {
+            showToast('Ошибка загрузки ключей');
+            return;
+        }
+        const data = await response.json();
+        renderKeys(data.keys);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function renderKeys(keys) {
+    if (keys.length === 0) {
+        keysBody.innerHTML = '<tr><td colspan="5" style="text-align: center; color: #555; padding: 40px;">Нет API-ключей</td></tr>';
+        return;
+    }
+
+    keysBody.innerHTML = keys.map((key) => `
+        <tr>
+            <td class="file-name">${escapeHTML(key.name)}${key.ssh_fingerprint ? `<div class="file-doc">SSH: ${escapeHTML(key.ssh_fingerprint)}</div>` : ''}</td>
+            <td class="file-date"><code>${key.key_id}</code></td>
+            <td class="file-date">${formatDate(key.created_at)}</td>
+            <td class="file-date">${formatDate(key.last_used_at)}</td>
+            <td>
+                <div class="actions-cell">
+                    <button class="copy-btn-table" onclick="setSSHKey('${key.key_id}', ${Boolean(key.ssh_fingerprint)})" title="SSH-ключ для SFTP">
+                        <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                            <circle cx="8" cy="15" r="4"></circle>
+                            <path d="M10.8 12.2 20 3M16 7l3 3M18 5l2 2"></path>
+                        </svg>
+                    </button>
+                    <button class="delete-btn-table" onclick="deleteKey('${key.key_id}')" title="Отозвать">
+                        <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
+                            <polyline points="3 6 5 6 21 6"></polyline>
+                            <path d="M19 6v14a2 2 0 0 1-2 2H7a2 2 0 0 1-2-2V6m3 0V4a2 2 0 0 1 2-2h4a2 2 0 0 1 2 2v2"></path>
+                        </svg>
+                    </button>
+                </div>
+            </td>
+        </tr>
+    `).join('');
+}
+
+async function createKey() {
+    try {
+        const response = await fetch('/api/keys', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ name: keyName.value })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка создания ключа');
+            return;
+        }
+        keyName.value = '';
+        keySecretText.textContent = `${data.key_id}:${data.secret}`;
+        keySecret.hidden = false;
+        loadKeys();
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function deleteKey(keyID) {
+    if (!confirm('Отозвать ключ? Программы, использующие его, перестанут работать.')) return;
+
+    try {
+        const response = await fetch('/api/keys/' + encodeURIComponent(keyID), {
+            method: 'DELETE'
+        });
+
+        if (response.ok) {
+            loadKeys();
+            showToast('Ключ отозван');
+        } else {
+            showToast('Ошибка удаления');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+// setSSHKey attaches a public key for the SFTP server to an API key; an
+// empty answer removes the one attached.
+async function setSSHKey(keyID, attached) {
+    const publicKey = prompt('Публичный SSH-ключ (строка из ~/.ssh/id_ed25519.pub)' + (attached ? '. Оставьте пустым, чтобы отвязать текущий' : ''));
+    if (publicKey === null || (!publicKey.trim() && !attached)) return;
+
+    try {
+        const response = await fetch('/api/keys/' + encodeURIComponent(keyID) + '/ssh', {
+            method: publicKey.trim() ? 'PUT' : 'DELETE',
+            headers: { 'Content-Type': 'application/json' },
+            body: publicKey.trim() ? JSON.stringify({ public_key: publicKey }) : undefined
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка');
+            return;
+        }
+        loadKeys();
+        showToast(publicKey.trim() ? 'SSH-ключ привязан' : 'SSH-ключ отвязан');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function showDefaults(data) {
+    defaultExpires.value = data.expires || '';
+    defaultPassword.value = '';
+    defaultPassword.placeholder = data.password_set ? 'Пароль задан, введите новый' : 'Пароль для новых файлов';
+    defaultPasswordClear.checked = false;
+    defaultStripExif.checked = !!data.strip_exif;
+    defaultVisibility.value = data.visibility || 'public';
+}
+
+async function loadDefaults() {
+    try {
+        const response = await fetch('/api/account/defaults');
+        if (response.ok) showDefaults(await response.json());
+    } catch (error) {
+        console.error('Failed to load upload defaults:', error);
+    }
+}
+
+async function saveDefaults() {
+    try {
+        const response = await fetch('/api/account/defaults', {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                expires: defaultExpires.value,
+                password: defaultPassword.value,
+                clear_password: defaultPasswordClear.checked,
+                strip_exif: defaultStripExif.checked,
+                visibility: defaultVisibility.value
+            })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка сохранения');
+            return;
+        }
+        showDefaults(data);
+        showToast('Сохранено');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function loadIdentities() {
+    try {
+        const response = await fetch('/api/account/identities');
+        if (!response.ok) return;
+        const data = await response.json();
+        if (data.providers.length === 0) return;
+
+        identitiesSection.hidden = false;
+        identitiesList.innerHTML = data.providers.map((p) => {
+            const linked = data.identities.find((id) => id.provider === p.name);
+            if (!linked) {
+                return `<a class="keys-btn" href="/auth/${encodeURIComponent(p.name)}?link=1">Привязать ${escapeHTML(p.label)}</a>`;
+            }
+            const email = linked.email ? ` (${escapeHTML(linked.email)})` : '';
+            return `<button class="keys-btn" onclick="unlinkIdentity('${escapeHTML(p.name)}')">Отвязать ${escapeHTML(p.label)}${email}</button>`;
+        }).join('');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function unlinkIdentity(provider) {
+    if (!confirm('Отвязать ' + provider + '?')) return;
+    try {
+        const response = await fetch('/api/account/identities?provider=' + encodeURIComponent(provider), { method: 'DELETE' });
+        if (response.ok) {
+            showToast('Отвязано');
+            loadIdentities();
+        } else if (response.status === 409) {
+            showToast('Это единственный способ входа');
+        } else {
+            showToast('Ошибка');
+        }
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+async function redeemCoupon() {
+    const code = couponCode.value.trim();
+    if (!code) return;
+
+    try {
+        const response = await fetch('/api/coupons/redeem', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ code })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка активации');
+            return;
+        }
+        couponCode.value = '';
+        showToast('Промокод активирован до ' + formatDate(data.until));
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+// claimUploads moves anonymous uploads, given by their deletion links, into
+// this account.
+async function claimUploads(tokens) {
+    if (tokens.length === 0) {
+        showToast('Нечего привязывать');
+        return;
+    }
+
+    try {
+        const response = await fetch('/api/dashboard/claim', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ tokens })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка привязки');
+            return;
+        }
+        claimLink.value = '';
+        loadFiles();
+        showToast('Привязано файлов: ' + data.claimed);
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+function claimFromHistory() {
+    const history = JSON.parse(localStorage.getItem('uploadHistory') || '[]');
+    claimUploads(history.map((item) => item.deletionUrl).filter(Boolean));
+}
+
+function copyToClipboard(text) {
+    navigator.clipboard.writeText(text).then(() => {
+        showToast('Скопировано');
+    });
+}
+
+function showToast(message) {
+    const toastSpan = toast.querySelector('span');
+    toastSpan.textContent = message;
+    toast.classList.add('show');
+
+    setTimeout(() => {
+        toast.classList.remove('show');
+    }, 2000);
+}
+
+document.getElementById('createKeyBtn').addEventListener('click', createKey);
+document.getElementById('newFolderBtn').addEventListener('click', createFolder);
+document.getElementById('redeemCouponBtn').addEventListener('click', redeemCoupon);
+document.getElementById('saveDefaultsBtn').addEventListener('click', saveDefaults);
+document.getElementById('claimLinkBtn').addEventListener('click', () => claimUploads([claimLink.value.trim()].filter(Boolean)));
+document.getElementById('claimHistoryBtn').addEventListener('click', claimFromHistory);
+keySecretText.addEventListener('click', () => copyToClipboard(keySecretText.textContent));
+
+loadFiles();
+loadKeys();
+loadDefaults();
+loadIdentities();
+claimFromLink();
@@ -0,0 +1,40 @@
+// End-to-end encryption for uploads. The file is sealed with AES-256-GCM in
+// the browser; the key goes into the fragment of the share link and never
+// reaches the server. Layout: 12-byte IV, then the ciphertext of a 4-byte
+// big-endian header length, a JSON header {name, type} and the content.
+
+function bytesToBase64url(bytes) {
+    let binary = '';
+    for (const byte of bytes) binary += String.fromCharCode(byte);
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function base64urlToBytes(text) {
+    const binary = atob(text.replace(/-/g, '+').replace(/_/g, '/'));
+    return Uint8Array.from(binary, (c) => c.charCodeAt(0));
+}
+
+// e2eEncrypt returns the sealed blob and the key to put in the link.
+async function e2eEncrypt(file) {
+    const key = await crypto.subtle.generateKey({ name: 'AES-GCM', length: 256 }, true, ['encrypt']);
+    const iv = crypto.getRandomValues(new Uint8Array(12));
+    const header = new TextEncoder().encode(JSON.stringify({ name: file.name, type: file.type }));
+    const length = new Uint8Array(4);
+    new DataView(length.buffer).setUint32(0, header.length);
+
+    const plain = await new Blob([length, header, file]).arrayBuffer();
+    const sealed = await crypto.subtle.encrypt({ name: 'AES-GCM', iv }, key, plain);
+    const raw = new Uint8Array(await crypto.subtle.exportKey('raw', key));
+    return { blob: new Blob([iv, sealed]), key: bytesToBase64url(raw) };
+}
+
+// e2eDecrypt opens a sealed buffer and returns {name, type, data}.
+async function e2eDecrypt(buffer, keyText) {
+    const key = await crypto.subtle.importKey('raw', base64urlToBytes(keyText), 'AES-GCM', false, ['decrypt']);
+    const bytes = new Uint8Array(buffer);
+    const plain = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: bytes.slice(0, 12) }, key, bytes.slice(12));
+    const view = new DataView(plain);
+    const headerLength = view.getUint32(0);
+    const header = JSON.parse(new TextDecoder().decode(new Uint8Array(plain, 4, headerLength)));
+    return { name: header.name, type: header.type || 'application/octet-stream', data: plain.slice(4 + headerLength) };
+}
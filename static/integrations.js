@@ -16,29 +16,59 @@ function showToast(message) {
     }, 2000);
 }
 
-document.getElementById('downloadShareX').addEventListener('click', () => {
-    const config = {
-        "Version": "14.1.0",
-        "Name": "XyliUploader",
-        "DestinationType": "ImageUploader",
-        "RequestMethod": "POST",
-        "RequestURL": "https://img.xyli.eu/upload",
-        "Body": "MultipartFormData",
-        "FileFormName": "file",
-        "URL": "{json:link}",
-        "DeletionURL": "{json:deletion_link}",
-        "ErrorMessage": "{json:error}"
-    };
-
-    const blob = new Blob([JSON.stringify(config, null, 2)], { type: 'application/json' });
-    const url = URL.createObjectURL(blob);
-    const a = document.createElement('a');
-    a.href = url;
-    a.download = 'XyliUploader.sxcu';
-    document.body.appendChild(a);
-    a.click();
-    document.body.removeChild(a);
-    URL.revokeObjectURL(url);
-
-    showToast('Скачано');
+const integrationKey = document.getElementById('integrationKey');
+
+async function loadKeys() {
+    try {
+        const response = await fetch('/api/keys');
+        if (!response.ok) {
+            document.getElementById('integrationHint').hidden = false;
+            return;
+        }
+        const data = await response.json();
+        for (const key of data.keys) {
+            const option = document.createElement('option');
+            option.value = key.key_id;
+            option.textContent = key.name + ' (' + key.key_id + ')';
+            integrationKey.appendChild(option);
+        }
+    } catch (error) {
+        console.error('Failed to load API keys:', error);
+    }
+}
+
+// downloadConfig fetches a config generated for this user and saves it under
+// the name the server suggests.
+async function downloadConfig(name) {
+    try {
+        const response = await fetch('/api/integrations/' + name, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ key_id: integrationKey.value })
+        });
+        if (!response.ok) {
+            const data = await response.json();
+            showToast(data.error || 'Ошибка');
+            return;
+        }
+        const disposition = response.headers.get('Content-Disposition') || '';
+        const match = disposition.match(/filename="([^"]+)"/);
+        const url = URL.createObjectURL(await response.blob());
+        const a = document.createElement('a');
+        a.href = url;
+        a.download = match ? match[1] : name;
+        document.body.appendChild(a);
+        a.click();
+        document.body.removeChild(a);
+        URL.revokeObjectURL(url);
+        showToast('Скачано');
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    }
+}
+
+document.querySelectorAll('[data-integration]').forEach((button) => {
+    button.addEventListener('click', () => downloadConfig(button.dataset.integration));
 });
+
+loadKeys();
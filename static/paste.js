@@ -0,0 +1,122 @@
+const pasteForm = document.getElementById('pasteForm');
+const pasteContent = document.getElementById('pasteContent');
+const pasteFilename = document.getElementById('pasteFilename');
+const pasteLanguage = document.getElementById('pasteLanguage');
+const pasteBtn = document.getElementById('pasteBtn');
+const expirySelect = document.getElementById('expirySelect');
+const pastePassword = document.getElementById('pastePassword');
+const captchaWidget = document.getElementById('captchaWidget');
+const toast = document.getElementById('toast');
+
+// loadInstanceConfig keeps the lifetimes in line with the paste limits.
+async function loadInstanceConfig() {
+    try {
+        const response = await fetch('/api/config');
+        if (!response.ok) return;
+        const data = await response.json();
+
+        for (const option of [...expirySelect.options]) {
+            const allowed = option.value === ''
+                ? !data.expiry.paste.max
+                : data.expiry.options.includes(option.value);
+            if (!allowed) option.remove();
+        }
+        const preferred = data.expiry.paste.default;
+        if (preferred && [...expirySelect.options].some((o) => o.value === preferred)) {
+            expirySelect.value = preferred;
+        }
+    } catch (error) {
+        // Keep the built-in defaults.
+    }
+}
+
+loadInstanceConfig();
+
+// captchaToken is the answer of the captcha widget, shown to anonymous
+// visitors when the instance requires one.
+function captchaToken() {
+    if (!captchaWidget) return '';
+    const field = captchaWidget.querySelector('[name="h-captcha-response"], [name="cf-turnstile-response"]');
+    return field ? field.value : '';
+}
+
+// resetCaptcha asks for a new answer; each one is good for a single paste.
+function resetCaptcha() {
+    if (!captchaWidget) return;
+    if (window.hcaptcha) window.hcaptcha.reset();
+    if (window.turnstile) window.turnstile.reset();
+}
+
+// Tab inserts a tab instead of leaving the field.
+pasteContent.addEventListener('keydown', (e) => {
+    if (e.key !== 'Tab' || e.shiftKey) return;
+    e.preventDefault();
+    pasteContent.setRangeText('\t', pasteContent.selectionStart, pasteContent.selectionEnd, 'end');
+});
+
+pasteForm.addEventListener('submit', async (e) => {
+    e.preventDefault();
+    if (!pasteContent.value.trim()) {
+        showToast('Вставьте текст');
+        return;
+    }
+    if (captchaWidget && !captchaToken()) {
+        showToast('Пройдите проверку на робота');
+        return;
+    }
+
+    pasteBtn.disabled = true;
+    pasteBtn.textContent = 'Сохранение...';
+
+    const body = JSON.stringify({
+        content: pasteContent.value,
+        language: pasteLanguage.value,
+        filename: pasteFilename.value,
+        expires: expirySelect.value,
+        password: pastePassword.value,
+    });
+    const headers = { 'Content-Type': 'application/json' };
+    if (captchaWidget) {
+        headers['X-Captcha-Token'] = captchaToken();
+    }
+
+    try {
+        let response = await fetch('/paste', { method: 'POST', headers, body });
+
+        if (response.status === 429) {
+            const data = await response.json();
+            if (data.challenge) {
+                pasteBtn.textContent = 'Проверка...';
+                const solution = await solveChallenge(data.challenge, data.difficulty);
+                response = await fetch('/paste', {
+                    method: 'POST',
+                    headers: { ...headers, 'X-Xyli-Challenge': data.challenge, 'X-Xyli-Solution': solution },
+                    body,
+                });
+            }
+        }
+
+        const data = await response.json();
+        if (!response.ok) {
+            showToast(data.error || 'Ошибка сохранения');
+            return;
+        }
+
+        const history = JSON.parse(localStorage.getItem('uploadHistory') || '[]');
+        history.unshift({ filename: data.filename, url: data.link, deletionUrl: data.deletion_link, date: new Date().toISOString() });
+        localStorage.setItem('uploadHistory', JSON.stringify(history.slice(0, 50)));
+        window.location.href = data.link;
+    } catch (error) {
+        showToast('Ошибка: ' + error.message);
+    } finally {
+        resetCaptcha();
+        pasteBtn.disabled = false;
+        pasteBtn.textContent = 'Сохранить';
+    }
+});
+
+function showToast(message) {
+    toast.querySelector('span').textContent = message;
+    toast.classList.add('show');
+    setTimeout(() => toast.classList.remove('show'), 2000);
+}
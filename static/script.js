@@ -1,10 +1,41 @@
 const dropZone = document.getElementById('dropZone');
 const fileInput = document.getElementById('fileInput');
 const uploadBtn = document.getElementById('uploadBtn');
+const expirySelect = document.getElementById('expirySelect');
+const maxDownloadsSelect = document.getElementById('maxDownloadsSelect');
+const filePassword = document.getElementById('filePassword');
+const e2eToggle = document.getElementById('e2eToggle');
+const stripExifToggle = document.getElementById('stripExifToggle');
+const captchaWidget = document.getElementById('captchaWidget');
 const historyBody = document.getElementById('historyBody');
 const toast = document.getElementById('toast');
 
 let selectedFile = null;
+let maxUploadSize = 100 * 1024 * 1024;
+
+// loadInstanceConfig adapts the form to the server's limits.
+async function loadInstanceConfig() {
+    try {
+        const response = await fetch('/api/config');
+        if (!response.ok) return;
+        const data = await response.json();
+
+        maxUploadSize = data.max_size;
+        for (const option of [...expirySelect.options]) {
+            const allowed = option.value === ''
+                ? data.expiry.allow_never
+                : data.expiry.options.includes(option.value);
+            if (!allowed) option.remove();
+        }
+        if (data.expiry.default && [...expirySelect.options].some((o) => o.value === data.expiry.default)) {
+            expirySelect.value = data.expiry.default;
+        }
+    } catch (error) {
+        // Keep the built-in defaults.
+    }
+}
+
+loadInstanceConfig();
 
 dropZone.addEventListener('click', () => fileInput.click());
 
@@ -35,6 +66,21 @@ fileInput.addEventListener('change', (e) => {
     }
 });
 
+// captchaToken is the answer of the captcha widget, shown to anonymous
+// visitors when the instance requires one.
+function captchaToken() {
+    if (!captchaWidget) return '';
+    const field = captchaWidget.querySelector('[name="h-captcha-response"], [name="cf-turnstile-response"]');
+    return field ? field.value : '';
+}
+
+// resetCaptcha asks for a new answer; each one is good for a single upload.
+function resetCaptcha() {
+    if (!captchaWidget) return;
+    if (window.hcaptcha) window.hcaptcha.reset();
+    if (window.turnstile) window.turnstile.reset();
+}
+
 function updateDropZoneText() {
     const dropText = dropZone.querySelector('.drop-text');
     if (selectedFile) {
@@ -48,30 +94,80 @@ uploadBtn.addEventListener('click', async () => {
         return;
     }
 
-    if (selectedFile.size > 100 * 1024 * 1024) {
+    if (selectedFile.size > maxUploadSize) {
         showToast('Файл слишком большой');
         return;
     }
 
+    if (captchaWidget && !captchaToken()) {
+        showToast('Пройдите проверку на робота');
+        return;
+    }
+
     uploadBtn.disabled = true;
     uploadBtn.textContent = 'Загрузка...';
 
-    const formData = new FormData();
-    formData.append('file', selectedFile);
-
     try {
-        const response = await fetch('/upload', {
+        // With end-to-end encryption the server only sees the sealed blob, and
+        // the key is added to the link as its fragment.
+        const formData = new FormData();
+        let linkKey = '';
+        if (e2eToggle.checked) {
+            uploadBtn.textContent = 'Шифрование...';
+            const sealed = await e2eEncrypt(selectedFile);
+            formData.append('file', sealed.blob, 'encrypted.bin');
+            formData.append('e2e', 'true');
+            linkKey = '#' + sealed.key;
+            uploadBtn.textContent = 'Загрузка...';
+        } else {
+            formData.append('file', selectedFile);
+        }
+        if (expirySelect.value) {
+            formData.append('expires', expirySelect.value);
+        }
+        if (maxDownloadsSelect.value) {
+            formData.append('max_downloads', maxDownloadsSelect.value);
+        }
+        if (filePassword.value) {
+            formData.append('password', filePassword.value);
+        }
+        if (stripExifToggle.checked) {
+            formData.append('strip_exif', 'true');
+        }
+        if (captchaWidget) {
+            formData.append('captcha_token', captchaToken());
+        }
+
+        let response = await fetch('/upload', {
             method: 'POST',
             body: formData
         });
 
+        if (response.status === 429) {
+            const data = await response.json();
+            if (data.challenge) {
+                uploadBtn.textContent = 'Проверка...';
+                const solution = await solveChallenge(data.challenge, data.difficulty);
+                uploadBtn.textContent = 'Загрузка...';
+                response = await fetch('/upload', {
+                    method: 'POST',
+                    headers: {
+                        'X-Xyli-Challenge': data.challenge,
+                        'X-Xyli-Solution': solution
+                    },
+                    body: formData
+                });
+            }
+        }
+
         if (response.ok) {
             const data = await response.json();
-            saveToHistory(selectedFile.name, data.link, data.deletion_link);
+            saveToHistory(selectedFile.name, data.link + linkKey, data.deletion_link);
             loadHistory();
 
             selectedFile = null;
             fileInput.value = '';
+            filePassword.value = '';
             const dropText = dropZone.querySelector('.drop-text');
             dropText.textContent = 'Перетащите или выберите файл';
 
@@ -82,6 +178,7 @@ uploadBtn.addEventListener('click', async () => {
     } catch (error) {
         showToast('Ошибка: ' + error.message);
     } finally {
+        resetCaptcha();
         uploadBtn.disabled = false;
         uploadBtn.textContent = 'Upload';
     }
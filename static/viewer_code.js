@@ -0,0 +1,171 @@
+const code = document.getElementById('code');
+const maxPreviewBytes = 1024 * 1024;
+const tailInterval = 2000;
+
+// Files uploaded in append mode are still growing: keep asking /raw/ for the
+// bytes after the ones already shown and add them to the page.
+const growing = 'growing' in code.dataset;
+const isLog = growing || /\.log$/i.test(document.title);
+const decoder = new TextDecoder('utf-8');
+let offset = 0;
+let pending = '';
+let pendingLine = null;
+let shown = 0;
+
+const logLevels = [
+    [/\b(FATAL|PANIC|CRIT(ICAL)?|ERR(OR)?|FAIL(ED|URE)?)\b/i, 'log-error'],
+    [/\bWARN(ING)?\b/i, 'log-warn'],
+    [/\bINFO\b/i, 'log-info'],
+    [/\b(DEBUG|TRACE)\b/i, 'log-debug'],
+];
+const logTimestamp = /^\[?\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?\]?|^\[?\d{2}:\d{2}:\d{2}(\.\d+)?\]?/;
+
+function logLine(text) {
+    const line = document.createElement('span');
+    line.className = 'log-line';
+    for (const [pattern, className] of logLevels) {
+        if (pattern.test(text)) {
+            line.classList.add(className);
+            break;
+        }
+    }
+    const stamp = text.match(logTimestamp);
+    if (stamp) {
+        const time = document.createElement('span');
+        time.className = 'log-time';
+        time.textContent = stamp[0];
+        line.appendChild(time);
+        text = text.slice(stamp[0].length);
+    }
+    line.appendChild(document.createTextNode(text));
+    return line;
+}
+
+function appendLog(text) {
+    const lines = (pending + text).split('\n');
+    pending = lines.pop();
+    if (pendingLine) {
+        pendingLine.remove();
+        pendingLine = null;
+    }
+    for (const line of lines) {
+        code.appendChild(logLine(line + '\n'));
+    }
+    if (pending) {
+        pendingLine = code.appendChild(logLine(pending));
+    }
+
+    // While following, keep only the end of the log on the page.
+    shown += text.length;
+    while (shown > maxPreviewBytes && code.firstChild && code.firstChild !== pendingLine) {
+        shown -= code.firstChild.textContent.length;
+        code.firstChild.remove();
+    }
+}
+
+function addNote(text, above) {
+    const note = document.createElement('div');
+    note.className = 'code-note tail-note';
+    note.textContent = text;
+    if (above) {
+        code.before(note);
+    } else {
+        code.after(note);
+    }
+    return note;
+}
+
+function atBottom() {
+    return window.innerHeight + window.scrollY >= document.body.scrollHeight - 40;
+}
+
+async function follow(note) {
+    const stick = atBottom();
+    try {
+        const response = await fetch(code.dataset.src, {
+            headers: { Range: `bytes=${offset}-` },
+            cache: 'no-store',
+        });
+        if (response.status === 206 || response.status === 200) {
+            const data = await response.arrayBuffer();
+            if (response.status === 200) {
+                // The range was ignored; start over from the whole file.
+                code.textContent = '';
+                pending = '';
+                pendingLine = null;
+                shown = 0;
+                offset = 0;
+            }
+            offset += data.byteLength;
+            appendLog(decoder.decode(data, { stream: true }));
+        } else if (response.status !== 416) {
+            note.textContent = 'Не удалось получить продолжение файла, повтор…';
+        }
+        if (response.ok || response.status === 416) {
+            if (!response.headers.has('X-Xyli-Growing')) {
+                appendLog(decoder.decode());
+                note.textContent = 'Загрузка завершена';
+                return;
+            }
+            note.textContent = 'Файл ещё загружается, новые строки появятся автоматически';
+        }
+    } catch (error) {
+        note.textContent = 'Нет связи с сервером, повтор…';
+    }
+    if (stick) {
+        window.scrollTo(0, document.body.scrollHeight);
+    }
+    setTimeout(() => follow(note), tailInterval);
+}
+
+async function loadCode() {
+    try {
+        const response = await fetch(code.dataset.src, growing ? { cache: 'no-store' } : {});
+        if (!response.ok) {
+            code.textContent = 'Не удалось загрузить файл';
+            return;
+        }
+        const data = await response.arrayBuffer();
+        offset = data.byteLength;
+        let text = decoder.decode(data, { stream: growing });
+        const truncated = text.length > maxPreviewBytes;
+
+        if (isLog) {
+            if (truncated) {
+                text = text.slice(text.length - maxPreviewBytes);
+                text = text.slice(text.indexOf('\n') + 1);
+                addNote('… показан только конец файла, скачайте его целиком', true);
+            }
+            code.textContent = '';
+            appendLog(text);
+            if (growing) {
+                setTimeout(() => follow(addNote('Файл ещё загружается, новые строки появятся автоматически')), tailInterval);
+            }
+            return;
+        }
+
+        if (truncated) {
+            text = text.slice(0, maxPreviewBytes);
+        }
+
+        if (/\.json$/i.test(document.title) || response.headers.get('Content-Type')?.includes('json')) {
+            try {
+                text = JSON.stringify(JSON.parse(text), null, 2);
+            } catch (e) {
+                // Not valid JSON, show it as is.
+            }
+        }
+
+        code.textContent = text;
+        if (truncated) {
+            const note = document.createElement('div');
+            note.className = 'code-note';
+            note.textContent = '\n… файл обрезан, скачайте его целиком';
+            code.appendChild(note);
+        }
+    } catch (error) {
+        code.textContent = 'Ошибка: ' + error.message;
+    }
+}
+
+loadCode();
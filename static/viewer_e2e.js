@@ -0,0 +1,66 @@
+const card = document.getElementById('e2eCard');
+const preview = document.getElementById('e2ePreview');
+const nameLabel = document.getElementById('e2eName');
+const statusLabel = document.getElementById('e2eStatus');
+const downloadLink = document.getElementById('e2eDownload');
+
+const maxTextPreview = 1024 * 1024;
+
+function setStatus(text, error) {
+    statusLabel.textContent = text;
+    statusLabel.classList.toggle('error', Boolean(error));
+}
+
+// showPreview puts the decrypted file on the page when the browser can show it.
+function showPreview(file, url) {
+    let element;
+    if (file.type.startsWith('image/') && file.type !== 'image/svg+xml') {
+        element = document.createElement('img');
+    } else if (file.type.startsWith('video/')) {
+        element = document.createElement('video');
+        element.controls = true;
+    } else if (file.type.startsWith('audio/')) {
+        element = document.createElement('audio');
+        element.controls = true;
+    } else if ((file.type.startsWith('text/') || file.type === 'application/json') && file.data.byteLength <= maxTextPreview) {
+        element = document.createElement('pre');
+        element.textContent = new TextDecoder().decode(file.data);
+    } else {
+        return;
+    }
+    if (element.tagName !== 'PRE') {
+        element.src = url;
+    }
+    preview.replaceChildren(element);
+}
+
+async function decryptFile() {
+    const key = location.hash.slice(1);
+    if (!key) {
+        setStatus('В ссылке нет ключа, файл не расшифровать', true);
+        return;
+    }
+
+    setStatus('Расшифровка...');
+    try {
+        const response = await fetch(card.dataset.src);
+        if (!response.ok) {
+            setStatus('Ошибка загрузки', true);
+            return;
+        }
+        const file = await e2eDecrypt(await response.arrayBuffer(), key);
+        const url = URL.createObjectURL(new Blob([file.data], { type: file.type }));
+
+        document.title = file.name;
+        nameLabel.textContent = file.name;
+        downloadLink.href = url;
+        downloadLink.download = file.name;
+        downloadLink.hidden = false;
+        showPreview(file, url);
+        setStatus('');
+    } catch (error) {
+        setStatus('Не удалось расшифровать файл: неверный ключ или файл повреждён', true);
+    }
+}
+
+decryptFile();
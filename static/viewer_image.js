@@ -37,6 +37,10 @@ container.addEventListener('click', function(e) {
     if (hasMoved) return;
 
     if (!isZoomed) {
+        if (img.dataset.full) {
+            img.src = img.dataset.full;
+            delete img.dataset.full;
+        }
         img.style.maxWidth = 'none';
         img.style.maxHeight = 'none';
         container.classList.add('zoomed');
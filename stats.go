@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usage statistics start as raw events (one per upload, view or download)
+// that are batched into stat_events and expire after a retention period.
+// An hourly job rolls them up into one document per day in stats_daily,
+// per-file daily counters in stats_daily_files and per-month totals in
+// stats_monthly, so reports never have to scan raw events.
+
+const (
+	statUpload   = "upload"
+	statView     = "view"
+	statDownload = "download"
+
+	statsDayFormat   = "2006-01-02"
+	statsMonthFormat = "2006-01"
+)
+
+type statEvent struct {
+	Type    string             `bson:"type"`
+	ShortID string             `bson:"short_id,omitempty"`
+	OwnerID primitive.ObjectID `bson:"owner_id,omitempty"`
+	KeyID   string             `bson:"key_id,omitempty"`
+	Bytes   int64              `bson:"bytes"`
+	At      time.Time          `bson:"at"`
+	// Partial marks a ranged download that does not start at the beginning,
+	// such as a player seeking; it is not counted as a download of the file.
+	Partial bool `bson:"partial,omitempty"`
+}
+
+// statTotals is the shape shared by daily and monthly roll-ups.
+type statTotals struct {
+	Period        string    `bson:"_id" json:"period"`
+	Uploads       int64     `bson:"uploads" json:"uploads"`
+	UploadBytes   int64     `bson:"upload_bytes" json:"upload_bytes"`
+	Views         int64     `bson:"views" json:"views"`
+	Downloads     int64     `bson:"downloads" json:"downloads"`
+	DownloadBytes int64     `bson:"download_bytes" json:"download_bytes"`
+	UpdatedAt     time.Time `bson:"updated_at" json:"-"`
+
+	UploadText   string `bson:"-" json:"upload_size_text"`
+	DownloadText string `bson:"-" json:"download_size_text"`
+}
+
+var (
+	statEventsColl  *mongo.Collection
+	statsDailyColl  *mongo.Collection
+	statsFilesColl  *mongo.Collection
+	statsMonthlyCol *mongo.Collection
+
+	statQueue = make(chan statEvent, 10000)
+	statsStop = make(chan struct{})
+	statsDone = make(chan struct{})
+)
+
+func initStats(ctx context.Context) {
+	cfg := &config().Stats
+	if cfg.RawRetentionDays <= 0 {
+		cfg.RawRetentionDays = 30
+	}
+	if cfg.FileRetentionDays <= 0 {
+		cfg.FileRetentionDays = 400
+	}
+
+	statEventsColl = db.Collection("stat_events")
+	statsDailyColl = db.Collection("stats_daily")
+	statsFilesColl = db.Collection("stats_daily_files")
+	statsMonthlyCol = db.Collection("stats_monthly")
+
+	_, err := statEventsColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(cfg.RawRetentionDays * 24 * 3600)),
+	})
+	if err != nil {
+		log.Printf("Error creating stat_events index: %v", err)
+	}
+	_, err = statsFilesColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "day", Value: 1}, {Key: "short_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "date", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(cfg.FileRetentionDays * 24 * 3600))},
+		{Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "day", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Error creating stats_daily_files indexes: %v", err)
+	}
+}
+
+// recordStat queues an event without blocking the request. Events are
+// dropped when the queue is full or the database is down.
+func recordStat(ev statEvent) {
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	switch ev.Type {
+	case statUpload:
+		uploadsTotal.Add(1)
+		uploadedBytes.Add(ev.Bytes)
+	case statDownload:
+		downloadsTotal.Add(1)
+		downloadedBytes.Add(ev.Bytes)
+	}
+	select {
+	case statQueue <- ev:
+	default:
+	}
+}
+
+// recordUploadStat records a stored upload from its metadata.
+func recordUploadStat(metadata bson.M, size int64) {
+	ev := statEvent{Type: statUpload, Bytes: size}
+	ev.ShortID, _ = metadata["short_id"].(string)
+	ev.OwnerID, _ = metadata["owner_id"].(primitive.ObjectID)
+	ev.KeyID, _ = metadata["api_key_id"].(string)
+	recordStat(ev)
+}
+
+func runStatsWriter() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []interface{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if dbBreaker.Allow() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_, err := statEventsColl.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+			cancel()
+			dbBreaker.Record(err)
+			if err != nil {
+				log.Printf("Error writing %d stat events: %v", len(batch), err)
+			}
+			bumpFileCounters(batch)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case ev := <-statQueue:
+			batch = append(batch, ev)
+			if len(batch) >= 500 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-statsStop:
+			for len(statQueue) > 0 {
+				batch = append(batch, <-statQueue)
+			}
+			flush()
+			close(statsDone)
+			return
+		}
+	}
+}
+
+// bumpFileCounters adds a batch's views and downloads to the counters kept
+// in each file's metadata.
+func bumpFileCounters(batch []interface{}) {
+	type counts struct{ views, downloads int64 }
+	files := map[string]*counts{}
+	for _, item := range batch {
+		ev := item.(statEvent)
+		if ev.ShortID == "" || ev.Partial || (ev.Type != statView && ev.Type != statDownload) {
+			continue
+		}
+		c := files[ev.ShortID]
+		if c == nil {
+			c = &counts{}
+			files[ev.ShortID] = c
+		}
+		if ev.Type == statView {
+			c.views++
+		} else {
+			c.downloads++
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	models := make([]mongo.WriteModel, 0, len(files))
+	for shortID, c := range files {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"metadata.short_id": shortID}).
+			SetUpdate(bson.M{"$inc": bson.M{"metadata.views": c.views, "metadata.downloads": c.downloads}}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := gfsBucket.GetFilesCollection().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	dbBreaker.Record(err)
+	if err != nil {
+		log.Printf("Error updating counters of %d files: %v", len(files), err)
+	}
+}
+
+// handleFileStats serves /stats/{id}: how often a file was viewed and
+// downloaded, with the counts written out in the client's language.
+func handleFileStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shortID := strings.TrimPrefix(r.URL.Path, "/stats/")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var doc fileRecord
+	err := findFileByShortID(ctx, shortID, &doc)
+	if err == errFileNotFound {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// Private files answer exactly like missing ones.
+	if !fileVisible(r, &doc) {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if !requireVisible(w, r, &doc) || !requireUnlocked(w, r, &doc) {
+		return
+	}
+
+	loc := requestLocale(r)
+	w.Header().Set("Content-Type", "application/json")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Vary", "Accept-Language")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        shortID,
+		"views":     doc.Metadata.Views,
+		"downloads": doc.Metadata.Downloads,
+		"text":      loc.fileCounters(doc.Metadata.Views, doc.Metadata.Downloads),
+	})
+}
+
+// stopStats writes out queued events before the process exits.
+func stopStats(ctx context.Context) {
+	close(statsStop)
+	select {
+	case <-statsDone:
+	case <-ctx.Done():
+	}
+}
+
+func runStatsRollup() {
+	time.Sleep(time.Minute)
+	rollupStats()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		rollupStats()
+	}
+}
+
+// rollupStats recomputes every day since the last roll-up (at most as far
+// back as raw events are kept) and the months they fall in. Recomputing is
+// idempotent, so the current day is simply refreshed every run.
+func rollupStats() {
+	if !dbBreaker.Allow() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -config().Stats.RawRetentionDays)
+
+	var last statTotals
+	err := statsDailyColl.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&last)
+	dbBreaker.Record(err)
+	if err == nil {
+		if day, err := time.Parse(statsDayFormat, last.Period); err == nil && day.After(from) {
+			from = day
+		}
+	}
+
+	months := map[string]bool{}
+	for day := from; !day.After(today); day = day.AddDate(0, 0, 1) {
+		if err := rollupDay(ctx, day); err != nil {
+			log.Printf("Error rolling up stats for %s: %v", day.Format(statsDayFormat), err)
+			return
+		}
+		months[day.Format(statsMonthFormat)] = true
+	}
+	for month := range months {
+		if err := rollupMonth(ctx, month); err != nil {
+			log.Printf("Error rolling up stats for %s: %v", month, err)
+		}
+	}
+}
+
+func rollupDay(ctx context.Context, day time.Time) error {
+	match := bson.D{{Key: "$match", Value: bson.M{"at": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}}}}
+
+	cursor, err := statEventsColl.Aggregate(ctx, mongo.Pipeline{
+		match,
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$type",
+			"count": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$bytes"},
+		}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		Type  string `bson:"_id"`
+		Count int64  `bson:"count"`
+		Bytes int64  `bson:"bytes"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	totals := statTotals{Period: day.Format(statsDayFormat), UpdatedAt: time.Now()}
+	for _, g := range groups {
+		switch g.Type {
+		case statUpload:
+			totals.Uploads, totals.UploadBytes = g.Count, g.Bytes
+		case statView:
+			totals.Views = g.Count
+		case statDownload:
+			totals.Downloads, totals.DownloadBytes = g.Count, g.Bytes
+		}
+	}
+	_, err = statsDailyColl.ReplaceOne(ctx, bson.M{"_id": totals.Period}, totals, options.Replace().SetUpsert(true))
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+
+	cursor, err = statEventsColl.Aggregate(ctx, mongo.Pipeline{
+		match,
+		{{Key: "$match", Value: bson.M{"type": bson.M{"$in": bson.A{statView, statDownload}}, "short_id": bson.M{"$exists": true}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            "$short_id",
+			"owner_id":       bson.M{"$first": "$owner_id"},
+			"key_id":         bson.M{"$first": "$key_id"},
+			"views":          bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$type", statView}}, 1, 0}}},
+			"downloads":      bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$type", statDownload}}, 1, 0}}},
+			"download_bytes": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$type", statDownload}}, "$bytes", 0}}},
+		}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var files []struct {
+		ShortID       string              `bson:"_id"`
+		OwnerID       *primitive.ObjectID `bson:"owner_id"`
+		KeyID         string              `bson:"key_id"`
+		Views         int64               `bson:"views"`
+		Downloads     int64               `bson:"downloads"`
+		DownloadBytes int64               `bson:"download_bytes"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(files))
+	for _, f := range files {
+		doc := bson.M{
+			"day":            totals.Period,
+			"date":           day,
+			"short_id":       f.ShortID,
+			"views":          f.Views,
+			"downloads":      f.Downloads,
+			"download_bytes": f.DownloadBytes,
+		}
+		if f.OwnerID != nil {
+			doc["owner_id"] = *f.OwnerID
+		}
+		if f.KeyID != "" {
+			doc["key_id"] = f.KeyID
+		}
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"day": totals.Period, "short_id": f.ShortID}).
+			SetReplacement(doc).
+			SetUpsert(true))
+	}
+	_, err = statsFilesColl.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	dbBreaker.Record(err)
+	return err
+}
+
+func rollupMonth(ctx context.Context, month string) error {
+	cursor, err := statsDailyColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": bson.M{"$regex": "^" + month}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            month,
+			"uploads":        bson.M{"$sum": "$uploads"},
+			"upload_bytes":   bson.M{"$sum": "$upload_bytes"},
+			"views":          bson.M{"$sum": "$views"},
+			"downloads":      bson.M{"$sum": "$downloads"},
+			"download_bytes": bson.M{"$sum": "$download_bytes"},
+		}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var totals []statTotals
+	if err := cursor.All(ctx, &totals); err != nil || len(totals) == 0 {
+		return err
+	}
+	totals[0].UpdatedAt = time.Now()
+	_, err = statsMonthlyCol.ReplaceOne(ctx, bson.M{"_id": month}, totals[0], options.Replace().SetUpsert(true))
+	dbBreaker.Record(err)
+	return err
+}
+
+// handleAdminStats returns daily totals for the last ?days= days (30 by
+// default) and monthly totals for the last year.
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 || days > 366 {
+		days = 30
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	daily := []statTotals{}
+	cursor, err := statsDailyColl.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(days)))
+	dbBreaker.Record(err)
+	if err == nil {
+		err = cursor.All(ctx, &daily)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	monthly := []statTotals{}
+	cursor, err = statsMonthlyCol.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(12))
+	dbBreaker.Record(err)
+	if err == nil {
+		err = cursor.All(ctx, &monthly)
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, list := range [][]statTotals{daily, monthly} {
+		for i := range list {
+			list[i].UploadText = formatSize(list[i].UploadBytes)
+			list[i].DownloadText = formatSize(list[i].DownloadBytes)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"daily":   daily,
+		"monthly": monthly,
+	})
+}
+
+// parseStatsRange understands "30d" (the last 30 days including today) and
+// "2024-01-01..2024-03-31". Both ends are inclusive UTC days.
+func parseStatsRange(value string) (from, to time.Time, err error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if value == "" {
+		value = "30d"
+	}
+	if start, end, ok := strings.Cut(value, ".."); ok {
+		if from, err = time.Parse(statsDayFormat, start); err != nil {
+			return
+		}
+		if to, err = time.Parse(statsDayFormat, end); err != nil {
+			return
+		}
+	} else {
+		days, convErr := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if convErr != nil || !strings.HasSuffix(value, "d") || days <= 0 {
+			return from, to, fmt.Errorf("invalid range %q", value)
+		}
+		from, to = today.AddDate(0, 0, 1-days), today
+	}
+	if to.Before(from) || to.Sub(from) > 10*366*24*time.Hour {
+		return from, to, fmt.Errorf("invalid range %q", value)
+	}
+	return from, to, nil
+}
+
+type fileUsage struct {
+	ShortID       string `bson:"_id" json:"short_id"`
+	Filename      string `bson:"-" json:"filename"`
+	Views         int64  `bson:"views" json:"views"`
+	Downloads     int64  `bson:"downloads" json:"downloads"`
+	DownloadBytes int64  `bson:"download_bytes" json:"download_bytes"`
+}
+
+// usageTotals sums daily roll-ups between from and to, per day or per month.
+func usageTotals(ctx context.Context, from, to time.Time, group string) ([]statTotals, error) {
+	var period interface{} = "$_id"
+	if group == "month" {
+		period = bson.M{"$substrBytes": bson.A{"$_id", 0, len(statsMonthFormat)}}
+	}
+	cursor, err := statsDailyColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": bson.M{"$gte": from.Format(statsDayFormat), "$lte": to.Format(statsDayFormat)}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            period,
+			"uploads":        bson.M{"$sum": "$uploads"},
+			"upload_bytes":   bson.M{"$sum": "$upload_bytes"},
+			"views":          bson.M{"$sum": "$views"},
+			"downloads":      bson.M{"$sum": "$downloads"},
+			"download_bytes": bson.M{"$sum": "$download_bytes"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	totals := []statTotals{}
+	err = cursor.All(ctx, &totals)
+	return totals, err
+}
+
+// topFiles ranks files by downloaded bytes between from and to.
+func topFiles(ctx context.Context, from, to time.Time, limit int) ([]fileUsage, error) {
+	cursor, err := statsFilesColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"day": bson.M{"$gte": from.Format(statsDayFormat), "$lte": to.Format(statsDayFormat)}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            "$short_id",
+			"views":          bson.M{"$sum": "$views"},
+			"downloads":      bson.M{"$sum": "$downloads"},
+			"download_bytes": bson.M{"$sum": "$download_bytes"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "download_bytes", Value: -1}, {Key: "views", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	files := []fileUsage{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.ShortID
+	}
+	cursor, err = gfsBucket.GetFilesCollection().Find(ctx,
+		bson.M{"metadata.short_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"filename": 1, "metadata.short_id": 1}))
+	dbBreaker.Record(err)
+	if err != nil {
+		return files, nil
+	}
+	var docs []fileRecord
+	cursor.All(ctx, &docs)
+	names := make(map[string]string, len(docs))
+	for _, d := range docs {
+		names[d.Metadata.ShortID] = d.Filename
+	}
+	for i := range files {
+		files[i].Filename = names[files[i].ShortID]
+	}
+	return files, nil
+}
+
+// handleStatsExport serves usage, bandwidth and top-file numbers for a date
+// range as JSON or, one report at a time, as CSV:
+//
+//	/api/stats/export?range=30d&group=day|month&format=json|csv&report=usage|files&limit=100
+func handleStatsExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	from, to, err := parseStatsRange(q.Get("range"))
+	if err != nil {
+		jsonError(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+	group := q.Get("group")
+	if group != "month" {
+		group = "day"
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	format, report := q.Get("format"), q.Get("report")
+	if format != "csv" {
+		format = "json"
+	}
+	if report != "files" {
+		report = "usage"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var usage []statTotals
+	var files []fileUsage
+	if format == "json" || report == "usage" {
+		if usage, err = usageTotals(ctx, from, to, group); err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if format == "json" || report == "files" {
+		if files, err = topFiles(ctx, from, to, limit); err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	span := from.Format(statsDayFormat) + "-" + to.Format(statsDayFormat)
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"xyli-stats-%s.json\"", span))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":  from.Format(statsDayFormat),
+			"to":    to.Format(statsDayFormat),
+			"group": group,
+			"usage": usage,
+			"files": files,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"xyli-%s-%s.csv\"", report, span))
+	out := csv.NewWriter(w)
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	if report == "files" {
+		out.Write([]string{"short_id", "filename", "views", "downloads", "download_bytes"})
+		for _, f := range files {
+			out.Write([]string{f.ShortID, csvText(f.Filename), itoa(f.Views), itoa(f.Downloads), itoa(f.DownloadBytes)})
+		}
+	} else {
+		out.Write([]string{group, "uploads", "upload_bytes", "views", "downloads", "download_bytes"})
+		for _, t := range usage {
+			out.Write([]string{t.Period, itoa(t.Uploads), itoa(t.UploadBytes), itoa(t.Views), itoa(t.Downloads), itoa(t.DownloadBytes)})
+		}
+	}
+	out.Flush()
+}
+
+// csvText keeps user-supplied text from being evaluated as a formula when
+// the export is opened in a spreadsheet.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
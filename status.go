@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The public status page answers "is it me or the server" without an
+// account: uptime, how full the storage is, whether MongoDB answers, how
+// much background work is queued and any recent incidents. Incidents are
+// opened automatically by the circuit breaker and the SLO evaluator; an
+// operator can add a banner of their own with status.incident.
+
+const (
+	statusCacheTTL = 10 * time.Second
+	maxIncidents   = 20
+)
+
+var startedAt = time.Now()
+
+type incident struct {
+	key        string
+	Message    string     `json:"message"`
+	Since      time.Time  `json:"since"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+var incidents struct {
+	mu   sync.Mutex
+	list []*incident
+}
+
+// openIncident records an incident unless one with the same key is still open.
+func openIncident(key, message string) {
+	incidents.mu.Lock()
+	defer incidents.mu.Unlock()
+
+	for _, inc := range incidents.list {
+		if inc.key == key && inc.ResolvedAt == nil {
+			return
+		}
+	}
+	incidents.list = append(incidents.list, &incident{key: key, Message: message, Since: time.Now()})
+	if len(incidents.list) > maxIncidents {
+		incidents.list = incidents.list[len(incidents.list)-maxIncidents:]
+	}
+}
+
+func resolveIncident(key string) {
+	incidents.mu.Lock()
+	defer incidents.mu.Unlock()
+
+	for _, inc := range incidents.list {
+		if inc.key == key && inc.ResolvedAt == nil {
+			now := time.Now()
+			inc.ResolvedAt = &now
+		}
+	}
+}
+
+// recentIncidents returns open incidents and those resolved within
+// status.incidentHours, newest first.
+func recentIncidents() []incident {
+	incidents.mu.Lock()
+	defer incidents.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Duration(config().Status.IncidentHours) * time.Hour)
+	recent := []incident{}
+	for i := len(incidents.list) - 1; i >= 0; i-- {
+		inc := incidents.list[i]
+		if inc.ResolvedAt == nil || inc.ResolvedAt.After(cutoff) {
+			recent = append(recent, *inc)
+		}
+	}
+	return recent
+}
+
+type statusReport struct {
+	Status        string    `json:"status"`
+	Banner        string    `json:"banner,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	Database      struct {
+		OK        bool  `json:"ok"`
+		Breaker   bool  `json:"breaker_open"`
+		LatencyMs int64 `json:"latency_ms"`
+	} `json:"database"`
+	Storage struct {
+		Backend  string `json:"backend"`
+		Files    int64  `json:"files"`
+		Bytes    int64  `json:"bytes"`
+		Capacity int64  `json:"capacity,omitempty"`
+	} `json:"storage"`
+	Queues struct {
+		Posters int `json:"posters"`
+		Stats   int `json:"stats"`
+		Spool   int `json:"spool"`
+	} `json:"queues"`
+	Incidents []incident `json:"incidents"`
+	CheckedAt time.Time  `json:"checked_at"`
+}
+
+var statusCache struct {
+	mu     sync.Mutex
+	report *statusReport
+}
+
+func initStatus(c *Config) {
+	if c.Status.IncidentHours <= 0 {
+		c.Status.IncidentHours = 24
+	}
+}
+
+// currentStatus builds a status report. The expensive parts (database ping,
+// storage totals) are reused for statusCacheTTL so the public page cannot be
+// used to hammer MongoDB.
+func currentStatus(ctx context.Context) statusReport {
+	statusCache.mu.Lock()
+	defer statusCache.mu.Unlock()
+
+	if statusCache.report == nil || time.Since(statusCache.report.CheckedAt) > statusCacheTTL {
+		// The result is shared, so a client hanging up must not cut it short.
+		statusCache.report = checkStatus(context.WithoutCancel(ctx))
+	}
+
+	report := *statusCache.report
+	report.UptimeSeconds = int64(time.Since(startedAt).Seconds())
+	report.Incidents = recentIncidents()
+	report.Queues.Stats = len(statQueue)
+	report.Queues.Posters = len(posterQueue)
+	report.Banner = config().Status.Incident
+
+	report.Status = "ok"
+	if report.Queues.Spool > 0 || report.Banner != "" {
+		report.Status = "degraded"
+	}
+	for _, inc := range report.Incidents {
+		if inc.ResolvedAt == nil {
+			report.Status = "degraded"
+		}
+	}
+	if !report.Database.OK {
+		report.Status = "down"
+	}
+	return report
+}
+
+func checkStatus(ctx context.Context) *statusReport {
+	report := &statusReport{StartedAt: startedAt, CheckedAt: time.Now()}
+	report.Storage.Backend = config().Storage.Backend
+	if report.Storage.Backend == "" {
+		report.Storage.Backend = "gridfs"
+	}
+	report.Storage.Capacity = config().Status.StorageCapacity
+	report.Queues.Spool = spoolCount()
+
+	report.Database.Breaker = dbBreaker.Open()
+	if !report.Database.Breaker {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		start := time.Now()
+		err := client.Ping(pingCtx, nil)
+		cancel()
+		dbBreaker.Record(err)
+		report.Database.OK = err == nil
+		report.Database.LatencyMs = time.Since(start).Milliseconds()
+	}
+	if !report.Database.OK {
+		return report
+	}
+
+	aggCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	cursor, err := gfsBucket.GetFilesCollection().Aggregate(aggCtx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"files": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$length"},
+		}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return report
+	}
+	var totals []struct {
+		Files int64 `bson:"files"`
+		Bytes int64 `bson:"bytes"`
+	}
+	if cursor.All(aggCtx, &totals) == nil && len(totals) > 0 {
+		report.Storage.Files, report.Storage.Bytes = totals[0].Files, totals[0].Bytes
+	}
+	return report
+}
+
+// spoolCount returns the number of uploads waiting in the spool.
+func spoolCount() int {
+	if !config().Spool.Enabled {
+		return 0
+	}
+	entries, _ := os.ReadDir(config().Spool.Dir)
+	n := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") {
+			n++
+		}
+	}
+	return n
+}
+
+func formatUptime(seconds int64) string {
+	d, h, m := seconds/86400, seconds%86400/3600, seconds%3600/60
+	switch {
+	case d > 0:
+		return fmt.Sprintf("%d д %d ч", d, h)
+	case h > 0:
+		return fmt.Sprintf("%d ч %d мин", h, m)
+	}
+	return fmt.Sprintf("%d мин", m)
+}
+
+// handleStatusAPI serves the status report as JSON.
+func handleStatusAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := currentStatus(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleStatusPage renders the status report as a page. It does not go
+// through guardStorage: it has to work best while MongoDB is down.
+func handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := currentStatus(r.Context())
+	loc := requestLocale(r)
+
+	usedPercent := 0
+	if report.Storage.Capacity > 0 {
+		usedPercent = int(report.Storage.Bytes * 100 / report.Storage.Capacity)
+		if usedPercent > 100 {
+			usedPercent = 100
+		}
+	}
+	data := struct {
+		statusReport
+		Uptime      string
+		Used        string
+		Capacity    string
+		UsedPercent int
+	}{
+		statusReport: report,
+		Uptime:       formatUptime(report.UptimeSeconds),
+		Used:         loc.size(report.Storage.Bytes),
+		Capacity:     loc.size(report.Storage.Capacity),
+		UsedPercent:  usedPercent,
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/status.html"))
+	w.Header().Set("Cache-Control", "no-store")
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
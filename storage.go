@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// Storage keeps file content. The file documents themselves (name, size,
+// metadata) always live in the GridFS files collection, so every lookup
+// works the same regardless of where the bytes are. Each document records
+// the backend that holds its content in metadata.storage.
+type Storage interface {
+	Name() string
+	// Put stores the content and inserts the file document with the given metadata.
+	Put(ctx context.Context, id primitive.ObjectID, filename string, r io.Reader, metadata bson.M) (int64, error)
+	Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error)
+	// Delete removes both the content and the file document.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	Stat(ctx context.Context, id primitive.ObjectID) (*ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Size     int64
+	Modified time.Time
+}
+
+var (
+	store    Storage
+	backends = map[string]Storage{}
+)
+
+func initStorage() error {
+	backends["gridfs"] = &gridFSStorage{}
+
+	switch config().Storage.Backend {
+	case "", "gridfs":
+		store = backends["gridfs"]
+	case "disk":
+		disk, err := newDiskStorage(config().Storage.Disk.Dir)
+		if err != nil {
+			return err
+		}
+		backends[disk.Name()] = disk
+		store = disk
+	case "s3":
+		s3, err := newS3Storage()
+		if err != nil {
+			return err
+		}
+		backends[s3.Name()] = s3
+		store = s3
+	default:
+		return fmt.Errorf("unknown storage backend %q", config().Storage.Backend)
+	}
+	return nil
+}
+
+// storageFor returns the backend holding an existing file. Documents written
+// before the abstraction existed carry no storage field and live in GridFS.
+func storageFor(backend string) (Storage, error) {
+	if backend == "" {
+		backend = "gridfs"
+	}
+	s, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("storage backend %q is not configured", backend)
+	}
+	return s, nil
+}
+
+func openStoredFile(ctx context.Context, f *fileRecord) (io.ReadCloser, error) {
+	s, err := storageFor(f.Metadata.Storage)
+	if err != nil {
+		return nil, err
+	}
+	id := f.ID
+	if !f.Metadata.ContentID.IsZero() {
+		id = f.Metadata.ContentID
+	}
+	rc, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return newCountedStream(rc, f.Metadata.Storage), nil
+}
+
+// skipContent moves a stream from openStoredFile n bytes ahead and returns
+// how far it got. GridFS streams skip over their chunk buffers without
+// copying, files on disk seek, and other backends have the bytes read and
+// thrown away.
+func skipContent(r io.Reader, n int64) (int64, error) {
+	if c, ok := r.(*countedStream); ok {
+		r = c.ReadCloser
+	}
+	switch s := r.(type) {
+	case *gridfs.DownloadStream:
+		return s.Skip(n)
+	case io.Seeker:
+		if _, err := s.Seek(n, io.SeekCurrent); err == nil {
+			return n, nil
+		}
+	}
+	return io.CopyN(io.Discard, r, n)
+}
+
+// deleteStoredFile removes a file together with any objects derived from it,
+// such as thumbnails. Content shared with deduplicated uploads is kept until
+// its last reference is gone.
+func deleteStoredFile(ctx context.Context, f *fileRecord) error {
+	switch {
+	case !f.Metadata.ContentID.IsZero():
+		if err := deleteFileDoc(ctx, f.ID); err != nil {
+			return err
+		}
+		if err := releaseContent(ctx, f.Metadata.ContentID); err != nil {
+			log.Printf("Error releasing content %s: %v", f.Metadata.ContentID.Hex(), err)
+		}
+	default:
+		retired, err := retireSharedContent(ctx, f.ID)
+		if err != nil {
+			return err
+		}
+		if !retired {
+			s, err := storageFor(f.Metadata.Storage)
+			if err != nil {
+				return err
+			}
+			if err := s.Delete(ctx, f.ID); err != nil {
+				return err
+			}
+		}
+	}
+	deleteWebhook(f)
+
+	cursor, err := gfsBucket.FindContext(ctx, bson.M{"metadata.derived_from": f.ID})
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil
+	}
+	var derived []fileRecord
+	cursor.All(ctx, &derived)
+	for i := range derived {
+		deleteStoredFile(ctx, &derived[i])
+	}
+	return nil
+}
+
+// insertFileDoc records content kept outside GridFS in the files collection,
+// shaped like a regular GridFS document so queries need not care.
+func insertFileDoc(ctx context.Context, id primitive.ObjectID, filename string, length int64, metadata bson.M, backend string) error {
+	metadata["storage"] = backend
+	_, err := gfsBucket.GetFilesCollection().InsertOne(ctx, bson.D{
+		{Key: "_id", Value: id},
+		{Key: "length", Value: length},
+		{Key: "chunkSize", Value: int32(0)},
+		{Key: "uploadDate", Value: time.Now()},
+		{Key: "filename", Value: filename},
+		{Key: "metadata", Value: metadata},
+	})
+	dbBreaker.Record(err)
+	return err
+}
+
+func deleteFileDoc(ctx context.Context, id primitive.ObjectID) error {
+	_, err := gfsBucket.GetFilesCollection().DeleteOne(ctx, bson.M{"_id": id})
+	dbBreaker.Record(err)
+	return err
+}
+
+func statFileDoc(ctx context.Context, id primitive.ObjectID) (*ObjectInfo, error) {
+	var doc fileRecord
+	err := gfsBucket.GetFilesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: doc.Length, Modified: doc.UploadDate}, nil
+}
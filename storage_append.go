@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Files uploaded in append mode (CI logs, recordings) keep growing while
+// people already watch them. Their content lives in MongoDB as segments that
+// each record the byte range they cover, whatever storage backend is
+// configured, so a reader can fetch just the part it has not seen yet. The
+// file document carries metadata.growing until the producer closes it, and
+// its length only ever counts committed segments.
+
+const (
+	appendSegmentSize = 1 << 20
+
+	// An uncommitted segment this old was left behind by a writer that died
+	// between storing it and moving the length past it.
+	appendOrphanAge = 30 * time.Second
+)
+
+type appendSegment struct {
+	FileID primitive.ObjectID `bson:"file_id"`
+	Offset int64              `bson:"offset"`
+	End    int64              `bson:"end"`
+	Data   []byte             `bson:"data"`
+	Sealed bool               `bson:"sealed,omitempty"`
+	At     time.Time          `bson:"at"`
+}
+
+type appendStorage struct {
+	segments *mongo.Collection
+}
+
+var (
+	appendStore *appendStorage
+
+	errAppendClosed   = errors.New("file is not open for appending")
+	errAppendTooLarge = errors.New("file would exceed the maximum upload size")
+	errAppendConflict = errors.New("another append to this file is in progress")
+	errAppendOffset   = errors.New("append offset does not match the file length")
+)
+
+func initAppend(ctx context.Context) {
+	appendStore = &appendStorage{segments: db.Collection("append_segments")}
+	backends[appendStore.Name()] = appendStore
+
+	_, err := appendStore.segments.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "file_id", Value: 1}, {Key: "offset", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Error creating append_segments index: %v", err)
+	}
+}
+
+func (s *appendStorage) Name() string { return "append" }
+
+// Put creates the file document, still growing, with r as its first content.
+func (s *appendStorage) Put(ctx context.Context, id primitive.ObjectID, filename string, r io.Reader, metadata bson.M) (int64, error) {
+	metadata["growing"] = true
+	if err := insertFileDoc(ctx, id, filename, 0, metadata, s.Name()); err != nil {
+		return 0, err
+	}
+	n, err := s.Append(ctx, id, -1, r)
+	if err != nil {
+		s.Delete(ctx, id)
+		return 0, err
+	}
+	return n, nil
+}
+
+// Append adds everything in r to the end of a growing file and returns the
+// new length. With at >= 0 the content must start exactly there, so a
+// producer retrying a chunk cannot store it twice; a mismatch returns
+// errAppendOffset with the current length.
+func (s *appendStorage) Append(ctx context.Context, id primitive.ObjectID, at int64, r io.Reader) (int64, error) {
+	buf := make([]byte, appendSegmentSize)
+	var length int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			var appendErr error
+			length, appendErr = s.appendSegment(ctx, id, at, append([]byte(nil), buf[:n]...))
+			if appendErr != nil {
+				return length, appendErr
+			}
+			if at >= 0 {
+				at = length
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return length, err
+		}
+	}
+	if length == 0 {
+		info, err := statFileDoc(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		length = info.Size
+	}
+	return length, nil
+}
+
+// appendSegment stores data right after the committed end of the file, then
+// moves the length past it if nobody else got there first.
+func (s *appendStorage) appendSegment(ctx context.Context, id primitive.ObjectID, at int64, data []byte) (int64, error) {
+	files := gfsBucket.GetFilesCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		var doc fileRecord
+		err := files.FindOne(ctx, bson.M{"_id": id, "metadata.growing": true}).Decode(&doc)
+		dbBreaker.Record(err)
+		if err == mongo.ErrNoDocuments {
+			return 0, errAppendClosed
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset := doc.Length
+		if at >= 0 && at != offset {
+			return offset, errAppendOffset
+		}
+		end := offset + int64(len(data))
+		if end > config().Upload.MaxSize {
+			return offset, errAppendTooLarge
+		}
+
+		seg := appendSegment{FileID: id, Offset: offset, End: end, Data: data, At: time.Now()}
+		if contentAEAD != nil {
+			if seg.Data, err = sealSegment(id, offset, data); err != nil {
+				return offset, err
+			}
+			seg.Sealed = true
+		}
+		res, err := s.segments.InsertOne(ctx, seg)
+		dbBreaker.Record(err)
+		if mongo.IsDuplicateKeyError(err) {
+			s.removeOrphan(ctx, id, offset)
+			continue
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		update, err := files.UpdateOne(ctx,
+			bson.M{"_id": id, "length": offset, "metadata.growing": true},
+			bson.M{"$set": bson.M{"length": end}})
+		dbBreaker.Record(err)
+		if err == nil && update.MatchedCount == 1 {
+			return end, nil
+		}
+		_, delErr := s.segments.DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": res.InsertedID})
+		dbBreaker.Record(delErr)
+		if err != nil {
+			return offset, err
+		}
+	}
+	return 0, errAppendConflict
+}
+
+// removeOrphan deletes a stale uncommitted segment at offset, so a writer
+// that crashed mid-append does not block the file forever.
+func (s *appendStorage) removeOrphan(ctx context.Context, id primitive.ObjectID, offset int64) {
+	var doc fileRecord
+	err := gfsBucket.GetFilesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	dbBreaker.Record(err)
+	if err != nil || doc.Length > offset {
+		return
+	}
+	_, err = s.segments.DeleteOne(ctx, bson.M{
+		"file_id": id,
+		"offset":  offset,
+		"at":      bson.M{"$lt": time.Now().Add(-appendOrphanAge)},
+	})
+	dbBreaker.Record(err)
+}
+
+// Close marks a growing file as complete.
+func (s *appendStorage) Close(ctx context.Context, id primitive.ObjectID, set bson.M) error {
+	update := bson.M{"$unset": bson.M{"metadata.growing": "", "metadata.append_token": ""}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	res, err := gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": id, "metadata.growing": true}, update)
+	dbBreaker.Record(err)
+	if err == nil && res.MatchedCount == 0 {
+		return errAppendClosed
+	}
+	return err
+}
+
+func (s *appendStorage) Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	info, err := statFileDoc(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.OpenRange(ctx, id, 0, info.Size)
+}
+
+// OpenRange reads the committed bytes from start up to length.
+func (s *appendStorage) OpenRange(ctx context.Context, id primitive.ObjectID, start, length int64) (io.ReadCloser, error) {
+	cursor, err := s.segments.Find(ctx,
+		bson.M{"file_id": id, "end": bson.M{"$gt": start}, "offset": bson.M{"$lt": length}},
+		options.Find().SetSort(bson.D{{Key: "offset", Value: 1}}))
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{ctx: ctx, cursor: cursor, pos: start, length: length}, nil
+}
+
+type segmentReader struct {
+	ctx    context.Context
+	cursor *mongo.Cursor
+	buf    []byte
+	pos    int64
+	length int64
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.pos >= r.length {
+			return 0, io.EOF
+		}
+		if !r.cursor.Next(r.ctx) {
+			if err := r.cursor.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		var seg appendSegment
+		if err := r.cursor.Decode(&seg); err != nil {
+			return 0, err
+		}
+		if seg.Offset > r.pos {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if seg.Sealed {
+			var err error
+			if seg.Data, err = openSegment(seg.FileID, seg.Offset, seg.Data); err != nil {
+				return 0, err
+			}
+		}
+		end := min(seg.End, r.length)
+		r.buf = seg.Data[r.pos-seg.Offset : end-seg.Offset]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *segmentReader) Close() error {
+	return r.cursor.Close(context.WithoutCancel(r.ctx))
+}
+
+func (s *appendStorage) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if err := deleteFileDoc(ctx, id); err != nil {
+		return err
+	}
+	_, err := s.segments.DeleteMany(ctx, bson.M{"file_id": id})
+	dbBreaker.Record(err)
+	return err
+}
+
+func (s *appendStorage) Stat(ctx context.Context, id primitive.ObjectID) (*ObjectInfo, error) {
+	return statFileDoc(ctx, id)
+}
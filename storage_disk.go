@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// diskStorage keeps content under dir, sharded by the last two hex digits of
+// the file ID so no single directory grows too large.
+type diskStorage struct {
+	dir string
+}
+
+func newDiskStorage(dir string) (*diskStorage, error) {
+	if dir == "" {
+		dir = "data"
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskStorage{dir: dir}, nil
+}
+
+func (s *diskStorage) Name() string { return "disk" }
+
+func (s *diskStorage) path(id primitive.ObjectID) string {
+	hex := id.Hex()
+	return filepath.Join(s.dir, hex[len(hex)-2:], hex)
+}
+
+func (s *diskStorage) Put(ctx context.Context, id primitive.ObjectID, filename string, r io.Reader, metadata bson.M) (int64, error) {
+	path := s.path(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+
+	if err := insertFileDoc(ctx, id, filename, n, metadata, s.Name()); err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *diskStorage) Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	return os.Open(s.path(id))
+}
+
+func (s *diskStorage) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if err := deleteFileDoc(ctx, id); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *diskStorage) Stat(ctx context.Context, id primitive.ObjectID) (*ObjectInfo, error) {
+	info, err := os.Stat(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: info.Size(), Modified: info.ModTime()}, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type gridFSStorage struct{}
+
+func (s *gridFSStorage) Name() string { return "gridfs" }
+
+func (s *gridFSStorage) Put(ctx context.Context, id primitive.ObjectID, filename string, r io.Reader, metadata bson.M) (int64, error) {
+	opts := options.GridFSUpload().SetMetadata(metadata)
+
+	uploadStream, err := gfsBucket.OpenUploadStreamWithID(id, filename, opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		return 0, err
+	}
+	defer uploadStream.Close()
+
+	n, err := io.Copy(uploadStream, r)
+	if err != nil {
+		uploadStream.Abort()
+		dbBreaker.Record(err)
+		return 0, err
+	}
+	err = uploadStream.Close()
+	dbBreaker.Record(err)
+	return n, err
+}
+
+func (s *gridFSStorage) Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	downloadStream, err := gfsBucket.OpenDownloadStream(id)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	return downloadStream, nil
+}
+
+func (s *gridFSStorage) Delete(ctx context.Context, id primitive.ObjectID) error {
+	err := gfsBucket.DeleteContext(ctx, id)
+	dbBreaker.Record(err)
+	return err
+}
+
+func (s *gridFSStorage) Stat(ctx context.Context, id primitive.ObjectID) (*ObjectInfo, error) {
+	return statFileDoc(ctx, id)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// s3Storage talks to any S3-compatible object store (AWS, MinIO, R2, ...)
+// with plain HTTP requests signed by SigV4.
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func newS3Storage() (*s3Storage, error) {
+	cfg := config().Storage.S3
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("storage.s3.endpoint and storage.s3.bucket are required")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Storage{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    cfg.Bucket,
+		prefix:    strings.Trim(cfg.Prefix, "/"),
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		pathStyle: cfg.PathStyle,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *s3Storage) Name() string { return "s3" }
+
+func (s *s3Storage) objectURL(id primitive.ObjectID) string {
+	key := id.Hex()
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return u.String()
+}
+
+func (s *s3Storage) request(ctx context.Context, method string, id primitive.ObjectID, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(id), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	signV4(req, payloadHash, s.accessKey, s.secretKey, s.region, "s3")
+	return s.client.Do(req)
+}
+
+func s3Error(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Put buffers the upload in a temporary file first: S3 needs the length and
+// payload hash before the request starts.
+func (s *s3Storage) Put(ctx context.Context, id primitive.ObjectID, filename string, r io.Reader, metadata bson.M) (int64, error) {
+	tmp, err := os.CreateTemp("", "xyli-s3-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	resp, err := s.request(ctx, http.MethodPut, id, tmp, n, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error(resp)
+	}
+
+	if err := insertFileDoc(ctx, id, filename, n, metadata, s.Name()); err != nil {
+		s.deleteObject(ctx, id)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	resp, err := s.request(ctx, http.MethodGet, id, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) deleteObject(ctx context.Context, id primitive.ObjectID) error {
+	resp, err := s.request(ctx, http.MethodDelete, id, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if err := deleteFileDoc(ctx, id); err != nil {
+		return err
+	}
+	return s.deleteObject(ctx, id)
+}
+
+func (s *s3Storage) Stat(ctx context.Context, id primitive.ObjectID) (*ObjectInfo, error) {
+	resp, err := s.request(ctx, http.MethodHead, id, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3: %s", resp.Status)
+	}
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modified, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	return &ObjectInfo{Size: size, Modified: modified}, nil
+}
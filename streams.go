@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Upload streams are append mode for accounts: a producer signed in with a
+// session or API key opens a stream, gets the share link straight away and
+// keeps sending chunks until it finalizes. Chunks may carry X-Stream-Offset,
+// the length the producer believes the file has; a chunk that does not
+// start there is refused with the actual length, so retrying after a lost
+// response never duplicates data. Appends count against the account's tier
+// like regular uploads do.
+//
+//	POST   /api/streams                 open, JSON {filename, content_type, expires}
+//	GET    /api/streams/{id}            current length and state
+//	POST   /api/streams/{id}            append the request body
+//	POST   /api/streams/{id}/finalize   close the file, checksum and scan it
+//	DELETE /api/streams/{id}            abort and delete
+
+const streamOffsetHeader = "X-Stream-Offset"
+
+func streamResponse(f *fileRecord) map[string]interface{} {
+	resp := map[string]interface{}{
+		"id":         f.Metadata.ShortID,
+		"link":       fmt.Sprintf("%s/%s", config().Upload.BaseURL, f.Metadata.ShortID),
+		"stream_url": fmt.Sprintf("%s/api/streams/%s", config().Upload.BaseURL, f.Metadata.ShortID),
+		"length":     f.Length,
+		"growing":    f.Metadata.Growing,
+	}
+	if f.Metadata.ExpiresAt != nil {
+		resp["expires_at"] = f.Metadata.ExpiresAt
+	}
+	checksums := map[string]string{}
+	for name, sum := range map[string]string{"sha256": f.Metadata.SHA256, "md5": f.Metadata.MD5, "sha1": f.Metadata.SHA1} {
+		if sum != "" {
+			checksums[name] = sum
+		}
+	}
+	if len(checksums) > 0 {
+		resp["checksums"] = checksums
+	}
+	return resp
+}
+
+func writeStream(w http.ResponseWriter, status int, resp map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleStreamOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, key := requestAuth(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Expires     string `json:"expires"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Filename = strings.TrimSpace(req.Filename)
+	if req.Filename == "" {
+		jsonError(w, "filename is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	_, tier := effectiveTier(ctx, user)
+	err := checkTierQuota(ctx, user, 0)
+	if isTierLimit(err) {
+		jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// There is nothing to sniff yet, so the type comes from the producer or
+	// the extension.
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(strings.ToLower(filepath.Ext(req.Filename)))
+	}
+	contentType = safeContentType(contentType)
+	ttl, err := uploadExpiry(defaultExpires(user, req.Expires), tier, isPaste(contentType))
+	if err != nil {
+		jsonError(w, "Invalid expires value", http.StatusBadRequest)
+		return
+	}
+
+	metadata := newUploadMetadata(contentType, user)
+	if key != nil {
+		metadata["api_key_id"] = key.KeyID
+	}
+	if hash, _ := uploadPasswordHash(user, ""); hash != "" {
+		metadata["password_hash"] = hash
+	}
+	if visibility, _ := uploadVisibility(user, ""); visibility != "" {
+		metadata["visibility"] = visibility
+	}
+	var f fileRecord
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+		metadata["expires_at"] = expiresAt
+		f.Metadata.ExpiresAt = &expiresAt
+	}
+
+	f.ID = primitive.NewObjectID()
+	if _, err := appendStore.Put(ctx, f.ID, req.Filename, strings.NewReader(""), metadata); err != nil {
+		if isMongoOutage(err) {
+			serveUnavailable(w, true)
+			return
+		}
+		jsonError(w, "Upload error", http.StatusInternalServerError)
+		return
+	}
+	f.Metadata.ShortID = metadata["short_id"].(string)
+	f.Metadata.Growing = true
+	notFoundCache.Forget(f.Metadata.ShortID)
+
+	resp := streamResponse(&f)
+	resp["deletion_link"] = fmt.Sprintf("%s/delete/%s", config().Upload.BaseURL, metadata["delete_token"])
+	writeStream(w, http.StatusCreated, resp)
+}
+
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	shortID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/streams/"), "/")
+	if action != "" && action != "finalize" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	var f fileRecord
+	err := findFile(ctx, bson.M{
+		"metadata.short_id": shortID,
+		"metadata.owner_id": user.ID,
+		"metadata.storage":  appendStore.Name(),
+	}, &f)
+	if isMongoOutage(err) {
+		serveUnavailable(w, true)
+		return
+	}
+	if err == errFileNotFound {
+		jsonError(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Decode error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		writeStream(w, http.StatusOK, streamResponse(&f))
+	case r.Method == http.MethodPost && action == "":
+		appendToStream(ctx, w, r, user, &f)
+	case r.Method == http.MethodPost && action == "finalize":
+		finalizeStream(ctx, w, &f)
+	case r.Method == http.MethodDelete && action == "":
+		if err := deleteStoredFile(ctx, &f); err != nil {
+			jsonError(w, "Delete error", http.StatusInternalServerError)
+			return
+		}
+		writeStream(w, http.StatusOK, map[string]interface{}{"status": "deleted"})
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// streamAllowance is how many more bytes the user's tier lets f grow by.
+func streamAllowance(ctx context.Context, user *User, f *fileRecord) (int64, error) {
+	_, tier := effectiveTier(ctx, user)
+	allowance := tier.MaxFileSize - f.Length
+	if tier.MaxStorage > 0 {
+		_, used, err := accountUsage(ctx, user.ID)
+		if err != nil {
+			return 0, err
+		}
+		allowance = min(allowance, tier.MaxStorage-used)
+	}
+	return max(allowance, 0), nil
+}
+
+func appendToStream(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, f *fileRecord) {
+	if !f.Metadata.Growing {
+		writeStream(w, http.StatusConflict, map[string]interface{}{"error": "Stream is already finalized", "length": f.Length})
+		return
+	}
+	at := int64(-1)
+	if v := r.Header.Get(streamOffsetHeader); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			jsonError(w, "Invalid "+streamOffsetHeader+" header", http.StatusBadRequest)
+			return
+		}
+		at = n
+	}
+
+	allowance, err := streamAllowance(ctx, user, f)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if r.ContentLength > allowance {
+		jsonError(w, errTierStorage.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	length, err := appendStore.Append(ctx, f.ID, at, http.MaxBytesReader(w, r.Body, allowance))
+	if err == errAppendOffset {
+		writeStream(w, http.StatusConflict, map[string]interface{}{"error": "Offset does not match the stream length", "length": length})
+		return
+	}
+	if !writeAppendError(w, err) {
+		return
+	}
+	f.Length = length
+	writeStream(w, http.StatusOK, streamResponse(f))
+}
+
+// finalizeStream closes the stream. Finalizing twice returns the finished
+// file again, so a producer can safely retry.
+func finalizeStream(ctx context.Context, w http.ResponseWriter, f *fileRecord) {
+	if f.Metadata.Growing {
+		err := finishAppend(ctx, f)
+		if isInfected(err) {
+			jsonError(w, "File rejected: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err == errScannerUnavailable {
+			setUnavailable(w.Header(), scannerRetryAfter)
+			jsonError(w, "Virus scanner unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil && err != errAppendClosed {
+			writeAppendError(w, err)
+			return
+		}
+		metadata := bson.M{"short_id": f.Metadata.ShortID, "content_type": f.Metadata.ContentType, "owner_id": f.Metadata.OwnerID, "api_key_id": f.Metadata.APIKeyID}
+		recordUploadStat(metadata, f.Length)
+		uploadWebhook(f.Filename, f.Length, metadata)
+	}
+
+	if err := findFile(ctx, bson.M{"_id": f.ID}, f); err != nil {
+		writeAppendError(w, err)
+		return
+	}
+	writeStream(w, http.StatusOK, streamResponse(f))
+}
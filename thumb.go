@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/sync/singleflight"
+)
+
+// Thumbnails are stored as derived objects: regular file documents without
+// a short ID whose metadata.derived_from points at the original upload.
+// They are generated on first request and removed together with the original.
+
+const maxThumbSourcePixels = 50_000_000
+
+var thumbGroup singleflight.Group
+
+type derivedRecord struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Length   int64              `bson:"length"`
+	Metadata struct {
+		ContentType string `bson:"content_type"`
+		Storage     string `bson:"storage,omitempty"`
+	} `bson:"metadata"`
+}
+
+func initThumbnails() {
+	cfg := &config().Thumbnails
+	if cfg.MaxWidth <= 0 {
+		cfg.MaxWidth = 1024
+	}
+	if cfg.MaxHeight <= 0 {
+		cfg.MaxHeight = 1024
+	}
+	if cfg.Quality <= 0 || cfg.Quality > 100 {
+		cfg.Quality = 80
+	}
+}
+
+func thumbVariant() string {
+	return fmt.Sprintf("%dx%d", config().Thumbnails.MaxWidth, config().Thumbnails.MaxHeight)
+}
+
+func thumbnailable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// fitWithin scales w×h down to fit the bounds, keeping the aspect ratio.
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// decodeImage decodes an image after checking its dimensions, so a small
+// file claiming enormous dimensions cannot exhaust memory.
+func decodeImage(r io.Reader) (image.Image, error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbSourcePixels {
+		return nil, fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	return src, err
+}
+
+// encodeImage writes img as JPEG or PNG. An empty format picks PNG for
+// images with transparency and JPEG for everything else.
+func encodeImage(img *image.RGBA, format string, quality int) ([]byte, string, error) {
+	if format == "" {
+		format = "jpeg"
+		if !img.Opaque() {
+			format = "png"
+		}
+	}
+
+	var out bytes.Buffer
+	if format == "png" {
+		err := png.Encode(&out, img)
+		return out.Bytes(), "image/png", err
+	}
+	err := jpeg.Encode(&out, img, &jpeg.Options{Quality: quality})
+	return out.Bytes(), "image/jpeg", err
+}
+
+// renderThumbnail decodes an image and encodes a scaled-down copy.
+func renderThumbnail(r io.Reader) ([]byte, string, error) {
+	src, err := decodeImage(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := src.Bounds()
+	w, h := fitWithin(b.Dx(), b.Dy(), config().Thumbnails.MaxWidth, config().Thumbnails.MaxHeight)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return encodeImage(dst, "", config().Thumbnails.Quality)
+}
+
+func findDerived(ctx context.Context, parent primitive.ObjectID, kind, variant string) (*derivedRecord, error) {
+	var doc derivedRecord
+	err := findFile(ctx, bson.M{
+		"metadata.derived_from": parent,
+		"metadata.derivative":   kind,
+		"metadata.variant":      variant,
+	}, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// thumbnailFor returns the cached thumbnail of a file, generating it on the
+// first request. Concurrent requests for the same file share one render.
+func thumbnailFor(ctx context.Context, f *fileRecord) (*derivedRecord, error) {
+	variant := thumbVariant()
+	doc, err := findDerived(ctx, f.ID, "thumb", variant)
+	if err != errFileNotFound {
+		return doc, err
+	}
+
+	v, err, _ := thumbGroup.Do(f.ID.Hex()+"/"+variant, func() (interface{}, error) {
+		// Other requests may be waiting on this render, so it must not die
+		// with the request that happened to start it.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 60*time.Second)
+		defer cancel()
+		if doc, err := findDerived(ctx, f.ID, "thumb", variant); err != errFileNotFound {
+			return doc, err
+		}
+
+		content, err := openStoredFile(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		defer content.Close()
+
+		data, contentType, err := renderThumbnail(content)
+		if err != nil {
+			return nil, err
+		}
+
+		doc := &derivedRecord{ID: primitive.NewObjectID(), Length: int64(len(data))}
+		doc.Metadata.ContentType = contentType
+		metadata := bson.M{
+			"content_type": contentType,
+			"derived_from": f.ID,
+			"derivative":   "thumb",
+			"variant":      variant,
+		}
+		if _, err := store.Put(ctx, doc.ID, "thumb-"+f.Filename, bytes.NewReader(data), metadata); err != nil {
+			return nil, err
+		}
+		doc.Metadata.Storage, _ = metadata["storage"].(string)
+		return doc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*derivedRecord), nil
+}
+
+func handleThumb(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shortID := strings.TrimPrefix(r.URL.Path, "/thumb/")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	var fileDoc fileRecord
+	err := findFileByShortID(ctx, shortID, &fileDoc)
+	if err == errFileNotFound {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !requireVisible(w, r, &fileDoc) {
+		return
+	}
+	if !requireSigned(w, r, &fileDoc) {
+		return
+	}
+	if !requireUnlocked(w, r, &fileDoc) {
+		return
+	}
+	if burnsAfterDownload(&fileDoc) {
+		http.Error(w, "no previews for this file", http.StatusNotFound)
+		return
+	}
+	if !requireEnabled(w, &fileDoc) {
+		return
+	}
+	if !thumbnailable(fileDoc.Metadata.ContentType) {
+		// Formats we cannot decode, such as SVG, are small enough to show as is.
+		if getFileType(fileDoc.Metadata.ContentType) == "image" {
+			http.Redirect(w, r, "/raw/"+shortID, http.StatusFound)
+			return
+		}
+		http.Error(w, "no thumbnail for this file type", http.StatusNotFound)
+		return
+	}
+
+	thumb, err := thumbnailFor(ctx, &fileDoc)
+	if err != nil {
+		http.Error(w, "thumbnail error", http.StatusInternalServerError)
+		return
+	}
+
+	serveDerived(w, r, thumb)
+}
+
+// serveDerived streams a derived object such as a thumbnail or poster frame.
+// They are cached like the files they come from, see cache.go.
+func serveDerived(w http.ResponseWriter, r *http.Request, doc *derivedRecord) {
+	// Protected, private and signed-only files were marked private already.
+	private := strings.HasPrefix(w.Header().Get("Cache-Control"), "private")
+	if serveCached(w, r, derivedETag(doc.ID), doc.ID.Timestamp(), revalidateCacheControl(private)) {
+		return
+	}
+	w.Header().Set("Content-Type", doc.Metadata.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(doc.Length, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	s, err := storageFor(doc.Metadata.Storage)
+	if err != nil {
+		http.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	content, err := s.Get(r.Context(), doc.ID)
+	if err != nil {
+		http.Error(w, "download error", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+	io.Copy(w, content)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tier is a storage plan assigned to accounts. Limits left at zero fall
+// back to the global upload settings (file size, expiry) or are unlimited
+// (storage, file count); upload.maxSize stays the hard cap on file size.
+// MaxExpiry "never" lets a tier keep files forever even when
+// upload.maxExpiry is set. The paste lifetimes fall back to the global paste
+// settings, then to the tier's file lifetimes.
+type Tier struct {
+	MaxFileSize        int64  `json:"maxFileSize"`
+	MaxStorage         int64  `json:"maxStorage"`
+	MaxFiles           int64  `json:"maxFiles"`
+	DefaultExpiry      string `json:"defaultExpiry"`
+	MaxExpiry          string `json:"maxExpiry"`
+	PasteDefaultExpiry string `json:"pasteDefaultExpiry"`
+	PasteMaxExpiry     string `json:"pasteMaxExpiry"`
+}
+
+var (
+	errTierFileSize = errors.New("file exceeds the size limit of your plan")
+	errTierStorage  = errors.New("storage quota of your plan exceeded")
+	errTierFiles    = errors.New("file limit of your plan reached")
+)
+
+// initTiers validates the tier definitions. Without any, every account gets
+// an implicit "default" tier bound only by the global upload settings.
+func initTiers(c *Config) error {
+	cfg := &c.Tiers
+	if len(cfg.Definitions) == 0 {
+		cfg.Definitions = map[string]*Tier{"default": {}}
+		cfg.Default = "default"
+	}
+	if cfg.Default == "" {
+		cfg.Default = "free"
+	}
+	if cfg.Definitions[cfg.Default] == nil {
+		return fmt.Errorf("tiers.default %q is not defined", cfg.Default)
+	}
+	for name, t := range cfg.Definitions {
+		if t == nil {
+			return fmt.Errorf("tier %q is empty", name)
+		}
+		if t.MaxFileSize <= 0 || t.MaxFileSize > c.Upload.MaxSize {
+			t.MaxFileSize = c.Upload.MaxSize
+		}
+		if t.DefaultExpiry == "" {
+			t.DefaultExpiry = c.Upload.DefaultExpiry
+		}
+		if t.MaxExpiry == "" {
+			t.MaxExpiry = c.Upload.MaxExpiry
+		}
+		t.PasteDefaultExpiry = orDefault(t.PasteDefaultExpiry, orDefault(c.Upload.PasteDefaultExpiry, t.DefaultExpiry))
+		t.PasteMaxExpiry = orDefault(t.PasteMaxExpiry, orDefault(c.Upload.PasteMaxExpiry, t.MaxExpiry))
+		for key, value := range map[string]string{
+			"defaultExpiry":      t.DefaultExpiry,
+			"maxExpiry":          t.MaxExpiry,
+			"pasteDefaultExpiry": t.PasteDefaultExpiry,
+			"pasteMaxExpiry":     t.PasteMaxExpiry,
+		} {
+			if _, err := parseExpiry(value); err != nil {
+				return fmt.Errorf("tier %q: invalid %s %q", name, key, value)
+			}
+		}
+	}
+	return nil
+}
+
+// tierFor returns the name and limits of the user's tier. Accounts without
+// a tier, or with one that no longer exists, get the default tier.
+func tierFor(user *User) (string, *Tier) {
+	if t := config().Tiers.Definitions[user.Tier]; user.Tier != "" && t != nil {
+		return user.Tier, t
+	}
+	return config().Tiers.Default, config().Tiers.Definitions[config().Tiers.Default]
+}
+
+// accountUsage counts the files and bytes a user currently stores.
+func accountUsage(ctx context.Context, userID primitive.ObjectID) (files, bytes int64, err error) {
+	cursor, err := gfsBucket.GetFilesCollection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"metadata.owner_id":     userID,
+			"metadata.derived_from": bson.M{"$exists": false},
+			"metadata.expires_at":   notExpired(),
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"files": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$length"},
+		}}},
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return 0, 0, err
+	}
+	var totals []struct {
+		Files int64 `bson:"files"`
+		Bytes int64 `bson:"bytes"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil || len(totals) == 0 {
+		return 0, 0, err
+	}
+	return totals[0].Files, totals[0].Bytes, nil
+}
+
+// checkTierQuota reports whether the user may store another size bytes.
+func checkTierQuota(ctx context.Context, user *User, size int64) error {
+	return checkTierRoom(ctx, user, 1, size, size)
+}
+
+// checkTierRoom is checkTierQuota for count files adding up to size, the
+// largest of them being largest bytes.
+func checkTierRoom(ctx context.Context, user *User, count, size, largest int64) error {
+	_, tier := effectiveTier(ctx, user)
+	if largest > tier.MaxFileSize {
+		return errTierFileSize
+	}
+	if tier.MaxStorage <= 0 && tier.MaxFiles <= 0 {
+		return nil
+	}
+	files, bytes, err := accountUsage(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if tier.MaxFiles > 0 && files+count > tier.MaxFiles {
+		return errTierFiles
+	}
+	if tier.MaxStorage > 0 && bytes+size > tier.MaxStorage {
+		return errTierStorage
+	}
+	return nil
+}
+
+func isTierLimit(err error) bool {
+	return err == errTierFileSize || err == errTierStorage || err == errTierFiles
+}
+
+// tierSummary describes a user's tier, active boosts and how much of it is
+// in use.
+func tierSummary(ctx context.Context, user *User) (map[string]interface{}, error) {
+	name, tier := effectiveTier(ctx, user)
+	files, bytes, err := accountUsage(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	boosts, err := activeBoosts(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"tier":   name,
+		"limits": tier,
+		"boosts": boosts,
+		"usage":  map[string]int64{"files": files, "bytes": bytes},
+	}, nil
+}
+
+// handleAdminTiers lists the configured tiers.
+func handleAdminTiers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	names := make([]string, 0, len(config().Tiers.Definitions))
+	for name := range config().Tiers.Definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": config().Tiers.Default,
+		"names":   names,
+		"tiers":   config().Tiers.Definitions,
+	})
+}
+
+// handleAdminUserTier shows (GET ?username=) or changes (POST) the tier of
+// an account. Billing integrations call it when a subscription changes; an
+// empty tier puts the account back on the default one.
+func handleAdminUserTier(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Tier     string `json:"tier"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		req.Username = r.URL.Query().Get("username")
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Tier != "" && config().Tiers.Definitions[req.Tier] == nil {
+			jsonError(w, "Unknown tier", http.StatusBadRequest)
+			return
+		}
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var user User
+	var err error
+	if r.Method == http.MethodPost {
+		update := bson.M{"$set": bson.M{"tier": req.Tier}}
+		if req.Tier == "" {
+			update = bson.M{"$unset": bson.M{"tier": ""}}
+		}
+		err = usersColl.FindOneAndUpdate(ctx, bson.M{"username": req.Username}, update).Decode(&user)
+		user.Tier = req.Tier
+	} else {
+		err = usersColl.FindOne(ctx, bson.M{"username": req.Username}).Decode(&user)
+	}
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		jsonError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	summary, err := tierSummary(ctx, &user)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	summary["username"] = user.Username
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks HTTPS itself when server.tls is set up, so a small
+// deployment needs no reverse proxy in front:
+//
+//   - certFile and keyFile name a certificate and key in PEM. The files are
+//     read again within a minute of changing, so an external renewal (e.g.
+//     certbot) needs no restart.
+//   - acme.enabled gets certificates from Let's Encrypt (or acme.directoryURL)
+//     for acme.domains, by default the host of upload.baseURL, and renews them
+//     on its own. They are kept in acme.cacheDir.
+//
+// With TLS, plain HTTP on redirectPort (80 by default with ACME, off
+// otherwise) answers the ACME HTTP-01 challenge and redirects everything
+// else to HTTPS.
+
+var (
+	tlsConfig      *tls.Config
+	redirectServer *http.Server
+)
+
+func initTLS() error {
+	cfg := &config().Server.TLS
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("server.tls needs both certFile and keyFile")
+	}
+	if cfg.CertFile != "" && cfg.ACME.Enabled {
+		return errors.New("server.tls takes either certFile and keyFile or acme, not both")
+	}
+
+	var challenge func(http.Handler) http.Handler
+	switch {
+	case cfg.CertFile != "":
+		certs := &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+		if _, err := certs.load(); err != nil {
+			return fmt.Errorf("server.tls: %w", err)
+		}
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+
+	case cfg.ACME.Enabled:
+		if len(cfg.ACME.Domains) == 0 {
+			u, err := url.Parse(config().Upload.BaseURL)
+			if err != nil || u.Hostname() == "" {
+				return errors.New("server.tls.acme needs domains or a baseURL")
+			}
+			cfg.ACME.Domains = []string{u.Hostname()}
+		}
+		if cfg.ACME.CacheDir == "" {
+			cfg.ACME.CacheDir = "acme-cache"
+		}
+		if cfg.RedirectPort == 0 {
+			cfg.RedirectPort = 80
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACME.Domains...),
+			Cache:      autocert.DirCache(cfg.ACME.CacheDir),
+			Email:      cfg.ACME.Email,
+		}
+		if cfg.ACME.DirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: cfg.ACME.DirectoryURL}
+		}
+		tlsConfig = m.TLSConfig()
+		challenge = m.HTTPHandler
+		log.Printf("ACME certificates for %s", strings.Join(cfg.ACME.Domains, ", "))
+
+	default:
+		return nil
+	}
+
+	tlsConfig.MinVersion = tls.VersionTLS12
+	if cfg.RedirectPort > 0 {
+		var handler http.Handler = http.HandlerFunc(redirectToHTTPS)
+		if challenge != nil {
+			handler = challenge(handler)
+		}
+		redirectServer = &http.Server{
+			Addr:              fmt.Sprintf("%s:%d", config().Server.Host, cfg.RedirectPort),
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+	return nil
+}
+
+// serveHTTP runs the main server, over TLS when it is configured.
+func serveHTTP(srv *http.Server) error {
+	if tlsConfig == nil {
+		return srv.ListenAndServe()
+	}
+	srv.TLSConfig = tlsConfig
+	return srv.ListenAndServeTLS("", "")
+}
+
+func serveRedirects() {
+	log.Printf("Redirecting HTTP on %s to HTTPS", redirectServer.Addr)
+	if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "use https", http.StatusBadRequest)
+		return
+	}
+	target := strings.TrimSuffix(config().Upload.BaseURL, "/")
+	if !strings.HasPrefix(target, "https://") {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if config().Server.Port != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(config().Server.Port))
+		}
+		target = "https://" + host
+	}
+	http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// certReloader serves a certificate from files and picks up new ones,
+// checking the files at most once a minute.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (c *certReloader) load() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && time.Since(c.checked) < time.Minute {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	modTime := c.modTime
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			if c.cert != nil {
+				log.Printf("Error checking TLS certificate: %v", err)
+				return c.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Likely caught halfway through a renewal; keep the old one.
+			log.Printf("Error reloading TLS certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		log.Printf("Reloaded TLS certificate from %s", c.certFile)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return c.cert, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.load()
+}
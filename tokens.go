@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// With tokens.enabled, API clients that would rather not keep a cookie jar
+// sign in for a pair of tokens:
+//
+//	POST /api/v1/auth/token     {"username", "password"}
+//	POST /api/v1/auth/refresh   {"refresh_token"}
+//	POST /api/v1/auth/revoke    {"refresh_token"}, or the access token as Bearer
+//	GET    /api/account/tokens        lists the signed-in token sessions
+//	DELETE /api/account/tokens?id=    revokes one
+//
+// The access token is a short-lived HS256 JWT sent as "Authorization:
+// Bearer <token>" and accepted wherever a session cookie is. The refresh
+// token is opaque and single-use: every refresh returns a new pair, and
+// presenting the refresh token that was just replaced revokes the whole
+// session, as it means the token leaked. Any other unknown refresh token is
+// simply refused. Sessions are kept in token_sessions; access tokens
+// of a revoked session stop working right away.
+
+const refreshTokenSep = "."
+
+var (
+	errBadToken = errors.New("invalid token")
+
+	tokenKey      []byte
+	tokenSessions *mongo.Collection
+)
+
+type tokenSession struct {
+	ID              primitive.ObjectID `bson:"_id" json:"id"`
+	UserID          primitive.ObjectID `bson:"user_id" json:"-"`
+	RefreshHash     string             `bson:"refresh_hash" json:"-"`
+	PrevRefreshHash string             `bson:"prev_refresh_hash,omitempty" json:"-"`
+	UserAgent       string             `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
+	RefreshedAt     *time.Time         `bson:"refreshed_at,omitempty" json:"refreshed_at,omitempty"`
+	ExpiresAt       time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt       *time.Time         `bson:"revoked_at,omitempty" json:"-"`
+}
+
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func initTokens(ctx context.Context) {
+	cfg := &config().Tokens
+	if cfg.AccessTTLMinutes <= 0 {
+		cfg.AccessTTLMinutes = 15
+	}
+	if cfg.RefreshTTLDays <= 0 {
+		cfg.RefreshTTLDays = 30
+	}
+	if cfg.Secret != "" {
+		tokenKey = []byte(cfg.Secret)
+	} else {
+		tokenKey = make([]byte, 32)
+		rand.Read(tokenKey)
+		if cfg.Enabled {
+			log.Printf("tokens.secret is not set; access tokens will not survive a restart")
+		}
+	}
+
+	tokenSessions = db.Collection("token_sessions")
+	_, err := tokenSessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("Error creating token_sessions indexes: %v", err)
+	}
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseRefreshToken splits a refresh token into its session ID and secret.
+func parseRefreshToken(token string) (primitive.ObjectID, string, error) {
+	id, secret, ok := strings.Cut(token, refreshTokenSep)
+	if !ok || secret == "" {
+		return primitive.NilObjectID, "", errBadToken
+	}
+	sid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, "", errBadToken
+	}
+	return sid, secret, nil
+}
+
+func signJWT(claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyAccessToken checks the signature, issuer and expiry of an access
+// token and returns its claims.
+func verifyAccessToken(token string) (*accessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errBadToken
+	}
+	enc := base64.RawURLEncoding
+	header, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, errBadToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(header, &h) != nil || h.Alg != "HS256" {
+		return nil, errBadToken
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, errBadToken
+	}
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errBadToken
+	}
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errBadToken
+	}
+	var claims accessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errBadToken
+	}
+	if claims.Issuer != config().Upload.BaseURL || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errBadToken
+	}
+	return &claims, nil
+}
+
+// isAccessToken tells a JWT apart from an API key secret, which never
+// contains a dot.
+func isAccessToken(token string) bool {
+	return config().Tokens.Enabled && strings.Count(token, ".") == 2
+}
+
+// tokenUser resolves an access token to a user, as long as its session has
+// not been revoked.
+func tokenUser(ctx context.Context, token string) *User {
+	claims, err := verifyAccessToken(token)
+	if err != nil || dbBreaker.Open() {
+		return nil
+	}
+	sid, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		return nil
+	}
+	uid, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var sess tokenSession
+	err = tokenSessions.FindOne(ctx, bson.M{
+		"_id":        sid,
+		"user_id":    uid,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&sess)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil
+	}
+
+	var user User
+	err = usersColl.FindOne(ctx, bson.M{"_id": uid}).Decode(&user)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil
+	}
+	return &user
+}
+
+// issueTokens returns a new access token for the session and the response
+// carrying it together with refreshSecret.
+func issueTokens(sess *tokenSession, refreshSecret string) (map[string]interface{}, error) {
+	now := time.Now()
+	ttl := time.Duration(config().Tokens.AccessTTLMinutes) * time.Minute
+	access, err := signJWT(accessClaims{
+		Issuer:    config().Upload.BaseURL,
+		Subject:   sess.UserID.Hex(),
+		SessionID: sess.ID.Hex(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"access_token":       access,
+		"token_type":         "Bearer",
+		"expires_in":         int(ttl.Seconds()),
+		"refresh_token":      sess.ID.Hex() + refreshTokenSep + refreshSecret,
+		"refresh_expires_in": int(time.Until(sess.ExpiresAt).Seconds()),
+	}, nil
+}
+
+func writeTokens(w http.ResponseWriter, resp map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleTokenLogin(w http.ResponseWriter, r *http.Request) {
+	if !config().Tokens.Enabled {
+		jsonError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var user User
+	err := usersColl.FindOne(ctx, bson.M{"username": strings.TrimSpace(req.Username)}).Decode(&user)
+	dbBreaker.Record(err)
+	if err != nil && err != mongo.ErrNoDocuments {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err == mongo.ErrNoDocuments || user.PasswordHash == "" ||
+		bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		jsonError(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 200 {
+		userAgent = userAgent[:200]
+	}
+	secret := generateToken()
+	sess := tokenSession{
+		ID:          primitive.NewObjectID(),
+		UserID:      user.ID,
+		RefreshHash: hashRefreshSecret(secret),
+		UserAgent:   userAgent,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   time.Now().AddDate(0, 0, config().Tokens.RefreshTTLDays),
+	}
+	_, err = tokenSessions.InsertOne(ctx, sess)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	resp, err := issueTokens(&sess, secret)
+	if err != nil {
+		jsonError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, resp)
+}
+
+func handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if !config().Tokens.Enabled {
+		jsonError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	sid, secret, err := parseRefreshToken(req.RefreshToken)
+	if err != nil {
+		jsonError(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	next := generateToken()
+	var sess tokenSession
+	err = tokenSessions.FindOneAndUpdate(ctx, bson.M{
+		"_id":          sid,
+		"refresh_hash": hashRefreshSecret(secret),
+		"revoked_at":   bson.M{"$exists": false},
+		"expires_at":   bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{
+		"refresh_hash":      hashRefreshSecret(next),
+		"prev_refresh_hash": hashRefreshSecret(secret),
+		"refreshed_at":      now,
+		"expires_at":        now.AddDate(0, 0, config().Tokens.RefreshTTLDays),
+	}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&sess)
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		// A live session that rotated away from this refresh token means
+		// it was already used. Anything else is just a wrong token and
+		// leaves the session alone.
+		res, err := tokenSessions.UpdateOne(ctx, bson.M{
+			"_id":               sid,
+			"prev_refresh_hash": hashRefreshSecret(secret),
+			"revoked_at":        bson.M{"$exists": false},
+			"expires_at":        bson.M{"$gt": now},
+		}, bson.M{"$set": bson.M{"revoked_at": now}})
+		dbBreaker.Record(err)
+		if err == nil && res.ModifiedCount > 0 {
+			log.Printf("Refresh token of session %s used twice, session revoked", sid.Hex())
+		}
+		jsonError(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	resp, err := issueTokens(&sess, next)
+	if err != nil {
+		jsonError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, resp)
+}
+
+// revokeTokenSession revokes a session of the user, or of anyone when
+// userID is zero.
+func revokeTokenSession(ctx context.Context, sid, userID primitive.ObjectID) (bool, error) {
+	filter := bson.M{"_id": sid, "revoked_at": bson.M{"$exists": false}}
+	if !userID.IsZero() {
+		filter["user_id"] = userID
+	}
+	res, err := tokenSessions.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	dbBreaker.Record(err)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// handleTokenRevoke answers 200 for unknown tokens too, as RFC 7009 asks.
+func handleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	if !config().Tokens.Enabled {
+		jsonError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sid primitive.ObjectID
+	if token := bearerToken(r); isAccessToken(token) {
+		claims, err := verifyAccessToken(token)
+		if err != nil {
+			jsonError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sid, _ = primitive.ObjectIDFromHex(claims.SessionID)
+	} else {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		id, secret, err := parseRefreshToken(req.RefreshToken)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			n, err := tokenSessions.CountDocuments(ctx, bson.M{"_id": id, "refresh_hash": hashRefreshSecret(secret)})
+			cancel()
+			dbBreaker.Record(err)
+			if err == nil && n > 0 {
+				sid = id
+			}
+		}
+	}
+
+	if !sid.IsZero() {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		if _, err := revokeTokenSession(ctx, sid, primitive.NilObjectID); err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"revoked": true})
+}
+
+func handleAccountTokens(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		cursor, err := tokenSessions.Find(ctx, bson.M{
+			"user_id":    user.ID,
+			"revoked_at": bson.M{"$exists": false},
+			"expires_at": bson.M{"$gt": time.Now()},
+		}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		sessions := []tokenSession{}
+		if err := cursor.All(ctx, &sessions); err != nil {
+			jsonError(w, "Decode error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"sessions": sessions})
+
+	case http.MethodDelete:
+		sid, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+		if err != nil {
+			jsonError(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		revoked, err := revokeTokenSession(ctx, sid, user.ID)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !revoked {
+			jsonError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": sid.Hex(), "status": "revoked"})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A file or an album can be handed to another account, for instance when
+// the person who uploaded a team's assets leaves. The owner (or an admin)
+// either names the new owner, who must have room for it in their tier, or
+// asks for a claim token that whoever is logged in can redeem within a week.
+// Quota usage is computed from metadata.owner_id, so moving the owner moves
+// the file's bytes to the other account; the API key it was uploaded with
+// stays behind. An album goes together with the files in it that belong to
+// its owner, and only if the new owner has room for all of them.
+
+const transferTTL = 7 * 24 * time.Hour
+
+// transferOwnership makes to the owner of f, if their tier has room for it.
+func transferOwnership(ctx context.Context, f *fileRecord, to *User) error {
+	if err := checkTierQuota(ctx, to, f.Length); err != nil {
+		return err
+	}
+	_, err := gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": f.ID}, fileOwnerUpdate(to))
+	dbBreaker.Record(err)
+	return err
+}
+
+func fileOwnerUpdate(to *User) bson.M {
+	return bson.M{
+		"$set":   bson.M{"metadata.owner_id": to.ID},
+		"$unset": bson.M{"metadata.api_key_id": "", "metadata.transfer_token": "", "metadata.transfer_expires": ""},
+	}
+}
+
+// transferAlbum makes to the owner of a and of its unexpired files that
+// belong to a's owner, if their tier has room for all of them together.
+// Files another account put in the album stay with that account.
+func transferAlbum(ctx context.Context, a *album, to *User) error {
+	cursor, err := gfsBucket.FindContext(ctx, bson.M{
+		"metadata.short_id":   bson.M{"$in": a.Files},
+		"metadata.owner_id":   a.OwnerID,
+		"metadata.expires_at": notExpired(),
+	})
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+	var files []fileRecord
+	err = cursor.All(ctx, &files)
+	dbBreaker.Record(err)
+	if err != nil {
+		return err
+	}
+
+	var size, largest int64
+	ids := make([]primitive.ObjectID, 0, len(files))
+	for i := range files {
+		size += files[i].Length
+		largest = max(largest, files[i].Length)
+		ids = append(ids, files[i].ID)
+	}
+	if err := checkTierRoom(ctx, to, int64(len(files)), size, largest); err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		_, err = gfsBucket.GetFilesCollection().UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, fileOwnerUpdate(to))
+		dbBreaker.Record(err)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = albumsColl.UpdateOne(ctx, bson.M{"_id": a.ID}, bson.M{
+		"$set":   bson.M{"owner_id": to.ID, "updated_at": time.Now().UTC().Truncate(time.Millisecond)},
+		"$unset": bson.M{"transfer_token": "", "transfer_expires": ""},
+	})
+	dbBreaker.Record(err)
+	return err
+}
+
+// newTransferToken returns a claim token and when it stops working.
+func newTransferToken() (string, time.Time) {
+	return generateID() + generateID() + generateID() + generateID(), time.Now().Add(transferTTL).UTC().Truncate(time.Millisecond)
+}
+
+// writeClaimLink answers a transfer that waits to be claimed.
+func writeClaimLink(w http.ResponseWriter, token string, expires time.Time) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"claim_token": token,
+		"claim_link":  fmt.Sprintf("%s/dashboard#claim=%s", config().Upload.BaseURL, token),
+		"expires_at":  expires,
+	})
+}
+
+// findTransferRecipient looks up the account named in a transfer, answering
+// the request itself when there is none.
+func findTransferRecipient(ctx context.Context, w http.ResponseWriter, username string) (*User, bool) {
+	var to User
+	err := usersColl.FindOne(ctx, bson.M{"username": username}).Decode(&to)
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		jsonError(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &to, true
+}
+
+// handleFileTransfer moves a file to the account named in "to", or, without
+// it, returns a claim link for the file.
+func handleFileTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+		To string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	doc, err := findManagedFile(ctx, user, req.ID)
+	if err == errFileNotFound {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if req.To = strings.TrimSpace(req.To); req.To == "" {
+		token, expires := newTransferToken()
+		_, err := gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{
+			"metadata.transfer_token":   token,
+			"metadata.transfer_expires": expires,
+		}})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeClaimLink(w, token, expires)
+		return
+	}
+
+	to, ok := findTransferRecipient(ctx, w, req.To)
+	if !ok {
+		return
+	}
+	if to.ID == doc.Metadata.OwnerID {
+		jsonError(w, "The file already belongs to this user", http.StatusBadRequest)
+		return
+	}
+
+	err = transferOwnership(ctx, doc, to)
+	if isTierLimit(err) {
+		jsonError(w, "The recipient's plan has no room for this file: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s transferred %s to %s", user.Username, req.ID, to.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": req.ID, "owner": to.Username})
+}
+
+// serveAlbumTransfer answers POST /api/albums/{id}/transfer, which moves a
+// to the account named in "to", or, without it, returns a claim link for it.
+func serveAlbumTransfer(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User, a *album) {
+	var req struct {
+		To string `json:"to"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if req.To = strings.TrimSpace(req.To); req.To == "" {
+		token, expires := newTransferToken()
+		_, err := albumsColl.UpdateOne(ctx, bson.M{"_id": a.ID}, bson.M{"$set": bson.M{
+			"transfer_token":   token,
+			"transfer_expires": expires,
+		}})
+		dbBreaker.Record(err)
+		if err != nil {
+			jsonError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeClaimLink(w, token, expires)
+		return
+	}
+
+	to, ok := findTransferRecipient(ctx, w, req.To)
+	if !ok {
+		return
+	}
+	if to.ID == a.OwnerID {
+		jsonError(w, "The album already belongs to this user", http.StatusBadRequest)
+		return
+	}
+
+	err := transferAlbum(ctx, a, to)
+	if isTierLimit(err) {
+		jsonError(w, "The recipient's plan has no room for this album: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s transferred album %s to %s", user.Username, a.ShortID, to.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"album": a.ShortID, "owner": to.Username})
+}
+
+// handleTransferClaim gives the logged-in user the file or album a claim
+// token was issued for.
+func handleTransferClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var doc fileRecord
+	err := findFile(ctx, bson.M{
+		"metadata.transfer_token":   req.Token,
+		"metadata.transfer_expires": bson.M{"$gt": time.Now()},
+	}, &doc)
+	if err == errFileNotFound {
+		claimAlbum(ctx, w, user, req.Token)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	err = transferOwnership(ctx, &doc, user)
+	if isTierLimit(err) {
+		jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s claimed %s", user.Username, doc.Metadata.ShortID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": doc.Metadata.ShortID, "filename": doc.Filename, "link": doc.Link()})
+}
+
+// claimAlbum redeems a claim token issued for an album.
+func claimAlbum(ctx context.Context, w http.ResponseWriter, user *User, token string) {
+	var a album
+	err := albumsColl.FindOne(ctx, bson.M{
+		"transfer_token":   token,
+		"transfer_expires": bson.M{"$gt": time.Now()},
+	}).Decode(&a)
+	dbBreaker.Record(err)
+	if err == mongo.ErrNoDocuments {
+		jsonError(w, "Invalid or expired claim token", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	err = transferAlbum(ctx, &a, user)
+	if isTierLimit(err) {
+		jsonError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s claimed album %s", user.Username, a.ShortID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"album": a.ShortID, "title": a.Title, "link": a.Link()})
+}
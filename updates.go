@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With updates.enabled the server asks updates.url every intervalHours for
+// the latest release and, when it is newer than the running version, says
+// so in the log and on the admin page (GET /api/admin/update). Nothing is
+// downloaded or installed. The URL answers either like GitHub's "latest
+// release" API ({"tag_name", "html_url"}) or with {"version", "url"}.
+// Development builds are never told to update, since their version says
+// nothing about which release they are based on.
+
+const defaultUpdatesURL = "https://api.github.com/repos/manukek/XyliLoader/releases/latest"
+
+var updateClient = &http.Client{Timeout: 30 * time.Second}
+
+type updateStatus struct {
+	Latest    string    `json:"latest,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	Available bool      `json:"available"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	updateMu    sync.Mutex
+	updateState updateStatus
+)
+
+func initUpdates() {
+	cfg := &config().Updates
+	if cfg.URL == "" {
+		cfg.URL = defaultUpdatesURL
+	}
+	if cfg.IntervalHours <= 0 {
+		cfg.IntervalHours = 24
+	}
+}
+
+func runUpdateChecker() {
+	ticker := time.NewTicker(time.Duration(config().Updates.IntervalHours) * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		checkForUpdate()
+		<-ticker.C
+	}
+}
+
+func checkForUpdate() {
+	latest, url, err := fetchLatestRelease()
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	updateState.CheckedAt = time.Now()
+	if err != nil {
+		updateState.Error = err.Error()
+		log.Printf("Error checking for updates: %v", err)
+		return
+	}
+	announce := latest != updateState.Latest
+	updateState = updateStatus{
+		Latest:    latest,
+		URL:       url,
+		Available: newerVersion(latest, serverVersion()),
+		CheckedAt: updateState.CheckedAt,
+	}
+	if announce && updateState.Available {
+		log.Printf("Update available: %s (running %s) %s", latest, serverVersion(), url)
+	}
+}
+
+func fetchLatestRelease() (version, url string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config().Updates.URL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "XyliLoader/"+serverVersion())
+	resp, err := updateClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("%s answered %s", config().Updates.URL, resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+		Version string `json:"version"`
+		URL     string `json:"url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&release); err != nil {
+		return "", "", err
+	}
+	version, url = release.TagName, release.HTMLURL
+	if release.Version != "" {
+		version, url = release.Version, release.URL
+	}
+	if parseVersion(version) == nil {
+		return "", "", fmt.Errorf("no release version in the answer of %s", config().Updates.URL)
+	}
+	return version, url, nil
+}
+
+// parseVersion reads "v1.2.3" or "1.2"; anything after a "-" or "+" is
+// ignored. It returns nil for anything else.
+func parseVersion(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// newerVersion reports whether latest is a later release than current.
+func newerVersion(latest, current string) bool {
+	l, c := parseVersion(latest), parseVersion(current)
+	if l == nil || c == nil {
+		return false
+	}
+	for i := 0; i < max(len(l), len(c)); i++ {
+		var a, b int
+		if i < len(l) {
+			a = l[i]
+		}
+		if i < len(c) {
+			b = c[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
+
+func handleAdminUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r, true) == nil {
+		return
+	}
+	updateMu.Lock()
+	status := updateState
+	updateMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool   `json:"enabled"`
+		Current string `json:"current"`
+		updateStatus
+	}{config().Updates.Enabled, serverVersion(), status})
+}
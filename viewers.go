@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ViewerRule maps files to a viewer. Match is either a file extension
+// (".glb"), an exact content type ("application/json") or a type wildcard
+// ("image/*"). Template names a file in templates/ or a viewer plugin.
+type ViewerRule struct {
+	Match    string `json:"match"`
+	Template string `json:"template"`
+}
+
+// A viewer plugin is a self-contained directory viewers/<name>/ holding
+// viewer.html plus any scripts, styles and other files it needs. Its .css
+// and .js/.mjs files are linked into the page automatically and everything
+// in the directory is served from /viewer-assets/<name>/ with a content
+// hash in the URL, so browsers can cache the assets indefinitely.
+
+const (
+	fallbackViewer   = "viewer_file"
+	viewerPluginsDir = "viewers"
+	viewerPluginPage = "viewer.html"
+)
+
+// defaultViewers are used after any rules from the config, so an instance
+// only needs to list what it adds or overrides.
+var defaultViewers = []ViewerRule{
+	{Match: ".glb", Template: "viewer_model"},
+	{Match: ".gltf", Template: "viewer_model"},
+	{Match: "model/gltf-binary", Template: "viewer_model"},
+	{Match: "model/gltf+json", Template: "viewer_model"},
+	{Match: "image/*", Template: "viewer_image"},
+	{Match: "video/*", Template: "viewer_video"},
+	{Match: "audio/*", Template: "viewer_audio"},
+	{Match: "application/pdf", Template: "viewer_pdf"},
+	{Match: "application/json", Template: "viewer_code"},
+	{Match: "application/xml", Template: "viewer_code"},
+	{Match: "application/javascript", Template: "viewer_code"},
+	{Match: "text/*", Template: "viewer_code"},
+}
+
+// ViewerAssets are the plugin files linked from a viewer page.
+type ViewerAssets struct {
+	Styles  []string
+	Scripts []string
+	Modules []string
+}
+
+type viewerPlugin struct {
+	assets  ViewerAssets
+	version map[string]string
+}
+
+var (
+	viewerRules   []ViewerRule
+	viewerPlugins = map[string]*viewerPlugin{}
+)
+
+func initViewers() error {
+	if err := loadViewerPlugins(); err != nil {
+		return err
+	}
+
+	viewerRules = append(append([]ViewerRule(nil), config().Viewers...), defaultViewers...)
+	for i, rule := range viewerRules {
+		rule.Match = strings.ToLower(strings.TrimSpace(rule.Match))
+		if rule.Match == "" || strings.ContainsAny(rule.Template, `/\.`) {
+			return fmt.Errorf("invalid viewer rule %q -> %q", rule.Match, rule.Template)
+		}
+		if _, err := os.Stat(viewerTemplatePath(rule.Template)); err != nil {
+			return fmt.Errorf("viewer template for %q: %w", rule.Match, err)
+		}
+		viewerRules[i] = rule
+	}
+	return nil
+}
+
+func loadViewerPlugins() error {
+	dirs, err := os.ReadDir(viewerPluginsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		name := dir.Name()
+		files, err := os.ReadDir(filepath.Join(viewerPluginsDir, name))
+		if err != nil {
+			return err
+		}
+
+		plugin := &viewerPlugin{version: map[string]string{}}
+		var names []string
+		for _, f := range files {
+			if f.IsDir() || f.Name() == viewerPluginPage {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(viewerPluginsDir, name, f.Name()))
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			plugin.version[f.Name()] = hex.EncodeToString(sum[:6])
+			names = append(names, f.Name())
+		}
+		sort.Strings(names)
+
+		for _, file := range names {
+			url := fmt.Sprintf("/viewer-assets/%s/%s?v=%s", name, file, plugin.version[file])
+			switch path.Ext(file) {
+			case ".css":
+				plugin.assets.Styles = append(plugin.assets.Styles, url)
+			case ".js":
+				plugin.assets.Scripts = append(plugin.assets.Scripts, url)
+			case ".mjs":
+				plugin.assets.Modules = append(plugin.assets.Modules, url)
+			}
+		}
+		viewerPlugins[name] = plugin
+	}
+	return nil
+}
+
+func viewerTemplatePath(name string) string {
+	if _, ok := viewerPlugins[name]; ok {
+		return filepath.Join(viewerPluginsDir, name, viewerPluginPage)
+	}
+	return "templates/" + name + ".html"
+}
+
+// viewerFor picks the template for a file. Extension rules win over content
+// type rules because many clients upload everything as octet-stream.
+func viewerFor(filename, contentType string) string {
+	ext := strings.ToLower(path.Ext(filename))
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+
+	for _, rule := range viewerRules {
+		if strings.HasPrefix(rule.Match, ".") && rule.Match == ext {
+			return rule.Template
+		}
+	}
+	for _, rule := range viewerRules {
+		if rule.Match == contentType {
+			return rule.Template
+		}
+		if prefix, ok := strings.CutSuffix(rule.Match, "/*"); ok && strings.HasPrefix(contentType, prefix+"/") {
+			return rule.Template
+		}
+	}
+	return fallbackViewer
+}
+
+// viewerTemplate returns the template of a viewer along with the plugin
+// assets the page should link, if it is a plugin.
+func viewerTemplate(name string) (*template.Template, ViewerAssets) {
+	tmpl := parseViewer(viewerTemplatePath(name))
+	if plugin, ok := viewerPlugins[name]; ok {
+		return tmpl, plugin.assets
+	}
+	return tmpl, ViewerAssets{}
+}
+
+// viewerETag identifies the page the viewer renders for a file. It covers
+// everything the page is built from: the file's metadata, the viewer
+// template and the embed tags (by modification time, so edits take effect),
+// plugin asset versions, the settings passed to the template and variant,
+// which holds whatever else the page depends on (the language, relative
+// times).
+func viewerETag(name, fileID, filename, contentType string, length int64, uploaded time.Time, variant string) string {
+	var modified time.Time
+	if info, err := os.Stat(viewerTemplatePath(name)); err == nil {
+		modified = info.ModTime()
+	}
+	var assets ViewerAssets
+	if plugin, ok := viewerPlugins[name]; ok {
+		assets = plugin.assets
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00%d\x00%s\x00%d\x00%d\x00%v\x00%s\x00%s\x00%t\x00%s",
+		fileID, filename, contentType, length, uploaded.UnixNano(),
+		name, modified.UnixNano(), embedModified().UnixNano(), assets, config().Upload.BaseURL, config().Display.SizeUnits, config().Posters.Enabled, variant)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether the request's If-None-Match lists etag.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handleViewerAssets serves plugin files. Requests carrying the current
+// content hash are cached for a year; anything else only briefly.
+func handleViewerAssets(w http.ResponseWriter, r *http.Request) {
+	name, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/viewer-assets/"), "/")
+	plugin, found := viewerPlugins[name]
+	if !ok || !found || file == viewerPluginPage || strings.Contains(file, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	version, found := plugin.version[file]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("v") == version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	http.ServeFile(w, r, filepath.Join(viewerPluginsDir, name, file))
+}
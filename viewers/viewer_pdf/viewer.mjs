@@ -0,0 +1,60 @@
+import * as pdfjsLib from 'https://cdnjs.cloudflare.com/ajax/libs/pdf.js/4.0.379/pdf.min.mjs';
+
+pdfjsLib.GlobalWorkerOptions.workerSrc = 'https://cdnjs.cloudflare.com/ajax/libs/pdf.js/4.0.379/pdf.worker.min.mjs';
+
+const pages = document.getElementById('pages');
+const maxPages = 50;
+
+function showMessage(text) {
+    const message = document.createElement('div');
+    message.className = 'pdf-message';
+    message.textContent = text;
+    pages.appendChild(message);
+}
+
+// waitForPreview polls until the PDF converted from an office document is
+// ready. It reports false when it takes too long.
+async function waitForPreview() {
+    for (let attempt = 0; attempt < 30; attempt++) {
+        const response = await fetch(pages.dataset.src, { method: 'HEAD' });
+        if (response.ok) return true;
+        if (response.status !== 404 || !response.headers.has('Retry-After')) return false;
+        if (attempt === 0) showMessage('Готовим предпросмотр документа...');
+        await new Promise((resolve) => setTimeout(resolve, 5000));
+    }
+    return false;
+}
+
+async function render() {
+    try {
+        if ('preview' in pages.dataset) {
+            const ready = await waitForPreview();
+            pages.replaceChildren();
+            if (!ready) {
+                showMessage('Предпросмотр недоступен, скачайте файл');
+                return;
+            }
+        }
+        const pdf = await pdfjsLib.getDocument(pages.dataset.src).promise;
+        const count = Math.min(pdf.numPages, maxPages);
+        const scale = window.devicePixelRatio || 1;
+
+        for (let i = 1; i <= count; i++) {
+            const page = await pdf.getPage(i);
+            const viewport = page.getViewport({ scale: 1.5 * scale });
+            const canvas = document.createElement('canvas');
+            canvas.width = viewport.width;
+            canvas.height = viewport.height;
+            pages.appendChild(canvas);
+            await page.render({ canvasContext: canvas.getContext('2d'), viewport }).promise;
+        }
+
+        if (pdf.numPages > maxPages) {
+            showMessage(`Показаны первые ${maxPages} страниц из ${pdf.numPages}, скачайте файл целиком`);
+        }
+    } catch (error) {
+        showMessage('Не удалось открыть PDF: ' + error.message);
+    }
+}
+
+render();
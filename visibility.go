@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Every file is public, unlisted or private (metadata.visibility, empty
+// for public). Unlisted files work for anyone with the link but ask search
+// engines to stay away. Private files are only served to their owner, by
+// session or API key, or with a signed link; everyone else gets the same
+// 404 as for a file that does not exist, on the viewer page, /raw/ and the
+// previews alike. Private files are left out of album pages. Uploads take
+// a visibility field and fall back to the account default; owners change it
+// later with POST /api/dashboard/files/visibility.
+
+const (
+	visibilityPublic   = "public"
+	visibilityUnlisted = "unlisted"
+	visibilityPrivate  = "private"
+)
+
+var (
+	errBadVisibility    = errors.New("visibility must be public, unlisted or private")
+	errPrivateAnonymous = errors.New("private uploads need an account")
+)
+
+// parseVisibility normalizes a requested visibility; public is stored as "".
+func parseVisibility(v string) (string, error) {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case "", visibilityPublic:
+		return "", nil
+	case visibilityUnlisted, visibilityPrivate:
+		return v, nil
+	}
+	return "", errBadVisibility
+}
+
+// visibilityOrPublic is a stored visibility as the API reports it.
+func visibilityOrPublic(v string) string {
+	if v == "" {
+		return visibilityPublic
+	}
+	return v
+}
+
+// fileVisible reports whether the request may see f at all.
+func fileVisible(r *http.Request, f *fileRecord) bool {
+	if f.Metadata.Visibility != visibilityPrivate || signedRequest(r, f) {
+		return true
+	}
+	user := requestUser(r)
+	return user != nil && (user.ID == f.Metadata.OwnerID || isAdmin(user))
+}
+
+// requireVisible answers 404 and returns false when f is private and the
+// request is not allowed to see it. Other responses for private and
+// unlisted files are kept out of shared caches and search engines.
+func requireVisible(w http.ResponseWriter, r *http.Request, f *fileRecord) bool {
+	if f.Metadata.Visibility == "" {
+		return true
+	}
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	if f.Metadata.Visibility != visibilityPrivate {
+		return true
+	}
+	if !fileVisible(r, f) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return false
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	return true
+}
+
+// handleFileVisibility changes the visibility of one of the caller's files.
+func handleFileVisibility(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	if user == nil {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID         string `json:"id"`
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		jsonError(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	visibility, err := parseVisibility(req.Visibility)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	doc, err := findManagedFile(ctx, user, req.ID)
+	if err == errFileNotFound {
+		jsonError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if doc.Metadata.ReportHold != "" && !isAdmin(user) {
+		jsonError(w, "File is under review", http.StatusConflict)
+		return
+	}
+	if visibility == visibilityPrivate && doc.Metadata.OwnerID.IsZero() {
+		jsonError(w, errPrivateAnonymous.Error(), http.StatusBadRequest)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"metadata.visibility": visibility}}
+	if visibility == "" {
+		update = bson.M{"$unset": bson.M{"metadata.visibility": ""}}
+	}
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": doc.ID}, update)
+	dbBreaker.Record(err)
+	if err != nil {
+		jsonError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	doc.Metadata.Visibility = visibility
+	if doc.Metadata.OwnerID != user.ID {
+		log.Printf("Admin %s set visibility=%s on %s", user.Username, visibilityOrPublic(doc.Metadata.Visibility), req.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         req.ID,
+		"visibility": visibilityOrPublic(doc.Metadata.Visibility),
+	})
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/webdav"
+)
+
+// /dav/ serves each account's uploads as a WebDAV folder, so they can be
+// mounted in Explorer, Finder, davfs2 or rclone. Clients log in with Basic
+// auth: any username and an API key secret as the password. Files written
+// through the mount are stored as ordinary uploads of the account, with its
+// default expiry and password. The folder is flat; two files with the same
+// name are told apart by their ID, as "name [ID].ext".
+
+const davMaxFiles = 5000
+
+var davLocks = webdav.NewMemLS()
+
+func handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	if !config().WebDAV.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	_, secret, ok := r.BasicAuth()
+	if !ok {
+		secret = bearerToken(r)
+	}
+	key, user := lookupAPIKey("secret", secret)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="XyliLoader", charset="UTF-8"`)
+		http.Error(w, "API key required", http.StatusUnauthorized)
+		return
+	}
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: &davFS{user: user, key: key},
+		LockSystem: davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(w, r)
+}
+
+// davName is the name f has in the folder.
+func davName(f *fileRecord, duplicate bool) string {
+	if !duplicate {
+		return f.Filename
+	}
+	ext := path.Ext(f.Filename)
+	return fmt.Sprintf("%s [%s]%s", strings.TrimSuffix(f.Filename, ext), f.Metadata.ShortID, ext)
+}
+
+type davFS struct {
+	user *User
+	key  *APIKey
+}
+
+func (d *davFS) ownerFilter() bson.M {
+	return bson.M{"metadata.owner_id": d.user.ID, "metadata.expires_at": notExpired()}
+}
+
+func (d *davFS) list(ctx context.Context) ([]fileRecord, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "filename", Value: 1}}).SetLimit(davMaxFiles)
+	cursor, err := gfsBucket.GetFilesCollection().Find(ctx, d.ownerFilter(), opts)
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	var files []fileRecord
+	err = cursor.All(ctx, &files)
+	dbBreaker.Record(err)
+	return files, err
+}
+
+// lookup finds the file shown as name.
+func (d *davFS) lookup(ctx context.Context, name string) (*fileRecord, error) {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || strings.Contains(name, "/") {
+		return nil, os.ErrNotExist
+	}
+
+	// "name [ID].ext"
+	ext := path.Ext(name)
+	if stem := strings.TrimSuffix(name, ext); strings.HasSuffix(stem, "]") {
+		if i := strings.LastIndex(stem, " ["); i >= 0 {
+			var f fileRecord
+			err := findFileByShortID(ctx, stem[i+2:len(stem)-1], &f)
+			if err == nil && f.Metadata.OwnerID == d.user.ID && davName(&f, true) == name {
+				return &f, nil
+			}
+			if err != nil && err != errFileNotFound {
+				return nil, err
+			}
+		}
+	}
+
+	filter := d.ownerFilter()
+	filter["filename"] = name
+	cursor, err := gfsBucket.GetFilesCollection().Find(ctx, filter, options.Find().SetLimit(2))
+	dbBreaker.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	var files []fileRecord
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	// Duplicates are only reachable by their "[ID]" names.
+	if len(files) != 1 {
+		return nil, os.ErrNotExist
+	}
+	return &files[0], nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if strings.Trim(name, "/") == "" {
+		return os.ErrExist
+	}
+	return os.ErrPermission
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if strings.Trim(name, "/") == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, os.ErrPermission
+		}
+		return &davDir{fs: d, ctx: ctx}, nil
+	}
+
+	existing, err := d.lookup(ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if existing != nil && flag&os.O_TRUNC == 0 {
+			// Uploads cannot be changed in place.
+			return nil, os.ErrPermission
+		}
+		if existing == nil && flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		if strings.Contains(strings.TrimPrefix(name, "/"), "/") {
+			return nil, os.ErrNotExist
+		}
+		tmp, err := os.CreateTemp("", "xyli-dav-*")
+		if err != nil {
+			return nil, err
+		}
+		return &davWriter{fs: d, ctx: ctx, name: path.Base(name), tmp: tmp, replaces: existing}, nil
+	}
+	if existing == nil {
+		return nil, os.ErrNotExist
+	}
+	return &davReader{ctx: ctx, f: existing, name: path.Base(name)}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	if strings.Trim(name, "/") == "" {
+		return os.ErrPermission
+	}
+	f, err := d.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	return deleteStoredFile(ctx, f)
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	f, err := d.lookup(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	newName = strings.TrimPrefix(newName, "/")
+	if newName == "" || strings.Contains(newName, "/") {
+		return os.ErrPermission
+	}
+	if target, err := d.lookup(ctx, newName); err == nil && target.ID != f.ID {
+		if err := deleteStoredFile(ctx, target); err != nil {
+			return err
+		}
+	}
+	_, err = gfsBucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": f.ID}, bson.M{"$set": bson.M{"filename": newName}})
+	dbBreaker.Record(err)
+	return err
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if strings.Trim(name, "/") == "" {
+		return davDirInfo{}, nil
+	}
+	f, err := d.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &davFileInfo{f: f, name: path.Base(name)}, nil
+}
+
+type davDirInfo struct{}
+
+func (davDirInfo) Name() string       { return "/" }
+func (davDirInfo) Size() int64        { return 0 }
+func (davDirInfo) Mode() os.FileMode  { return fs.ModeDir | 0o755 }
+func (davDirInfo) ModTime() time.Time { return time.Time{} }
+func (davDirInfo) IsDir() bool        { return true }
+func (davDirInfo) Sys() interface{}   { return nil }
+
+type davFileInfo struct {
+	f    *fileRecord
+	name string
+}
+
+func (i *davFileInfo) Name() string       { return i.name }
+func (i *davFileInfo) Size() int64        { return i.f.Length }
+func (i *davFileInfo) Mode() os.FileMode  { return 0o644 }
+func (i *davFileInfo) ModTime() time.Time { return i.f.UploadDate }
+func (i *davFileInfo) IsDir() bool        { return false }
+func (i *davFileInfo) Sys() interface{}   { return nil }
+
+// ContentType and ETag keep the webdav package from reading the content.
+func (i *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	return i.f.Metadata.ContentType, nil
+}
+
+func (i *davFileInfo) ETag(ctx context.Context) (string, error) {
+	return `"` + i.f.ID.Hex() + `"`, nil
+}
+
+// davDir is the open root folder.
+type davDir struct {
+	fs   *davFS
+	ctx  context.Context
+	read bool
+}
+
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *davDir) Stat() (os.FileInfo, error)                   { return davDirInfo{}, nil }
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	files, err := d.fs.list(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]int, len(files))
+	for _, f := range files {
+		seen[f.Filename]++
+	}
+	infos := make([]os.FileInfo, 0, len(files))
+	for i := range files {
+		f := &files[i]
+		infos = append(infos, &davFileInfo{f: f, name: davName(f, seen[f.Filename] > 1)})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// davReader reads a file, reopening the stored content when a client
+// seeks backwards.
+type davReader struct {
+	ctx     context.Context
+	f       *fileRecord
+	name    string
+	content io.ReadCloser
+	pos     int64 // offset of content
+	offset  int64 // offset the next Read starts at
+}
+
+func (r *davReader) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (r *davReader) Write([]byte) (int, error)          { return 0, os.ErrPermission }
+func (r *davReader) Stat() (os.FileInfo, error) {
+	return &davFileInfo{f: r.f, name: r.name}, nil
+}
+
+func (r *davReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.f.Length
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *davReader) Read(p []byte) (int, error) {
+	if r.offset >= r.f.Length {
+		return 0, io.EOF
+	}
+	if r.content != nil && r.pos > r.offset {
+		r.content.Close()
+		r.content = nil
+	}
+	if r.content == nil {
+		var err error
+		if r.f.Metadata.Storage == appendStore.Name() {
+			r.content, err = appendStore.OpenRange(r.ctx, r.f.ID, 0, r.f.Length)
+		} else {
+			r.content, err = openStoredFile(r.ctx, r.f)
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.pos = 0
+	}
+	if r.pos < r.offset {
+		n, err := skipContent(r.content, r.offset-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.content.Read(p)
+	r.pos += int64(n)
+	r.offset = r.pos
+	return n, err
+}
+
+func (r *davReader) Close() error {
+	if r.content != nil {
+		return r.content.Close()
+	}
+	return nil
+}
+
+// davWriter collects a new file and stores it on Close, replacing the file
+// of the same name, if any.
+type davWriter struct {
+	fs       *davFS
+	ctx      context.Context
+	name     string
+	tmp      *os.File
+	size     int64
+	replaces *fileRecord
+}
+
+func (w *davWriter) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (w *davWriter) Read([]byte) (int, error)           { return 0, os.ErrInvalid }
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence != io.SeekStart {
+		return w.size, nil
+	}
+	return 0, os.ErrInvalid
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > config().Upload.MaxSize {
+		return 0, fmt.Errorf("file too large (max %s)", formatSize(config().Upload.MaxSize))
+	}
+	n, err := w.tmp.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *davWriter) Stat() (os.FileInfo, error) {
+	f := &fileRecord{Filename: w.name, Length: w.size, UploadDate: time.Now()}
+	return &davFileInfo{f: f, name: w.name}, nil
+}
+
+func (w *davWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+	_, err := storeMountedFile(w.ctx, w.fs.user, w.fs.key, w.name, w.tmp, w.size, w.replaces)
+	return err
+}
+
+// storeMountedFile stores the first size bytes of tmp as a new upload of
+// user, with the account's defaults, for the file-system style endpoints.
+// The file it replaces, if any, is deleted once the new one is stored.
+func storeMountedFile(ctx context.Context, user *User, key *APIKey, name string, tmp *os.File, size int64, replaces *fileRecord) (bson.M, error) {
+	tierCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	_, tier := effectiveTier(tierCtx, user)
+	err := checkTierQuota(tierCtx, user, size)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, sniffLen)
+	n, _ := tmp.ReadAt(head, 0)
+	contentType := detectContentType(name, head[:n], "")
+	ttl, err := uploadExpiry(defaultExpires(user, ""), tier, isPaste(contentType))
+	if err != nil {
+		return nil, err
+	}
+	metadata := newUploadMetadata(contentType, user)
+	if key != nil {
+		metadata["api_key_id"] = key.KeyID
+	}
+	if hash, _ := uploadPasswordHash(user, ""); hash != "" {
+		metadata["password_hash"] = hash
+	}
+	if strip, _ := uploadStripEXIF(user, ""); strip {
+		metadata["strip_exif"] = true
+	}
+	if visibility, _ := uploadVisibility(user, ""); visibility != "" {
+		metadata["visibility"] = visibility
+	}
+	if ttl > 0 {
+		metadata["expires_at"] = time.Now().Add(ttl).UTC().Truncate(time.Millisecond)
+	}
+	if err := storeUpload(ctx, name, io.NewSectionReader(tmp, 0, size), metadata); err != nil {
+		return nil, err
+	}
+	notFoundCache.Forget(metadata["short_id"].(string))
+	if replaces != nil {
+		return metadata, deleteStoredFile(ctx, replaces)
+	}
+	return metadata, nil
+}
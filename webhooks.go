@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhooks listed in the webhooks config section receive a JSON POST when a
+// file is uploaded, deleted or removed on expiry, for wiring the instance
+// into chat bots and automation tools. With a secret, the body is signed
+// with HMAC-SHA256 in X-Xyli-Signature, as metering webhooks are. Failed
+// deliveries are retried with growing delays; deliveries still pending when
+// the process exits are lost.
+
+const (
+	webhookUpload = "upload"
+	webhookDelete = "delete"
+	webhookExpire = "expire"
+)
+
+// webhookBackoff is the wait before each retry of a failed delivery.
+var webhookBackoff = []time.Duration{30 * time.Second, 2 * time.Minute, 10 * time.Minute, time.Hour}
+
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // all events when empty
+}
+
+type webhookFile struct {
+	ID          string     `json:"id"`
+	Filename    string     `json:"filename"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type"`
+	Link        string     `json:"link"`
+	OwnerID     string     `json:"owner_id,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type webhookPayload struct {
+	Delivery string      `json:"delivery"`
+	Event    string      `json:"event"`
+	At       time.Time   `json:"at"`
+	File     webhookFile `json:"file"`
+}
+
+type webhookDelivery struct {
+	hook    *WebhookConfig
+	body    []byte
+	event   string
+	id      string
+	attempt int
+}
+
+var webhookQueue chan *webhookDelivery
+
+func initWebhooks() error {
+	if len(config().Webhooks) == 0 {
+		return nil
+	}
+	for i, hook := range config().Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks[%d]: invalid url %q", i, hook.URL)
+		}
+		for _, event := range hook.Events {
+			if event != webhookUpload && event != webhookDelete && event != webhookExpire {
+				return fmt.Errorf("webhooks[%d]: unknown event %q", i, event)
+			}
+		}
+	}
+	webhookQueue = make(chan *webhookDelivery, 1000)
+	for i := 0; i < 2; i++ {
+		go webhookWorker()
+	}
+	return nil
+}
+
+// webhookSignature is the X-Xyli-Signature value for body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *WebhookConfig) wants(event string) bool {
+	return len(h.Events) == 0 || containsString(h.Events, event)
+}
+
+// fireWebhooks queues event for every webhook that wants it. It never
+// blocks: deliveries are dropped when the queue is full.
+func fireWebhooks(event string, file webhookFile) {
+	if webhookQueue == nil {
+		return
+	}
+	id := primitive.NewObjectID().Hex()
+	body, err := json.Marshal(webhookPayload{Delivery: id, Event: event, At: time.Now().UTC(), File: file})
+	if err != nil {
+		return
+	}
+	for i := range config().Webhooks {
+		hook := &config().Webhooks[i]
+		if !hook.wants(event) {
+			continue
+		}
+		select {
+		case webhookQueue <- &webhookDelivery{hook: hook, body: body, event: event, id: id}:
+		default:
+			log.Printf("Webhook queue full, dropped %s event for %s", event, hook.URL)
+		}
+	}
+}
+
+// uploadWebhook announces a stored upload from its metadata.
+func uploadWebhook(filename string, size int64, metadata bson.M) {
+	file := webhookFile{Filename: filename, Size: size}
+	file.ID, _ = metadata["short_id"].(string)
+	file.ContentType, _ = metadata["content_type"].(string)
+	if owner, ok := metadata["owner_id"].(primitive.ObjectID); ok {
+		file.OwnerID = owner.Hex()
+	}
+	if expires, ok := metadata["expires_at"].(time.Time); ok {
+		file.ExpiresAt = &expires
+	}
+	file.Link = fmt.Sprintf("%s/%s", config().Upload.BaseURL, file.ID)
+	fireWebhooks(webhookUpload, file)
+	announceDiscordUpload(file)
+}
+
+// deleteWebhook announces a deleted file; files past their expiry are
+// reported as expired.
+func deleteWebhook(f *fileRecord) {
+	if f.Metadata.ShortID == "" {
+		return
+	}
+	event := webhookDelete
+	if exp := f.Metadata.ExpiresAt; exp != nil && !exp.After(time.Now()) {
+		event = webhookExpire
+	}
+	file := webhookFile{
+		ID:          f.Metadata.ShortID,
+		Filename:    f.Filename,
+		Size:        f.Length,
+		ContentType: f.Metadata.ContentType,
+		Link:        f.Link(),
+		ExpiresAt:   f.Metadata.ExpiresAt,
+	}
+	if !f.Metadata.OwnerID.IsZero() {
+		file.OwnerID = f.Metadata.OwnerID.Hex()
+	}
+	fireWebhooks(event, file)
+}
+
+func webhookWorker() {
+	for d := range webhookQueue {
+		err := sendWebhook(d)
+		if err == nil {
+			continue
+		}
+		if d.attempt >= len(webhookBackoff) {
+			log.Printf("Giving up on %s webhook %s to %s: %v", d.event, d.id, d.hook.URL, err)
+			continue
+		}
+		wait := webhookBackoff[d.attempt]
+		d.attempt++
+		log.Printf("Webhook %s to %s failed (%v), retrying in %s", d.id, d.hook.URL, err, wait)
+		time.AfterFunc(wait, func() {
+			select {
+			case webhookQueue <- d:
+			default:
+				log.Printf("Webhook queue full, dropped retry of %s", d.id)
+			}
+		})
+	}
+}
+
+func sendWebhook(d *webhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "XyliLoader-Webhook")
+	req.Header.Set("X-Xyli-Event", d.event)
+	req.Header.Set("X-Xyli-Delivery", d.id)
+	if d.hook.Secret != "" {
+		req.Header.Set("X-Xyli-Signature", webhookSignature(d.hook.Secret, d.body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}